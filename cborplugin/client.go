@@ -16,7 +16,8 @@
 
 // Package cborplugin is a plugin system allowing mix network services
 // to be added in any language. It communicates queries and responses to and from
-// the mix server using CBOR over HTTP over UNIX domain socket. Beyond that,
+// the mix server using CBOR over HTTP over UNIX domain socket, or over TCP
+// for plugins running on another host. Beyond that,
 // a client supplied SURB is used to route the response back to the client
 // as described in our Kaetzchen specification document:
 //
@@ -28,10 +29,12 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os/exec"
+	"sync"
 	"syscall"
 	"time"
 
@@ -46,6 +49,12 @@ type Request struct {
 	ID      uint64
 	Payload []byte
 	HasSURB bool
+
+	// SURBCount is the number of SURBs that accompanied the request.
+	// Responses larger than a single Sphinx payload are split across
+	// the SURBs by the provider, so each SURB can carry up to
+	// core/constants.ForwardPayloadLength - 4 bytes of the response.
+	SURBCount int
 }
 
 // Response is the response received after sending a Request to the plugin.
@@ -53,6 +62,14 @@ type Response struct {
 	Payload []byte
 }
 
+// Document is the PKI document for the current epoch, sent to plugins
+// whenever it changes.  Plugins that are not interested in the network
+// topology can leave the /document handler unimplemented.
+type Document struct {
+	Epoch   uint64
+	Payload []byte
+}
+
 // Parameters is an optional mapping that plugins can publish, these get
 // advertised to clients in the MixDescriptor.
 // The output of GetParameters() ends up being published in a map
@@ -79,6 +96,10 @@ type ServicePlugin interface {
 	// the Provider's descriptor.
 	GetParameters() *Parameters
 
+	// OnDocument is the method that is called when the Provider has a
+	// new PKI document for the current epoch.
+	OnDocument(doc *Document) error
+
 	// Halt stops the plugin.
 	Halt()
 }
@@ -94,25 +115,50 @@ type Client struct {
 	logBackend *log.Backend
 	log        *logging.Logger
 	httpClient *http.Client
+	baseURL    string
 	cmd        *exec.Cmd
 	socketPath string
 	endpoint   string
 	capability string
+	sandbox    *Sandbox
 	// params     *Parameters
+
+	// outputLog and outputLevel are used to log the plugin's output.
+	outputLog   *logging.Logger
+	outputLevel string
+
+	// version and features are negotiated with the plugin on launch.
+	version  int
+	features map[string]bool
+
+	// drainLock, draining and inFlight track the requests in progress,
+	// so that they can complete before the plugin is stopped.
+	drainLock sync.RWMutex
+	draining  bool
+	inFlight  sync.WaitGroup
 }
 
 // New creates a new plugin client instance which represents the single execution
 // of the external plugin program.
 func New(command, capability, endpoint string, logBackend *log.Backend) *Client {
+	l := logBackend.GetLogger(command)
 	return &Client{
-		capability: capability,
-		endpoint:   endpoint,
-		logBackend: logBackend,
-		log:        logBackend.GetLogger(command),
-		httpClient: nil,
+		capability:  capability,
+		endpoint:    endpoint,
+		logBackend:  logBackend,
+		log:         l,
+		httpClient:  nil,
+		outputLog:   l,
+		outputLevel: DefaultOutputLevel,
 	}
 }
 
+// SetSandbox sets the resource limits and isolation applied to the plugin,
+// and must be called before Start.
+func (c *Client) SetSandbox(sandbox *Sandbox) {
+	c.sandbox = sandbox
+}
+
 // Start execs the plugin and starts a worker thread to listen
 // on the halt chan sends a TERM signal to the plugin if the shutdown
 // even is dispatched.
@@ -135,6 +181,7 @@ func (c *Client) worker() {
 }
 
 func (c *Client) setupHTTPClient(socketPath string) {
+	c.baseURL = "http://unix"
 	c.httpClient = &http.Client{
 		Timeout: 5 * time.Second,
 		Transport: &http.Transport{
@@ -146,17 +193,20 @@ func (c *Client) setupHTTPClient(socketPath string) {
 }
 
 func (c *Client) logPluginStderr(stderr io.ReadCloser) {
-	logWriter := c.logBackend.GetLogWriter(c.cmd.Path, "DEBUG")
-	_, err := io.Copy(logWriter, stderr)
-	if err != nil {
-		c.log.Errorf("Failed to proxy cborplugin stderr to DEBUG log: %s", err)
-	}
-	c.Halt()
+	c.logOutput("stderr", bufio.NewScanner(stderr), stderr)
+
+	// Halt waits for all of the worker goroutines, including this one.
+	go c.Halt()
 }
 
 func (c *Client) launch(command string, args []string) error {
 	// exec plugin
 	c.cmd = exec.Command(command, args...)
+	if c.sandbox != nil {
+		if err := c.sandbox.apply(c.cmd); err != nil {
+			return err
+		}
+	}
 	stdout, err := c.cmd.StdoutPipe()
 	if err != nil {
 		c.log.Debugf("pipe failure: %s", err)
@@ -172,8 +222,15 @@ func (c *Client) launch(command string, args []string) error {
 		c.log.Debugf("failed to exec: %s", err)
 		return err
 	}
+	if c.sandbox != nil {
+		if err = c.sandbox.setLimits(c.cmd.Process.Pid); err != nil {
+			_ = c.cmd.Process.Kill()
+			_ = c.cmd.Wait()
+			return err
+		}
+	}
 
-	// proxy stderr to our debug log
+	// proxy stderr to our log
 	c.Go(func() {
 		c.logPluginStderr(stderr)
 	})
@@ -182,21 +239,47 @@ func (c *Client) launch(command string, args []string) error {
 	stdoutScanner := bufio.NewScanner(stdout)
 	stdoutScanner.Scan()
 	c.socketPath = stdoutScanner.Text()
+	if c.sandbox != nil {
+		c.socketPath = c.sandbox.hostPath(c.socketPath)
+	}
 	c.log.Debugf("plugin socket path:'%s'\n", c.socketPath)
 	c.setupHTTPClient(c.socketPath)
 
+	// proxy the rest of stdout to our log
+	c.Go(func() {
+		c.logOutput("stdout", stdoutScanner, stdout)
+	})
+
+	if err = c.handshake(); err != nil {
+		c.log.Errorf("plugin handshake failure: %s", err)
+		_ = c.cmd.Process.Kill()
+		return err
+	}
+	c.log.Debugf("plugin protocol version: %d, features: %v", c.version, c.features)
+
 	c.log.Debug("finished launching plugin.")
 	return nil
 }
 
 // OnRequest send a query request to plugin using CBOR + HTTP over Unix domain socket.
 func (c *Client) OnRequest(request *Request) ([]byte, error) {
+	if !c.beginRequest() {
+		return nil, ErrDraining
+	}
+	defer c.endRequest()
+
+	if request.SURBCount > 1 && !c.HasFeature(FeatureMultiSURB) {
+		// The plugin can only reply with a single payload.
+		r := *request
+		r.SURBCount = 1
+		request = &r
+	}
 	serialized, err := cbor.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 
-	rawResponse, err := c.httpClient.Post("http://unix/request", "application/octet-stream", bytes.NewReader(serialized))
+	rawResponse, err := c.httpClient.Post(c.baseURL+"/request", "application/octet-stream", bytes.NewReader(serialized))
 	if err != nil {
 		return nil, err
 	}
@@ -209,6 +292,56 @@ func (c *Client) OnRequest(request *Request) ([]byte, error) {
 	return response.Payload, nil
 }
 
+// OnDocument sends the current PKI document to the plugin using CBOR +
+// HTTP over Unix domain socket.
+func (c *Client) OnDocument(doc *Document) error {
+	if !c.HasFeature(FeatureDocument) {
+		return nil
+	}
+	serialized, err := cbor.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	rawResponse, err := c.httpClient.Post(c.baseURL+"/document", "application/octet-stream", bytes.NewReader(serialized))
+	if err != nil {
+		return err
+	}
+	defer rawResponse.Body.Close()
+	switch rawResponse.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		// Plugins are not required to handle documents.
+		return nil
+	default:
+		return fmt.Errorf("cborplugin: unexpected /document status: %v", rawResponse.Status)
+	}
+}
+
+// Ping checks that the plugin is alive and responsive.  Plugins that do
+// not negotiate the health feature are considered healthy as long as they
+// are able to respond to HTTP requests.
+func (c *Client) Ping() error {
+	select {
+	case <-c.HaltCh():
+		return fmt.Errorf("cborplugin: plugin has exited")
+	default:
+	}
+
+	rawResponse, err := c.httpClient.Post(c.baseURL+"/health", "application/octet-stream", http.NoBody)
+	if err != nil {
+		return err
+	}
+	defer rawResponse.Body.Close()
+	switch {
+	case rawResponse.StatusCode == http.StatusOK:
+		return nil
+	case rawResponse.StatusCode == http.StatusNotFound && !c.HasFeature(FeatureHealth):
+		return nil
+	default:
+		return fmt.Errorf("cborplugin: unexpected /health status: %v", rawResponse.Status)
+	}
+}
+
 // Capability are used in Mix Descriptor publication to give
 // service clients more information about the service. Not
 // plugins will need to use this feature.
@@ -222,7 +355,7 @@ func (c *Client) Capability() string {
 func (c *Client) GetParameters() *Parameters {
 	// get plugin parameters if any
 	c.log.Debug("requesting plugin Parameters for Mix Descriptor publication...")
-	rawResponse, err := c.httpClient.Post("http://unix/parameters", "application/octet-stream", http.NoBody)
+	rawResponse, err := c.httpClient.Post(c.baseURL+"/parameters", "application/octet-stream", http.NoBody)
 	if err != nil {
 		c.log.Debugf("post failure: %s", err)
 		c.Halt()
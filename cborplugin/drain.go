@@ -0,0 +1,70 @@
+// drain.go - Graceful plugin shutdown.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrDraining is the error returned for requests made to a plugin that is
+// being shut down.
+var ErrDraining = errors.New("cborplugin: plugin is shutting down")
+
+// beginRequest registers an in-flight request, and returns false iff the
+// plugin is being shut down.  Each successful call must be paired with a
+// call to endRequest.
+func (c *Client) beginRequest() bool {
+	c.drainLock.RLock()
+	defer c.drainLock.RUnlock()
+
+	if c.draining {
+		return false
+	}
+	c.inFlight.Add(1)
+	return true
+}
+
+func (c *Client) endRequest() {
+	c.inFlight.Done()
+}
+
+// Shutdown stops sending requests to the plugin, waits up to timeout for
+// the in-flight requests to complete, and then stops the plugin.  Unlike
+// Halt, this allows requests with side effects, eg: broadcasting a
+// transaction, to run to completion.
+func (c *Client) Shutdown(timeout time.Duration) {
+	c.drainLock.Lock()
+	c.draining = true
+	c.drainLock.Unlock()
+
+	doneCh := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+		c.log.Debugf("plugin drained.")
+	case <-c.HaltCh():
+		// The plugin exited on its own.
+	case <-time.After(timeout):
+		c.log.Warningf("plugin still has in-flight requests after %v, stopping anyway.", timeout)
+	}
+	c.Halt()
+}
@@ -0,0 +1,89 @@
+// drain_test.go - Plugin draining tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdown(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	c := New("echo", "echo", "+echo", logBackend)
+	require.True(c.beginRequest())
+
+	doneCh := make(chan struct{})
+	go func() {
+		c.Shutdown(time.Minute)
+		close(doneCh)
+	}()
+
+	// New requests are refused once the plugin is draining.
+	require.Eventually(func() bool {
+		c.drainLock.RLock()
+		defer c.drainLock.RUnlock()
+		return c.draining
+	}, time.Second, time.Millisecond)
+	require.False(c.beginRequest())
+	_, err = c.OnRequest(&Request{})
+	require.Equal(ErrDraining, err)
+
+	// The in-flight request is waited for.
+	select {
+	case <-doneCh:
+		require.FailNow("Shutdown returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.endRequest()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		require.FailNow("Shutdown did not return once drained")
+	}
+	select {
+	case <-c.HaltCh():
+	default:
+		require.FailNow("the plugin was not halted")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	c := New("echo", "echo", "+echo", logBackend)
+	require.True(c.beginRequest())
+
+	// A stuck request does not prevent the plugin from stopping.
+	start := time.Now()
+	c.Shutdown(50 * time.Millisecond)
+	require.True(time.Since(start) >= 50*time.Millisecond)
+	select {
+	case <-c.HaltCh():
+	default:
+		require.FailNow("the plugin was not halted")
+	}
+}
@@ -0,0 +1,122 @@
+// handshake.go - cbor plugin protocol negotiation
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// ProtocolVersion is the newest plugin protocol version supported by
+	// the server.  Version 0 is the protocol spoken by plugins that do not
+	// implement the /handshake handler.
+	ProtocolVersion = 1
+
+	// FeatureHealth indicates that the plugin implements the /health
+	// handler.
+	FeatureHealth = "health"
+
+	// FeatureDocument indicates that the plugin implements the /document
+	// handler, and wants to receive PKI documents.
+	FeatureDocument = "document"
+
+	// FeatureMultiSURB indicates that the plugin handles the SURBCount of
+	// requests, and can return responses larger than a single payload.
+	FeatureMultiSURB = "multi-surb"
+)
+
+var (
+	// supportedFeatures are the optional features supported by the server.
+	supportedFeatures = []string{FeatureHealth, FeatureDocument, FeatureMultiSURB}
+
+	// legacyFeatures are the features assumed for version 0 plugins, which
+	// were sent documents and SURB counts, and whose /health handler is
+	// optional.
+	legacyFeatures = []string{FeatureDocument, FeatureMultiSURB}
+)
+
+// Hello is the handshake message exchanged with the plugin on startup.
+// The server sends the newest version and the features it supports, and
+// the plugin replies with the version it will speak, which must not be
+// newer, and the subset of the features it supports.
+type Hello struct {
+	Version  int
+	Features []string
+}
+
+// handshake negotiates the protocol version and features with the plugin.
+// Plugins predating the handshake speak version 0, and keep being treated
+// as before the handshake was introduced.
+func (c *Client) handshake() error {
+	serialized, err := cbor.Marshal(&Hello{
+		Version:  ProtocolVersion,
+		Features: supportedFeatures,
+	})
+	if err != nil {
+		return err
+	}
+
+	rawResponse, err := c.httpClient.Post(c.baseURL+"/handshake", "application/octet-stream", bytes.NewReader(serialized))
+	if err != nil {
+		return err
+	}
+	defer rawResponse.Body.Close()
+	switch rawResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		c.setFeatures(0, legacyFeatures)
+		return nil
+	default:
+		return fmt.Errorf("cborplugin: unexpected /handshake status: %v", rawResponse.Status)
+	}
+
+	hello := new(Hello)
+	if err = cbor.NewDecoder(rawResponse.Body).Decode(hello); err != nil {
+		return err
+	}
+	if hello.Version < 1 || hello.Version > ProtocolVersion {
+		return fmt.Errorf("cborplugin: unsupported protocol version: %v", hello.Version)
+	}
+	c.setFeatures(hello.Version, hello.Features)
+	return nil
+}
+
+func (c *Client) setFeatures(version int, features []string) {
+	c.version = version
+	c.features = make(map[string]bool)
+	for _, f := range features {
+		for _, s := range supportedFeatures {
+			if f == s {
+				c.features[f] = true
+			}
+		}
+	}
+}
+
+// Version returns the negotiated plugin protocol version.
+func (c *Client) Version() int {
+	return c.version
+}
+
+// HasFeature returns true iff the feature was negotiated with the plugin.
+func (c *Client) HasFeature(feature string) bool {
+	return c.features[feature]
+}
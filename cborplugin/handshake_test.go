@@ -0,0 +1,92 @@
+// handshake_test.go - Plugin protocol handshake tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	var replyLock sync.Mutex
+	var reply *Hello
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/handshake" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hello := new(Hello)
+		if err := cbor.NewDecoder(r.Body).Decode(hello); err != nil || hello.Version != ProtocolVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		replyLock.Lock()
+		defer replyLock.Unlock()
+		if reply == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp, _ := cbor.Marshal(reply)
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+
+	handshake := func(hello *Hello) (*Client, error) {
+		replyLock.Lock()
+		reply = hello
+		replyLock.Unlock()
+
+		c := New("echo", "echo", "+echo", logBackend)
+		c.httpClient = srv.Client()
+		c.baseURL = srv.URL
+		return c, c.handshake()
+	}
+
+	// Plugins without the /handshake handler speak version 0.
+	c, err := handshake(nil)
+	require.NoError(err)
+	require.Equal(0, c.Version())
+	require.False(c.HasFeature(FeatureHealth))
+	require.True(c.HasFeature(FeatureDocument))
+	require.True(c.HasFeature(FeatureMultiSURB))
+
+	// Only the supported features are negotiated.
+	c, err = handshake(&Hello{Version: ProtocolVersion, Features: []string{FeatureHealth, "teleport"}})
+	require.NoError(err)
+	require.Equal(ProtocolVersion, c.Version())
+	require.True(c.HasFeature(FeatureHealth))
+	require.False(c.HasFeature(FeatureDocument))
+	require.False(c.HasFeature(FeatureMultiSURB))
+	require.False(c.HasFeature("teleport"))
+
+	// Unsupported versions are rejected.
+	_, err = handshake(&Hello{Version: ProtocolVersion + 1})
+	require.Error(err)
+	_, err = handshake(&Hello{Version: 0})
+	require.Error(err)
+}
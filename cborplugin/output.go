@@ -0,0 +1,69 @@
+// output.go - Logging of plugin output.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// DefaultOutputLevel is the level at which plugin output is logged, unless
+// set with SetOutputLogging.
+const DefaultOutputLevel = "DEBUG"
+
+// SetOutputLogging sets the logger name and the level used for the lines
+// the plugin writes to its stdout and stderr, and must be called before
+// Start.  By default the output is logged at DEBUG, under the name of the
+// plugin command.
+func (c *Client) SetOutputLogging(name, level string) {
+	c.outputLog = c.logBackend.GetLogger(name)
+	c.outputLevel = strings.ToUpper(level)
+}
+
+func (c *Client) logOutputLine(stream, line string) {
+	l := c.outputLog
+	switch c.outputLevel {
+	case "ERROR":
+		l.Errorf("%s: %s", stream, line)
+	case "WARNING":
+		l.Warningf("%s: %s", stream, line)
+	case "NOTICE":
+		l.Noticef("%s: %s", stream, line)
+	case "INFO":
+		l.Infof("%s: %s", stream, line)
+	default:
+		l.Debugf("%s: %s", stream, line)
+	}
+}
+
+// logOutput logs the plugin's output line by line, so that the output of
+// concurrent plugins is not interleaved mid-line, until the plugin closes
+// the stream.
+func (c *Client) logOutput(stream string, scanner *bufio.Scanner, r io.Reader) {
+	for scanner.Scan() {
+		c.logOutputLine(stream, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		c.log.Errorf("Failed to read plugin %s: %s", stream, err)
+
+		// Keep draining the stream, so the plugin doesn't block on
+		// writing to it.
+		_, _ = io.Copy(ioutil.Discard, r)
+	}
+}
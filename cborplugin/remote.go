@@ -0,0 +1,100 @@
+// remote.go - TCP transport for remote plugins.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/hashcloak/Meson-server/httpsign"
+)
+
+// Remote is a plugin running on another host (or container), that is
+// reached over TCP instead of being executed by the server.
+type Remote struct {
+	// Address is the host:port the plugin listens on.
+	Address string
+
+	// TLSConfig is the TLS configuration used to connect to the plugin,
+	// optionally with a client certificate for mTLS.  It is required, as
+	// the requests and responses must not be exposed to the network.
+	TLSConfig *tls.Config
+
+	// SharedSecret is the HMAC-SHA256 key used to sign requests, if any,
+	// as specified by the httpsign package.
+	SharedSecret []byte
+}
+
+// signingTransport signs the requests sent to a remote plugin.
+type signingTransport struct {
+	key  []byte
+	base http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := httpsign.SignRequest(t.key, req, body); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Connect connects to a remote plugin, instead of executing it with Start.
+// The plugin is expected to serve the same HTTP handlers as a local one.
+func (c *Client) Connect(remote *Remote) error {
+	if remote.TLSConfig == nil {
+		return errors.New("cborplugin: remote plugins require TLS")
+	}
+	transport := &http.Transport{TLSClientConfig: remote.TLSConfig}
+	c.httpClient = &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: transport,
+	}
+	if remote.SharedSecret != nil {
+		c.httpClient.Transport = &signingTransport{
+			key:  remote.SharedSecret,
+			base: transport,
+		}
+	}
+	c.baseURL = "https://" + remote.Address
+
+	if err := c.handshake(); err != nil {
+		c.log.Errorf("plugin handshake failure: %s", err)
+		return err
+	}
+	c.log.Debugf("remote plugin %s protocol version: %d, features: %v", remote.Address, c.version, c.features)
+
+	c.Go(func() {
+		<-c.HaltCh()
+		transport.CloseIdleConnections()
+	})
+	return nil
+}
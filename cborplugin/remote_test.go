@@ -0,0 +1,101 @@
+// remote_test.go - TCP transport for remote plugins tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashcloak/Meson-server/httpsign"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteConnect(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	key := []byte("s3kr1t")
+	var noncesLock sync.Mutex
+	nonces := make(map[string]bool)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		noncesLock.Lock()
+		defer noncesLock.Unlock()
+		nonce := r.Header.Get(httpsign.NonceHeader)
+		if httpsign.Verify(key, r, body, time.Minute) != nil || nonces[nonce] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		nonces[nonce] = true
+		resp, _ := cbor.Marshal(&Hello{Version: ProtocolVersion, Features: []string{FeatureHealth}})
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+
+	// Plain HTTP is refused.
+	c := New("remote", "echo", "+echo", logBackend)
+	err = c.Connect(&Remote{Address: srv.Listener.Addr().String(), SharedSecret: key})
+	require.Error(err)
+
+	// Unknown certificates are refused.
+	err = c.Connect(&Remote{
+		Address:      srv.Listener.Addr().String(),
+		TLSConfig:    &tls.Config{},
+		SharedSecret: key,
+	})
+	require.Error(err)
+
+	// The signed handshake succeeds over TLS.
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	c = New("remote", "echo", "+echo", logBackend)
+	err = c.Connect(&Remote{
+		Address:      srv.Listener.Addr().String(),
+		TLSConfig:    &tls.Config{RootCAs: roots},
+		SharedSecret: key,
+	})
+	require.NoError(err)
+	defer c.Halt()
+	require.Equal(ProtocolVersion, c.Version())
+	require.True(c.HasFeature(FeatureHealth))
+	noncesLock.Lock()
+	require.Len(nonces, 1)
+	noncesLock.Unlock()
+
+	// A wrong key is rejected by the plugin.
+	c2 := New("remote", "echo", "+echo", logBackend)
+	err = c2.Connect(&Remote{
+		Address:      srv.Listener.Addr().String(),
+		TLSConfig:    &tls.Config{RootCAs: roots},
+		SharedSecret: []byte("wrong"),
+	})
+	require.Error(err)
+}
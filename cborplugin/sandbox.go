@@ -0,0 +1,71 @@
+// sandbox.go - Resource limits and isolation for plugins.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"os/exec"
+	"path/filepath"
+)
+
+// Sandbox specifies the resource limits and isolation applied to a
+// plugin process.  Zero values leave the corresponding limit unset.
+type Sandbox struct {
+	// WorkingDir is the working directory of the plugin, inside the
+	// Chroot if one is set.
+	WorkingDir string
+
+	// Chroot is the directory the plugin is confined to.  The plugin
+	// Command, and the socket path it reports are relative to it.
+	Chroot string
+
+	// Namespaces isolates the plugin in new mount, PID, IPC, and UTS
+	// namespaces.
+	Namespaces bool
+
+	// MaxMemory is the maximum size of the plugin's address space in
+	// bytes.
+	MaxMemory uint64
+
+	// MaxCPUTime is the maximum CPU time that the plugin may consume in
+	// seconds, after which it is killed.
+	MaxCPUTime uint64
+
+	// MaxOpenFiles is the maximum number of open file descriptors.
+	MaxOpenFiles uint64
+
+	// MaxProcesses is the maximum number of processes for the plugin's
+	// user.
+	MaxProcesses uint64
+}
+
+func (s *Sandbox) hasLimits() bool {
+	return s.MaxMemory != 0 || s.MaxCPUTime != 0 || s.MaxOpenFiles != 0 || s.MaxProcesses != 0
+}
+
+// apply configures cmd to be executed in the sandbox.
+func (s *Sandbox) apply(cmd *exec.Cmd) error {
+	cmd.Dir = s.WorkingDir
+	return s.applyIsolation(cmd)
+}
+
+// hostPath returns the path as seen from outside the sandbox.
+func (s *Sandbox) hostPath(path string) string {
+	if s.Chroot == "" {
+		return path
+	}
+	return filepath.Join(s.Chroot, path)
+}
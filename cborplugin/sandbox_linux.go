@@ -0,0 +1,66 @@
+// sandbox_linux.go - Resource limits and isolation for plugins on Linux.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func (s *Sandbox) applyIsolation(cmd *exec.Cmd) error {
+	attr := &syscall.SysProcAttr{
+		Chroot: s.Chroot,
+
+		// Ensure that the plugin does not outlive the server.
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if s.Namespaces {
+		// Note: This requires CAP_SYS_ADMIN.
+		attr.Cloneflags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// setLimits applies the resource limits to the running process pid.
+//
+// Note: The limits are applied right after the process is started, as the
+// standard library provides no way to do so between fork and exec.
+func (s *Sandbox) setLimits(pid int) error {
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{unix.RLIMIT_AS, s.MaxMemory},
+		{unix.RLIMIT_CPU, s.MaxCPUTime},
+		{unix.RLIMIT_NOFILE, s.MaxOpenFiles},
+		{unix.RLIMIT_NPROC, s.MaxProcesses},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		rlim := &unix.Rlimit{Cur: l.value, Max: l.value}
+		if err := unix.Prlimit(pid, l.resource, rlim, nil); err != nil {
+			return fmt.Errorf("cborplugin: failed to set rlimit %v: %v", l.resource, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// sandbox_linux_test.go - Plugin sandbox tests on Linux.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSandboxIsolation(t *testing.T) {
+	require := require.New(t)
+
+	s := &Sandbox{Chroot: "/srv/plugin"}
+	cmd := exec.Command("/plugin")
+	require.NoError(s.apply(cmd))
+	require.Equal("/srv/plugin", cmd.SysProcAttr.Chroot)
+	require.Equal(syscall.SIGKILL, cmd.SysProcAttr.Pdeathsig)
+	require.Zero(cmd.SysProcAttr.Cloneflags)
+
+	s.Namespaces = true
+	require.NoError(s.apply(cmd))
+	require.NotZero(cmd.SysProcAttr.Cloneflags & syscall.CLONE_NEWPID)
+	require.NotZero(cmd.SysProcAttr.Cloneflags & syscall.CLONE_NEWNS)
+}
+
+func TestSandboxLimits(t *testing.T) {
+	require := require.New(t)
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("failed to start sleep: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	s := &Sandbox{MaxMemory: 1 << 30, MaxOpenFiles: 64}
+	require.NoError(s.setLimits(cmd.Process.Pid))
+
+	var rlim unix.Rlimit
+	require.NoError(unix.Prlimit(cmd.Process.Pid, unix.RLIMIT_AS, nil, &rlim))
+	require.Equal(uint64(1<<30), rlim.Cur)
+	require.Equal(uint64(1<<30), rlim.Max)
+	require.NoError(unix.Prlimit(cmd.Process.Pid, unix.RLIMIT_NOFILE, nil, &rlim))
+	require.Equal(uint64(64), rlim.Cur)
+
+	// Unset limits are left alone.
+	var want unix.Rlimit
+	require.NoError(unix.Prlimit(0, unix.RLIMIT_CPU, nil, &want))
+	require.NoError(unix.Prlimit(cmd.Process.Pid, unix.RLIMIT_CPU, nil, &rlim))
+	require.Equal(want, rlim)
+}
@@ -0,0 +1,39 @@
+// sandbox_other.go - Resource limits and isolation for plugins.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package cborplugin
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func (s *Sandbox) applyIsolation(cmd *exec.Cmd) error {
+	if s.Chroot != "" || s.Namespaces {
+		return errors.New("cborplugin: plugin isolation is only supported on Linux")
+	}
+	return nil
+}
+
+func (s *Sandbox) setLimits(pid int) error {
+	if s.hasLimits() {
+		return errors.New("cborplugin: plugin resource limits are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// sandbox_test.go - Plugin sandbox tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandbox(t *testing.T) {
+	require := require.New(t)
+
+	s := &Sandbox{WorkingDir: "/work"}
+	require.False(s.hasLimits())
+	require.Equal("/tmp/plugin.sock", s.hostPath("/tmp/plugin.sock"))
+
+	cmd := exec.Command("echo")
+	require.NoError(s.apply(cmd))
+	require.Equal("/work", cmd.Dir)
+
+	// Paths reported by a confined plugin are relative to the chroot.
+	s.Chroot = "/srv/plugin"
+	require.Equal("/srv/plugin/tmp/plugin.sock", s.hostPath("/tmp/plugin.sock"))
+
+	s.MaxOpenFiles = 64
+	require.True(s.hasLimits())
+}
@@ -19,20 +19,38 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 
 	server "github.com/hashcloak/Meson-server"
 	"github.com/hashcloak/Meson-server/config"
 )
 
+// configFiles is the list of config files, one per server instance.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *configFiles) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func main() {
-	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
+	var cfgFiles configFiles
+	flag.Var(&cfgFiles, "f", "Path to the server config file, can be repeated to run a mix and a provider in one process.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
 	testConfig := flag.Bool("t", false, "Test meson server config.")
 	flag.Parse()
+	if len(cfgFiles) == 0 {
+		cfgFiles = configFiles{"katzenpost.toml"}
+	}
 
 	// Set the umask to something "paranoid".
 	syscall.Umask(0077)
@@ -47,13 +65,21 @@ func main() {
 		}
 	}
 
-	cfg, err := config.LoadFile(*cfgFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
-		os.Exit(-1)
+	cfgs := make([]*config.Config, 0, len(cfgFiles))
+	for _, f := range cfgFiles {
+		cfg, err := config.LoadFile(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", f, err)
+			os.Exit(-1)
+		}
+		if *genOnly && !cfg.Debug.GenerateOnly {
+			cfg.Debug.GenerateOnly = true
+		}
+		cfgs = append(cfgs, cfg)
 	}
-	if *genOnly && !cfg.Debug.GenerateOnly {
-		cfg.Debug.GenerateOnly = true
+	if err := checkInstances(cfgs); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid server instances: %v\n", err)
+		os.Exit(-1)
 	}
 	if *testConfig {
 		fmt.Printf("The Meson server configuration looks good.\n")
@@ -64,32 +90,151 @@ func main() {
 	haltCh := make(chan os.Signal)
 	signal.Notify(haltCh, os.Interrupt, syscall.SIGTERM) // nolint
 
-	rotateCh := make(chan os.Signal)
+	rotateCh := make(chan os.Signal, 1)
 	signal.Notify(rotateCh, syscall.SIGHUP) // nolint
 
-	// Start up the server.
-	svr, err := server.New(cfg)
-	if err != nil {
-		if err == server.ErrGenerateOnly {
-			os.Exit(0)
+	// Start up the server instances.
+	svrs := make([]*server.Server, 0, len(cfgs))
+	shutdown := func() {
+		for _, svr := range svrs {
+			svr.Shutdown()
 		}
-		fmt.Fprintf(os.Stderr, "Failed to spawn server instance: %v\n", err)
-		os.Exit(-1)
 	}
-	defer svr.Shutdown()
+	for i, cfg := range cfgs {
+		svr, err := server.New(cfg)
+		if err != nil {
+			if err == server.ErrGenerateOnly {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Failed to spawn server instance '%v': %v\n", cfgFiles[i], err)
+			shutdown()
+			os.Exit(-1)
+		}
+		svrs = append(svrs, svr)
+	}
+	if len(svrs) == 0 {
+		os.Exit(0)
+	}
+	defer shutdown()
 
 	// Halt the server gracefully on SIGINT/SIGTERM.
 	go func() {
 		<-haltCh
-		svr.Shutdown()
+		shutdown()
 	}()
 
-	// Rotate server logs upon SIGHUP.
+	// Rotate server logs and reload the reloadable configuration sections
+	// upon SIGHUP.
 	go func() {
-		<-rotateCh
-		svr.RotateLog()
+		for range rotateCh {
+			for i, svr := range svrs {
+				svr.RotateLog()
+
+				newCfg, err := config.LoadFile(cfgFiles[i])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload config file '%v': %v\n", cfgFiles[i], err)
+					continue
+				}
+				r := svr.Reload(newCfg)
+				for _, v := range r.Failed {
+					fmt.Fprintf(os.Stderr, "Failed to reload configuration: %v\n", v)
+				}
+				if len(r.RestartRequired) > 0 {
+					fmt.Fprintf(os.Stderr, "Configuration changes requiring a restart: %v\n", r.RestartRequired)
+				}
+			}
+		}
 	}()
 
-	// Wait for the server to explode or be terminated.
-	svr.Wait()
+	// Wait for any of the servers to explode or be terminated, the
+	// instances share the fate of the process.
+	doneCh := make(chan struct{}, len(svrs))
+	for _, svr := range svrs {
+		go func(svr *server.Server) {
+			svr.Wait()
+			doneCh <- struct{}{}
+		}(svr)
+	}
+	<-doneCh
+	shutdown()
+	for range svrs[1:] {
+		<-doneCh
+	}
+}
+
+// checkInstances ensures that the server instances run in one process do
+// not share any state, each has its own identity, keys, queues and PKI
+// descriptor.
+func checkInstances(cfgs []*config.Config) error {
+	seen := make(map[string]bool)
+	claim := func(what, v string) error {
+		if v == "" {
+			return nil
+		}
+		if seen[what+v] {
+			return fmt.Errorf("%v '%v' is used by more than one instance", what, v)
+		}
+		seen[what+v] = true
+		return nil
+	}
+
+	// The listeners conflict if they use the same port on the same or a
+	// wildcard host, whatever way the addresses are spelled.
+	type listener struct {
+		desc, host, port string
+	}
+	var listeners []*listener
+	claimListener := func(what, addr string) error {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			// Rejected by the configuration validation.
+			return nil
+		}
+		if host == "localhost" {
+			host = "127.0.0.1"
+		} else if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+			if ip.IsUnspecified() {
+				host = ""
+			}
+		}
+		desc := fmt.Sprintf("%v '%v'", what, addr)
+		for _, l := range listeners {
+			if l.port == port && (l.host == host || l.host == "" || host == "") {
+				return fmt.Errorf("%v conflicts with %v", desc, l.desc)
+			}
+		}
+		listeners = append(listeners, &listener{desc, host, port})
+		return nil
+	}
+	for _, cfg := range cfgs {
+		if err := claim("Identifier", cfg.Server.Identifier); err != nil {
+			return err
+		}
+		if err := claim("DataDir", cfg.Server.DataDir); err != nil {
+			return err
+		}
+		if err := claim("Management.Path", cfg.Management.Path); err != nil {
+			return err
+		}
+		if cfg.Management.EnableHTTP {
+			if err := claimListener("Management.HTTPAddress", cfg.Management.HTTPAddress); err != nil {
+				return err
+			}
+			if err := claim("Management.HTTPTokenFile", cfg.Management.HTTPTokenFile); err != nil {
+				return err
+			}
+		}
+		if cfg.Management.GRPC != nil {
+			if err := claimListener("Management.GRPC.Address", cfg.Management.GRPC.Address); err != nil {
+				return err
+			}
+		}
+		for _, addr := range cfg.Server.Addresses {
+			if err := claimListener("Address", addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
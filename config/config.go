@@ -45,6 +45,7 @@ import (
 const (
 	defaultAddress             = ":3219"
 	defaultLogLevel            = "NOTICE"
+	defaultPluginLogLevel      = "DEBUG"
 	defaultNumProviderWorkers  = 1
 	defaultNumKaetzchenWorkers = 3
 	defaultUnwrapDelay         = 10 // 10 ms.
@@ -55,11 +56,26 @@ const (
 	defaultConnectTimeout      = 60 * 1000 // 60 sec.
 	defaultHandshakeTimeout    = 30 * 1000 // 30 sec.
 	defaultReauthInterval      = 30 * 1000 // 30 sec.
+	defaultPKIRecheckInterval  = 60 * 1000 // 60 sec.
+	defaultPKIRecheckJitter    = 10 * 1000 // 10 sec.
+	defaultPKIFetchTimeout     = 30 * 1000 // 30 sec.
+	defaultClockSkewThreshold  = 30 * 1000 // 30 sec.
+	maxStaleConsensusGrace     = 2         // NumMixKeys - 1.
 	defaultProviderDelay       = 500       // 500 ms.
 	defaultKaetzchenDelay      = 750       // 750 ms.
+	defaultHealthCheckInterval = 10 * 1000 // 10 sec.
+	defaultExternTimeout       = 5 * 1000  // 5 sec.
+	defaultReassemblyTimeout   = 60 * 1000 // 60 sec.
+	defaultDrainTimeout        = 10 * 1000 // 10 sec.
+	defaultSlowRequest         = 5 * 1000  // 5 sec.
+	defaultBreakerCooldown     = 30        // 30 sec.
+	defaultPluginMaxMemory     = 1 << 30   // 1 GiB.
+	defaultPluginMaxOpenFiles  = 1024
 	defaultUserDB              = "users.db"
 	defaultSpoolDB             = "spool.db"
 	defaultManagementSocket    = "management_sock"
+	defaultManagementHTTP      = "127.0.0.1:3220"
+	defaultManagementHTTPToken = "management_http_token"
 
 	backendPgx = "pgx"
 
@@ -71,6 +87,18 @@ const (
 
 	// BackendExtern is a External (RESTful http) backend.
 	BackendExtern = "extern"
+
+	// BackendLDAP is a LDAP directory backend.
+	BackendLDAP = "ldap"
+
+	// ProxyTypeSOCKS5 is a SOCKS5 upstream proxy.
+	ProxyTypeSOCKS5 = "socks5"
+
+	// ValidationLenient logs PKI document oddities but accepts the document.
+	ValidationLenient = "lenient"
+
+	// ValidationStrict rejects PKI documents with oddities.
+	ValidationStrict = "strict"
 )
 
 var defaultLogging = Logging{
@@ -175,6 +203,12 @@ type Debug struct {
 	// inbound Sphinx packet processing.
 	NumSphinxWorkers int
 
+	// SphinxWorkerAffinity pins each incoming connection to a single Sphinx
+	// worker instance, so that packets received over a connection are
+	// unwrapped in arrival order.  This trades off even load distribution
+	// across the workers for ordering.
+	SphinxWorkerAffinity bool
+
 	// NumProviderWorkers specifies the number of worker instances to use for
 	// provider specific packet processing.
 	NumProviderWorkers int
@@ -192,6 +226,11 @@ type Debug struct {
 	// as unlimited.
 	SchedulerQueueSize int
 
+	// KaetzchenQueueSize is the maximum number of requests waiting for a
+	// Kaetzchen worker, per queue, before new requests start getting
+	// dropped.  A value <= 0 is treated as unlimited.
+	KaetzchenQueueSize int
+
 	// SchedulerMaxBurst is the maximum number of packets that will be
 	// dispatched per scheduler wakeup event.
 	SchedulerMaxBurst int
@@ -208,6 +247,26 @@ type Debug struct {
 	// in milliseconds.
 	KaetzchenDelay int
 
+	// KaetzchenReassemblyTimeout is the maximum time allowed to receive all
+	// the fragments of a Kaetzchen request spanning multiple packets in
+	// milliseconds.
+	KaetzchenReassemblyTimeout int
+
+	// KaetzchenHealthCheckInterval is the interval between health checks
+	// of the external Kaetzchen plugins in milliseconds.  Plugins that fail
+	// a health check are restarted with an exponential backoff.
+	KaetzchenHealthCheckInterval int
+
+	// KaetzchenDrainTimeout is the maximum time allowed for the in-flight
+	// requests of an external Kaetzchen plugin to complete when it is
+	// stopped on shutdown, unload or restart, in milliseconds.
+	KaetzchenDrainTimeout int
+
+	// KaetzchenSlowRequest is the duration in milliseconds after which a
+	// Kaetzchen request is logged as slow, with the service and the
+	// instance that served it.
+	KaetzchenSlowRequest int
+
 	// SchedulerSlack is the maximum allowed scheduler slack due to queueing
 	// and or processing in milliseconds.
 	SchedulerSlack int
@@ -233,6 +292,40 @@ type Debug struct {
 	// reauthenticated in milliseconds.
 	ReauthInterval int
 
+	// PKIRecheckInterval specifies the interval at which the PKI worker
+	// will fetch missing documents and check if the descriptor needs to be
+	// published in milliseconds.
+	PKIRecheckInterval int
+
+	// PKIRecheckJitter specifies the maximum random jitter added to the
+	// PKIRecheckInterval in milliseconds.  A negative value disables the
+	// jitter.
+	PKIRecheckJitter int
+
+	// PKIFetchTimeout specifies the maximum time a single PKI document
+	// fetch can take in milliseconds.
+	PKIFetchTimeout int
+
+	// ClockSkewThreshold specifies the maximum allowed skew between the
+	// local clock and the epoch boundaries reported by the PKI in
+	// milliseconds, before a warning is logged.  Only the Katzenmint
+	// backend reports epoch boundaries, the epochs of the directory
+	// authorities are derived from the local clock.
+	ClockSkewThreshold int
+
+	// StaleConsensusGrace specifies the number of epochs for which the most
+	// recent PKI document will be used to continue forwarding when the
+	// document for the current epoch is unavailable.  It is bounded by the
+	// lifetime of the published mix keys.  If left as 0, forwarding is
+	// suspended till a current document is available.
+	StaleConsensusGrace int
+
+	// EpochPeriod overrides the epoch duration in milliseconds, for private
+	// test networks using the Katzenpost authorities.  It MUST match the
+	// period used by the authority.  If left as 0, the PKI backend's
+	// default is used.
+	EpochPeriod int
+
 	// SendDecoyTraffic enables sending decoy traffic.  This is still
 	// experimental and untuned and thus is disabled by default.
 	//
@@ -279,6 +372,18 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.KaetzchenDelay <= 0 {
 		dCfg.KaetzchenDelay = defaultKaetzchenDelay
 	}
+	if dCfg.KaetzchenReassemblyTimeout <= 0 {
+		dCfg.KaetzchenReassemblyTimeout = defaultReassemblyTimeout
+	}
+	if dCfg.KaetzchenHealthCheckInterval <= 0 {
+		dCfg.KaetzchenHealthCheckInterval = defaultHealthCheckInterval
+	}
+	if dCfg.KaetzchenDrainTimeout <= 0 {
+		dCfg.KaetzchenDrainTimeout = defaultDrainTimeout
+	}
+	if dCfg.KaetzchenSlowRequest <= 0 {
+		dCfg.KaetzchenSlowRequest = defaultSlowRequest
+	}
 	if dCfg.SchedulerSlack < defaultSchedulerSlack {
 		// TODO/perf: Tune this.
 		dCfg.SchedulerSlack = defaultSchedulerSlack
@@ -303,6 +408,28 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.ReauthInterval <= 0 {
 		dCfg.ReauthInterval = defaultReauthInterval
 	}
+	if dCfg.PKIRecheckInterval <= 0 {
+		dCfg.PKIRecheckInterval = defaultPKIRecheckInterval
+	}
+	if dCfg.PKIRecheckJitter < 0 {
+		dCfg.PKIRecheckJitter = 0
+	} else if dCfg.PKIRecheckJitter == 0 {
+		dCfg.PKIRecheckJitter = defaultPKIRecheckJitter
+	}
+	if dCfg.PKIFetchTimeout <= 0 {
+		dCfg.PKIFetchTimeout = defaultPKIFetchTimeout
+	}
+	if dCfg.ClockSkewThreshold <= 0 {
+		dCfg.ClockSkewThreshold = defaultClockSkewThreshold
+	}
+	if dCfg.StaleConsensusGrace < 0 {
+		dCfg.StaleConsensusGrace = 0
+	} else if dCfg.StaleConsensusGrace > maxStaleConsensusGrace {
+		dCfg.StaleConsensusGrace = maxStaleConsensusGrace
+	}
+	if dCfg.EpochPeriod < 0 {
+		dCfg.EpochPeriod = 0
+	}
 }
 
 // Logging is the Katzenpost server logging configuration.
@@ -368,6 +495,22 @@ type Provider struct {
 	// from it's extension (eg: `alice+foo`).
 	RecipientDelimiter string
 
+	// AliasDB is the path to the recipient alias database, that maps
+	// additional recipients to user accounts and Kaetzchen endpoints.  If
+	// left empty, recipient aliases are disabled.
+	AliasDB string
+
+	// Policy is the optional recipient allow/deny policy.
+	Policy *ProviderPolicy
+
+	// Accounting is the optional service usage accounting configuration.
+	Accounting *Accounting
+
+	// DeliveryReceipts enables delivery receipts in the SURB-ACKs sent
+	// for messages stored in a user's spool, and negative receipts for
+	// the messages that could not be stored.
+	DeliveryReceipts bool
+
 	// Kaetzchen is the list of configured internal Kaetzchen (auto-responder agents)
 	// for this provider.
 	Kaetzchen []*Kaetzchen
@@ -375,6 +518,136 @@ type Provider struct {
 	// CBORPluginKaetzchen is the list of configured external CBOR Kaetzchen plugins
 	// for this provider.
 	CBORPluginKaetzchen []*CBORPluginKaetzchen
+
+	// PluginDir is the directory of the external Kaetzchen plugin programs
+	// that may be loaded by name with the LOAD_PLUGIN management command.
+	// If left empty, LOAD_PLUGIN only loads the configured plugins.
+	PluginDir string
+
+	// PluginSandbox is the sandbox applied to the plugins loaded from the
+	// PluginDir.  If left unset, the plugins run in the PluginDir, with
+	// conservative resource limits on Linux.
+	PluginSandbox *PluginSandbox
+}
+
+const (
+	// PolicyAllow is the policy action that accepts traffic.
+	PolicyAllow = "allow"
+
+	// PolicyDeny is the policy action that drops traffic.
+	PolicyDeny = "deny"
+)
+
+// ProviderPolicy is the Provider's recipient allow/deny policy.
+//
+// Note: Packets reach the Provider via the final mix layer, so the source
+// Provider of a packet is never identifiable, and rules only apply to the
+// recipient.
+type ProviderPolicy struct {
+	// DefaultAction is the action taken for traffic that does not match any
+	// rule, either `allow` (default) or `deny`.
+	DefaultAction string
+
+	// Rules are the policy rules, the first matching rule applies.
+	Rules []*PolicyRule
+}
+
+// PolicyRule is a Provider policy rule.
+type PolicyRule struct {
+	// Name is the name of the rule, used to label the drop counts.
+	Name string
+
+	// Action is the action taken for matching traffic, either `allow` or
+	// `deny`.
+	Action string
+
+	// Recipients are the user names and Kaetzchen endpoints matched by the
+	// rule, with `*` matching every recipient.
+	Recipients []string
+}
+
+func (pCfg *ProviderPolicy) validate() error {
+	switch pCfg.DefaultAction {
+	case "":
+		pCfg.DefaultAction = PolicyAllow
+	case PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("config: Provider: Policy: Invalid DefaultAction: '%v'", pCfg.DefaultAction)
+	}
+
+	names := make(map[string]bool)
+	for i, r := range pCfg.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("config: Provider: Policy: Duplicate rule: '%v'", r.Name)
+		}
+		names[r.Name] = true
+		switch r.Action {
+		case PolicyAllow, PolicyDeny:
+		default:
+			return fmt.Errorf("config: Provider: Policy: Rule '%v' has invalid Action: '%v'", r.Name, r.Action)
+		}
+		if len(r.Recipients) == 0 {
+			return fmt.Errorf("config: Provider: Policy: Rule '%v' has no Recipients", r.Name)
+		}
+	}
+	return nil
+}
+
+const (
+	// AccountingLog records usage in the server log.
+	AccountingLog = "log"
+
+	// AccountingSQL records usage in a SQL database.
+	AccountingSQL = "sql"
+
+	// AccountingWebhook posts usage to a HTTP endpoint.
+	AccountingWebhook = "webhook"
+
+	defaultAccountingInterval = 60 // 60 sec.
+)
+
+// Accounting is the Provider's service usage accounting configuration.
+// Usage is aggregated per user and service, and flushed to the sink
+// periodically.
+type Accounting struct {
+	// Sink is where usage records are written, one of `log`, `sql` or
+	// `webhook`.
+	Sink string
+
+	// FlushInterval is the interval between usage flushes in seconds.
+	FlushInterval int
+
+	// DataSourceName is the Postgresql data source name or URI, for the
+	// `sql` sink.
+	DataSourceName string
+
+	// URL is the URL usage records are POSTed to as JSON, for the
+	// `webhook` sink.
+	URL string
+}
+
+func (aCfg *Accounting) validate() error {
+	if aCfg.FlushInterval <= 0 {
+		aCfg.FlushInterval = defaultAccountingInterval
+	}
+	switch aCfg.Sink {
+	case AccountingLog:
+	case AccountingSQL:
+		if aCfg.DataSourceName == "" {
+			return fmt.Errorf("config: Provider: Accounting: DataSourceName is required for the sql sink")
+		}
+	case AccountingWebhook:
+		u, err := url.Parse(aCfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("config: Provider: Accounting: URL '%v' is invalid", aCfg.URL)
+		}
+	default:
+		return fmt.Errorf("config: Provider: Accounting: Invalid Sink: '%v'", aCfg.Sink)
+	}
+	return nil
 }
 
 // SQLDB is the SQL database backend configuration.
@@ -389,6 +662,10 @@ type SQLDB struct {
 	//
 	//  - pgx: https://godoc.org/github.com/jackc/pgx#ParseConnectionString
 	DataSourceName string
+
+	// DisableMigrations disables automatically upgrading the database schema
+	// on startup, for operators that manage schema changes themselves.
+	DisableMigrations bool
 }
 
 func (sCfg *SQLDB) validate() error {
@@ -414,6 +691,9 @@ type UserDB struct {
 
 	// Externally defined (RESTful http) userdb (`extern`).
 	Extern *ExternUserDB
+
+	// LDAP directory backed userdb (`ldap`).
+	LDAP *LDAPUserDB
 }
 
 // BoltUserDB is the BoltDB implementation of userdb.
@@ -428,6 +708,106 @@ type ExternUserDB struct {
 	// ProviderURL is the base url used for the external provider authentication API.
 	// It should be in the form `http://localhost:8080/`
 	ProviderURL string
+
+	// CACertificate is the optional path to the PEM encoded CA certificate
+	// used to verify a `https` ProviderURL, instead of the system roots.
+	CACertificate string
+
+	// ClientCertificate and ClientKey are the optional paths to the PEM
+	// encoded certificate and key used to authenticate to the API (mTLS).
+	ClientCertificate string
+	ClientKey         string
+
+	// SigningKey is the optional shared secret used to sign the requests
+	// with HMAC-SHA256.
+	SigningKey string
+
+	// RequestTimeout is the timeout in milliseconds for each request.
+	RequestTimeout int
+
+	// CacheTTL is the number of seconds the responses are cached for, 0
+	// disables caching.
+	CacheTTL int
+
+	// FailureThreshold is the number of consecutive failed requests after
+	// which requests are refused for BreakerCooldown seconds, instead of
+	// stalling connection handshakes.  0 disables the circuit breaker.
+	FailureThreshold int
+	BreakerCooldown  int
+}
+
+func (eCfg *ExternUserDB) applyDefaults() {
+	if eCfg.RequestTimeout <= 0 {
+		eCfg.RequestTimeout = defaultExternTimeout
+	}
+	if eCfg.BreakerCooldown <= 0 {
+		eCfg.BreakerCooldown = defaultBreakerCooldown
+	}
+}
+
+// LDAPUserDB is the LDAP directory user authentication.  The directory is
+// only read, accounts are managed with the directory's own tooling.
+type LDAPUserDB struct {
+	// URL is the directory server URL, either `ldap://` or `ldaps://`.
+	URL string
+
+	// StartTLS upgrades `ldap://` connections with StartTLS.
+	StartTLS bool
+
+	// BindDN and BindPassword are the credentials used to search the
+	// directory, if left empty an anonymous bind is used.
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the base of the user search.
+	BaseDN string
+
+	// UserFilter is the search filter that matches a user, with `%s`
+	// replaced by the escaped user name.  If left empty `(uid=%s)` is used.
+	UserFilter string
+
+	// LinkKeyAttribute is the attribute holding the hex encoded link layer
+	// authentication key.  If left empty `katzenpostLinkKey` is used.
+	LinkKeyAttribute string
+
+	// IdentityKeyAttribute is the attribute holding the optional hex
+	// encoded identity key.  If left empty `katzenpostIdentityKey` is used.
+	IdentityKeyAttribute string
+}
+
+func (lCfg *LDAPUserDB) applyDefaults() {
+	if lCfg.UserFilter == "" {
+		lCfg.UserFilter = "(uid=%s)"
+	}
+	if lCfg.LinkKeyAttribute == "" {
+		lCfg.LinkKeyAttribute = "katzenpostLinkKey"
+	}
+	if lCfg.IdentityKeyAttribute == "" {
+		lCfg.IdentityKeyAttribute = "katzenpostIdentityKey"
+	}
+}
+
+func (lCfg *LDAPUserDB) validate() error {
+	u, err := url.Parse(lCfg.URL)
+	if err != nil {
+		return fmt.Errorf("config: Provider: LDAP URL should be a valid url: %v", err)
+	}
+	switch u.Scheme {
+	case "ldap":
+	case "ldaps":
+		if lCfg.StartTLS {
+			return fmt.Errorf("config: Provider: LDAP StartTLS is invalid for ldaps URLs")
+		}
+	default:
+		return fmt.Errorf("config: Provider: LDAP URL should be of ldap or ldaps schema")
+	}
+	if lCfg.BaseDN == "" {
+		return fmt.Errorf("config: Provider: LDAP BaseDN should be defined")
+	}
+	if strings.Count(lCfg.UserFilter, "%s") != 1 {
+		return fmt.Errorf("config: Provider: LDAP UserFilter '%v' should contain exactly one %%s", lCfg.UserFilter)
+	}
+	return nil
 }
 
 // SpoolDB is the user message spool configuration.
@@ -438,6 +818,51 @@ type SpoolDB struct {
 
 	// BoltDB backed spool (`bolt`).
 	Bolt *BoltSpoolDB
+
+	// Quota is the optional per-user spool limit, currently only supported
+	// by the `bolt` backend.
+	Quota *SpoolQuota
+
+	// MessageTTL is the maximum time in hours a message is retained in a
+	// user's spool, 0 for no limit.  Currently only supported by the `bolt`
+	// backend.
+	MessageTTL int
+}
+
+const (
+	// SpoolQuotaRejectNew rejects new messages to users that are over
+	// quota.
+	SpoolQuotaRejectNew = "reject-new"
+
+	// SpoolQuotaDropOldest discards the oldest messages of users that are
+	// over quota to make room for new ones.
+	SpoolQuotaDropOldest = "drop-oldest"
+)
+
+// SpoolQuota is the per-user spool limit.
+type SpoolQuota struct {
+	// MaxMessages is the maximum number of spooled messages per user, 0 for
+	// no limit.
+	MaxMessages uint64
+
+	// MaxBytes is the maximum total size of the spooled messages per user,
+	// 0 for no limit.
+	MaxBytes uint64
+
+	// Policy is the action taken when a user is over quota, either
+	// `reject-new` (default) or `drop-oldest`.
+	Policy string
+}
+
+func (qCfg *SpoolQuota) validate() error {
+	switch qCfg.Policy {
+	case "":
+		qCfg.Policy = SpoolQuotaRejectNew
+	case SpoolQuotaRejectNew, SpoolQuotaDropOldest:
+	default:
+		return fmt.Errorf("config: Provider: SpoolDB: Invalid Quota Policy: '%v'", qCfg.Policy)
+	}
+	return nil
 }
 
 // BoltSpoolDB is the BolTDB implementation of the spool.
@@ -462,6 +887,44 @@ type Kaetzchen struct {
 	// initialization routine.
 	Config map[string]interface{}
 
+	// RateLimit is the maximum number of requests per minute that the
+	// agent will accept from all senders combined, with excess requests
+	// being dropped.  If set to 0, requests are not rate limited.
+	RateLimit uint64
+
+	// RateBurst is the maximum number of requests that the agent will
+	// accept at once.  If set to 0, it defaults to RateLimit.
+	RateBurst uint64
+
+	// UserRateLimit is the maximum number of requests per minute that the
+	// agent will accept from each user, which requires AllowedUsers to be
+	// set, as only authenticated requests have a known sender.  If set to
+	// 0, users are only limited by RateLimit.
+	UserRateLimit uint64
+
+	// UserRateBurst is the maximum number of requests that the agent will
+	// accept at once from each user.  If set to 0, it defaults to
+	// UserRateLimit.
+	UserRateBurst uint64
+
+	// CacheTTL is the number of seconds for which the agent's replies are
+	// cached and served to identical requests without querying the agent.
+	// It must only be set for agents answering read-only queries.  If set
+	// to 0, replies are not cached.
+	CacheTTL uint64
+
+	// DedupWindow is the number of seconds for which requests to the agent
+	// are remembered, so that retransmitted requests are answered with the
+	// original reply instead of being made again.  If set to 0, requests
+	// are not deduplicated.
+	DedupWindow uint64
+
+	// AllowedUsers is the list of the Provider's users allowed to make
+	// requests to the agent, with `*` allowing any user.  Requests must
+	// then be authenticated by the user.  If left empty, anyone including
+	// anonymous senders may make requests.
+	AllowedUsers []string
+
 	// Disable disabled a configured agent.
 	Disable bool
 }
@@ -482,6 +945,9 @@ func (kCfg *Kaetzchen) validate() error {
 	if _, err = mail.ParseAddress(kCfg.Endpoint + "@test.invalid"); err != nil {
 		return fmt.Errorf("config: Kaetzchen: '%v' has non local-part endpoint '%v': %v", kCfg.Capability, kCfg.Endpoint, err)
 	}
+	if kCfg.UserRateLimit != 0 && len(kCfg.AllowedUsers) == 0 {
+		return fmt.Errorf("config: Kaetzchen: '%v' has UserRateLimit set without AllowedUsers", kCfg.Capability)
+	}
 
 	return nil
 }
@@ -509,11 +975,67 @@ type CBORPluginKaetzchen struct {
 	// for this service.
 	MaxConcurrency int
 
+	// Sandbox is the optional resource limits and isolation applied to
+	// the plugin processes.
+	Sandbox *PluginSandbox
+
+	// Remote is the optional configuration of a plugin running on another
+	// host or container, reached over TCP.  Remote plugins are not
+	// executed by the server, so Command and Sandbox are ignored.
+	Remote *PluginRemote
+
+	// RateLimit is the maximum number of requests per minute that the
+	// agent will accept from all senders combined, with excess requests
+	// being dropped.  If set to 0, requests are not rate limited.
+	RateLimit uint64
+
+	// RateBurst is the maximum number of requests that the agent will
+	// accept at once.  If set to 0, it defaults to RateLimit.
+	RateBurst uint64
+
+	// UserRateLimit is the maximum number of requests per minute that the
+	// agent will accept from each user, which requires AllowedUsers to be
+	// set, as only authenticated requests have a known sender.  If set to
+	// 0, users are only limited by RateLimit.
+	UserRateLimit uint64
+
+	// UserRateBurst is the maximum number of requests that the agent will
+	// accept at once from each user.  If set to 0, it defaults to
+	// UserRateLimit.
+	UserRateBurst uint64
+
+	// CacheTTL is the number of seconds for which the agent's replies are
+	// cached and served to identical requests without querying the agent.
+	// It must only be set for agents answering read-only queries.  If set
+	// to 0, replies are not cached.
+	CacheTTL uint64
+
+	// DedupWindow is the number of seconds for which requests to the agent
+	// are remembered, so that retransmitted requests are answered with the
+	// original reply instead of being made again.  If set to 0, requests
+	// are not deduplicated.
+	DedupWindow uint64
+
+	// AllowedUsers is the list of the Provider's users allowed to make
+	// requests to the agent, with `*` allowing any user.  Requests must
+	// then be authenticated by the user.  If left empty, anyone including
+	// anonymous senders may make requests.
+	AllowedUsers []string
+
+	// LogLevel is the level at which the lines written by the plugin to
+	// its stdout and stderr are logged, under the `plugin/<Capability>/<n>`
+	// logger.  If left empty, it defaults to DEBUG.
+	LogLevel string
+
 	// Disable disabled a configured agent.
 	Disable bool
 }
 
-func (kCfg *CBORPluginKaetzchen) validate() error {
+// Validate checks the agent configuration, and sets the defaults of the
+// optional parameters.  It is called for the configured agents when the
+// configuration is loaded, and must be called for the agents configured
+// by other means.
+func (kCfg *CBORPluginKaetzchen) Validate() error {
 	if kCfg.Capability == "" {
 		return fmt.Errorf("config: Kaetzchen: Capability is invalid")
 	}
@@ -526,13 +1048,113 @@ func (kCfg *CBORPluginKaetzchen) validate() error {
 	if epNorm != kCfg.Endpoint {
 		return fmt.Errorf("config: Kaetzchen: '%v' has non-normalized endpoint %v", kCfg.Capability, kCfg.Endpoint)
 	}
-	if kCfg.Command == "" {
+	if kCfg.Command == "" && kCfg.Remote == nil {
 		return fmt.Errorf("config: Kaetzchen: Command is invalid")
 	}
 	if _, err = mail.ParseAddress(kCfg.Endpoint + "@test.invalid"); err != nil {
 		return fmt.Errorf("config: Kaetzchen: '%v' has non local-part endpoint '%v': %v", kCfg.Capability, kCfg.Endpoint, err)
 	}
+	if kCfg.UserRateLimit != 0 && len(kCfg.AllowedUsers) == 0 {
+		return fmt.Errorf("config: Kaetzchen: '%v' has UserRateLimit set without AllowedUsers", kCfg.Capability)
+	}
+	if kCfg.Sandbox != nil {
+		if err = kCfg.Sandbox.validate(); err != nil {
+			return fmt.Errorf("config: Kaetzchen: '%v' has invalid Sandbox: %v", kCfg.Capability, err)
+		}
+	}
+	if kCfg.Remote != nil {
+		if err = kCfg.Remote.validate(); err != nil {
+			return fmt.Errorf("config: Kaetzchen: '%v' has invalid Remote: %v", kCfg.Capability, err)
+		}
+	}
+	lvl := strings.ToUpper(kCfg.LogLevel)
+	switch lvl {
+	case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
+	case "":
+		lvl = defaultPluginLogLevel
+	default:
+		return fmt.Errorf("config: Kaetzchen: '%v' has invalid LogLevel '%v'", kCfg.Capability, kCfg.LogLevel)
+	}
+	kCfg.LogLevel = lvl
+
+	return nil
+}
+
+// PluginSandbox is the resource limits and isolation applied to an external
+// Kaetzchen plugin.  Zero values leave the corresponding limit unset.
+//
+// Note: Only WorkingDir is supported on platforms other than Linux.
+type PluginSandbox struct {
+	// WorkingDir is the working directory of the plugin, inside the
+	// Chroot if one is set.
+	WorkingDir string
+
+	// Chroot is the directory the plugin is confined to.  The plugin
+	// Command must be inside the Chroot, and is specified relative to it.
+	Chroot string
+
+	// Namespaces isolates the plugin in new mount, PID, IPC, and UTS
+	// namespaces, which requires the server to have CAP_SYS_ADMIN.
+	Namespaces bool
+
+	// MaxMemory is the maximum size of the plugin's address space in
+	// bytes.
+	MaxMemory uint64
+
+	// MaxCPUTime is the maximum CPU time that the plugin may consume in
+	// seconds, after which it is killed and restarted.
+	MaxCPUTime uint64
+
+	// MaxOpenFiles is the maximum number of open file descriptors.
+	MaxOpenFiles uint64
+
+	// MaxProcesses is the maximum number of processes for the plugin's
+	// user.
+	MaxProcesses uint64
+}
+
+func (sCfg *PluginSandbox) validate() error {
+	if sCfg.WorkingDir != "" && !filepath.IsAbs(sCfg.WorkingDir) {
+		return fmt.Errorf("WorkingDir '%v' is not an absolute path", sCfg.WorkingDir)
+	}
+	if sCfg.Chroot != "" && !filepath.IsAbs(sCfg.Chroot) {
+		return fmt.Errorf("Chroot '%v' is not an absolute path", sCfg.Chroot)
+	}
+	return nil
+}
+
+// PluginRemote is the configuration of an external Kaetzchen plugin
+// reached over TCP.  Requests must be authenticated, with a SharedSecret,
+// a ClientCertificate (mTLS), or both.
+type PluginRemote struct {
+	// Address is the host:port the plugin listens on.
+	Address string
+
+	// SharedSecret is the optional key used to sign the requests with
+	// HMAC-SHA256, in addition to TLS.
+	SharedSecret string
 
+	// CACertificate is the optional path to the PEM encoded CA certificate
+	// used to verify the plugin, instead of the system roots.  Remote
+	// plugins are always reached over TLS.
+	CACertificate string
+
+	// ClientCertificate and ClientKey are the optional paths to the PEM
+	// encoded certificate and key used to authenticate to the plugin.
+	ClientCertificate string
+	ClientKey         string
+}
+
+func (rCfg *PluginRemote) validate() error {
+	if _, _, err := net.SplitHostPort(rCfg.Address); err != nil {
+		return fmt.Errorf("Address '%v' is invalid: %v", rCfg.Address, err)
+	}
+	if (rCfg.ClientCertificate == "") != (rCfg.ClientKey == "") {
+		return errors.New("ClientCertificate and ClientKey must be set together")
+	}
+	if rCfg.SharedSecret == "" && rCfg.ClientCertificate == "" {
+		return errors.New("SharedSecret or ClientCertificate is required")
+	}
 	return nil
 }
 
@@ -551,9 +1173,27 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 		if pCfg.UserDB.Bolt.UserDB == "" {
 			pCfg.UserDB.Bolt.UserDB = filepath.Join(sCfg.DataDir, defaultUserDB)
 		}
+	case BackendExtern:
+		if pCfg.UserDB.Extern != nil {
+			pCfg.UserDB.Extern.applyDefaults()
+		}
+	case BackendLDAP:
+		if pCfg.UserDB.LDAP != nil {
+			pCfg.UserDB.LDAP.applyDefaults()
+		}
 	default:
 	}
 
+	if pCfg.PluginDir != "" && pCfg.PluginSandbox == nil {
+		pCfg.PluginSandbox = &PluginSandbox{
+			WorkingDir: pCfg.PluginDir,
+		}
+		if runtime.GOOS == "linux" {
+			pCfg.PluginSandbox.MaxMemory = defaultPluginMaxMemory
+			pCfg.PluginSandbox.MaxOpenFiles = defaultPluginMaxOpenFiles
+		}
+	}
+
 	if pCfg.SpoolDB == nil {
 		pCfg.SpoolDB = &SpoolDB{}
 	}
@@ -573,6 +1213,19 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 }
 
 func (pCfg *Provider) validate() error {
+	if pCfg.AliasDB != "" && !filepath.IsAbs(pCfg.AliasDB) {
+		return fmt.Errorf("config: Provider: AliasDB '%v' is not an absolute path", pCfg.AliasDB)
+	}
+	if pCfg.Policy != nil {
+		if err := pCfg.Policy.validate(); err != nil {
+			return err
+		}
+	}
+	if pCfg.Accounting != nil {
+		if err := pCfg.Accounting.validate(); err != nil {
+			return err
+		}
+	}
 	if pCfg.EnableUserRegistrationHTTP {
 		for _, addr := range pCfg.UserRegistrationHTTPAddresses {
 			h, p, err := net.SplitHostPort(addr)
@@ -617,6 +1270,19 @@ func (pCfg *Provider) validate() error {
 		default:
 			return fmt.Errorf("config: Provider: ProviderURL should be of http schema")
 		}
+		if (pCfg.UserDB.Extern.ClientCertificate == "") != (pCfg.UserDB.Extern.ClientKey == "") {
+			return fmt.Errorf("config: Provider: ClientCertificate and ClientKey should both be defined for Extern")
+		}
+		if pCfg.UserDB.Extern.CacheTTL < 0 || pCfg.UserDB.Extern.FailureThreshold < 0 {
+			return fmt.Errorf("config: Provider: CacheTTL and FailureThreshold should not be negative for Extern")
+		}
+	case BackendLDAP:
+		if pCfg.UserDB.LDAP == nil {
+			return fmt.Errorf("config: Provider: LDAP section should be defined")
+		}
+		if err := pCfg.UserDB.LDAP.validate(); err != nil {
+			return err
+		}
 	case BackendSQL:
 		if pCfg.SQLDB == nil {
 			return fmt.Errorf("config: Provider: UserDB configured for an SQL backend without a SQLDB block")
@@ -634,9 +1300,36 @@ func (pCfg *Provider) validate() error {
 		if pCfg.SQLDB == nil {
 			return fmt.Errorf("config: Provider: SpoolDB configured for an SQL backend without a SQLDB block")
 		}
+		if pCfg.SpoolDB.Quota != nil {
+			return fmt.Errorf("config: Provider: SpoolDB Quota is not supported by the SQL backend")
+		}
+		if pCfg.SpoolDB.MessageTTL != 0 {
+			return fmt.Errorf("config: Provider: SpoolDB MessageTTL is not supported by the SQL backend")
+		}
 	default:
 		return fmt.Errorf("config: Provider: Invalid SpoolDB Backend: '%v'", pCfg.SpoolDB.Backend)
 	}
+	if pCfg.SpoolDB.Quota != nil {
+		if err := pCfg.SpoolDB.Quota.validate(); err != nil {
+			return err
+		}
+	}
+	if pCfg.SpoolDB.MessageTTL < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MessageTTL is invalid: %v", pCfg.SpoolDB.MessageTTL)
+	}
+
+	if pCfg.PluginDir != "" && !filepath.IsAbs(pCfg.PluginDir) {
+		return fmt.Errorf("config: Provider: PluginDir '%v' is not an absolute path", pCfg.PluginDir)
+	}
+	if pCfg.PluginSandbox != nil {
+		if err := pCfg.PluginSandbox.validate(); err != nil {
+			return fmt.Errorf("config: Provider: PluginSandbox is invalid: %v", err)
+		}
+		if pCfg.PluginSandbox.Chroot != "" {
+			// The plugins are executed from the PluginDir.
+			return errors.New("config: Provider: PluginSandbox Chroot is not supported")
+		}
+	}
 
 	capaMap := make(map[string]bool)
 	for _, v := range pCfg.Kaetzchen {
@@ -649,7 +1342,7 @@ func (pCfg *Provider) validate() error {
 		capaMap[v.Capability] = true
 	}
 	for _, v := range pCfg.CBORPluginKaetzchen {
-		if err := v.validate(); err != nil {
+		if err := v.Validate(); err != nil {
 			return err
 		}
 		if capaMap[v.Capability] {
@@ -661,25 +1354,71 @@ func (pCfg *Provider) validate() error {
 	return nil
 }
 
-// PKI is the Katzenpost directory authority configuration.
+// PKI is the Katzenpost directory authority configuration.  Exactly one
+// of the backends must be configured.
 type PKI struct {
 	// Nonvoting is a non-voting directory authority.
 	Nonvoting *Nonvoting
-	Voting    *Voting
+
+	// VotingAuthority is a Katzenpost voting directory authority.
+	VotingAuthority *VotingAuthority
+
+	// Katzenmint is the Katzenmint (Tendermint) chain based directory
+	// authority.
+	Katzenmint *Katzenmint
+
+	// Voting is the deprecated name of the Katzenmint section.
+	Voting *Voting
+
+	// Static is a PKI document loaded from a local file, for test networks.
+	Static *Static
+
+	// Validation is the PKI document validation mode, either `lenient`
+	// (the default) or `strict`.  Lenient validation logs documents with
+	// missing parameters or topology oddities, while strict validation
+	// rejects them.
+	Validation string
 }
 
 func (pCfg *PKI) validate() error {
-	nrCfg := 0
-	if pCfg.Nonvoting != nil && pCfg.Voting != nil {
-		return errors.New("pki config failure: cannot configure voting and nonvoting pki")
+	switch pCfg.Validation {
+	case "":
+		pCfg.Validation = ValidationLenient
+	case ValidationLenient, ValidationStrict:
+	default:
+		return fmt.Errorf("config: PKI: Invalid Validation mode: '%v'", pCfg.Validation)
+	}
+
+	// Older configurations used the Voting section for Katzenmint.
+	if pCfg.Voting != nil {
+		if pCfg.Katzenmint != nil {
+			return errors.New("config: PKI: Voting and Katzenmint are both set, use Katzenmint only")
+		}
+		pCfg.Katzenmint, pCfg.Voting = pCfg.Voting, nil
 	}
+
+	nrCfg := 0
 	if pCfg.Nonvoting != nil {
 		if err := pCfg.Nonvoting.validate(); err != nil {
 			return err
 		}
 		nrCfg++
-	} else {
-		if err := pCfg.Voting.validate(); err != nil {
+	}
+	if pCfg.VotingAuthority != nil {
+		pCfg.VotingAuthority.applyDefaults()
+		if err := pCfg.VotingAuthority.validate(); err != nil {
+			return err
+		}
+		nrCfg++
+	}
+	if pCfg.Katzenmint != nil {
+		if err := pCfg.Katzenmint.validate(); err != nil {
+			return err
+		}
+		nrCfg++
+	}
+	if pCfg.Static != nil {
+		if err := pCfg.Static.validate(); err != nil {
 			return err
 		}
 		nrCfg++
@@ -712,6 +1451,32 @@ func (nCfg *Nonvoting) validate() error {
 	return nil
 }
 
+// Static is a PKI document loaded from a local file instead of being
+// fetched from a directory authority.
+type Static struct {
+	// File is the absolute path to the PKI document.
+	File string
+
+	// PublicKey is the public key of the non-voting authority that signed
+	// the document, in Base64 or Base16 format.  If left empty, File is
+	// an unsigned JSON encoded document that is used for every epoch,
+	// which is only suitable for testing.
+	PublicKey string
+}
+
+func (sCfg *Static) validate() error {
+	if !filepath.IsAbs(sCfg.File) {
+		return fmt.Errorf("config: PKI/Static: File '%v' is not an absolute path", sCfg.File)
+	}
+	if sCfg.PublicKey != "" {
+		var pubKey eddsa.PublicKey
+		if err := pubKey.FromString(sCfg.PublicKey); err != nil {
+			return fmt.Errorf("config: PKI/Static: Invalid PublicKey: %v", err)
+		}
+	}
+	return nil
+}
+
 // Peer is a voting peer.
 type Peer struct {
 	Addresses         []string
@@ -719,33 +1484,84 @@ type Peer struct {
 	LinkPublicKey     string
 }
 
-// func (p *Peer) validate() error {
-// 	for _, address := range p.Addresses {
-// 		if err := utils.EnsureAddrIPPort(address); err != nil {
-// 			return fmt.Errorf("Voting Peer: Address is invalid: %v", err)
-// 		}
-// 	}
-// 	var pubKey eddsa.PublicKey
-// 	if err := pubKey.FromString(p.IdentityPublicKey); err != nil {
-// 		return fmt.Errorf("Voting Peer: Invalid IdentityPublicKey: %v", err)
-// 	}
-// 	if err := pubKey.FromString(p.LinkPublicKey); err != nil {
-// 		return fmt.Errorf("Voting Peer: Invalid LinkPublicKey: %v", err)
-// 	}
-// 	return nil
-// }
-
-// Voting is a voting directory authority.
-type Voting struct {
-	ChainID            string
-	TrustOptions       light.TrustOptions
-	PrimaryAddress     string
+func (p *Peer) validate() error {
+	for _, address := range p.Addresses {
+		if err := utils.EnsureAddrIPPort(address); err != nil {
+			return fmt.Errorf("Voting Peer: Address is invalid: %v", err)
+		}
+	}
+	var idKey eddsa.PublicKey
+	if err := idKey.UnmarshalText([]byte(p.IdentityPublicKey)); err != nil {
+		return fmt.Errorf("Voting Peer: Invalid IdentityPublicKey: %v", err)
+	}
+	var linkKey ecdh.PublicKey
+	if err := linkKey.UnmarshalText([]byte(p.LinkPublicKey)); err != nil {
+		return fmt.Errorf("Voting Peer: Invalid LinkPublicKey: %v", err)
+	}
+	return nil
+}
+
+// VotingAuthority is a Katzenpost voting directory authority.
+type VotingAuthority struct {
+	// Peers is the list of directory authority peers.
+	Peers []*Peer
+
+	// SignatureThreshold is the number of valid authority signatures
+	// required before a PKI document is trusted.  If left as 0, a majority
+	// of the Peers is required.
+	SignatureThreshold int
+}
+
+func (vCfg *VotingAuthority) applyDefaults() {
+	if vCfg.SignatureThreshold == 0 {
+		vCfg.SignatureThreshold = len(vCfg.Peers)/2 + 1
+	}
+}
+
+func (vCfg *VotingAuthority) validate() error {
+	if len(vCfg.Peers) == 0 {
+		return fmt.Errorf("config: PKI/VotingAuthority: No Peers configured")
+	}
+	if vCfg.SignatureThreshold < 0 || vCfg.SignatureThreshold > len(vCfg.Peers) {
+		return fmt.Errorf("config: PKI/VotingAuthority: SignatureThreshold %v is invalid for %v Peers", vCfg.SignatureThreshold, len(vCfg.Peers))
+	}
+	for _, peer := range vCfg.Peers {
+		if err := peer.validate(); err != nil {
+			return fmt.Errorf("config: PKI/VotingAuthority: %v", err)
+		}
+	}
+	return nil
+}
+
+// Katzenmint is the Katzenmint (Tendermint) chain based directory
+// authority.  Documents and descriptor inclusion are verified with the
+// Tendermint light client.
+type Katzenmint struct {
+	// ChainID is the Tendermint chain ID.
+	ChainID string
+
+	// TrustOptions is the light client's trusted header.
+	TrustOptions light.TrustOptions
+
+	// PrimaryAddress is the address of the light client's primary node.
+	PrimaryAddress string
+
+	// WitnessesAddresses are the addresses of the light client's witnesses.
 	WitnessesAddresses []string
-	DatabaseName       string
-	DatabaseDir        string
-	RPCAddress         string
+
+	// DatabaseName and DatabaseDir specify the light client's trusted
+	// store.
+	DatabaseName string
+	DatabaseDir  string
+
+	// RPCAddress is the address of the node used to query and post to the
+	// chain, starting with `tcp://`.
+	RPCAddress string
 }
 
+// Voting is the deprecated name for Katzenmint.
+type Voting = Katzenmint
+
 // AuthorityPeersFromPeers loads keys and instances config.AuthorityPeer for each Peer
 func AuthorityPeersFromPeers(peers []*Peer) ([]*config.AuthorityPeer, error) {
 	authPeers := []*config.AuthorityPeer{}
@@ -770,7 +1586,7 @@ func AuthorityPeersFromPeers(peers []*Peer) ([]*config.AuthorityPeer, error) {
 	return authPeers, nil
 }
 
-func (vCfg *Voting) validate() error {
+func (vCfg *Katzenmint) validate() error {
 	if err := vCfg.TrustOptions.ValidateBasic(); err != nil {
 		return fmt.Errorf("config: %+v", err)
 	}
@@ -785,10 +1601,44 @@ func (vCfg *Voting) validate() error {
 	}
 	parsedAddress := strings.Split(vCfg.RPCAddress, "tcp://")
 	if len(parsedAddress) <= 1 {
-		return fmt.Errorf("config: PKI/Voting: Address is invalid: address should start with tcp://")
+		return fmt.Errorf("config: PKI/Katzenmint: Address is invalid: address should start with tcp://")
 	}
 	if err := utils.EnsureAddrIPPort(parsedAddress[1]); err != nil {
-		return fmt.Errorf("config: PKI/Voting: Address is invalid: %v", err)
+		return fmt.Errorf("config: PKI/Katzenmint: Address is invalid: %v", err)
+	}
+	return nil
+}
+
+// UpstreamProxy is the outgoing connection proxy configuration.
+type UpstreamProxy struct {
+	// Type is the proxy type, currently only `socks5` is supported.
+	Type string
+
+	// Address is the proxy's IP/port combination (eg: a Tor SOCKSPort).
+	Address string
+
+	// User is the optional proxy username.
+	User string
+
+	// Password is the optional proxy password.
+	Password string
+
+	// AllConnections routes the outgoing connections to other nodes via
+	// the proxy in addition to the PKI traffic.
+	AllConnections bool
+}
+
+func (uCfg *UpstreamProxy) validate() error {
+	switch strings.ToLower(uCfg.Type) {
+	case ProxyTypeSOCKS5:
+	default:
+		return fmt.Errorf("config: UpstreamProxy: Invalid Type: '%v'", uCfg.Type)
+	}
+	if err := utils.EnsureAddrIPPort(uCfg.Address); err != nil {
+		return fmt.Errorf("config: UpstreamProxy: Address is invalid: %v", err)
+	}
+	if uCfg.User == "" && uCfg.Password != "" {
+		return fmt.Errorf("config: UpstreamProxy: Password set without User")
 	}
 	return nil
 }
@@ -801,31 +1651,142 @@ type Management struct {
 	// Path specifies the path to the manaagment interface socket.  If left
 	// empty it will use `management_sock` under the DataDir.
 	Path string
+
+	// EnableHTTP enables the HTTP management API, that mirrors the
+	// management commands with JSON responses.
+	EnableHTTP bool
+
+	// HTTPAddress is the address the HTTP management API listens on.  If
+	// left empty it will use `127.0.0.1:3220`.
+	HTTPAddress string
+
+	// HTTPTokenFile is the path to the file holding the bearer token that
+	// the HTTP management API requests must be authorized with.  The file
+	// is generated if it does not exist, and must only be accessible by the
+	// server's user.  If left empty it will use `management_http_token`
+	// under the DataDir.
+	HTTPTokenFile string
+
+	// HTTPAllowRemote allows a non-loopback HTTPAddress.  The HTTP
+	// management API does not use TLS, so this should only be used with a
+	// trusted network.
+	HTTPAllowRemote bool
+
+	// GRPC is the optional gRPC management API configuration.
+	GRPC *ManagementGRPC
+}
+
+// ManagementGRPC is the gRPC management API configuration.  Clients are
+// authenticated with mutual TLS, and authorized per management command.
+type ManagementGRPC struct {
+	// Address is the address the gRPC management API listens on.
+	Address string
+
+	// Certificate and Key are the paths to the PEM encoded certificate and
+	// key of the server.
+	Certificate string
+	Key         string
+
+	// ClientCA is the path to the PEM encoded CA certificate that client
+	// certificates must be signed by.
+	ClientCA string
+
+	// Clients are the clients allowed to use the API.
+	Clients []*ManagementGRPCClient
+}
+
+// ManagementGRPCClient is a client of the gRPC management API.
+type ManagementGRPCClient struct {
+	// Name is the common name of the client's certificate.
+	Name string
+
+	// Commands are the management commands the client is allowed to
+	// execute, with `*` allowing all of them.
+	Commands []string
+}
+
+func (gCfg *ManagementGRPC) validate() error {
+	if _, _, err := net.SplitHostPort(gCfg.Address); err != nil {
+		return fmt.Errorf("config: Management: GRPC: Address '%v' is invalid: %v", gCfg.Address, err)
+	}
+	if gCfg.Certificate == "" || gCfg.Key == "" || gCfg.ClientCA == "" {
+		return errors.New("config: Management: GRPC: Certificate, Key and ClientCA are required")
+	}
+	if len(gCfg.Clients) == 0 {
+		return errors.New("config: Management: GRPC: no Clients")
+	}
+	names := make(map[string]bool)
+	for _, c := range gCfg.Clients {
+		if c.Name == "" {
+			return errors.New("config: Management: GRPC: Client Name is empty")
+		}
+		if names[c.Name] {
+			return fmt.Errorf("config: Management: GRPC: Client '%v' is listed more than once", c.Name)
+		}
+		names[c.Name] = true
+		if len(c.Commands) == 0 {
+			return fmt.Errorf("config: Management: GRPC: Client '%v' has no Commands", c.Name)
+		}
+	}
+	return nil
 }
 
 func (mCfg *Management) applyDefaults(sCfg *Server) {
 	if mCfg.Path == "" {
 		mCfg.Path = filepath.Join(sCfg.DataDir, defaultManagementSocket)
 	}
+	if mCfg.HTTPAddress == "" {
+		mCfg.HTTPAddress = defaultManagementHTTP
+	}
+	if mCfg.HTTPTokenFile == "" {
+		mCfg.HTTPTokenFile = filepath.Join(sCfg.DataDir, defaultManagementHTTPToken)
+	}
 }
 
 func (mCfg *Management) validate() error {
 	if !mCfg.Enable {
+		if mCfg.EnableHTTP || mCfg.GRPC != nil {
+			return fmt.Errorf("config: Management: EnableHTTP and GRPC require Enable")
+		}
 		return nil
 	}
 	if !filepath.IsAbs(mCfg.Path) {
 		return fmt.Errorf("config: Management: Path '%v' is not an absolute path", mCfg.Path)
 	}
+	if mCfg.EnableHTTP {
+		h, _, err := net.SplitHostPort(mCfg.HTTPAddress)
+		if err != nil {
+			return fmt.Errorf("config: Management: HTTPAddress '%v' is invalid: %v", mCfg.HTTPAddress, err)
+		}
+		if !mCfg.HTTPAllowRemote && !isLoopback(h) {
+			return fmt.Errorf("config: Management: HTTPAddress '%v' is not a loopback address", mCfg.HTTPAddress)
+		}
+		if !filepath.IsAbs(mCfg.HTTPTokenFile) {
+			return fmt.Errorf("config: Management: HTTPTokenFile '%v' is not an absolute path", mCfg.HTTPTokenFile)
+		}
+	}
+	if mCfg.GRPC != nil {
+		return mCfg.GRPC.validate()
+	}
 	return nil
 }
 
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // Config is the top level Katzenpost server configuration.
 type Config struct {
-	Server     *Server
-	Logging    *Logging
-	Provider   *Provider
-	PKI        *PKI
-	Management *Management
+	Server        *Server
+	Logging       *Logging
+	Provider      *Provider
+	PKI           *PKI
+	UpstreamProxy *UpstreamProxy
+	Management    *Management
 
 	Debug *Debug
 }
@@ -859,6 +1820,11 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.PKI.validate(); err != nil {
 		return err
 	}
+	if cfg.UpstreamProxy != nil {
+		if err := cfg.UpstreamProxy.validate(); err != nil {
+			return err
+		}
+	}
 	if cfg.Server.IsProvider {
 		if cfg.Provider == nil {
 			cfg.Provider = &Provider{}
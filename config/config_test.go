@@ -122,3 +122,45 @@ PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
 	require.EqualError(err, "config: Server: Identifier is not set")
 
 }
+
+func TestPKIBackendSelection(t *testing.T) {
+	require := require.New(t)
+
+	const noBackendConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+
+[PKI]
+`
+
+	_, err := Load([]byte(noBackendConfig))
+	require.EqualError(err, "config: Only one authority backend should be configured, got: 0")
+
+	const votingAuthorityConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+
+[PKI]
+[PKI.VotingAuthority]
+[[PKI.VotingAuthority.Peers]]
+Addresses = [ "127.0.0.1:6999" ]
+IdentityPublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+LinkPublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	_, err = Load([]byte(votingAuthorityConfig))
+	require.NoError(err, "Load() with voting authority config")
+
+	const multipleBackendConfig = votingAuthorityConfig + `
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	_, err = Load([]byte(multipleBackendConfig))
+	require.EqualError(err, "config: Only one authority backend should be configured, got: 2")
+}
@@ -0,0 +1,85 @@
+// connections.go - Katzenpost server connection table.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/thwack"
+)
+
+// formatConnection formats the state of a link as `key=value` pairs.
+func formatConnection(info *glue.ConnectionInfo, now time.Time) string {
+	direction, state := "outgoing", "connecting"
+	if info.Incoming {
+		direction = "incoming"
+	}
+	if !info.ConnectedAt.IsZero() {
+		state = "connected"
+	}
+
+	s := []string{
+		direction,
+		"peer=" + info.Peer,
+		"addr=" + info.Address,
+		"state=" + state,
+	}
+	if !info.ConnectedAt.IsZero() {
+		s = append(s, fmt.Sprintf("uptime=%v", now.Sub(info.ConnectedAt).Round(time.Second)))
+	}
+	if !info.Incoming {
+		s = append(s, fmt.Sprintf("queue=%v", info.QueueLength))
+		s = append(s, fmt.Sprintf("reconnects=%v", info.Reconnects))
+	}
+	if info.LastError != nil {
+		s = append(s, fmt.Sprintf("last_error=%q", info.LastError.Error()))
+		s = append(s, fmt.Sprintf("last_error_age=%v", now.Sub(info.LastErrorAt).Round(time.Second)))
+	}
+	return strings.Join(s, " ")
+}
+
+// onConnections handles `CONNECTIONS`, that lists the state of the
+// incoming and outgoing links, one per line.
+func (s *Server) onConnections(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("CONNECTIONS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	var incoming []*glue.ConnectionInfo
+	for _, listener := range s.listeners {
+		incoming = append(incoming, listener.Connections()...)
+	}
+	outgoing := s.connector.Connections()
+	for _, conns := range [][]*glue.ConnectionInfo{incoming, outgoing} {
+		sort.Slice(conns, func(i, j int) bool { return conns[i].Peer < conns[j].Peer })
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	now := time.Now()
+	w := c.Writer()
+	for _, info := range append(incoming, outgoing...) {
+		if err := w.PrintfLine("%v-%v", thwack.StatusOk, formatConnection(info, now)); err != nil {
+			return err
+		}
+	}
+	return w.PrintfLine("%v %v incoming, %v outgoing", thwack.StatusOk, len(incoming), len(outgoing))
+}
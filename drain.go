@@ -0,0 +1,144 @@
+// drain.go - Katzenpost server graceful drain.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+const (
+	// defaultDrainWait is the time DRAIN waits for the queues to empty
+	// by default, it is below the timeout of the network management APIs.
+	defaultDrainWait  = 30 * time.Second
+	drainPollInterval = 100 * time.Millisecond
+
+	// drainGracePeriod is the time after which the established incoming
+	// connections are closed while draining.
+	drainGracePeriod = 10 * time.Second
+)
+
+// drainBacklog returns the number of packets that still have to go through
+// the server, and a description of where they are.
+func (s *Server) drainBacklog() (int, string) {
+	inbound := 0
+	for _, ch := range s.inboundPackets {
+		inbound += ch.Len()
+	}
+	scheduled := s.scheduler.QueueLength()
+	outgoing := s.connector.QueueLength()
+	provider := 0
+	if s.provider != nil {
+		provider = s.provider.Backlog()
+	}
+
+	total := inbound + scheduled + outgoing + provider
+	desc := fmt.Sprintf("inbound: %v, scheduler: %v, outgoing: %v, provider: %v", inbound, scheduled, outgoing, provider)
+	return total, desc
+}
+
+// IsDraining returns true iff the server is draining.
+func (s *Server) IsDraining() bool {
+	return atomic.LoadUint32(&s.draining) == 1
+}
+
+// Drain stops accepting new incoming connections and client submissions,
+// and waits up to timeout for the scheduler, the outgoing connections and
+// the Kaetzchen to process the queued packets.  It returns true iff the
+// server is ready to be shutdown without losing the packets it accepted.
+//
+// The peers of a mix keep sending packets over the established
+// connections, so the backlog would rarely reach 0.  The incoming
+// connections are therefore closed drainGracePeriod after draining
+// started, and the packets the peers send afterwards are not accepted,
+// but left to the peers' own queues.  The node should be removed from the
+// PKI document beforehand, so that no more packets are routed through it.
+//
+// Draining can not be canceled, and Drain may be called again to keep
+// waiting.
+func (s *Server) Drain(timeout time.Duration) (bool, string) {
+	if atomic.CompareAndSwapUint32(&s.draining, 0, 1) {
+		s.log.Noticef("Draining, no longer accepting connections and client submissions.")
+		s.drainLock.Lock()
+		s.drainStartedAt = time.Now()
+		s.drainLock.Unlock()
+		for _, l := range s.listeners {
+			l.Drain()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		s.closeDrainedConns()
+		n, desc := s.drainBacklog()
+		if n == 0 {
+			s.log.Noticef("Drained, ready for shutdown.")
+			return true, desc
+		}
+		if time.Now().After(deadline) {
+			s.log.Noticef("Still draining, %v", desc)
+			return false, desc
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// closeDrainedConns closes the incoming connections once the drain grace
+// period expired, see Drain.
+func (s *Server) closeDrainedConns() {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	if s.drainConnsClosed || s.drainStartedAt.IsZero() || time.Since(s.drainStartedAt) < drainGracePeriod {
+		return
+	}
+	s.log.Noticef("Draining, closing the incoming connections.")
+	for _, l := range s.listeners {
+		l.CloseConns()
+	}
+	s.drainConnsClosed = true
+}
+
+// onDrain handles `DRAIN [timeout_sec]`, that drains the server, and
+// replies once it is ready for shutdown, or with the remaining backlog if
+// the timeout expires first.
+func (s *Server) onDrain(c *thwack.Conn, l string) error {
+	timeout := defaultDrainWait
+	sp := strings.Split(l, " ")
+	switch len(sp) {
+	case 1:
+	case 2:
+		sec, err := strconv.ParseUint(sp[1], 10, 32)
+		if err != nil {
+			c.Log().Debugf("DRAIN invalid timeout: '%v'", sp[1])
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		timeout = time.Duration(sec) * time.Second
+	default:
+		c.Log().Debugf("DRAIN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if ready, desc := s.Drain(timeout); !ready {
+		return c.Writer().PrintfLine("%v draining, %v", thwack.StatusTransactionFailed, desc)
+	}
+	return c.Writer().PrintfLine("%v ready for shutdown", thwack.StatusOk)
+}
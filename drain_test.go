@@ -0,0 +1,123 @@
+// drain_test.go - Katzenpost server graceful drain tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+)
+
+type drainScheduler struct {
+	glue.Scheduler
+
+	n int32
+}
+
+func (s *drainScheduler) QueueLength() int {
+	return int(atomic.LoadInt32(&s.n))
+}
+
+type drainConnector struct {
+	glue.Connector
+}
+
+func (c *drainConnector) QueueLength() int {
+	return 0
+}
+
+type drainListener struct {
+	glue.Listener
+
+	drains     int32
+	closeConns int32
+}
+
+func (l *drainListener) Drain() {
+	atomic.AddInt32(&l.drains, 1)
+}
+
+func (l *drainListener) CloseConns() {
+	atomic.AddInt32(&l.closeConns, 1)
+}
+
+func newDrainTestServer(t *testing.T) (*Server, *drainScheduler, *drainListener) {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	q, l := new(drainScheduler), new(drainListener)
+	s := &Server{
+		log:            logBackend.GetLogger("server"),
+		inboundPackets: []*channels.InfiniteChannel{channels.NewInfiniteChannel()},
+		scheduler:      q,
+		connector:      new(drainConnector),
+		listeners:      []glue.Listener{l},
+	}
+	return s, q, l
+}
+
+func TestDrain(t *testing.T) {
+	require := require.New(t)
+
+	s, q, l := newDrainTestServer(t)
+	require.False(s.IsDraining())
+
+	// The backlog is reported if it doesn't drain in time.
+	atomic.StoreInt32(&q.n, 2)
+	ready, desc := s.Drain(0)
+	require.False(ready)
+	require.True(s.IsDraining())
+	require.True(strings.Contains(desc, "scheduler: 2"), desc)
+	require.Equal(int32(1), atomic.LoadInt32(&l.drains))
+
+	// Draining again keeps waiting, without draining the listeners again.
+	go func() {
+		time.Sleep(2 * drainPollInterval)
+		atomic.StoreInt32(&q.n, 0)
+	}()
+	ready, _ = s.Drain(10 * time.Second)
+	require.True(ready)
+	require.Equal(int32(1), atomic.LoadInt32(&l.drains))
+	require.Zero(atomic.LoadInt32(&l.closeConns), "within the grace period")
+}
+
+func TestCloseDrainedConns(t *testing.T) {
+	require := require.New(t)
+
+	s, _, l := newDrainTestServer(t)
+
+	// Nothing is closed unless draining.
+	s.closeDrainedConns()
+	require.Zero(atomic.LoadInt32(&l.closeConns))
+
+	s.drainStartedAt = time.Now()
+	s.closeDrainedConns()
+	require.Zero(atomic.LoadInt32(&l.closeConns))
+
+	// The incoming connections are closed once after the grace period.
+	s.drainStartedAt = time.Now().Add(-drainGracePeriod)
+	s.closeDrainedConns()
+	require.Equal(int32(1), atomic.LoadInt32(&l.closeConns))
+	s.closeDrainedConns()
+	require.Equal(int32(1), atomic.LoadInt32(&l.closeConns))
+}
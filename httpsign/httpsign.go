@@ -0,0 +1,103 @@
+// httpsign.go - Signed HTTP requests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package httpsign implements the signatures of the HTTP requests sent to
+// remote CBOR plugins and to the external user database, so that they can
+// authenticate the server and reject stale or replayed requests.
+package httpsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	// SignatureHeader is the header carrying the hex encoded HMAC-SHA256
+	// of the request timestamp, nonce, path and body.
+	SignatureHeader = "X-Meson-Signature"
+
+	// TimestampHeader is the header carrying the request time in seconds
+	// since the UNIX epoch, so that services can reject stale requests.
+	TimestampHeader = "X-Meson-Timestamp"
+
+	// NonceHeader is the header carrying a random hex encoded nonce, unique
+	// to each request, so that services can reject replayed requests by
+	// remembering the nonces of the requests that are not yet stale.
+	NonceHeader = "X-Meson-Nonce"
+
+	nonceSize = 16
+)
+
+var (
+	errMissingHeaders = errors.New("httpsign: missing signature headers")
+	errStale          = errors.New("httpsign: stale request")
+	errBadSignature   = errors.New("httpsign: invalid signature")
+)
+
+// Sign returns the hex encoded signature of a request.
+func Sign(key []byte, timestamp, nonce, path string, body []byte) string {
+	m := hmac.New(sha256.New, key)
+	_, _ = m.Write([]byte(timestamp + "\n" + nonce + "\n" + path + "\n"))
+	_, _ = m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SignRequest sets the signature headers of req, with a fresh timestamp
+// and nonce.  body must be the request body.
+func SignRequest(key []byte, req *http.Request, body []byte) error {
+	var rawNonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, rawNonce[:]); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(rawNonce[:])
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(key, ts, nonce, req.URL.Path, body))
+	return nil
+}
+
+// Verify checks the signature headers of req, with body being the request
+// body, and rejects requests older than maxAge.  Rejecting replayed nonces
+// is left to the caller.
+func Verify(key []byte, req *http.Request, body []byte, maxAge time.Duration) error {
+	ts := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	sig, err := hex.DecodeString(req.Header.Get(SignatureHeader))
+	if ts == "" || nonce == "" || err != nil {
+		return errMissingHeaders
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errMissingHeaders
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return errStale
+	}
+	want, _ := hex.DecodeString(Sign(key, ts, nonce, req.URL.Path, body))
+	if !hmac.Equal(sig, want) {
+		return errBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// httpsign_test.go - Signed HTTP request tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package httpsign
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignRequest(t *testing.T) {
+	require := require.New(t)
+
+	key := []byte("s3kr1t")
+	body := []byte("user=alice")
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "https://127.0.0.1/exists", nil)
+		require.NoError(err)
+		require.NoError(SignRequest(key, req, body))
+		return req
+	}
+
+	req := newRequest()
+	require.NoError(Verify(key, req, body, time.Minute))
+	require.Equal(Sign(key, req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader), "/exists", body), req.Header.Get(SignatureHeader))
+
+	// Every request has a fresh nonce.
+	require.NotEqual(req.Header.Get(NonceHeader), newRequest().Header.Get(NonceHeader))
+
+	// The key, body, path, nonce and timestamp are all authenticated.
+	require.Error(Verify([]byte("wrong"), req, body, time.Minute))
+	require.Error(Verify(key, req, []byte("user=bob"), time.Minute))
+	req.URL.Path = "/isvalid"
+	require.Error(Verify(key, req, body, time.Minute))
+
+	req = newRequest()
+	req.Header.Set(NonceHeader, "00")
+	require.Error(Verify(key, req, body, time.Minute))
+
+	req = newRequest()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix()+1, 10))
+	require.Error(Verify(key, req, body, time.Minute))
+
+	// Stale and unsigned requests are rejected.
+	req = newRequest()
+	ts := strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, Sign(key, ts, req.Header.Get(NonceHeader), req.URL.Path, body))
+	require.Equal(errStale, Verify(key, req, body, time.Minute))
+
+	req = newRequest()
+	req.Header.Del(SignatureHeader)
+	require.Equal(errMissingHeaders, Verify(key, req, body, time.Minute))
+}
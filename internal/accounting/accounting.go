@@ -0,0 +1,198 @@
+// accounting.go - Katzenpost server service usage accounting.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package accounting implements the Provider's service usage accounting,
+// for billing or quota enforcement by operators offering paid services.
+package accounting
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/worker"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+var flushFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "accounting_flush_failures_total",
+		Subsystem: constants.ProviderSubsystem,
+		Help:      "Number of failed service usage flushes",
+	},
+)
+
+// Record is the usage of a service by a user over a period.  The User is
+// empty for anonymous requests.
+type Record struct {
+	Start         time.Time
+	End           time.Time
+	User          string
+	Capability    string
+	Requests      uint64
+	RequestBytes  uint64
+	ResponseBytes uint64
+}
+
+// Sink is a destination for usage records.
+type Sink interface {
+	// Write writes the usage records.
+	Write([]*Record) error
+
+	// Close closes the sink.
+	Close()
+}
+
+type usageKey struct {
+	user       string
+	capability string
+}
+
+// Accountant aggregates service usage, and periodically flushes it to a
+// Sink.  A nil Accountant discards usage.
+type Accountant struct {
+	sync.Mutex
+	worker.Worker
+
+	log      *logging.Logger
+	sink     Sink
+	interval time.Duration
+
+	start time.Time
+	usage map[usageKey]*Record
+}
+
+// Record records a request by a user to a service.
+func (a *Accountant) Record(user, capability string, requestBytes, responseBytes int) {
+	if a == nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.add(&Record{
+		User:          user,
+		Capability:    capability,
+		Requests:      1,
+		RequestBytes:  uint64(requestBytes),
+		ResponseBytes: uint64(responseBytes),
+	})
+}
+
+// add adds the usage of a record to the aggregated usage.  It must be
+// called with the lock held.
+func (a *Accountant) add(u *Record) {
+	k := usageKey{u.User, u.Capability}
+	r, ok := a.usage[k]
+	if !ok {
+		r = &Record{User: u.User, Capability: u.Capability}
+		a.usage[k] = r
+	}
+	r.Requests += u.Requests
+	r.RequestBytes += u.RequestBytes
+	r.ResponseBytes += u.ResponseBytes
+}
+
+func (a *Accountant) flush() {
+	a.Lock()
+	now := time.Now()
+	records := make([]*Record, 0, len(a.usage))
+	for _, r := range a.usage {
+		r.Start, r.End = a.start, now
+		records = append(records, r)
+	}
+	a.usage = make(map[usageKey]*Record)
+	a.Unlock()
+
+	if len(records) == 0 {
+		a.start = now
+		return
+	}
+	if err := a.sink.Write(records); err != nil {
+		// Keep the usage for the next flush, rather than losing it.
+		a.log.Errorf("Failed to flush usage records: %v", err)
+		flushFailures.Inc()
+		a.Lock()
+		for _, r := range records {
+			a.add(r)
+		}
+		a.Unlock()
+		return
+	}
+	a.start = now
+}
+
+func (a *Accountant) worker() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.HaltCh():
+			a.flush()
+			a.sink.Close()
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// Halt flushes the outstanding usage and stops the Accountant.
+func (a *Accountant) Halt() {
+	if a == nil {
+		return
+	}
+	a.Worker.Halt()
+}
+
+// New constructs a new Accountant writing to the sink described by cfg.
+func New(cfg *config.Accounting, logBackend *log.Backend) (*Accountant, error) {
+	a := &Accountant{
+		log:      logBackend.GetLogger("accounting"),
+		interval: time.Duration(cfg.FlushInterval) * time.Second,
+		start:    time.Now(),
+		usage:    make(map[usageKey]*Record),
+	}
+
+	var err error
+	switch cfg.Sink {
+	case config.AccountingLog:
+		a.sink = &logSink{log: a.log}
+	case config.AccountingSQL:
+		a.sink, err = newSQLSink(cfg.DataSourceName)
+	case config.AccountingWebhook:
+		a.sink = newWebhookSink(cfg.URL)
+	default:
+		err = fmt.Errorf("accounting: invalid sink: '%v'", cfg.Sink)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.Go(a.worker)
+	return a, nil
+}
+
+func init() {
+	prometheus.MustRegister(flushFailures)
+}
@@ -0,0 +1,135 @@
+// accounting_test.go - Katzenpost server service usage accounting tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package accounting
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+type webhook struct {
+	sync.Mutex
+
+	fail    int32
+	flushes [][]*Record
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&w.fail) != 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var body struct {
+		Records []*Record
+	}
+	if err := codec.NewDecoder(r.Body, &codec.JsonHandle{}).Decode(&body); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sort.Slice(body.Records, func(i, j int) bool {
+		return body.Records[i].User+body.Records[i].Capability < body.Records[j].User+body.Records[j].Capability
+	})
+
+	w.Lock()
+	defer w.Unlock()
+	w.flushes = append(w.flushes, body.Records)
+}
+
+func (w *webhook) records() [][]*Record {
+	w.Lock()
+	defer w.Unlock()
+	return w.flushes
+}
+
+func TestAccountant(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	hook := new(webhook)
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	a, err := New(&config.Accounting{
+		Sink:          config.AccountingWebhook,
+		URL:           srv.URL,
+		FlushInterval: 3600,
+	}, logBackend)
+	require.NoError(err)
+
+	// Usage is aggregated by user and capability.
+	a.Record("alice", "echo", 10, 20)
+	a.Record("alice", "echo", 1, 2)
+	a.Record("", "echo", 5, 0)
+	a.Record("alice", "panda", 3, 4)
+	a.flush()
+	require.Len(hook.records(), 1)
+	flushed := hook.records()[0]
+	require.Len(flushed, 3)
+	require.Equal("", flushed[0].User)
+	require.Equal(uint64(1), flushed[0].Requests)
+	require.Equal("alice", flushed[1].User)
+	require.Equal("echo", flushed[1].Capability)
+	require.Equal(uint64(2), flushed[1].Requests)
+	require.Equal(uint64(11), flushed[1].RequestBytes)
+	require.Equal(uint64(22), flushed[1].ResponseBytes)
+	require.Equal("panda", flushed[2].Capability)
+	require.False(flushed[1].End.Before(flushed[1].Start))
+
+	// Nothing is written without usage.
+	a.flush()
+	require.Len(hook.records(), 1)
+
+	// Usage that failed to flush is kept for the next flush.
+	failures := testutil.ToFloat64(flushFailures)
+	atomic.StoreInt32(&hook.fail, 1)
+	a.Record("bob", "echo", 1, 1)
+	a.flush()
+	require.Equal(failures+1, testutil.ToFloat64(flushFailures))
+	require.Len(hook.records(), 1)
+
+	atomic.StoreInt32(&hook.fail, 0)
+	a.Record("bob", "echo", 1, 1)
+	a.flush()
+	require.Len(hook.records(), 2)
+	flushed = hook.records()[1]
+	require.Len(flushed, 1)
+	require.Equal(uint64(2), flushed[0].Requests)
+
+	// Halting flushes the outstanding usage.
+	a.Record("carol", "echo", 1, 1)
+	a.Halt()
+	require.Len(hook.records(), 3)
+	require.Equal("carol", hook.records()[2][0].User)
+
+	// A nil Accountant discards usage.
+	var nilAccountant *Accountant
+	nilAccountant.Record("alice", "echo", 1, 1)
+	nilAccountant.Halt()
+}
@@ -0,0 +1,142 @@
+// sinks.go - Katzenpost server service usage sinks.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package accounting
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	webhookTimeout = 10 * time.Second
+
+	sqlCreateUsageTable = `CREATE TABLE IF NOT EXISTS service_usage (
+		period_start   TIMESTAMPTZ NOT NULL,
+		period_end     TIMESTAMPTZ NOT NULL,
+		username       TEXT NOT NULL,
+		capability     TEXT NOT NULL,
+		requests       BIGINT NOT NULL,
+		request_bytes  BIGINT NOT NULL,
+		response_bytes BIGINT NOT NULL
+	)`
+	sqlInsertUsage = `INSERT INTO service_usage VALUES ($1, $2, $3, $4, $5, $6, $7)`
+)
+
+// logSink writes usage records to the server log.
+type logSink struct {
+	log *logging.Logger
+}
+
+func (s *logSink) Write(records []*Record) error {
+	for _, r := range records {
+		user := r.User
+		if user == "" {
+			user = "(anonymous)"
+		}
+		s.log.Noticef("Usage: %v %v requests=%v request_bytes=%v response_bytes=%v (%v - %v)", user, r.Capability, r.Requests, r.RequestBytes, r.ResponseBytes, r.Start.UTC().Format(time.RFC3339), r.End.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (s *logSink) Close() {}
+
+// sqlSink writes usage records to the service_usage table of a Postgresql
+// database.
+type sqlSink struct {
+	pool *pgx.ConnPool
+}
+
+func (s *sqlSink) Write(records []*Record) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+
+	for _, r := range records {
+		if _, err = tx.Exec(sqlInsertUsage, r.Start, r.End, r.User, r.Capability, int64(r.Requests), int64(r.RequestBytes), int64(r.ResponseBytes)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlSink) Close() {
+	s.pool.Close()
+}
+
+func newSQLSink(dataSourceName string) (*sqlSink, error) {
+	connCfg, err := pgx.ParseConnectionString(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:     connCfg,
+		MaxConnections: 2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = pool.Exec(sqlCreateUsageTable); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &sqlSink{pool: pool}, nil
+}
+
+// webhookSink POSTs usage records to a HTTP endpoint as a JSON object with
+// a `Records` array.
+type webhookSink struct {
+	url        string
+	client     *http.Client
+	jsonHandle codec.JsonHandle
+}
+
+func (s *webhookSink) Write(records []*Record) error {
+	var body []byte
+	enc := codec.NewEncoderBytes(&body, &s.jsonHandle)
+	if err := enc.Encode(map[string][]*Record{"Records": records}); err != nil {
+		return err
+	}
+
+	rsp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("accounting: webhook: %v", rsp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() {}
+
+func newWebhookSink(url string) *webhookSink {
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+	s.jsonHandle.Canonical = true
+	return s
+}
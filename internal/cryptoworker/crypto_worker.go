@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
 	"github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/mixkey"
@@ -171,6 +170,7 @@ func (w *Worker) worker() {
 
 	isProvider := w.glue.Config().Server.IsProvider
 	unwrapSlack := time.Duration(w.glue.Config().Debug.UnwrapDelay) * time.Millisecond
+	epochPeriod := w.glue.PKI().EpochPeriod()
 	defer w.derefKeys()
 
 	for {
@@ -236,7 +236,7 @@ func (w *Worker) worker() {
 
 			// Check and adjust the delay for queue dwell time.
 			pkt.Delay = time.Duration(pkt.NodeDelay.Delay) * time.Millisecond
-			if pkt.Delay > constants.NumMixKeys*epochtime.TestPeriod {
+			if pkt.Delay > constants.NumMixKeys*epochPeriod {
 				w.log.Debugf("Dropping packet: %v (Delay %v is past what is possible)", pkt.ID, pkt.Delay)
 				packetsDropped.Inc()
 				pkt.Dispose()
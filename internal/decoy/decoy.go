@@ -29,7 +29,6 @@ import (
 	"time"
 
 	"git.schwanenlied.me/yawning/avl.git"
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
 	internalConstants "github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/packet"
@@ -176,7 +175,7 @@ func (d *decoy) worker() {
 			d.log.Debugf("Terminating gracefully.")
 			return
 		case newEnt := <-d.docCh:
-			if !d.glue.Config().Debug.SendDecoyTraffic {
+			if !d.glue.RuntimeConfig().SendDecoyTraffic {
 				d.log.Debugf("Received PKI document but decoy traffic is disabled, ignoring.")
 				ignoredPKIDocs.Inc()
 				continue
@@ -211,7 +210,7 @@ func (d *decoy) worker() {
 			wakeInterval = time.Duration(maxDuration)
 		} else {
 			// The timer fired, and there is a valid document for this epoch.
-			if timerFired {
+			if timerFired && !d.glue.Draining() {
 				d.sendDecoyPacket(docCache)
 			}
 
@@ -302,7 +301,7 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			return
 		}
 
-		if deltaT := then.Sub(now); deltaT < epochtime.TestPeriod*2 {
+		if deltaT := then.Sub(now); deltaT < d.glue.PKI().EpochPeriod()*2 {
 			var zeroBytes [constants.UserForwardPayloadLength]byte
 			payload := make([]byte, 2, 2+sphinx.SURBLength+constants.UserForwardPayloadLength)
 			payload[0] = 1 // Packet has a SURB.
@@ -354,7 +353,7 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 			return
 		}
 
-		if then.Sub(now) < epochtime.TestPeriod*2 {
+		if then.Sub(now) < d.glue.PKI().EpochPeriod()*2 {
 			pkt, err := sphinx.NewPacket(rand.Reader, fwdPath, payload[:])
 			if err != nil {
 				d.log.Debugf("Failed to generate Sphinx packet: %v", err)
@@ -462,7 +461,7 @@ func (d *decoy) sweepSURBCtxs() {
 	}
 
 	now := monotime.Now()
-	slack := time.Duration(d.glue.Config().Debug.DecoySlack) * time.Millisecond
+	slack := time.Duration(d.glue.RuntimeConfig().DecoySlack) * time.Millisecond
 
 	var swept int
 	iter := d.surbETAs.Iterator(avl.Forward)
@@ -511,6 +510,7 @@ func New(glue glue.Glue) (glue.Decoy, error) {
 		return nil, err
 	}
 
+	glue.PKI().Subscribe(d)
 	d.Go(d.worker)
 	return d, nil
 }
@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/accounting"
 	"github.com/hashcloak/Meson-server/internal/mixkey"
 	"github.com/hashcloak/Meson-server/internal/packet"
 	"github.com/hashcloak/Meson-server/internal/pkicache"
@@ -53,6 +54,19 @@ type Glue interface {
 	Decoy() Decoy
 
 	ReshadowCryptoWorkers()
+
+	// Draining returns true iff the server is draining its queues before
+	// a shutdown.
+	Draining() bool
+
+	// RuntimeConfig returns the configuration options that may be changed
+	// by reloading the configuration, and must be used instead of the
+	// corresponding Config options.
+	RuntimeConfig() *RuntimeConfig
+
+	// SetLogLevel changes the log level of a module, or the global log
+	// level if module is empty.
+	SetLogLevel(module, level string) error
 }
 
 type MixKeys interface {
@@ -61,6 +75,8 @@ type MixKeys interface {
 	Prune() bool
 	Get(uint64) (*ecdh.PublicKey, bool)
 	Shadow(map[uint64]*mixkey.MixKey)
+	Rotate(uint64) ([]uint64, error)
+	Invalidate(uint64) (bool, error)
 }
 
 type PKI interface {
@@ -70,6 +86,17 @@ type PKI interface {
 	AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool)
 	GetRawConsensus(uint64) ([]byte, error)
 	Now() (epoch uint64, ellapsed time.Duration, till time.Duration, err error)
+	EpochPeriod() time.Duration
+	Reconfigure(*config.PKI) error
+	CurrentDocument() (*pki.Document, error)
+	Subscribe(DocumentSubscriber)
+	LastPublishedEpoch() uint64
+}
+
+// DocumentSubscriber is the interface implemented by components that wish
+// to be notified when there is a new PKI document for the current epoch.
+type DocumentSubscriber interface {
+	OnNewDocument(*pkicache.Entry)
 }
 
 type Provider interface {
@@ -80,12 +107,51 @@ type Provider interface {
 	OnPacket(*packet.Packet)
 	KaetzchenForPKI() (map[string]map[string]interface{}, error)
 	AdvertiseRegistrationHTTPAddresses() []string
+	Accounting() *accounting.Accountant
+	Reconfigure(*config.Provider) ([]string, error)
+
+	// Backlog returns the number of packets waiting to be delivered, and
+	// of Kaetzchen requests that are queued or being processed.
+	Backlog() int
+	Queues() *ProviderQueues
+}
+
+// RuntimeConfig is the part of the Debug configuration that is reloadable.
+// It is replaced as a whole by a reload, and must not be modified.
+type RuntimeConfig struct {
+	SendDecoyTraffic bool
+	DecoySlack       int
+	DisableRateLimit bool
+}
+
+// ProviderQueues describes the Provider queues.
+type ProviderQueues struct {
+	// Inbound is the number of packets waiting to be delivered.
+	Inbound int
+
+	// Kaetzchen is the number of requests waiting to be dispatched to the
+	// Kaetzchen, by queue, `builtin` for the built-in Kaetzchen and the
+	// capability for each plugin.
+	Kaetzchen map[string]int
+
+	// KaetzchenInFlight is the number of requests being processed.
+	KaetzchenInFlight int
+}
+
+// Len returns the total number of packets and requests in the queues.
+func (q *ProviderQueues) Len() int {
+	n := q.Inbound + q.KaetzchenInFlight
+	for _, v := range q.Kaetzchen {
+		n += v
+	}
+	return n
 }
 
 type Scheduler interface {
 	Halt()
 	OnNewMixMaxDelay(uint64)
 	OnPacket(*packet.Packet)
+	QueueLength() int
 }
 
 type Connector interface {
@@ -93,15 +159,48 @@ type Connector interface {
 	DispatchPacket(*packet.Packet)
 	IsValidForwardDest(*[constants.NodeIDLength]byte) bool
 	ForceUpdate()
+	QueueLength() int
+	Connections() []*ConnectionInfo
 }
 
 type Listener interface {
 	Halt()
+	Drain()
+	CloseConns()
+	Connections() []*ConnectionInfo
 	IsConnUnique(interface{}) bool
 	OnNewSendRatePerMinute(uint64)
 	OnNewSendBurst(uint64)
 }
 
+// ConnectionInfo describes the state of an incoming or outgoing link.
+type ConnectionInfo struct {
+	// Incoming is true iff the link was established by the peer.
+	Incoming bool
+
+	// Peer is the peer's name, the user name for clients, and the
+	// identity key for mixes.
+	Peer string
+
+	// Address is the remote address of the link.
+	Address string
+
+	// ConnectedAt is the time the link was established, it is zero while
+	// an outgoing link is (re)connecting.
+	ConnectedAt time.Time
+
+	// QueueLength is the number of packets queued for the peer.
+	QueueLength int
+
+	// Reconnects is the number of times an outgoing link was lost.
+	Reconnects uint64
+
+	// LastError is the last error of an outgoing link, and LastErrorAt
+	// the time it happened.
+	LastError   error
+	LastErrorAt time.Time
+}
+
 type Decoy interface {
 	Halt()
 	OnNewDocument(*pkicache.Entry)
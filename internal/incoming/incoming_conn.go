@@ -45,9 +45,10 @@ type incomingConn struct {
 	l   *listener
 	log *logging.Logger
 
-	c net.Conn
-	e *list.Element
-	w *wire.Session
+	c  net.Conn
+	e  *list.Element
+	w  *wire.Session
+	ch chan<- interface{}
 
 	id      uint64
 	retrSeq uint32
@@ -58,7 +59,9 @@ type incomingConn struct {
 	sendTokenIncr time.Duration
 	sendTokenLast time.Duration
 
-	isInitialized bool // Set by listener.
+	isInitialized bool      // Set by listener.
+	peer          string    // Set by listener.
+	connectedAt   time.Time // Set by listener.
 	fromClient    bool
 	fromMix       bool
 	canSend       bool
@@ -112,7 +115,7 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 			c.canSend = true // Clients can always send for now.
 
 			// Update the rate limiter parameters.
-			if c.l.glue.Config().Debug.DisableRateLimit {
+			if c.l.glue.RuntimeConfig().DisableRateLimit {
 				return true
 			}
 
@@ -444,6 +447,15 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	// to try to loop traffic back into the mix net, and sending packets
 	// that bypass the mix net.
 	pkt.MustForward = c.fromClient
+
+	// Client submissions are refused while the server is draining, so
+	// that the queues can empty before the shutdown.
+	if c.fromClient && c.l.glue.Draining() {
+		c.log.Debugf("Dropping packet: %v (Draining)", pkt.ID)
+		packetsDropped.Inc()
+		pkt.Dispose()
+		return nil
+	}
 	pkt.MustTerminate = c.l.glue.Config().Server.IsProvider && !c.fromClient
 
 	// If the packet was from the client, and there is a SendShift for the
@@ -479,7 +491,7 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	// time, we treat the moment the packet is inserted into the crypto
 	// worker queue as the time the packet was received.
 	pkt.RecvAt = monotime.Now()
-	c.l.incomingCh <- pkt
+	c.ch <- pkt
 
 	return nil
 }
@@ -493,6 +505,7 @@ func newIncomingConn(l *listener, conn net.Conn) *incomingConn {
 		maxSendTokens: 4, // Reasonable burst to avoid some unnecessary rate limiting.
 	}
 	c.log = l.glue.LogBackend().GetLogger(fmt.Sprintf("incoming:%d", c.id))
+	c.ch = l.incomingChs[c.id%uint64(len(l.incomingChs))]
 
 	c.log.Debugf("New incoming connection: %v", conn.RemoteAddr())
 
@@ -24,9 +24,12 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/debug"
 	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/worker"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -41,12 +44,14 @@ type listener struct {
 	l     net.Listener
 	conns *list.List
 
-	incomingCh chan<- interface{}
-	closeAllCh chan interface{}
-	closeAllWg sync.WaitGroup
+	incomingChs  []chan<- interface{}
+	closeAllCh   chan interface{}
+	closeAllOnce sync.Once
+	closeAllWg   sync.WaitGroup
 
 	sendRatePerMinute uint64
 	sendBurst         uint64
+	draining          uint32
 }
 
 func (l *listener) Halt() {
@@ -58,7 +63,28 @@ func (l *listener) Halt() {
 	//
 	// Note: Worst case this can take up to the handshake timeout to
 	// actually complete, since the channel isn't checked mid-handshake.
-	close(l.closeAllCh)
+	l.closeAll()
+	l.closeAllWg.Wait()
+}
+
+func (l *listener) closeAll() {
+	l.closeAllOnce.Do(func() {
+		close(l.closeAllCh)
+	})
+}
+
+// Drain stops accepting new connections, the established connections are
+// left open.
+func (l *listener) Drain() {
+	atomic.StoreUint32(&l.draining, 1)
+	l.l.Close()
+}
+
+// CloseConns closes the established connections, so that no more packets
+// are received, and waits for them to be closed.  It must only be called
+// after Drain.
+func (l *listener) CloseConns() {
+	l.closeAll()
 	l.closeAllWg.Wait()
 }
 
@@ -80,6 +106,9 @@ func (l *listener) worker() {
 	for {
 		conn, err := l.l.Accept()
 		if err != nil {
+			if atomic.LoadUint32(&l.draining) == 1 {
+				return
+			}
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
 				l.log.Errorf("Critical accept failure: %v", err)
 				return
@@ -116,6 +145,14 @@ func (l *listener) onInitializedConn(c *incomingConn) {
 	defer l.Unlock()
 
 	c.isInitialized = true
+	c.connectedAt = time.Now()
+	if creds, err := c.w.PeerCredentials(); err == nil {
+		if c.fromMix {
+			c.peer = debug.BytesToPrintString(creds.AdditionalData)
+		} else {
+			c.peer = utils.ASCIIBytesToPrintString(creds.AdditionalData)
+		}
+	}
 }
 
 func (l *listener) onClosedConn(c *incomingConn) {
@@ -127,6 +164,27 @@ func (l *listener) onClosedConn(c *incomingConn) {
 	l.conns.Remove(c.e)
 }
 
+// Connections returns the state of the established connections.
+func (l *listener) Connections() []*glue.ConnectionInfo {
+	l.Lock()
+	defer l.Unlock()
+
+	var conns []*glue.ConnectionInfo
+	for e := l.conns.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*incomingConn)
+		if !c.isInitialized {
+			continue
+		}
+		conns = append(conns, &glue.ConnectionInfo{
+			Incoming:    true,
+			Peer:        c.peer,
+			Address:     c.c.RemoteAddr().String(),
+			ConnectedAt: c.connectedAt,
+		})
+	}
+	return conns
+}
+
 func (l *listener) IsConnUnique(ptr interface{}) bool {
 	c := ptr.(*incomingConn)
 
@@ -165,16 +223,22 @@ func (l *listener) IsConnUnique(ptr interface{}) bool {
 	return true
 }
 
-// New creates a new listener.
-func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string) (glue.Listener, error) {
+// New creates a new listener.  Incoming connections are distributed
+// across the provided incomingChs, with all packets received over a given
+// connection being sent to the same channel.
+func New(glue glue.Glue, incomingChs []chan<- interface{}, id int, addr string) (glue.Listener, error) {
 	var err error
 
+	if len(incomingChs) == 0 {
+		return nil, fmt.Errorf("incoming: no packet channels")
+	}
+
 	l := &listener{
-		glue:       glue,
-		log:        glue.LogBackend().GetLogger(fmt.Sprintf("listener:%d", id)),
-		conns:      list.New(),
-		incomingCh: incomingCh,
-		closeAllCh: make(chan interface{}),
+		glue:        glue,
+		log:         glue.LogBackend().GetLogger(fmt.Sprintf("listener:%d", id)),
+		conns:       list.New(),
+		incomingChs: incomingChs,
+		closeAllCh:  make(chan interface{}),
 	}
 
 	l.l, err = net.Listen("tcp", addr)
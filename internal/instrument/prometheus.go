@@ -2,15 +2,21 @@ package instrument
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Init initialize instrumentation
+var initOnce sync.Once
+
+// Init initialize instrumentation, once per process since the metrics are
+// shared by all the server instances.
 func Init() {
-	// Expose registered metrics via HTTP
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		_ = http.ListenAndServe(":6543", nil)
-	}()
+	initOnce.Do(func() {
+		// Expose registered metrics via HTTP
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			_ = http.ListenAndServe(":6543", nil)
+		}()
+	})
 }
@@ -0,0 +1,85 @@
+// client.go - Katzenpost server management socket client.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package management implements the network management APIs, that mirror
+// the commands of the management socket.
+package management
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const commandTimeout = 60 * time.Second
+
+var errInvalidCommand = errors.New("management: invalid command")
+
+// Reply is the reply to a management command.
+type Reply struct {
+	// Status is the thwack status code, eg: 250 on success.
+	Status int `json:"status"`
+
+	// Lines are the lines of the reply, without the status codes.
+	Lines []string `json:"lines"`
+}
+
+// OK returns true iff the command succeeded.
+func (r *Reply) OK() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+// execute runs a management command over the management socket at path,
+// so that the commands behave exactly as they do on the socket.
+func execute(path string, command string, args []string) (*Reply, error) {
+	if command == "" || strings.ContainsAny(command, " \t\r\n") {
+		return nil, errInvalidCommand
+	}
+	for _, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\r\n") {
+			return nil, errInvalidCommand
+		}
+	}
+
+	conn, err := net.DialTimeout("unix", path, commandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(commandTimeout)); err != nil {
+		return nil, err
+	}
+	c := textproto.NewConn(conn)
+
+	// Consume the greeting.
+	if _, _, err = c.ReadResponse(0); err != nil {
+		return nil, err
+	}
+
+	line := strings.Join(append([]string{strings.ToUpper(command)}, args...), " ")
+	if err = c.PrintfLine("%s", line); err != nil {
+		return nil, err
+	}
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return nil, err
+		}
+	}
+	return &Reply{Status: code, Lines: strings.Split(msg, "\n")}, nil
+}
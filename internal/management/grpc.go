@@ -0,0 +1,217 @@
+// grpc.go - Katzenpost server gRPC management API.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// GRPCServiceName is the name of the gRPC management service.
+	GRPCServiceName = "meson.management.v1.Management"
+
+	// GRPCCodec is the name of the codec of the gRPC management service
+	// messages, that clients must use as the content-subtype, ie:
+	// `application/grpc+json`.
+	GRPCCodec = "json"
+
+	grpcExecuteMethod = "/" + GRPCServiceName + "/Execute"
+	grpcAnyCommand    = "*"
+)
+
+// CommandRequest is the request of the gRPC Execute method.
+type CommandRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// jsonCodec encodes the gRPC management messages as JSON, so that the
+// service can be described without generated protobuf code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return GRPCCodec
+}
+
+// GRPCServer is the gRPC management API.  Clients are authenticated with
+// mutual TLS, and are only allowed to execute the management commands
+// listed for their certificate's common name.
+type GRPCServer struct {
+	log        *logging.Logger
+	socketPath string
+	acls       map[string]map[string]bool
+	server     *grpc.Server
+}
+
+func (s *GRPCServer) authorize(ctx context.Context, command string) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "no peer")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", status.Error(codes.Unauthenticated, "no verified client certificate")
+	}
+	name := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	acl, ok := s.acls[name]
+	if !ok || !(acl[grpcAnyCommand] || acl[command]) {
+		return name, status.Errorf(codes.PermissionDenied, "'%v' is not allowed to execute %v", name, command)
+	}
+	return name, nil
+}
+
+func (s *GRPCServer) execute(ctx context.Context, req *CommandRequest) (*Reply, error) {
+	command := strings.ToUpper(req.Command)
+	name, err := s.authorize(ctx, command)
+	if err != nil {
+		s.log.Warningf("Rejected '%v' from '%v': %v", command, name, err)
+		return nil, err
+	}
+
+	reply, err := execute(s.socketPath, command, req.Args)
+	switch {
+	case err == errInvalidCommand:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		s.log.Errorf("Failed to execute '%v': %v", command, err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	s.log.Noticef("Executed '%v' for '%v': %v", command, name, reply.Status)
+	return reply, nil
+}
+
+func executeHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := new(CommandRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	s := srv.(*GRPCServer)
+	if interceptor == nil {
+		return s.execute(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: grpcExecuteMethod,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return s.execute(ctx, req.(*CommandRequest))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Execute",
+			Handler:    executeHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func loadServerTLSConfig(cfg *config.ManagementGRPC) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Certificate, cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("management: no certificates in '%v'", cfg.ClientCA)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// Halt stops the gRPC management API.
+func (s *GRPCServer) Halt() {
+	s.server.GracefulStop()
+}
+
+// NewGRPC starts the gRPC management API, that forwards the commands to
+// the management socket.
+func NewGRPC(cfg *config.Management, logBackend *log.Backend) (*GRPCServer, error) {
+	tlsCfg, err := loadServerTLSConfig(cfg.GRPC)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &GRPCServer{
+		log:        logBackend.GetLogger("mgmt/grpc"),
+		socketPath: cfg.Path,
+		acls:       make(map[string]map[string]bool),
+		server:     grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsCfg))),
+	}
+	for _, c := range cfg.GRPC.Clients {
+		acl := make(map[string]bool)
+		for _, cmd := range c.Commands {
+			acl[strings.ToUpper(cmd)] = true
+		}
+		s.acls[c.Name] = acl
+	}
+	s.server.RegisterService(&grpcServiceDesc, s)
+
+	l, err := net.Listen("tcp", cfg.GRPC.Address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := s.server.Serve(l); err != nil {
+			s.log.Errorf("gRPC management API failed: %v", err)
+		}
+	}()
+	s.log.Noticef("Listening on: %v", l.Addr())
+	return s, nil
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
@@ -0,0 +1,147 @@
+// grpc_test.go - gRPC management API tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// testCA is an in-memory certificate authority issuing client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	ca := &testCA{cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	return ca
+}
+
+// peerContext returns a context with the TLS state of a client presenting
+// a certificate for name, verified against the CA like the gRPC server
+// does.
+func (ca *testCA) peerContext(t *testing.T, name string) context.Context {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:     ca.pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.NoError(t, err)
+
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   chains,
+		}},
+	})
+}
+
+func TestGRPCAuthorize(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &GRPCServer{
+		log: logBackend.GetLogger("mgmt/grpc"),
+		acls: map[string]map[string]bool{
+			"monitor": {"STATUS": true, "QUEUES": true},
+			"admin":   {grpcAnyCommand: true},
+		},
+	}
+	ca := newTestCA(t)
+
+	// Unauthenticated clients.
+	_, err = s.authorize(context.Background(), "STATUS")
+	require.Equal(codes.Unauthenticated, status.Code(err), "no peer")
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242},
+	})
+	_, err = s.authorize(ctx, "STATUS")
+	require.Equal(codes.Unauthenticated, status.Code(err), "no TLS")
+	ctx = peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242},
+		AuthInfo: credentials.TLSInfo{},
+	})
+	_, err = s.authorize(ctx, "STATUS")
+	require.Equal(codes.Unauthenticated, status.Code(err), "no client certificate")
+
+	// Authenticated clients are limited to their commands.
+	for _, v := range []struct {
+		name    string
+		command string
+		code    codes.Code
+	}{
+		{"monitor", "STATUS", codes.OK},
+		{"monitor", "QUEUES", codes.OK},
+		{"monitor", "DRAIN", codes.PermissionDenied},
+		{"admin", "DRAIN", codes.OK},
+		{"mallory", "STATUS", codes.PermissionDenied},
+	} {
+		name, err := s.authorize(ca.peerContext(t, v.name), v.command)
+		require.Equal(v.code, status.Code(err), "%v %v", v.name, v.command)
+		require.Equal(v.name, name)
+	}
+}
@@ -0,0 +1,221 @@
+// http.go - Katzenpost server HTTP management API.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	httpCommandPrefix = "/v1/commands/"
+	maxHTTPBodySize   = 64 * 1024
+	httpTokenSize     = 32
+	minHTTPTokenSize  = 16
+)
+
+// HTTPServer is the HTTP management API.  Each management command is
+// exposed as `POST /v1/commands/<COMMAND>`, with the optional JSON body
+// `{"args": [...]}`, and returns the Reply as JSON.
+//
+// Requests must be authorized with the `Authorization: Bearer <token>`
+// header, and have the `application/json` content type, so that they can
+// not be sent cross-origin by a web browser running on the host.
+type HTTPServer struct {
+	log        *logging.Logger
+	socketPath string
+	token      []byte
+	server     *http.Server
+}
+
+type httpRequest struct {
+	Args []string `json:"args"`
+}
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+func (s *HTTPServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.Debugf("Failed to write response: %v", err)
+	}
+}
+
+func (s *HTTPServer) isAuthorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), s.token) == 1
+}
+
+func (s *HTTPServer) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeJSON(w, http.StatusMethodNotAllowed, &httpError{"method not allowed"})
+		return
+	}
+	if !s.isAuthorized(r) {
+		s.log.Warningf("Unauthorized request from %v", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeJSON(w, http.StatusUnauthorized, &httpError{"unauthorized"})
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		s.writeJSON(w, http.StatusUnsupportedMediaType, &httpError{"content type must be application/json"})
+		return
+	}
+
+	var req httpRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxHTTPBodySize)).Decode(&req)
+	if err != nil && err != io.EOF {
+		s.writeJSON(w, http.StatusBadRequest, &httpError{"malformed request: " + err.Error()})
+		return
+	}
+
+	command := strings.TrimPrefix(r.URL.Path, httpCommandPrefix)
+	reply, err := execute(s.socketPath, command, req.Args)
+	switch {
+	case err == errInvalidCommand:
+		s.writeJSON(w, http.StatusBadRequest, &httpError{err.Error()})
+		return
+	case err != nil:
+		s.log.Errorf("Failed to execute '%v': %v", command, err)
+		s.writeJSON(w, http.StatusBadGateway, &httpError{err.Error()})
+		return
+	}
+	s.log.Debugf("Executed '%v' from %v: %v", command, r.RemoteAddr, reply.Status)
+
+	status := http.StatusOK
+	switch {
+	case reply.OK():
+	case reply.Status == 500:
+		// Unknown command.
+		status = http.StatusNotFound
+	case reply.Status == 501:
+		// Syntax error.
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusInternalServerError
+	}
+	s.writeJSON(w, status, reply)
+}
+
+// Halt stops the HTTP management API.
+func (s *HTTPServer) Halt() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.log.Warningf("Failed to shutdown gracefully: %v", err)
+	}
+}
+
+// loadHTTPToken returns the bearer token stored in the file at path, and
+// generates the file if it does not exist.
+func loadHTTPToken(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		var raw [httpTokenSize]byte
+		if _, err = io.ReadFull(rand.Reader, raw[:]); err != nil {
+			return nil, err
+		}
+		token := []byte(hex.EncodeToString(raw[:]))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err = f.Write(append(token, '\n')); err != nil {
+			return nil, err
+		}
+		return token, f.Sync()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("management: HTTP token file '%v' is accessible by other users (mode %v)", path, perm)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	token := bytes.TrimSpace(b)
+	if len(token) < minHTTPTokenSize {
+		return nil, fmt.Errorf("management: HTTP token in '%v' is shorter than %v bytes", path, minHTTPTokenSize)
+	}
+	return token, nil
+}
+
+// NewHTTP starts the HTTP management API, that forwards the commands to
+// the management socket.
+func NewHTTP(cfg *config.Management, logBackend *log.Backend) (*HTTPServer, error) {
+	token, err := loadHTTPToken(cfg.HTTPTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &HTTPServer{
+		log:        logBackend.GetLogger("mgmt/http"),
+		socketPath: cfg.Path,
+		token:      token,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpCommandPrefix, s.handleCommand)
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l, err := net.Listen("tcp", cfg.HTTPAddress)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Errorf("HTTP management API failed: %v", err)
+		}
+	}()
+	s.log.Noticef("Listening on: %v", l.Addr())
+	return s, nil
+}
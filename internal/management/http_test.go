@@ -0,0 +1,100 @@
+// http_test.go - HTTP management API tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHTTPToken(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "mgmt_http_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	// The token is generated on first use, only readable by the owner.
+	token, err := loadHTTPToken(path)
+	require.NoError(err)
+	require.Len(token, 2*httpTokenSize)
+	fi, err := os.Stat(path)
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	reloaded, err := loadHTTPToken(path)
+	require.NoError(err)
+	require.Equal(token, reloaded)
+
+	require.NoError(os.Chmod(path, 0644))
+	_, err = loadHTTPToken(path)
+	require.Error(err, "world readable token file")
+
+	require.NoError(ioutil.WriteFile(path, []byte("short\n"), 0600))
+	require.NoError(os.Chmod(path, 0600))
+	_, err = loadHTTPToken(path)
+	require.Error(err, "short token")
+}
+
+func TestHTTPAuthorization(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &HTTPServer{
+		log:        logBackend.GetLogger("mgmt/http"),
+		socketPath: "/nonexistent/management_sock",
+		token:      []byte("0123456789abcdef0123456789abcdef"),
+	}
+
+	do := func(auth, contentType string) int {
+		r := httptest.NewRequest(http.MethodPost, httpCommandPrefix+"SHUTDOWN", strings.NewReader("{}"))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		s.handleCommand(w, r)
+		return w.Code
+	}
+
+	// A browser can send a simple cross-origin request, without custom
+	// headers.
+	require.Equal(http.StatusUnauthorized, do("", "text/plain"))
+	require.Equal(http.StatusUnauthorized, do("", "application/json"))
+	require.Equal(http.StatusUnauthorized, do("Bearer 0123456789abcdef", "application/json"))
+	require.Equal(http.StatusUnauthorized, do("Basic 0123456789abcdef0123456789abcdef", "application/json"))
+
+	const auth = "Bearer 0123456789abcdef0123456789abcdef"
+	require.Equal(http.StatusUnsupportedMediaType, do(auth, ""))
+	require.Equal(http.StatusUnsupportedMediaType, do(auth, "text/plain"))
+	require.Equal(http.StatusUnsupportedMediaType, do(auth, "application/x-www-form-urlencoded"))
+
+	// The authorized request reaches the (missing) management socket.
+	require.Equal(http.StatusBadGateway, do(auth, "application/json; charset=utf-8"))
+}
@@ -73,6 +73,7 @@ type MixKey struct {
 
 	refCount        int32
 	unlinkIfExpired bool
+	unlinked        bool
 }
 
 // SetUnlinkIfExpired sets if the key will be deleted when closed if it is
@@ -81,6 +82,22 @@ func (k *MixKey) SetUnlinkIfExpired(b bool) {
 	k.unlinkIfExpired = b
 }
 
+// Unlink deletes the key's database, so that a replacement key can be
+// created for the same epoch.  The key remains usable till it is closed.
+func (k *MixKey) Unlink() error {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.db == nil || k.unlinked {
+		return nil
+	}
+	if err := os.Remove(k.db.Path()); err != nil {
+		return err
+	}
+	k.unlinked = true
+	return nil
+}
+
 // PublicKey returns the public component of the key.
 func (k *MixKey) PublicKey() *ecdh.PublicKey {
 	return k.keypair.PublicKey()
@@ -268,7 +285,7 @@ func (k *MixKey) forceClose(epoch uint64) {
 
 		// Delete the database if the key is expired, and the owner requested
 		// full cleanup.
-		if k.unlinkIfExpired && k.epoch < epoch-1 {
+		if k.unlinkIfExpired && k.epoch < epoch-1 && !k.unlinked {
 			// People will probably complain that this doesn't attempt
 			// "secure" deletion, but that's fundamentally a lost cause
 			// given how many levels of indirection there are to files vs
@@ -49,6 +49,8 @@ func TestMixKey(t *testing.T) {
 		t.Errorf("create tests failed, skipping load tests")
 	}
 
+	t.Run("replace", doTestReplace)
+
 	// Clean up after all of the tests, by removing the temporary directory
 	// that holds keys.
 	os.RemoveAll(tmpDir)
@@ -115,6 +117,37 @@ func doTestUnlink(t *testing.T) {
 	require.True(os.IsNotExist(err), "Database should not exist")
 }
 
+func doTestReplace(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	const epoch = testEpoch + 1
+
+	k, err := New(tmpDir, epoch)
+	require.NoError(err, "New()")
+	k.SetUnlinkIfExpired(true)
+	f := k.db.Path()
+
+	err = k.Unlink()
+	require.NoError(err, "Unlink()")
+	assert.True(k.IsReplay([]byte{}), "IsReplay() after Unlink()")
+
+	// The replacement key is a new key.
+	kk, err := New(tmpDir, epoch)
+	require.NoError(err, "New() replacement")
+	kk.SetUnlinkIfExpired(true)
+	assert.NotEqual(k.PublicKey(), kk.PublicKey(), "Replacement public key")
+
+	// Closing the unlinked key must not remove the replacement's database.
+	k.Deref(epoch + 2)
+	_, err = os.Lstat(f)
+	assert.NoError(err, "Replacement database should exist")
+
+	kk.Deref(epoch + 2)
+	_, err = os.Lstat(f)
+	assert.True(os.IsNotExist(err), "Database should not exist")
+}
+
 func BenchmarkMixKey(b *testing.B) {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "mixkey_benchmarks")
@@ -62,6 +62,31 @@ func (co *connector) ForceUpdate() {
 	}
 }
 
+// QueueLength returns the number of packets queued for transmission across
+// all of the outgoing connections.
+func (co *connector) QueueLength() int {
+	co.RLock()
+	defer co.RUnlock()
+
+	n := 0
+	for _, c := range co.conns {
+		n += len(c.ch)
+	}
+	return n
+}
+
+// Connections returns the state of the outgoing connections.
+func (co *connector) Connections() []*glue.ConnectionInfo {
+	co.RLock()
+	defer co.RUnlock()
+
+	conns := make([]*glue.ConnectionInfo, 0, len(co.conns))
+	for _, c := range co.conns {
+		conns = append(conns, c.info())
+	}
+	return conns
+}
+
 func (co *connector) DispatchPacket(pkt *packet.Packet) {
 	co.RLock()
 	defer co.RUnlock()
@@ -19,15 +19,20 @@ package outgoing
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/debug"
+	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/hashcloak/Meson-server/internal/proxy"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/monotime"
 	cpki "github.com/katzenpost/core/pki"
@@ -38,6 +43,11 @@ import (
 
 var outgoingConnID uint64
 
+var (
+	errPeerClosed   = errors.New("outgoing: connection closed by peer")
+	errReauthFailed = errors.New("outgoing: peer reauthenticate failed")
+)
+
 type outgoingConn struct {
 	co  *connector
 	log *logging.Logger
@@ -48,6 +58,15 @@ type outgoingConn struct {
 	id         uint64
 	retryDelay time.Duration
 	canSend    bool
+
+	// The link state, for the connection table.
+	stateLock   sync.Mutex
+	peer        string
+	addr        string
+	connectedAt time.Time
+	reconnects  uint64
+	lastErr     error
+	lastErrAt   time.Time
 }
 
 var (
@@ -102,6 +121,49 @@ func (c *outgoingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 	return isValid
 }
 
+func (c *outgoingConn) setError(err error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.lastErr = err
+	c.lastErrAt = time.Now()
+}
+
+func (c *outgoingConn) setAddress(addr string) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	c.addr = addr
+}
+
+func (c *outgoingConn) setConnected(connected bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	switch {
+	case connected:
+		c.connectedAt = time.Now()
+	case !c.connectedAt.IsZero():
+		c.connectedAt = time.Time{}
+		c.reconnects++
+	}
+}
+
+func (c *outgoingConn) info() *glue.ConnectionInfo {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	return &glue.ConnectionInfo{
+		Peer:        c.peer,
+		Address:     c.addr,
+		ConnectedAt: c.connectedAt,
+		QueueLength: len(c.ch),
+		Reconnects:  c.reconnects,
+		LastError:   c.lastErr,
+		LastErrorAt: c.lastErrAt,
+	}
+}
+
 func (c *outgoingConn) dispatchPacket(pkt *packet.Packet) {
 	select {
 	case c.ch <- pkt:
@@ -141,10 +203,18 @@ func (c *outgoingConn) worker() {
 	// fact that the server doesn't use context everywhere instead.
 	dialCtx, cancelFn := context.WithCancel(context.Background())
 	defer cancelFn()
-	dialer := net.Dialer{
+	dialer := &net.Dialer{
 		KeepAlive: constants.KeepAliveInterval,
 		Timeout:   time.Duration(c.co.glue.Config().Debug.ConnectTimeout) * time.Millisecond,
 	}
+	dialFn := dialer.DialContext
+	if proxyCfg := c.co.glue.Config().UpstreamProxy; proxyCfg != nil && proxyCfg.AllConnections {
+		var err error
+		if dialFn, err = proxy.New(proxyCfg, dialer); err != nil {
+			c.log.Errorf("Failed to initialize upstream proxy: %v", err)
+			return
+		}
+	}
 	go func() {
 		// Bolt a bunch of channels to the dial canceler, such that closing
 		// either channel results in the dial context being canceled.
@@ -214,7 +284,8 @@ func (c *outgoingConn) worker() {
 
 			// Dial.
 			c.log.Debugf("Dialing: %v", addrPort)
-			conn, err := dialer.DialContext(dialCtx, "tcp", addrPort)
+			c.setAddress(addrPort)
+			conn, err := dialFn(dialCtx, "tcp", addrPort)
 			select {
 			case <-dialCtx.Done():
 				// Canceled.
@@ -225,6 +296,7 @@ func (c *outgoingConn) worker() {
 			default:
 				if err != nil {
 					c.log.Warningf("Failed to connect to '%v': %v", addrPort, err)
+					c.setError(err)
 					continue
 				}
 			}
@@ -234,7 +306,9 @@ func (c *outgoingConn) worker() {
 			start := time.Now()
 
 			// Handle the new connection.
-			if c.onConnEstablished(conn, dialCtx.Done()) {
+			wasHalted := c.onConnEstablished(conn, dialCtx.Done())
+			c.setConnected(false)
+			if wasHalted {
 				// Canceled with a connection established.
 				c.log.Debugf("Existing connection canceled.")
 				canceledOutgoingConns.Inc()
@@ -278,11 +352,13 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 	_ = conn.SetDeadline(time.Now().Add(timeoutMs))
 	if err = w.Initialize(conn); err != nil {
 		c.log.Errorf("Handshake failed: %v", err)
+		c.setError(err)
 		return
 	}
 	c.log.Debugf("Handshake completed.")
 	_ = conn.SetDeadline(time.Time{})
 	c.retryDelay = 0 // Reset the retry delay on successful handshakes.
+	c.setConnected(true)
 
 	// Since outgoing connections have no reverse traffic, read from the
 	// reverse path to detect that the connection has been closed.
@@ -316,6 +392,7 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 			}
 			if err := w.SendCommand(&cmd); err != nil {
 				c.log.Debugf("Dropping packet: %v (SendCommand failed: %v)", pkt.ID, err)
+				c.setError(err)
 				packetsDropped.Inc()
 				pkt.Dispose()
 				return
@@ -336,6 +413,7 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 		select {
 		case <-peerClosedCh:
 			c.log.Debugf("Connection closed by peer.")
+			c.setError(errPeerClosed)
 			return
 		case <-closeCh:
 			wasHalted = true
@@ -350,6 +428,7 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 			}
 			if !c.IsPeerValid(creds) {
 				c.log.Debugf("Disconnecting, peer reauthenticate failed.")
+				c.setError(errReauthFailed)
 				return
 			}
 			continue
@@ -398,6 +477,7 @@ func newOutgoingConn(co *connector, dst *cpki.MixDescriptor) *outgoingConn {
 		ch:  make(chan *packet.Packet, maxQueueSize),
 		id:  atomic.AddUint64(&outgoingConnID, 1), // Diagnostic only, wrapping is fine.
 	}
+	c.peer = debug.BytesToPrintString(dst.IdentityKey.Bytes())
 	c.log = co.glue.LogBackend().GetLogger(fmt.Sprintf("outgoing:%d", c.id))
 
 	c.log.Debugf("New outgoing connection: %+v", dst)
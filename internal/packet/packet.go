@@ -18,6 +18,8 @@
 package packet
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -29,6 +31,18 @@ import (
 	"github.com/katzenpost/core/utils"
 )
 
+const (
+	flagsMultiSURB = 2
+	flagsFragment  = 3
+
+	// fragmentHdrLength is the length of the header of a request fragment.
+	fragmentHdrLength = constants.SphinxPlaintextHeaderLength + 8 + 1 + 1 + 2
+
+	// MaxFragmentLength is the maximum length of the data carried by a
+	// request fragment.
+	MaxFragmentLength = constants.ForwardPayloadLength - fragmentHdrLength
+)
+
 var (
 	pktPool = sync.Pool{
 		New: func() interface{} {
@@ -42,6 +56,9 @@ var (
 		},
 	}
 	pktID uint64
+
+	errNilPacket  = errors.New("nil packet")
+	errNilCommand = errors.New("nil routing command")
 )
 
 type Packet struct {
@@ -72,6 +89,8 @@ func (pkt *Packet) Set(payload []byte, cmds []commands.RoutingCommand) error {
 func (pkt *Packet) splitCommands(cmds []commands.RoutingCommand) error {
 	for _, v := range cmds {
 		switch cmd := v.(type) {
+		case nil:
+			return errNilCommand
 		case *commands.NextNodeHop:
 			if pkt.NextNodeHop != nil {
 				return newRedundantError(cmd)
@@ -215,7 +234,36 @@ func newRedundantError(cmd commands.RoutingCommand) error {
 	return fmt.Errorf("redundant command: %T", cmd)
 }
 
+// ParseForwardPacket parses the payload of a forward packet destined for
+// the local Provider, and returns the user payload and the optional SURB.
+// The returned slices alias pkt.Payload.
+//
+// The payload is attacker controlled, so this MUST NOT panic regardless
+// of what the packet contains.
 func ParseForwardPacket(pkt *Packet) ([]byte, []byte, error) {
+	if pkt == nil {
+		return nil, nil, errNilPacket
+	}
+
+	// Sanity check the forward packet payload length.
+	if len(pkt.Payload) != constants.ForwardPayloadLength {
+		return nil, nil, fmt.Errorf("invalid payload length: %v", len(pkt.Payload))
+	}
+
+	ct, surb, err := parsePlaintext(pkt.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ct) != constants.UserForwardPayloadLength {
+		return nil, nil, fmt.Errorf("mis-sized user payload: %v", len(ct))
+	}
+
+	return ct, surb, nil
+}
+
+// parsePlaintext parses b, which should be a valid BlockSphinxPlaintext,
+// without any constraint on the length of the user payload.
+func parsePlaintext(b []byte) ([]byte, []byte, error) {
 	const (
 		hdrLength    = constants.SphinxPlaintextHeaderLength + sphinx.SURBLength
 		flagsPadding = 0
@@ -223,13 +271,6 @@ func ParseForwardPacket(pkt *Packet) ([]byte, []byte, error) {
 		reserved     = 0
 	)
 
-	// Sanity check the forward packet payload length.
-	if len(pkt.Payload) != constants.ForwardPayloadLength {
-		return nil, nil, fmt.Errorf("invalid payload length: %v", len(pkt.Payload))
-	}
-
-	// Parse the payload, which should be a valid BlockSphinxPlaintext.
-	b := pkt.Payload
 	if len(b) < hdrLength {
 		return nil, nil, fmt.Errorf("truncated message block")
 	}
@@ -245,17 +286,152 @@ func ParseForwardPacket(pkt *Packet) ([]byte, []byte, error) {
 	default:
 		return nil, nil, fmt.Errorf("invalid message flags: 0x%02x", b[0])
 	}
-	if len(ct) != constants.UserForwardPayloadLength {
-		return nil, nil, fmt.Errorf("mis-sized user payload: %v", len(ct))
-	}
 
 	return ct, surb, nil
 }
 
+// ParseMultiSURBPacket parses a forward packet's payload like
+// ParseForwardPacket, but additionally accepts multi-SURB requests, where
+// the user payload is prefixed with a count byte followed by that many
+// additional SURBs, so that responses larger than a single payload can be
+// returned.  The returned ct is not padded to UserForwardPayloadLength for
+// multi-SURB requests.
+func ParseMultiSURBPacket(pkt *Packet) ([]byte, [][]byte, error) {
+	if pkt == nil {
+		return nil, nil, errNilPacket
+	}
+	if len(pkt.Payload) == 0 || pkt.Payload[0] != flagsMultiSURB {
+		ct, surb, err := ParseForwardPacket(pkt)
+		if err != nil || surb == nil {
+			return ct, nil, err
+		}
+		return ct, [][]byte{surb}, nil
+	}
+
+	// Parse as a regular SURB bearing packet, and then split the
+	// additional SURBs off the user payload.
+	b := make([]byte, len(pkt.Payload))
+	copy(b, pkt.Payload)
+	b[0] = 1
+	ct, surb, err := ParseForwardPacket(&Packet{Payload: b})
+	if err != nil {
+		return nil, nil, err
+	}
+	return splitSURBs(ct, surb)
+}
+
+// ParseReassembledPayload parses the payload of a request reassembled from
+// fragments, which is laid out like the payload of a forward packet
+// accepted by ParseMultiSURBPacket, except that the user payload can be of
+// any length.
+func ParseReassembledPayload(b []byte) ([]byte, [][]byte, error) {
+	if len(b) == 0 || b[0] != flagsMultiSURB {
+		ct, surb, err := parsePlaintext(b)
+		if err != nil || surb == nil {
+			return ct, nil, err
+		}
+		return ct, [][]byte{surb}, nil
+	}
+
+	b = append([]byte{}, b...)
+	b[0] = 1
+	ct, surb, err := parsePlaintext(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return splitSURBs(ct, surb)
+}
+
+// splitSURBs splits the additional SURBs of a multi-SURB request off the
+// user payload.
+func splitSURBs(ct, surb []byte) ([]byte, [][]byte, error) {
+	if len(ct) == 0 {
+		return nil, nil, fmt.Errorf("truncated SURB count")
+	}
+	n := int(ct[0])
+	ct = ct[1:]
+	if n == 0 || len(ct) < n*sphinx.SURBLength {
+		return nil, nil, fmt.Errorf("invalid SURB count: %v", n)
+	}
+	surbs := make([][]byte, 0, n+1)
+	surbs = append(surbs, surb)
+	for i := 0; i < n; i++ {
+		surbs = append(surbs, ct[:sphinx.SURBLength])
+		ct = ct[sphinx.SURBLength:]
+	}
+
+	return ct, surbs, nil
+}
+
+// Fragment is a fragment of a request spanning multiple packets.  The
+// fragments of a request share a message ID chosen by the client, and
+// carry the payload of the request split into Count parts, which once
+// reassembled is parsed with ParseReassembledPayload.
+type Fragment struct {
+	MessageID uint64
+	Index     int
+	Count     int
+	Data      []byte
+}
+
+// IsFragment returns true iff the packet carries a fragment of a request
+// spanning multiple packets.
+func IsFragment(pkt *Packet) bool {
+	return pkt != nil && len(pkt.Payload) > 0 && pkt.Payload[0] == flagsFragment
+}
+
+// ParseFragment parses the payload of a forward packet carrying a request
+// fragment, laid out as the flags and reserved bytes, followed by the
+// big endian message ID, the fragment index and count bytes, the big
+// endian length of the fragment data, and the data.  The returned Data
+// aliases pkt.Payload.
+//
+// The payload is attacker controlled, so this MUST NOT panic regardless
+// of what the packet contains.
+func ParseFragment(pkt *Packet) (*Fragment, error) {
+	if pkt == nil {
+		return nil, errNilPacket
+	}
+	b := pkt.Payload
+	if len(b) != constants.ForwardPayloadLength {
+		return nil, fmt.Errorf("invalid payload length: %v", len(b))
+	}
+	if b[0] != flagsFragment {
+		return nil, fmt.Errorf("invalid message flags: 0x%02x", b[0])
+	}
+	if b[1] != 0 {
+		return nil, fmt.Errorf("invalid message reserved: 0x%02x", b[1])
+	}
+
+	f := &Fragment{
+		MessageID: binary.BigEndian.Uint64(b[2:10]),
+		Index:     int(b[10]),
+		Count:     int(b[11]),
+	}
+	if f.Count == 0 || f.Index >= f.Count {
+		return nil, fmt.Errorf("invalid fragment index: %v/%v", f.Index, f.Count)
+	}
+	n := int(binary.BigEndian.Uint16(b[12:fragmentHdrLength]))
+	if n > len(b)-fragmentHdrLength {
+		return nil, fmt.Errorf("invalid fragment length: %v", n)
+	}
+	f.Data = b[fragmentHdrLength : fragmentHdrLength+n]
+
+	return f, nil
+}
+
+// NewPacketFromSURB builds a new forward packet carrying payload, using the
+// SURB supplied in the request packet pkt.
 func NewPacketFromSURB(pkt *Packet, surb, payload []byte) (*Packet, error) {
+	if pkt == nil {
+		return nil, errNilPacket
+	}
 	if !pkt.IsToUser() {
 		return nil, fmt.Errorf("invalid commands to generate a SURB reply")
 	}
+	if len(surb) != sphinx.SURBLength {
+		return nil, fmt.Errorf("invalid SURB length: %v", len(surb))
+	}
 
 	// Pad out payloads to the full packet size.
 	var respPayload [constants.ForwardPayloadLength]byte
@@ -291,7 +467,10 @@ func NewPacketFromSURB(pkt *Packet, surb, payload []byte) (*Packet, error) {
 	cmds = append(cmds, nodeDelayCmd)
 
 	// Assemble the response packet.
-	respPkt, _ := New(rawRespPkt)
+	respPkt, err := New(rawRespPkt)
+	if err != nil {
+		return nil, err
+	}
 	_ = respPkt.Set(nil, cmds)
 
 	respPkt.RecvAt = pkt.RecvAt
@@ -0,0 +1,110 @@
+// packet_fuzz_test.go - Katzenpost server packet structure fuzz tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build go1.18
+// +build go1.18
+
+package packet
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	wireCommands "github.com/katzenpost/core/wire/commands"
+)
+
+// FuzzParseForwardPacket exercises the provider side forward payload
+// parser with arbitrary payloads.
+func FuzzParseForwardPacket(f *testing.F) {
+	f.Add(make([]byte, constants.ForwardPayloadLength))
+	withSURB := make([]byte, constants.ForwardPayloadLength)
+	withSURB[0] = 1
+	f.Add(withSURB)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pkt := &Packet{Payload: b}
+		ct, surb, err := ParseForwardPacket(pkt)
+		if err != nil {
+			return
+		}
+		if len(ct) != constants.UserForwardPayloadLength {
+			t.Fatalf("mis-sized ct: %v", len(ct))
+		}
+		if surb != nil && len(surb) != sphinx.SURBLength {
+			t.Fatalf("mis-sized SURB: %v", len(surb))
+		}
+	})
+}
+
+// FuzzSphinxPacket exercises the Sphinx packet framing path, from the
+// raw packet allocation through Unwrap and routing command splitting.
+func FuzzSphinxPacket(f *testing.F) {
+	k, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(make([]byte, constants.PacketLength))
+	f.Add(make([]byte, constants.PacketLength-1))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		pkt, err := New(b)
+		if err != nil {
+			return
+		}
+		defer pkt.Dispose()
+
+		payload, _, cmds, err := sphinx.Unwrap(k, pkt.Raw)
+		if err != nil {
+			return
+		}
+		if err = pkt.Set(payload, cmds); err != nil {
+			return
+		}
+		_ = pkt.CmdsToString()
+		if pkt.IsToUser() {
+			_, _, _ = ParseForwardPacket(pkt)
+		}
+	})
+}
+
+// FuzzWireCommand exercises the wire protocol command parser, and the
+// conversion of SendPacket commands into server packets.
+func FuzzWireCommand(f *testing.F) {
+	sendPacket := &wireCommands.SendPacket{SphinxPacket: make([]byte, constants.PacketLength)}
+	f.Add(sendPacket.ToBytes())
+	f.Add((&wireCommands.NoOp{}).ToBytes())
+	f.Add((&wireCommands.RetrieveMessage{Sequence: 1}).ToBytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cmd, err := wireCommands.FromBytes(b)
+		if err != nil {
+			return
+		}
+		if sp, ok := cmd.(*wireCommands.SendPacket); ok {
+			pkt, err := New(sp.SphinxPacket)
+			if err != nil {
+				return
+			}
+			pkt.Dispose()
+		}
+	})
+}
@@ -0,0 +1,151 @@
+// packet_test.go - Katzenpost server packet structure tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package packet
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwardPacket(t *testing.T) {
+	require := require.New(t)
+
+	_, _, err := ParseForwardPacket(nil)
+	require.Error(err, "ParseForwardPacket(nil)")
+
+	pkt := &Packet{}
+	_, _, err = ParseForwardPacket(pkt)
+	require.Error(err, "ParseForwardPacket(): no payload")
+
+	pkt.Payload = make([]byte, constants.ForwardPayloadLength-1)
+	_, _, err = ParseForwardPacket(pkt)
+	require.Error(err, "ParseForwardPacket(): truncated payload")
+
+	pkt.Payload = make([]byte, constants.ForwardPayloadLength)
+	ct, surb, err := ParseForwardPacket(pkt)
+	require.NoError(err, "ParseForwardPacket(): padding")
+	require.Nil(surb, "ParseForwardPacket(): padding SURB")
+	require.Len(ct, constants.UserForwardPayloadLength, "ParseForwardPacket(): padding ct")
+
+	pkt.Payload[0] = 1
+	ct, surb, err = ParseForwardPacket(pkt)
+	require.NoError(err, "ParseForwardPacket(): SURB")
+	require.Len(surb, sphinx.SURBLength, "ParseForwardPacket(): SURB length")
+	require.Len(ct, constants.UserForwardPayloadLength, "ParseForwardPacket(): SURB ct")
+
+	pkt.Payload[0] = 2
+	_, _, err = ParseForwardPacket(pkt)
+	require.Error(err, "ParseForwardPacket(): invalid flags")
+
+	pkt.Payload[0], pkt.Payload[1] = 0, 1
+	_, _, err = ParseForwardPacket(pkt)
+	require.Error(err, "ParseForwardPacket(): invalid reserved")
+}
+
+func TestParseMultiSURBPacket(t *testing.T) {
+	require := require.New(t)
+
+	pkt := &Packet{Payload: make([]byte, constants.ForwardPayloadLength)}
+	pkt.Payload[0] = 1
+	ct, surbs, err := ParseMultiSURBPacket(pkt)
+	require.NoError(err, "ParseMultiSURBPacket(): SURB")
+	require.Len(surbs, 1, "ParseMultiSURBPacket(): SURB count")
+	require.Len(ct, constants.UserForwardPayloadLength, "ParseMultiSURBPacket(): SURB ct")
+
+	pkt.Payload[0] = 2
+	_, _, err = ParseMultiSURBPacket(pkt)
+	require.Error(err, "ParseMultiSURBPacket(): zero extra SURBs")
+
+	pkt.Payload[constants.SphinxPlaintextHeaderLength+sphinx.SURBLength] = 3
+	ct, surbs, err = ParseMultiSURBPacket(pkt)
+	require.NoError(err, "ParseMultiSURBPacket(): multi-SURB")
+	require.Len(surbs, 4, "ParseMultiSURBPacket(): multi-SURB count")
+	for _, surb := range surbs {
+		require.Len(surb, sphinx.SURBLength, "ParseMultiSURBPacket(): SURB length")
+	}
+	require.Len(ct, constants.UserForwardPayloadLength-1-3*sphinx.SURBLength, "ParseMultiSURBPacket(): multi-SURB ct")
+
+	// The original payload must not be modified.
+	require.Equal(byte(2), pkt.Payload[0], "ParseMultiSURBPacket(): flags")
+}
+
+func TestParseFragment(t *testing.T) {
+	require := require.New(t)
+
+	pkt := &Packet{Payload: make([]byte, constants.ForwardPayloadLength)}
+	require.False(IsFragment(pkt), "IsFragment(): padding")
+
+	pkt.Payload[0] = 3
+	require.True(IsFragment(pkt), "IsFragment(): fragment")
+	_, err := ParseFragment(pkt)
+	require.Error(err, "ParseFragment(): zero count")
+
+	copy(pkt.Payload[2:], []byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2, 0, 5})
+	f, err := ParseFragment(pkt)
+	require.NoError(err, "ParseFragment()")
+	require.Equal(uint64(42), f.MessageID, "ParseFragment(): message ID")
+	require.Equal(1, f.Index, "ParseFragment(): index")
+	require.Equal(2, f.Count, "ParseFragment(): count")
+	require.Len(f.Data, 5, "ParseFragment(): data")
+
+	pkt.Payload[10] = 2
+	_, err = ParseFragment(pkt)
+	require.Error(err, "ParseFragment(): index out of bounds")
+
+	pkt.Payload[10] = 1
+	pkt.Payload[12], pkt.Payload[13] = 0xff, 0xff
+	_, err = ParseFragment(pkt)
+	require.Error(err, "ParseFragment(): oversized data")
+
+	// Reassembled payloads are not constrained to a single packet.
+	b := make([]byte, 2*constants.ForwardPayloadLength)
+	b[0] = 1
+	ct, surbs, err := ParseReassembledPayload(b)
+	require.NoError(err, "ParseReassembledPayload()")
+	require.Len(surbs, 1, "ParseReassembledPayload(): SURB count")
+	require.Len(ct, len(b)-constants.SphinxPlaintextHeaderLength-sphinx.SURBLength, "ParseReassembledPayload(): ct")
+}
+
+func TestSetRejectsMalformedCommands(t *testing.T) {
+	require := require.New(t)
+
+	pkt := &Packet{}
+	err := pkt.Set(nil, []commands.RoutingCommand{nil})
+	require.Error(err, "Set(): nil command")
+
+	pkt = &Packet{}
+	err = pkt.Set(nil, []commands.RoutingCommand{&commands.NodeDelay{}, &commands.NodeDelay{}})
+	require.Error(err, "Set(): redundant command")
+}
+
+func TestNewPacketFromSURBRejectsMalformed(t *testing.T) {
+	require := require.New(t)
+
+	_, err := NewPacketFromSURB(nil, nil, nil)
+	require.Error(err, "NewPacketFromSURB(nil)")
+
+	pkt := &Packet{
+		NodeDelay: &commands.NodeDelay{},
+		Recipient: &commands.Recipient{},
+	}
+	_, err = NewPacketFromSURB(pkt, make([]byte, sphinx.SURBLength-1), nil)
+	require.Error(err, "NewPacketFromSURB(): truncated SURB")
+}
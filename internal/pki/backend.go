@@ -0,0 +1,240 @@
+// backend.go - Katzenpost server PKI client backends.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	kpki "github.com/hashcloak/Meson-client/pkiclient"
+	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/proxy"
+	nClient "github.com/katzenpost/authority/nonvoting/client"
+	vClient "github.com/katzenpost/authority/voting/client"
+	"github.com/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
+	cEpochtime "github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var authoritySignatureFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "authority_signature_failures_total",
+		Subsystem: constants.PKISubsystem,
+		Help:      "Number of PKI documents missing a valid signature per authority",
+	},
+	[]string{"authority"},
+)
+
+// backend is a PKI client implementation, along with the notion of time
+// that the directory authority it talks to uses.
+type backend interface {
+	cpki.Client
+
+	// Now returns the current epoch, time since the start of the current
+	// epoch, and time till the next epoch.
+	Now() (uint64, time.Duration, time.Duration, error)
+
+	// Period returns the epoch duration.
+	Period() time.Duration
+}
+
+// referenceClock is implemented by the backends whose epochs are
+// maintained by the PKI, rather than derived from the local clock, and can
+// be used to detect skew of the local clock.
+type referenceClock interface {
+	// ReferenceNow returns the current epoch, and the time elapsed in it,
+	// according to the PKI.
+	ReferenceNow() (uint64, time.Duration, error)
+}
+
+// katzenmintBackend is the Katzenmint chain PKI backend.
+type katzenmintBackend struct {
+	kpki.Client
+}
+
+func (b *katzenmintBackend) Now() (uint64, time.Duration, time.Duration, error) {
+	return epochtime.Now(b.Client)
+}
+
+// ReferenceNow returns the epoch clock of the chain, which is advanced by
+// the block height.
+func (b *katzenmintBackend) ReferenceNow() (uint64, time.Duration, error) {
+	epoch, elapsed, _, err := epochtime.Now(b.Client)
+	return epoch, elapsed, err
+}
+
+func (b *katzenmintBackend) Period() time.Duration {
+	return epochtime.TestPeriod
+}
+
+// authorityBackend is the Katzenpost directory authority PKI backend,
+// which derives epochs from the system's civil time.
+type authorityBackend struct {
+	cpki.Client
+
+	period time.Duration
+
+	// verifiers and threshold, if set, specify the number of authority
+	// signatures required for a document to be accepted.
+	verifiers []cert.Verifier
+	threshold int
+}
+
+func (b *authorityBackend) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	d, rawDoc, err := b.Client.GetDoc(ctx, epoch)
+	if err != nil || b.verifiers == nil {
+		return d, rawDoc, err
+	}
+
+	_, good, bad, err := cert.VerifyThreshold(b.verifiers, b.threshold, rawDoc)
+	for _, v := range bad {
+		authoritySignatureFailures.With(prometheus.Labels{"authority": v.(*eddsa.PublicKey).String()}).Inc()
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("pki: document has %v/%v required signatures: %v", len(good), b.threshold, err)
+	}
+	return d, rawDoc, nil
+}
+
+func (b *authorityBackend) Now() (uint64, time.Duration, time.Duration, error) {
+	fromEpoch := time.Since(cEpochtime.Epoch)
+	if fromEpoch < 0 {
+		return 0, 0, 0, errors.New("pki: system time is before the epoch")
+	}
+	current := uint64(fromEpoch / b.period)
+	elapsed := fromEpoch - time.Duration(current)*b.period
+	return current, elapsed, b.period - elapsed, nil
+}
+
+func (b *authorityBackend) Period() time.Duration {
+	return b.period
+}
+
+// newBackend returns the PKI backend selected by the configuration.
+func newBackend(cfg *config.PKI, proxyCfg *config.UpstreamProxy, epochPeriod time.Duration, logBackend *log.Backend) (backend, error) {
+	dialFn, err := proxy.New(proxyCfg, &net.Dialer{KeepAlive: constants.KeepAliveInterval})
+	if err != nil {
+		return nil, err
+	}
+
+	// The Katzenpost authorities derive epochs from the civil time, so
+	// the period can be overridden for test networks.
+	authorityPeriod := cEpochtime.Period
+	if epochPeriod != 0 {
+		authorityPeriod = epochPeriod
+	}
+
+	switch {
+	case cfg.Nonvoting != nil:
+		pubKey := new(eddsa.PublicKey)
+		if err := pubKey.FromString(cfg.Nonvoting.PublicKey); err != nil {
+			return nil, err
+		}
+		impl, err := nClient.New(&nClient.Config{
+			LogBackend:    logBackend,
+			Address:       cfg.Nonvoting.Address,
+			PublicKey:     pubKey,
+			DialContextFn: dialFn,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &authorityBackend{Client: impl, period: authorityPeriod}, nil
+	case cfg.VotingAuthority != nil:
+		peers, err := config.AuthorityPeersFromPeers(cfg.VotingAuthority.Peers)
+		if err != nil {
+			return nil, err
+		}
+		impl, err := vClient.New(&vClient.Config{
+			LogBackend:    logBackend,
+			Authorities:   peers,
+			DialContextFn: dialFn,
+		})
+		if err != nil {
+			return nil, err
+		}
+		b := &authorityBackend{
+			Client:    impl,
+			period:    authorityPeriod,
+			threshold: cfg.VotingAuthority.SignatureThreshold,
+		}
+		for _, peer := range peers {
+			b.verifiers = append(b.verifiers, peer.IdentityPublicKey)
+		}
+		return b, nil
+	case cfg.Katzenmint != nil:
+		// The Tendermint RPC client does not allow the dialer to be
+		// overridden, so fail closed rather than bypass the proxy.
+		if proxyCfg != nil {
+			return nil, errors.New("pki: UpstreamProxy is not supported by the Katzenmint backend")
+		}
+		if epochPeriod != 0 {
+			return nil, errors.New("pki: EpochPeriod is set by the Katzenmint chain")
+		}
+		impl, err := kpki.NewPKIClient(&kpki.PKIClientConfig{
+			LogBackend:         logBackend,
+			ChainID:            cfg.Katzenmint.ChainID,
+			TrustOptions:       cfg.Katzenmint.TrustOptions,
+			PrimaryAddress:     cfg.Katzenmint.PrimaryAddress,
+			WitnessesAddresses: cfg.Katzenmint.WitnessesAddresses,
+			DatabaseName:       cfg.Katzenmint.DatabaseName,
+			DatabaseDir:        cfg.Katzenmint.DatabaseDir,
+			RPCAddress:         cfg.Katzenmint.RPCAddress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &katzenmintBackend{impl}, nil
+	case cfg.Static != nil:
+		impl := &staticClient{
+			log:  logBackend.GetLogger("pki/static"),
+			file: cfg.Static.File,
+		}
+		if cfg.Static.PublicKey != "" {
+			// The non-voting client is only used to verify and parse the
+			// document, so it never connects to an authority.
+			pubKey := new(eddsa.PublicKey)
+			if err := pubKey.FromString(cfg.Static.PublicKey); err != nil {
+				return nil, err
+			}
+			if impl.verifier, err = nClient.New(&nClient.Config{
+				LogBackend: logBackend,
+				PublicKey:  pubKey,
+			}); err != nil {
+				return nil, err
+			}
+		} else {
+			impl.log.Warningf("Using an unsigned static PKI document, this is only suitable for testing.")
+		}
+		return &authorityBackend{Client: impl, period: authorityPeriod}, nil
+	default:
+		return nil, errors.New("pki: no backend configured")
+	}
+}
+
+func init() {
+	prometheus.MustRegister(authoritySignatureFailures)
+}
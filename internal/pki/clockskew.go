@@ -0,0 +1,96 @@
+// clockskew.go - Katzenpost server clock skew detection.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+var clockSkew = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: constants.Namespace,
+		Name:      "clock_skew_seconds",
+		Subsystem: constants.PKISubsystem,
+		Help:      "Skew between the local clock and the PKI epoch boundaries",
+	},
+)
+
+// clockSkewMonitor tracks where the local wall clock places the epoch
+// boundaries reported by the PKI.  Since the epoch period is fixed, the
+// boundaries should stay put as time progresses, and any movement is skew
+// between the local clock and the PKI's.
+//
+// Note: This requires a backend whose epochs are maintained by the PKI,
+// the epochs of the directory authorities are derived from the local
+// clock, so there is nothing to compare against.
+type clockSkewMonitor struct {
+	refEpoch uint64
+	refStart time.Time
+}
+
+// observe records the current epoch according to the PKI, and the time
+// elapsed in it, at the local time now, and returns the skew relative to
+// the first observation.
+func (m *clockSkewMonitor) observe(now time.Time, epoch uint64, elapsed, period time.Duration) (time.Duration, bool) {
+	// Strip the monotonic clock reading, the skew of interest is that of
+	// the wall clock.
+	start := now.Round(0).Add(-elapsed)
+	if m.refStart.IsZero() || epoch < m.refEpoch {
+		m.refEpoch, m.refStart = epoch, start
+		return 0, false
+	}
+
+	expected := m.refStart.Add(time.Duration(epoch-m.refEpoch) * period)
+	return start.Sub(expected), true
+}
+
+// check observes the PKI epoch clock, updates the skew metric, and returns
+// true iff a warning was logged because the skew exceeds threshold.
+func (m *clockSkewMonitor) check(log *logging.Logger, now time.Time, epoch uint64, elapsed, period, threshold time.Duration) bool {
+	skew, ok := m.observe(now, epoch, elapsed, period)
+	if !ok {
+		return false
+	}
+	clockSkew.Set(skew.Seconds())
+
+	if skew > threshold || skew < -threshold {
+		log.Warningf("Local clock is skewed by %v relative to the PKI epoch clock, check NTP.", skew)
+		return true
+	}
+	return false
+}
+
+func (p *pki) checkClockSkew() {
+	clock, ok := p.backend().(referenceClock)
+	if !ok {
+		return
+	}
+	epoch, elapsed, err := clock.ReferenceNow()
+	if err != nil {
+		return
+	}
+	threshold := time.Duration(p.glue.Config().Debug.ClockSkewThreshold) * time.Millisecond
+	p.skewMonitor.check(p.log, time.Now(), epoch, elapsed, p.EpochPeriod(), threshold)
+}
+
+func init() {
+	prometheus.MustRegister(clockSkew)
+}
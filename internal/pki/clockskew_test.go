@@ -0,0 +1,88 @@
+// clockskew_test.go - PKI clock skew detection tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkewMonitor(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "pki_clockskew")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "katzenpost.log")
+	logBackend, err := log.New(logFile, "DEBUG", false)
+	require.NoError(err)
+	logger := logBackend.GetLogger("pki")
+
+	const (
+		period    = 20 * time.Minute
+		threshold = 30 * time.Second
+	)
+	now := time.Now()
+	var m clockSkewMonitor
+
+	// The first observation is the reference.
+	require.False(m.check(logger, now, 100, time.Minute, period, threshold))
+
+	// The PKI's epoch clock progresses along with the local clock.
+	now = now.Add(period)
+	require.False(m.check(logger, now, 101, time.Minute, period, threshold))
+	require.Equal(float64(0), testutil.ToFloat64(clockSkew))
+
+	// A small skew is reported, but not warned about.
+	now = now.Add(10 * time.Minute)
+	require.False(m.check(logger, now, 101, 11*time.Minute-10*time.Second, period, threshold))
+	require.Equal(float64(10), testutil.ToFloat64(clockSkew))
+
+	// The local clock runs ahead of the PKI's.
+	now = now.Add(10 * time.Minute)
+	require.True(m.check(logger, now, 102, 0, period, threshold))
+	require.Equal(float64(60), testutil.ToFloat64(clockSkew))
+
+	// The local clock runs behind the PKI's.
+	require.True(m.check(logger, now, 102, 2*time.Minute, period, threshold))
+	require.Equal(float64(-60), testutil.ToFloat64(clockSkew))
+
+	b, err := ioutil.ReadFile(logFile)
+	require.NoError(err)
+	require.Contains(string(b), "Local clock is skewed by 1m0s")
+	require.Contains(string(b), "Local clock is skewed by -1m0s")
+}
+
+func TestClockSkewReference(t *testing.T) {
+	require := require.New(t)
+
+	// The authority epochs are derived from the local clock, and can't be
+	// used as a reference.
+	var b backend = &authorityBackend{period: time.Minute}
+	_, ok := b.(referenceClock)
+	require.False(ok)
+	b = &katzenmintBackend{}
+	_, ok = b.(referenceClock)
+	require.True(ok)
+}
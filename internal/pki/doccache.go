@@ -0,0 +1,163 @@
+// doccache.go - Katzenpost server on-disk PKI document cache.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashcloak/Meson-server/internal/pkicache"
+)
+
+const (
+	docCacheDir    = "pki_docs"
+	docCachePrefix = "consensus-"
+)
+
+// The on-disk cache holds the validated raw documents for the next epoch,
+// the current epoch, and the StaleConsensusGrace previous epochs, so that
+// a restarted node can resume operation while the authority is
+// unreachable.
+
+func (p *pki) docCacheDir() string {
+	return filepath.Join(p.glue.Config().Server.DataDir, docCacheDir)
+}
+
+func (p *pki) docCachePath(epoch uint64) string {
+	return docCachePath(p.docCacheDir(), epoch)
+}
+
+func (p *pki) storeCachedDocument(epoch uint64, rawDoc []byte) {
+	if now, _, _, err := p.Now(); err != nil || epoch+p.staleGrace() < now {
+		return
+	}
+	if err := writeCachedDocument(p.docCacheDir(), epoch, rawDoc); err != nil {
+		p.log.Warningf("Failed to write cached PKI document for epoch %v: %v", epoch, err)
+	}
+}
+
+func (p *pki) loadCachedDocuments() bool {
+	now, _, _, err := p.Now()
+	if err != nil {
+		p.log.Debugf("Error fetching PKI epoch: %v", err)
+		return false
+	}
+
+	var didLoad bool
+	for _, epoch := range cachedEpochs(now, p.staleGrace()) {
+		rawDoc, err := ioutil.ReadFile(p.docCachePath(epoch))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				p.log.Warningf("Failed to read cached PKI document for epoch %v: %v", epoch, err)
+			}
+			continue
+		}
+		if err = p.loadCachedDocument(epoch, rawDoc); err != nil {
+			p.log.Warningf("Discarding cached PKI document for epoch %v: %v", epoch, err)
+			os.Remove(p.docCachePath(epoch))
+			continue
+		}
+		p.log.Noticef("Loaded cached PKI document for epoch %v.", epoch)
+		didLoad = true
+	}
+	return didLoad
+}
+
+func (p *pki) loadCachedDocument(epoch uint64, rawDoc []byte) error {
+	d, err := p.backend().Deserialize(rawDoc)
+	if err != nil {
+		return err
+	}
+	if d.Epoch != epoch {
+		return fmt.Errorf("document is for epoch %v", d.Epoch)
+	}
+	ent, err := pkicache.New(d, p.glue.IdentityKey().PublicKey(), p.glue.Config().Server.IsProvider)
+	if err != nil {
+		return err
+	}
+	if err = p.validateCacheEntry(ent); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.rawDocs[epoch] = rawDoc
+	p.docs[epoch] = ent
+	return nil
+}
+
+func (p *pki) pruneCachedDocuments(now uint64) {
+	pruneDocCache(p.docCacheDir(), now, p.staleGrace())
+}
+
+func docCachePath(dir string, epoch uint64) string {
+	return filepath.Join(dir, docCachePrefix+strconv.FormatUint(epoch, 10))
+}
+
+// cachedEpochs returns the epochs of the documents kept in the cache, from
+// the newest to the oldest.
+func cachedEpochs(now, grace uint64) []uint64 {
+	epochs := []uint64{now + 1}
+	for epoch := now; epoch+grace >= now; epoch-- {
+		epochs = append(epochs, epoch)
+		if epoch == 0 {
+			break
+		}
+	}
+	return epochs
+}
+
+func writeCachedDocument(dir string, epoch uint64, rawDoc []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Write then rename, so that a crash never leaves a truncated document
+	// behind.
+	fn := docCachePath(dir, epoch)
+	tmpFn := fn + ".tmp"
+	if err := ioutil.WriteFile(tmpFn, rawDoc, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFn, fn); err != nil {
+		os.Remove(tmpFn)
+		return err
+	}
+	return nil
+}
+
+// pruneDocCache removes the documents older than the grace period, and the
+// leftover temporary files.
+func pruneDocCache(dir string, now, grace uint64) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), docCachePrefix) {
+			continue
+		}
+		epoch, err := strconv.ParseUint(strings.TrimPrefix(fi.Name(), docCachePrefix), 10, 64)
+		if err != nil || epoch+grace < now {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// doccache_test.go - Katzenpost server on-disk PKI document cache tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedEpochs(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]uint64{11, 10}, cachedEpochs(10, 0))
+	require.Equal([]uint64{11, 10, 9, 8}, cachedEpochs(10, 2))
+	require.Equal([]uint64{2, 1, 0}, cachedEpochs(1, 2), "epochs do not wrap around")
+}
+
+func TestDocCache(t *testing.T) {
+	require := require.New(t)
+
+	dataDir, err := ioutil.TempDir("", "pki_docs")
+	require.NoError(err)
+	defer os.RemoveAll(dataDir)
+	dir := filepath.Join(dataDir, docCacheDir)
+
+	// Store.
+	for epoch := uint64(6); epoch <= 11; epoch++ {
+		err = writeCachedDocument(dir, epoch, []byte(fmt.Sprintf("document %d", epoch)))
+		require.NoError(err)
+	}
+	err = ioutil.WriteFile(docCachePath(dir, 12)+".tmp", []byte("truncated"), 0600)
+	require.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("unrelated"), 0600)
+	require.NoError(err)
+
+	fi, err := os.Stat(docCachePath(dir, 6))
+	require.NoError(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// Prune, the previous epochs within the grace period are kept.
+	pruneDocCache(dir, 10, 2)
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	require.ElementsMatch([]string{"README", "consensus-8", "consensus-9", "consensus-10", "consensus-11"}, names)
+
+	// Load, every epoch that was kept is tried.
+	var loaded []uint64
+	for _, epoch := range cachedEpochs(10, 2) {
+		rawDoc, err := ioutil.ReadFile(docCachePath(dir, epoch))
+		require.NoError(err)
+		require.Equal(fmt.Sprintf("document %d", epoch), string(rawDoc))
+		loaded = append(loaded, epoch)
+	}
+	require.Equal([]uint64{11, 10, 9, 8}, loaded)
+
+	// Without a grace period, only the current and next epochs are kept.
+	pruneDocCache(dir, 10, 0)
+	_, err = os.Stat(docCachePath(dir, 9))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(docCachePath(dir, 10))
+	require.NoError(err)
+}
@@ -0,0 +1,146 @@
+// docdiff.go - Katzenpost server PKI document change tracking.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"sort"
+
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/thwack"
+)
+
+// documentDiff is the set of changes between two consecutive documents.
+type documentDiff struct {
+	fromEpoch uint64
+	toEpoch   uint64
+	changes   []string
+}
+
+// diffDocuments returns a human readable list of changes between the
+// documents a and b, with nodes identified by name.
+func diffDocuments(a, b *cpki.Document) *documentDiff {
+	diff := &documentDiff{
+		fromEpoch: a.Epoch,
+		toEpoch:   b.Epoch,
+	}
+	addf := func(format string, args ...interface{}) {
+		diff.changes = append(diff.changes, fmt.Sprintf(format, args...))
+	}
+
+	diffParam := func(name string, x, y interface{}) {
+		if x != y {
+			addf("%v: %v -> %v", name, x, y)
+		}
+	}
+	diffParam("SendRatePerMinute", a.SendRatePerMinute, b.SendRatePerMinute)
+	diffParam("Mu", a.Mu, b.Mu)
+	diffParam("MuMaxDelay", a.MuMaxDelay, b.MuMaxDelay)
+	diffParam("LambdaP", a.LambdaP, b.LambdaP)
+	diffParam("LambdaPMaxDelay", a.LambdaPMaxDelay, b.LambdaPMaxDelay)
+	diffParam("LambdaL", a.LambdaL, b.LambdaL)
+	diffParam("LambdaLMaxDelay", a.LambdaLMaxDelay, b.LambdaLMaxDelay)
+	diffParam("LambdaD", a.LambdaD, b.LambdaD)
+	diffParam("LambdaDMaxDelay", a.LambdaDMaxDelay, b.LambdaDMaxDelay)
+	diffParam("LambdaM", a.LambdaM, b.LambdaM)
+	diffParam("LambdaMMaxDelay", a.LambdaMMaxDelay, b.LambdaMMaxDelay)
+	diffParam("Layers", len(a.Topology), len(b.Topology))
+
+	aNodes, bNodes := documentNodes(a), documentNodes(b)
+	for _, name := range sortedNames(bNodes) {
+		if oldRole, ok := aNodes[name]; !ok {
+			addf("added %v: %v", bNodes[name], name)
+		} else if oldRole != bNodes[name] {
+			addf("moved %v: %v -> %v", name, oldRole, bNodes[name])
+		}
+	}
+	for _, name := range sortedNames(aNodes) {
+		if _, ok := bNodes[name]; !ok {
+			addf("removed %v: %v", aNodes[name], name)
+		}
+	}
+
+	return diff
+}
+
+// documentNodes returns a map of node name to the node's role in the
+// document.
+func documentNodes(d *cpki.Document) map[string]string {
+	m := make(map[string]string)
+	for layer, nodes := range d.Topology {
+		for _, desc := range nodes {
+			m[desc.Name] = fmt.Sprintf("mix (layer %d)", layer)
+		}
+	}
+	for _, desc := range d.Providers {
+		m[desc.Name] = "provider"
+	}
+	return m
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// logDocumentDiff logs the changes between the document for epoch, and the
+// one for the previous epoch, and retains them for the management
+// interface.
+func (p *pki) logDocumentDiff(epoch uint64) {
+	prev, cur := p.entryForEpoch(epoch-1), p.entryForEpoch(epoch)
+	if prev == nil || cur == nil {
+		return
+	}
+
+	diff := diffDocuments(prev.Document(), cur.Document())
+	if len(diff.changes) == 0 {
+		p.log.Noticef("PKI document for epoch %v: no changes.", epoch)
+	} else {
+		p.log.Noticef("PKI document for epoch %v: %v changes.", epoch, len(diff.changes))
+		for _, change := range diff.changes {
+			p.log.Noticef("  %v", change)
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if p.lastDiff == nil || p.lastDiff.toEpoch <= epoch {
+		p.lastDiff = diff
+	}
+}
+
+func (p *pki) onDocumentDiff(c *thwack.Conn, l string) error {
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.lastDiff == nil {
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	w := c.Writer()
+	for _, change := range p.lastDiff.changes {
+		if err := w.PrintfLine("%v-%v", thwack.StatusOk, change); err != nil {
+			return err
+		}
+	}
+	return w.PrintfLine("%v epoch %v -> %v: %v changes", thwack.StatusOk, p.lastDiff.fromEpoch, p.lastDiff.toEpoch, len(p.lastDiff.changes))
+}
@@ -19,6 +19,7 @@ package pki
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -27,15 +28,16 @@ import (
 	"sync"
 	"time"
 
-	kpki "github.com/hashcloak/Meson-client/pkiclient"
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
+	"github.com/hashcloak/Meson-server/config"
 	"github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/debug"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/pkicache"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
 	cpki "github.com/katzenpost/core/pki"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/worker"
 	"github.com/prometheus/client_golang/prometheus"
@@ -43,11 +45,11 @@ import (
 )
 
 var (
-	errNotCached         = errors.New("pki: requested epoch document not in cache")
-	recheckInterval      = 1 * time.Minute
-	WarpedEpoch          = "false"
-	nextFetchTill        = epochtime.TestPeriod / 8
-	pkiEarlyConnectSlack = epochtime.TestPeriod / 6
+	errNotCached          = errors.New("pki: requested epoch document not in cache")
+	warpedRecheckInterval = 5 * time.Second
+	minPostRetryDelay     = 30 * time.Second
+	maxPostRetryDelay     = 10 * time.Minute
+	WarpedEpoch           = "false"
 )
 
 type pki struct {
@@ -57,13 +59,27 @@ type pki struct {
 	glue glue.Glue
 	log  *logging.Logger
 
-	impl               kpki.Client
+	implLock           sync.RWMutex
+	impl               backend
+	cfg                *config.PKI
 	descAddrMap        map[cpki.Transport][]string
 	docs               map[uint64]*pkicache.Entry
 	rawDocs            map[uint64][]byte
 	failedFetches      map[uint64]error
 	lastPublishedEpoch uint64
 	lastWarnedEpoch    uint64
+	lastFetchedAt      time.Time
+	fetchFailures      uint64
+	lastPostErr        error
+	postFailures       uint
+	nextPostAt         time.Time
+	skewMonitor        clockSkewMonitor
+	lastDiff           *documentDiff
+	forceUpdateCh      chan interface{}
+	forceRepublish     bool
+
+	subscribersLock sync.Mutex
+	docSubscribers  []glue.DocumentSubscriber
 }
 
 var (
@@ -105,16 +121,88 @@ var (
 	invalidPKICache = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: constants.Namespace,
-			Name:      "katzenpost_invalid_pki_cache_per_epoch_total",
+			Name:      "invalid_pki_cache_per_epoch_total",
 			Subsystem: constants.PKISubsystem,
 			Help:      "Number of invalid PKI caches per epoch",
 		},
 		[]string{"epoch"},
 	)
+	fetchPKIDocsConsecutiveFailures = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "fetch_pki_docs_consecutive_failures",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Number of consecutive failed PKI docs fetches",
+		},
+	)
+	pkiDocAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "pki_doc_age_seconds",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Time since a PKI doc was last successfully fetched",
+		},
+	)
+	newestPKIDocEpoch = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "newest_pki_doc_epoch",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Epoch of the newest valid PKI doc",
+		},
+	)
+	staleConsensusEpochs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "stale_consensus_epochs",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Number of epochs the newest PKI doc is behind the current epoch, if there is no current doc",
+		},
+	)
+	descriptorUploads = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "descriptor_uploads_total",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Number of successful descriptor uploads",
+		},
+	)
+	descriptorUploadConflicts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "descriptor_upload_conflicts_total",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Number of descriptor uploads rejected as conflicting or late",
+		},
+	)
+	descriptorUploadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "failed_descriptor_uploads_total",
+			Subsystem: constants.PKISubsystem,
+			Help:      "Number of failed descriptor uploads",
+		},
+	)
 	fetchedPKIDocsTimer *prometheus.Timer
 )
 
 func (p *pki) StartWorker() {
+	// The management interface is initialized after the PKI, so the
+	// commands are registered here.
+	if p.glue.Config().Management.Enable {
+		const (
+			cmdDescriptorStatus = "DESCRIPTOR_STATUS"
+			cmdPKIDiff          = "PKI_DIFF"
+			cmdPKIRefetch       = "PKI_REFETCH"
+			cmdPKIDocument      = "PKI_DOCUMENT"
+		)
+
+		p.glue.Management().RegisterCommand(cmdDescriptorStatus, p.onDescriptorStatus)
+		p.glue.Management().RegisterCommand(cmdPKIDiff, p.onDocumentDiff)
+		p.glue.Management().RegisterCommand(cmdPKIRefetch, p.onRefetch)
+		p.glue.Management().RegisterCommand(cmdPKIDocument, p.onDocument)
+	}
+
 	p.Go(p.worker)
 }
 
@@ -128,7 +216,7 @@ func (p *pki) worker() {
 		timer.Stop()
 	}()
 
-	if p.impl == nil {
+	if p.backend() == nil {
 		p.log.Warningf("No implementation is configured, disabling PKI interface.")
 		return
 	}
@@ -153,16 +241,25 @@ func (p *pki) worker() {
 	// is initialized, so that force updating the outgoing connection table
 	// is guaranteed to work.
 
+	// Resume from the documents persisted by a previous run, if any, so
+	// that the node can operate while the authority is unreachable.
+	if p.loadCachedDocuments() {
+		p.glue.Connector().ForceUpdate()
+	}
+
 	var lastUpdateEpoch, lastMuMaxDelay, lastSendTokenDuration uint64
+	fetchTimeout := time.Duration(p.glue.Config().Debug.PKIFetchTimeout) * time.Millisecond
 
 	for {
-		var timerFired bool
+		var timerFired, forced bool
 		select {
 		case <-p.HaltCh():
 			p.log.Debugf("Terminating gracefully.")
 			return
 		case <-pkiCtx.Done():
 			return
+		case <-p.forceUpdateCh:
+			forced = true
 		case <-timer.C:
 			timerFired = true
 		}
@@ -171,9 +268,8 @@ func (p *pki) worker() {
 		}
 
 		// Fetch the PKI documents as required.
-		var didUpdate bool
-		for _, epoch := range p.documentsToFetch() {
-			fetchedPKIDocsTimer = prometheus.NewTimer(fetchedPKIDocsDuration)
+		var didUpdate, didFetchNext bool
+		for _, epoch := range p.documentsToFetch(forced) {
 			// Certain errors in fetching documents are treated as hard
 			// failures that suppress further attempts to fetch the document
 			// for the epoch.
@@ -181,8 +277,11 @@ func (p *pki) worker() {
 				p.log.Debugf("Skipping fetch for epoch %v: %v", epoch, err)
 				continue
 			}
+			fetchedPKIDocsTimer = prometheus.NewTimer(fetchedPKIDocsDuration)
 
-			d, rawDoc, err := p.impl.GetDoc(pkiCtx, epoch)
+			fetchCtx, fetchCancelFn := context.WithTimeout(pkiCtx, fetchTimeout)
+			d, rawDoc, err := p.backend().GetDoc(fetchCtx, epoch)
+			fetchCancelFn()
 			if isCanceled() {
 				// Canceled mid-fetch.
 				return
@@ -190,6 +289,8 @@ func (p *pki) worker() {
 			if err != nil {
 				p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
 				failedFetchPKIDocs.With(prometheus.Labels{"epoch": fmt.Sprintf("%v", epoch)}).Inc()
+				p.fetchFailures++
+				fetchPKIDocsConsecutiveFailures.Set(float64(p.fetchFailures))
 				if err == cpki.ErrNoDocument {
 					p.setFailedFetch(epoch, err)
 				}
@@ -214,9 +315,17 @@ func (p *pki) worker() {
 			p.rawDocs[epoch] = rawDoc
 			p.docs[epoch] = ent
 			p.Unlock()
+			p.storeCachedDocument(epoch, rawDoc)
+			p.logDocumentDiff(epoch)
 			didUpdate = true
-			fetchedPKIDocs.With(prometheus.Labels{"epoch": fmt.Sprintf("%v", epoch)})
+			if now, _, _, err := p.Now(); err == nil && epoch > now {
+				didFetchNext = true
+			}
+			fetchedPKIDocs.With(prometheus.Labels{"epoch": fmt.Sprintf("%v", epoch)}).Inc()
 			fetchedPKIDocsTimer.ObserveDuration()
+			p.lastFetchedAt = time.Now()
+			p.fetchFailures = 0
+			fetchPKIDocsConsecutiveFailures.Set(0)
 		}
 
 		p.pruneFailures()
@@ -227,6 +336,9 @@ func (p *pki) worker() {
 			// If the PKI document map changed, kick the connector worker.
 			p.glue.Connector().ForceUpdate()
 		}
+		if didFetchNext {
+			p.prewarmNextEpoch()
+		}
 
 		// Check to see if we need to publish the descriptor, and do so, along
 		// with all the key rotation bits.
@@ -260,15 +372,91 @@ func (p *pki) worker() {
 					lastSendTokenDuration = newSendTokenDuration
 				}
 
-				p.log.Debugf("Updating decoy document for epoch %v.", now)
-				p.glue.Decoy().OnNewDocument(ent)
+				p.log.Debugf("Notifying subscribers of the document for epoch %v.", now)
+				for _, s := range p.subscribers() {
+					s.OnNewDocument(ent)
+				}
+
+				// Drop the connections to the peers that are not in the
+				// new epoch's document right at the transition.
+				if lastUpdateEpoch != 0 {
+					p.glue.Connector().ForceUpdate()
+				}
 
 				lastUpdateEpoch = now
 			}
 		}
 
-		timer.Reset(recheckInterval)
+		if !p.lastFetchedAt.IsZero() {
+			pkiDocAge.Set(time.Since(p.lastFetchedAt).Seconds())
+		}
+		p.checkClockSkew()
+		p.checkStaleConsensus()
+
+		timer.Reset(p.nextWakeup())
+	}
+}
+
+// prewarmNextEpoch prepares for the transition to the next epoch as soon
+// as the next epoch's document is available, so that the transition does
+// not result in packet loss.
+func (p *pki) prewarmNextEpoch() {
+	now, _, till, err := p.Now()
+	if err != nil {
+		return
+	}
+	p.log.Debugf("Pre-warming for epoch %v (%v till transition).", now+1, till)
+
+	// Ensure that the mix keys for the next epoch exist and are known to
+	// the crypto workers ahead of time.
+	didGen, err := p.glue.MixKeys().Generate(now + 1)
+	if err != nil {
+		p.log.Warningf("Failed to generate mix keys for epoch %v: %v", now+1, err)
+		return
+	}
+	if didGen {
+		p.glue.ReshadowCryptoWorkers()
+	}
+}
+
+// nextWakeup returns the time till the worker should run again, which is
+// the recheck delay, or the next epoch transition, if it is sooner and the
+// next epoch's document is available, or the next upload retry if it is
+// sooner.
+func (p *pki) nextWakeup() time.Duration {
+	const transitionSlack = 1 * time.Second
+
+	delay := p.recheckDelay()
+	now, _, till, err := p.Now()
+	if err != nil {
+		return delay
+	}
+	if till+transitionSlack < delay && p.entryForEpoch(now+1) != nil {
+		delay = till + transitionSlack
+	}
+
+	// Retry a failed upload on time, as the retry may be scheduled right
+	// before the publication deadline.
+	p.RLock()
+	nextPostAt := p.nextPostAt
+	p.RUnlock()
+	if untilPost := time.Until(nextPostAt); untilPost > 0 && untilPost < delay {
+		delay = untilPost
+	}
+	return delay
+}
+
+func (p *pki) recheckDelay() time.Duration {
+	if WarpedEpoch == "true" {
+		return warpedRecheckInterval
+	}
+
+	cfg := p.glue.Config().Debug
+	delay := time.Duration(cfg.PKIRecheckInterval) * time.Millisecond
+	if cfg.PKIRecheckJitter > 0 {
+		delay += time.Duration(rand.NewMath().Int63n(int64(cfg.PKIRecheckJitter))) * time.Millisecond
 	}
+	return delay
 }
 
 func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
@@ -286,7 +474,7 @@ func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
 	if !desc.LinkKey.Equal(p.glue.LinkKey().PublicKey()) {
 		return fmt.Errorf("self link key mismatch")
 	}
-	return nil
+	return p.validateDocument(ent.Document())
 }
 
 func (p *pki) getFailedFetch(epoch uint64) (bool, error) {
@@ -328,27 +516,40 @@ func (p *pki) pruneDocuments() {
 
 	p.Lock()
 	defer p.Unlock()
+	var newestEpoch uint64
 	for epoch := range p.docs {
 		if epoch < now-(constants.NumMixKeys-1) {
 			p.log.Debugf("Discarding PKI for epoch: %v", epoch)
 			delete(p.docs, epoch)
 			delete(p.rawDocs, epoch)
+			continue
 		}
 		if epoch > now+1 {
 			// This should NEVER happen.
 			p.log.Debugf("Far future PKI document exists, clock ran backwards?: %v", epoch)
 		}
+		if epoch > newestEpoch {
+			newestEpoch = epoch
+		}
 	}
+	newestPKIDocEpoch.Set(float64(newestEpoch))
+	p.pruneCachedDocuments(now)
 }
 
 func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
-	publishDeadline := epochtime.TestPeriod / 2
+	publishDeadline := p.EpochPeriod() / 2
 
 	epoch, _, till, err := p.Now()
 	if err != nil {
 		p.log.Debugf("Error fetching PKI epoch: %v", err)
 		return err
 	}
+	deadline := time.Now().Add(till - publishDeadline)
+	if p.takeForceRepublish() && p.lastPublishedEpoch == epoch+1 && till > publishDeadline {
+		p.log.Noticef("Uploading the descriptor for epoch %v again.", epoch+1)
+		p.setLastPublishedEpoch(epoch)
+	}
+
 	doPublishEpoch := uint64(0)
 	switch p.lastPublishedEpoch {
 	case 0:
@@ -385,6 +586,11 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		doPublishEpoch = epoch
 	}
 
+	// Back off after failed uploads, rather than hammering the authority.
+	if p.inPostBackoff() {
+		return nil
+	}
+
 	// Note: Why, yes I *could* cache the descriptor and save a trivial amount
 	// of time and CPU, but this is invoked infrequently enough that it's
 	// probably not worth it.
@@ -445,25 +651,153 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	}
 
 	// Post the descriptor to all the authorities.
-	err = p.impl.Post(pkiCtx, doPublishEpoch, p.glue.IdentityKey(), desc)
+	err = p.backend().Post(pkiCtx, doPublishEpoch, p.glue.IdentityKey(), desc)
 	switch err {
 	case nil:
 		p.log.Debugf("Posted descriptor for epoch: %v", doPublishEpoch)
-		p.lastPublishedEpoch = doPublishEpoch
+		p.setLastPublishedEpoch(doPublishEpoch)
+		descriptorUploads.Inc()
 	case cpki.ErrInvalidPostEpoch:
-		// Treat this class (conflict/late descriptor) as a permanent rejection
-		// and suppress further uploads.
+		// Conflict/late descriptor, eg: the addresses changed after an
+		// earlier upload.  The descriptor is regenerated on every attempt,
+		// so retry with backoff till the publication deadline passes.
 		p.log.Warningf("Authority rejected upload for epoch: %v (Conflict/Late)", doPublishEpoch)
-		p.lastPublishedEpoch = doPublishEpoch
+		descriptorUploadConflicts.Inc()
 	default:
-		// XXX: the voting authority implementation does not return any of the above error types...
-		// and the mix will continue to fail to submit the same descriptor repeatedly.
-		p.lastPublishedEpoch = doPublishEpoch
+		descriptorUploadFailures.Inc()
 	}
 
+	p.Lock()
+	defer p.Unlock()
+	p.lastPostErr = err
+	if err == nil {
+		p.postFailures = 0
+		p.nextPostAt = time.Time{}
+	} else {
+		p.postFailures++
+		backoff := minPostRetryDelay << (p.postFailures - 1)
+		if backoff > maxPostRetryDelay || backoff <= 0 {
+			backoff = maxPostRetryDelay
+		}
+
+		// The descriptor for the next epoch can not be uploaded after the
+		// publication deadline, so always retry before it.
+		if remaining := time.Until(deadline); doPublishEpoch == epoch+1 && backoff >= remaining {
+			backoff = remaining / 2
+		}
+		p.nextPostAt = time.Now().Add(backoff)
+	}
 	return err
 }
 
+// ForceUpdate wakes up the worker to fetch the current and next epochs'
+// documents even if they are cached, and to upload the descriptor again,
+// regardless of the upload backoff.
+func (p *pki) ForceUpdate() {
+	p.Lock()
+	p.failedFetches = make(map[uint64]error)
+	p.nextPostAt = time.Time{}
+	p.forceRepublish = true
+	p.Unlock()
+
+	// See connector.ForceUpdate().
+	select {
+	case p.forceUpdateCh <- true:
+	default:
+	}
+}
+
+// setLastPublishedEpoch sets the epoch of the last descriptor that was
+// uploaded.  It is only called by the worker, which may read the epoch
+// without holding the lock.
+func (p *pki) setLastPublishedEpoch(epoch uint64) {
+	p.Lock()
+	defer p.Unlock()
+	p.lastPublishedEpoch = epoch
+}
+
+// LastPublishedEpoch returns the epoch of the last descriptor that was
+// uploaded to the authority.
+func (p *pki) LastPublishedEpoch() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+	return p.lastPublishedEpoch
+}
+
+func (p *pki) takeForceRepublish() bool {
+	p.Lock()
+	defer p.Unlock()
+	force := p.forceRepublish
+	p.forceRepublish = false
+	return force
+}
+
+func (p *pki) onRefetch(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("PKI_REFETCH invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	p.log.Noticef("Refetching the PKI documents and uploading the descriptor, as requested via the management interface.")
+	p.ForceUpdate()
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *pki) inPostBackoff() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return time.Now().Before(p.nextPostAt)
+}
+
+func (p *pki) onDescriptorStatus(c *thwack.Conn, l string) error {
+	p.RLock()
+	defer p.RUnlock()
+
+	status := "ok"
+	if p.lastPostErr != nil {
+		status = fmt.Sprintf("failing (%v attempts, retry in %v): %v", p.postFailures, time.Until(p.nextPostAt).Round(time.Second), p.lastPostErr)
+	}
+	return c.Writer().PrintfLine("%v epoch %v: %v", thwack.StatusOk, p.lastPublishedEpoch, status)
+}
+
+// onDocument handles `PKI_DOCUMENT`, that outputs the documents for the
+// current epoch, and the next one if it is cached, as JSON, one per line.
+func (p *pki) onDocument(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("PKI_DOCUMENT invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	now, _, _, err := p.Now()
+	if err != nil {
+		c.Log().Errorf("PKI_DOCUMENT: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if p.entryForEpoch(now) == nil {
+		c.Log().Errorf("PKI_DOCUMENT: no document for the current epoch %v", now)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	w := c.Writer()
+	epochs := []uint64{}
+	for _, epoch := range []uint64{now, now + 1} {
+		ent := p.entryForEpoch(epoch)
+		if ent == nil {
+			continue
+		}
+		b, err := json.Marshal(ent.Document())
+		if err != nil {
+			c.Log().Errorf("PKI_DOCUMENT: failed to serialize the document for epoch %v: %v", epoch, err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+		if err = w.PrintfLine("%v-%s", thwack.StatusOk, b); err != nil {
+			return err
+		}
+		epochs = append(epochs, epoch)
+	}
+	return w.PrintfLine("%v epochs %v", thwack.StatusOk, epochs)
+}
+
 func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 	p.RLock()
 	defer p.RUnlock()
@@ -474,7 +808,9 @@ func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 	return nil
 }
 
-func (p *pki) documentsToFetch() []uint64 {
+// documentsToFetch returns the epochs of the documents to fetch, which are
+// the missing ones, and the current and next epochs' if force is set.
+func (p *pki) documentsToFetch(force bool) []uint64 {
 
 	ret := make([]uint64, 0, constants.NumMixKeys+1)
 	now, _, till, err := p.Now()
@@ -483,7 +819,7 @@ func (p *pki) documentsToFetch() []uint64 {
 		return nil
 	}
 	start := now
-	if till < nextFetchTill {
+	if nextFetchTill := p.EpochPeriod() / 8; till < nextFetchTill {
 		start = now + 1
 	}
 
@@ -491,7 +827,7 @@ func (p *pki) documentsToFetch() []uint64 {
 	defer p.RUnlock()
 
 	for epoch := start; epoch > now-constants.NumMixKeys; epoch-- {
-		if _, ok := p.docs[epoch]; !ok {
+		if _, ok := p.docs[epoch]; !ok || (force && epoch >= now) {
 			ret = append(ret, epoch)
 		}
 	}
@@ -508,7 +844,7 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	now, _, till, err := p.Now()
 	epochs := make([]uint64, 0, constants.NumMixKeys+1)
 	start := now
-	if till < pkiEarlyConnectSlack {
+	if pkiEarlyConnectSlack := p.EpochPeriod() / 6; till < pkiEarlyConnectSlack {
 		// Allow connections to new nodes 30 mins in advance of an epoch
 		// transition.
 		start = now + 1
@@ -523,19 +859,56 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	p.RLock()
 	defer p.RUnlock()
 
-	var nowDoc *pkicache.Entry
+	var nowDoc, staleDoc *pkicache.Entry
 	s := make([]*pkicache.Entry, 0, len(epochs))
 	for _, epoch := range epochs {
 		if e, ok := p.docs[epoch]; ok {
 			s = append(s, e)
-			if epoch == now {
+			switch {
+			case epoch == now:
 				nowDoc = e
+			case epoch < now && staleDoc == nil:
+				staleDoc = e
 			}
 		}
 	}
+
+	// If the document for the current epoch is missing, optionally fall
+	// back to the most recent document within the grace period, so that
+	// the node keeps forwarding during authority outages.
+	if nowDoc == nil && staleDoc != nil && now-staleDoc.Epoch() <= p.staleGrace() {
+		nowDoc = staleDoc
+	}
 	return s, nowDoc, now, till
 }
 
+func (p *pki) staleGrace() uint64 {
+	return uint64(p.glue.Config().Debug.StaleConsensusGrace)
+}
+
+// checkStaleConsensus warns if the node is operating on a stale document.
+func (p *pki) checkStaleConsensus() {
+	now, _, _, err := p.Now()
+	if err != nil || p.entryForEpoch(now) != nil {
+		staleConsensusEpochs.Set(0)
+		return
+	}
+
+	for epoch := now - 1; epoch > now-constants.NumMixKeys; epoch-- {
+		if p.entryForEpoch(epoch) == nil {
+			continue
+		}
+		age := now - epoch
+		staleConsensusEpochs.Set(float64(age))
+		if age <= p.staleGrace() {
+			p.log.Warningf("No PKI document for epoch %v, forwarding with the stale document for epoch %v.", now, epoch)
+		} else {
+			p.log.Warningf("No PKI document for epoch %v, forwarding is suspended.", now)
+		}
+		return
+	}
+}
+
 func (p *pki) AuthenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (desc *cpki.MixDescriptor, canSend, isValid bool) {
 	const earlySendSlack = 2 * time.Minute
 
@@ -672,11 +1045,91 @@ func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	return val, nil
 }
 
+// Subscribe registers s to be notified of the PKI document for the current
+// epoch, every time it changes.
+func (p *pki) Subscribe(s glue.DocumentSubscriber) {
+	p.subscribersLock.Lock()
+	defer p.subscribersLock.Unlock()
+	p.docSubscribers = append(p.docSubscribers, s)
+}
+
+func (p *pki) subscribers() []glue.DocumentSubscriber {
+	p.subscribersLock.Lock()
+	defer p.subscribersLock.Unlock()
+	return append([]glue.DocumentSubscriber{}, p.docSubscribers...)
+}
+
+// CurrentDocument returns the PKI document for the current epoch.
+func (p *pki) CurrentDocument() (*cpki.Document, error) {
+	now, _, _, err := p.Now()
+	if err != nil {
+		return nil, err
+	}
+	ent := p.entryForEpoch(now)
+	if ent == nil {
+		return nil, errNotCached
+	}
+	return ent.Document(), nil
+}
+
 func (p *pki) Now() (epoch uint64, ellapsed time.Duration, till time.Duration, err error) {
-	if p.impl == nil {
+	impl := p.backend()
+	if impl == nil {
 		return 0, 0, 0, fmt.Errorf("PKI client uninitialized.")
 	}
-	return epochtime.Now(p.impl)
+	return impl.Now()
+}
+
+func (p *pki) EpochPeriod() time.Duration {
+	return p.backend().Period()
+}
+
+func (p *pki) backend() backend {
+	p.implLock.RLock()
+	defer p.implLock.RUnlock()
+	return p.impl
+}
+
+// pkiConfig returns the directory authority configuration in use, which is
+// replaced by Reconfigure.
+func (p *pki) pkiConfig() *config.PKI {
+	p.implLock.RLock()
+	defer p.implLock.RUnlock()
+	return p.cfg
+}
+
+// Reconfigure replaces the directory authority configuration, allowing
+// the authority keys to be changed without restarting the server.  The
+// type of authority in use can not be changed.
+func (p *pki) Reconfigure(cfg *config.PKI) error {
+	oldCfg := p.pkiConfig()
+	switch {
+	case oldCfg.Katzenmint != nil:
+		return errors.New("pki: the Katzenmint backend can not be reconfigured")
+	case (cfg.Nonvoting != nil) != (oldCfg.Nonvoting != nil),
+		(cfg.VotingAuthority != nil) != (oldCfg.VotingAuthority != nil),
+		(cfg.Katzenmint != nil || cfg.Voting != nil) != (oldCfg.Katzenmint != nil),
+		(cfg.Static != nil) != (oldCfg.Static != nil):
+		return errors.New("pki: the PKI backend type can not be changed")
+	}
+
+	epochPeriod := time.Duration(p.glue.Config().Debug.EpochPeriod) * time.Millisecond
+	impl, err := newBackend(cfg, p.glue.Config().UpstreamProxy, epochPeriod, p.glue.LogBackend())
+	if err != nil {
+		return err
+	}
+
+	p.implLock.Lock()
+	p.impl = impl
+	p.cfg = cfg
+	p.implLock.Unlock()
+	p.log.Noticef("Reconfigured the directory authorities.")
+
+	// Documents that failed to validate may be acceptable now.
+	p.Lock()
+	p.failedFetches = make(map[uint64]error)
+	p.Unlock()
+	return nil
 }
 
 // New reuturns a new pki.
@@ -684,9 +1137,11 @@ func New(glue glue.Glue) (glue.PKI, error) {
 	p := &pki{
 		glue:          glue,
 		log:           glue.LogBackend().GetLogger("pki"),
+		cfg:           glue.Config().PKI,
 		docs:          make(map[uint64]*pkicache.Entry),
 		rawDocs:       make(map[uint64][]byte),
 		failedFetches: make(map[uint64]error),
+		forceUpdateCh: make(chan interface{}, 1), // See ForceUpdate().
 	}
 
 	var err error
@@ -714,26 +1169,10 @@ func New(glue glue.Glue) (glue.PKI, error) {
 		return nil, errors.New("Descriptor address map is zero size.")
 	}
 
-	if glue.Config().PKI.Nonvoting != nil {
-		return nil, fmt.Errorf("non-voting client was not supported in meson")
-	} else {
-		votingCfg := glue.Config().PKI.Voting
-		pkiCfg := &kpki.PKIClientConfig{
-			LogBackend:         glue.LogBackend(),
-			ChainID:            votingCfg.ChainID,
-			TrustOptions:       votingCfg.TrustOptions,
-			PrimaryAddress:     votingCfg.RPCAddress,
-			WitnessesAddresses: votingCfg.WitnessesAddresses,
-			DatabaseName:       votingCfg.DatabaseName,
-			DatabaseDir:        votingCfg.DatabaseDir,
-			RPCAddress:         votingCfg.RPCAddress,
-		}
-		p.impl, err = kpki.NewPKIClient(pkiCfg)
-		if err != nil {
-			return nil, err
-		}
+	epochPeriod := time.Duration(glue.Config().Debug.EpochPeriod) * time.Millisecond
+	if p.impl, err = newBackend(p.cfg, glue.Config().UpstreamProxy, epochPeriod, glue.LogBackend()); err != nil {
+		return nil, err
 	}
-	// TODO: Wire in a real PKI implementation in addition to the test one.
 
 	// Note: This does not start the worker immediately since the worker can
 	// make calls into the connector and crypto workers (on PKI updates),
@@ -776,8 +1215,13 @@ func init() {
 	prometheus.MustRegister(fetchedPKIDocs)
 	prometheus.MustRegister(fetchedPKIDocsDuration)
 	prometheus.MustRegister(failedFetchPKIDocs)
-
-	if WarpedEpoch == "true" {
-		recheckInterval = 5 * time.Second
-	}
+	prometheus.MustRegister(failedPKICacheGeneration)
+	prometheus.MustRegister(invalidPKICache)
+	prometheus.MustRegister(newestPKIDocEpoch)
+	prometheus.MustRegister(fetchPKIDocsConsecutiveFailures)
+	prometheus.MustRegister(pkiDocAge)
+	prometheus.MustRegister(staleConsensusEpochs)
+	prometheus.MustRegister(descriptorUploads)
+	prometheus.MustRegister(descriptorUploadConflicts)
+	prometheus.MustRegister(descriptorUploadFailures)
 }
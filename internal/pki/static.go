@@ -0,0 +1,75 @@
+// static.go - Katzenpost server static PKI document backend.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	cpki "github.com/katzenpost/core/pki"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// staticClient is a cpki.Client that serves a document from a local file,
+// for test networks that do not have a directory authority.
+//
+// If a verifier is provided, the file is a document signed by a non-voting
+// authority, and is only valid for the epoch that it was signed for.
+// Otherwise the file is an unsigned JSON encoded document, that is served
+// for every epoch.
+type staticClient struct {
+	log      *logging.Logger
+	file     string
+	verifier cpki.Client
+}
+
+func (c *staticClient) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	// The file is re-read every time so that it can be updated without
+	// restarting the server.
+	rawDoc, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := c.Deserialize(rawDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.verifier == nil {
+		d.Epoch = epoch
+	} else if d.Epoch != epoch {
+		return nil, nil, cpki.ErrNoDocument
+	}
+	return d, rawDoc, nil
+}
+
+func (c *staticClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
+	c.log.Debugf("Static PKI document in use, not posting descriptor for epoch: %v", epoch)
+	return nil
+}
+
+func (c *staticClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	if c.verifier != nil {
+		return c.verifier.Deserialize(raw)
+	}
+	d := new(cpki.Document)
+	if err := json.Unmarshal(raw, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,92 @@
+// validate.go - Katzenpost server PKI document validation.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+
+	"github.com/hashcloak/Meson-server/config"
+	cpki "github.com/katzenpost/core/pki"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+)
+
+// documentOddities returns the list of things that are wrong with a
+// document, that are not fatal to the server's operation.
+//
+// Note: Unknown fields are handled by the PKI backend's decoder, and never
+// reach this point.
+func documentOddities(d *cpki.Document) []error {
+	var errs []error
+
+	if d.Mu == 0 || d.MuMaxDelay == 0 {
+		errs = append(errs, fmt.Errorf("missing Mu parameters"))
+	}
+	if d.LambdaP == 0 || d.LambdaL == 0 || d.LambdaD == 0 || d.LambdaM == 0 {
+		errs = append(errs, fmt.Errorf("missing Lambda parameters"))
+	}
+	if d.SendRatePerMinute == 0 {
+		errs = append(errs, fmt.Errorf("missing SendRatePerMinute"))
+	}
+	if len(d.Providers) == 0 {
+		errs = append(errs, fmt.Errorf("no providers"))
+	}
+
+	seen := make(map[[sConstants.NodeIDLength]byte]bool)
+	checkDesc := func(desc *cpki.MixDescriptor) {
+		nodeID := desc.IdentityKey.ByteArray()
+		if seen[nodeID] {
+			errs = append(errs, fmt.Errorf("duplicate descriptor: %v", desc.Name))
+		}
+		seen[nodeID] = true
+		if len(desc.Addresses) == 0 {
+			errs = append(errs, fmt.Errorf("descriptor has no addresses: %v", desc.Name))
+		}
+	}
+	for layer, nodes := range d.Topology {
+		if len(nodes) == 0 {
+			errs = append(errs, fmt.Errorf("empty topology layer: %v", layer))
+		}
+		for _, desc := range nodes {
+			checkDesc(desc)
+		}
+	}
+	for _, desc := range d.Providers {
+		checkDesc(desc)
+	}
+
+	return errs
+}
+
+func (p *pki) validateDocument(d *cpki.Document) error {
+	errs := documentOddities(d)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	isStrict := p.pkiConfig().Validation == config.ValidationStrict
+	for _, err := range errs {
+		if isStrict {
+			p.log.Errorf("PKI document for epoch %v: %v", d.Epoch, err)
+		} else {
+			p.log.Warningf("PKI document for epoch %v: %v", d.Epoch, err)
+		}
+	}
+	if isStrict {
+		return fmt.Errorf("document failed strict validation (%v errors)", len(errs))
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+// alias.go - Katzenpost server recipient aliases.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hashcloak/Meson-server/internal/packet"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+const aliasesBucket = "aliases"
+
+var errAliasesDisabled = errors.New("provider: recipient aliases are disabled")
+
+// aliasDB maps recipient aliases to the recipient that owns them, either a
+// user or a Kaetzchen endpoint.  The aliases are cached in memory, since
+// every packet is checked against them.
+type aliasDB struct {
+	sync.RWMutex
+
+	db      *bolt.DB
+	aliases map[[sConstants.RecipientIDLength]byte][]byte
+}
+
+func aliasKey(alias []byte) [sConstants.RecipientIDLength]byte {
+	var k [sConstants.RecipientIDLength]byte
+	copy(k[:], alias)
+	return k
+}
+
+func (a *aliasDB) resolve(alias []byte) ([]byte, bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	target, ok := a.aliases[aliasKey(alias)]
+	return target, ok
+}
+
+func (a *aliasDB) add(alias, target []byte) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if err := a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(aliasesBucket)).Put(alias, target)
+	}); err != nil {
+		return err
+	}
+	a.aliases[aliasKey(alias)] = append([]byte{}, target...)
+	return nil
+}
+
+// remove removes the aliases for which fn returns true.
+func (a *aliasDB) remove(fn func(alias, target []byte) bool) error {
+	a.Lock()
+	defer a.Unlock()
+
+	var removed [][]byte
+	if err := a.db.Update(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(aliasesBucket)).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if !fn(k, v) {
+				continue
+			}
+			removed = append(removed, append([]byte{}, k...))
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, alias := range removed {
+		delete(a.aliases, aliasKey(alias))
+	}
+	return nil
+}
+
+// list returns the aliases of the target, sorted.
+func (a *aliasDB) list(target []byte) []string {
+	a.RLock()
+	defer a.RUnlock()
+
+	var aliases []string
+	for k, v := range a.aliases {
+		if bytes.Equal(v, target) {
+			aliases = append(aliases, string(bytes.TrimRight(k[:], "\x00")))
+		}
+	}
+	sort.Strings(aliases)
+	return aliases
+}
+
+func (a *aliasDB) close() {
+	_ = a.db.Sync()
+	a.db.Close()
+}
+
+func newAliasDB(f string) (*aliasDB, error) {
+	db, err := bolt.Open(f, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aliasDB{
+		db:      db,
+		aliases: make(map[[sConstants.RecipientIDLength]byte][]byte),
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(aliasesBucket))
+		if err != nil {
+			return err
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			a.aliases[aliasKey(k)] = append([]byte{}, v...)
+			return nil
+		})
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// resolveAlias rewrites the recipient of a packet addressed to an alias to
+// the alias' owner.
+func (p *provider) resolveAlias(pkt *packet.Packet) {
+	if p.aliases == nil {
+		return
+	}
+
+	alias, err := p.fixupRecipient(pkt.Recipient.ID[:])
+	if err != nil {
+		return
+	}
+	if target, ok := p.aliases.resolve(alias); ok {
+		p.log.Debugf("Packet: %v (Alias: '%v' -> '%v')", pkt.ID, utils.ASCIIBytesToPrintString(alias), utils.ASCIIBytesToPrintString(target))
+		pkt.Recipient.ID = aliasKey(target)
+	}
+}
+
+// isRecipient returns true iff the recipient is a user or Kaetzchen.
+func (p *provider) isRecipient(recipient []byte) bool {
+	id := aliasKey(recipient)
+	return p.userDB.Exists(recipient) || p.kaetzchenWorker.IsKaetzchen(id) || p.cborPluginKaetzchenWorker.IsKaetzchen(id)
+}
+
+func (p *provider) onAddAlias(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.aliases == nil {
+		c.Log().Errorf("ADD_ALIAS: %v", errAliasesDisabled)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 3 {
+		c.Log().Debugf("ADD_ALIAS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	alias, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil || len(alias) == 0 || len(alias) > sConstants.RecipientIDLength {
+		c.Log().Errorf("ADD_ALIAS invalid alias: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Kaetzchen endpoints are used verbatim, users are normalized.
+	target := []byte(sp[2])
+	if !p.isRecipient(target) {
+		if target, err = p.fixupUserNameCase(target); err != nil || !p.userDB.Exists(target) {
+			c.Log().Errorf("ADD_ALIAS invalid target: '%v'", sp[2])
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
+
+	// Aliases can't shadow other recipients, or be chained.
+	if _, ok := p.aliases.resolve(alias); ok || p.isRecipient(alias) {
+		c.Log().Errorf("ADD_ALIAS alias is already a recipient: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	if err = p.aliases.add(alias, target); err != nil {
+		c.Log().Errorf("Failed to add alias '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onRemoveAlias(c *thwack.Conn, l string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.aliases == nil {
+		c.Log().Errorf("REMOVE_ALIAS: %v", errAliasesDisabled)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("REMOVE_ALIAS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	alias, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("REMOVE_ALIAS invalid alias: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if _, ok := p.aliases.resolve(alias); !ok {
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if err = p.aliases.remove(func(k, v []byte) bool { return bytes.Equal(k, alias) }); err != nil {
+		c.Log().Errorf("Failed to remove alias '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (p *provider) onAliases(c *thwack.Conn, l string) error {
+	if p.aliases == nil {
+		c.Log().Errorf("ALIASES: %v", errAliasesDisabled)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("ALIASES invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	target := []byte(sp[1])
+	if !p.isRecipient(target) {
+		var err error
+		if target, err = p.fixupUserNameCase(target); err != nil {
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+	}
+	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, strings.Join(p.aliases.list(target), " "))
+}
+
+// removeUserAliases removes the aliases owned by a user that is being
+// removed.
+func (p *provider) removeUserAliases(u []byte) error {
+	if p.aliases == nil {
+		return nil
+	}
+	return p.aliases.remove(func(k, v []byte) bool { return bytes.Equal(v, u) })
+}
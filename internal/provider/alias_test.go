@@ -0,0 +1,158 @@
+// alias_test.go - Katzenpost server recipient alias tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/thwack"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestManagement serves the management commands registered by register
+// on a unix socket in dir, and returns a function sending a command and
+// returning the reply, and a function stopping the server.
+func newTestManagement(t *testing.T, p *provider, dir string, register func(*thwack.Server)) (func(string) string, func()) {
+	require := require.New(t)
+
+	s, err := thwack.New(&thwack.Config{
+		Net:         "unix",
+		Addr:        filepath.Join(dir, "management_sock"),
+		ServiceName: "test",
+		LogModule:   "mgmt",
+		NewLoggerFn: p.glue.LogBackend().GetLogger,
+	})
+	require.NoError(err)
+	register(s)
+	require.NoError(s.Start())
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "management_sock"))
+	require.NoError(err)
+	require.NoError(conn.SetDeadline(time.Now().Add(10 * time.Second)))
+	c := textproto.NewConn(conn)
+
+	// Skip the greeting.
+	_, err = c.ReadLine()
+	require.NoError(err)
+
+	return func(cmd string) string {
+			require.NoError(c.PrintfLine("%v", cmd))
+			l, err := c.ReadLine()
+			require.NoError(err)
+			return l
+		}, func() {
+			c.Close()
+			s.Halt()
+		}
+}
+
+func isStatus(status int, l string) bool {
+	return strings.HasPrefix(l, fmt.Sprintf("%v ", status)) || l == fmt.Sprintf("%v", status)
+}
+
+func TestAliasDB(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "aliases")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	a, err := newAliasDB(filepath.Join(dir, "aliases.db"))
+	require.NoError(err)
+	require.NoError(a.add([]byte("al"), []byte("alice")))
+	require.NoError(a.add([]byte("ali"), []byte("alice")))
+	require.NoError(a.add([]byte("b"), []byte("bob")))
+
+	target, ok := a.resolve([]byte("al"))
+	require.True(ok)
+	require.Equal([]byte("alice"), target)
+	_, ok = a.resolve([]byte("alice"))
+	require.False(ok)
+	require.Equal([]string{"al", "ali"}, a.list([]byte("alice")))
+
+	// The aliases persist.
+	require.NoError(a.remove(func(k, v []byte) bool { return string(k) == "ali" }))
+	a.close()
+	a, err = newAliasDB(filepath.Join(dir, "aliases.db"))
+	require.NoError(err)
+	defer a.close()
+	require.Equal([]string{"al"}, a.list([]byte("alice")))
+	require.Equal([]string{"b"}, a.list([]byte("bob")))
+}
+
+func TestAddAlias(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "aliases")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	p := newTestProvider(t)
+	udb := p.userDB.(*testUserDB)
+	udb.users["alice"] = true
+	udb.users["bob"] = true
+
+	// Aliases are disabled without an alias database.
+	cmd, halt := newTestManagement(t, p, dir, func(s *thwack.Server) {
+		s.RegisterCommand("ADD_ALIAS", p.onAddAlias)
+		s.RegisterCommand("REMOVE_ALIAS", p.onRemoveAlias)
+		s.RegisterCommand("ALIASES", p.onAliases)
+	})
+	defer halt()
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("ADD_ALIAS al alice")))
+
+	p.aliases, err = newAliasDB(filepath.Join(dir, "aliases.db"))
+	require.NoError(err)
+	defer p.aliases.close()
+
+	require.True(isStatus(thwack.StatusSyntaxError, cmd("ADD_ALIAS al")))
+	require.True(isStatus(thwack.StatusOk, cmd("ADD_ALIAS Al Alice")), "aliases and users are normalized")
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("ADD_ALIAS carl carol")), "unknown target")
+
+	// Aliases can't shadow users or other aliases, or be chained.
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("ADD_ALIAS bob alice")))
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("ADD_ALIAS al bob")))
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("ADD_ALIAS a2 al")))
+	require.Equal(fmt.Sprintf("%v al", thwack.StatusOk), cmd("ALIASES alice"))
+
+	// Packets to an alias are delivered to its owner.
+	pkt := &packet.Packet{Recipient: new(commands.Recipient)}
+	copy(pkt.Recipient.ID[:], "AL")
+	p.resolveAlias(pkt)
+	require.Equal(aliasKey([]byte("alice")), pkt.Recipient.ID)
+	copy(pkt.Recipient.ID[:], "bob")
+	p.resolveAlias(pkt)
+	require.Equal(aliasKey([]byte("bob")), pkt.Recipient.ID)
+
+	// Removing an alias frees it, as does removing its owner.
+	require.True(isStatus(thwack.StatusOk, cmd("REMOVE_ALIAS al")))
+	require.True(isStatus(thwack.StatusTransactionFailed, cmd("REMOVE_ALIAS al")))
+	require.True(isStatus(thwack.StatusOk, cmd("ADD_ALIAS al bob")))
+	require.NoError(p.removeUserAliases([]byte("bob")))
+	_, ok := p.aliases.resolve([]byte("al"))
+	require.False(ok)
+}
@@ -0,0 +1,172 @@
+// acl.go - Kaetzchen access control lists.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/crypto/ecdh"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	aclEnvelopeVersion = 0
+	aclMACContext      = "meson-service-acl-v0"
+	aclAnyUser         = "*"
+)
+
+var (
+	errACLMalformed = errors.New("malformed authentication envelope")
+	errACLDenied    = errors.New("user is not allowed")
+	errACLAuth      = errors.New("authentication failed")
+
+	aclRejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_acl_rejected_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests per service rejected by the access control list",
+		},
+		[]string{"capability"},
+	)
+)
+
+type serviceACL struct {
+	anyUser bool
+	users   map[string]bool
+}
+
+// aclTable holds the access control lists of the Kaetzchen endpoints.
+//
+// The sender of a request is not visible to the Provider, so requests to
+// restricted endpoints are wrapped in an envelope authenticated with the
+// user's link key:
+//
+//	version (1 byte) | user length (1 byte) | user |
+//	payload length (4 bytes, big endian) | HMAC-SHA256 (32 bytes) | payload
+//
+// The MAC is keyed with the ECDH shared secret of the user's link key and
+// the Provider's link key, and covers the context string, the endpoint,
+// the user and the payload, each followed by a NUL byte.
+type aclTable struct {
+	sync.RWMutex
+
+	acls map[[sConstants.RecipientIDLength]byte]*serviceACL
+}
+
+// setACL sets the users allowed to make requests to the endpoint.  An empty
+// list of users removes the restriction.
+func (t *aclTable) setACL(glue glue.Glue, endpoint [sConstants.RecipientIDLength]byte, users []string) error {
+	var acl *serviceACL
+	if len(users) > 0 {
+		acl = &serviceACL{users: make(map[string]bool)}
+		for _, u := range users {
+			if u == aclAnyUser {
+				acl.anyUser = true
+				continue
+			}
+			user, err := fixupUserName(glue.Config().Provider, u)
+			if err != nil {
+				return fmt.Errorf("provider: Kaetzchen: invalid AllowedUsers entry '%v': %v", u, err)
+			}
+			acl.users[string(user)] = true
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.acls == nil {
+		t.acls = make(map[[sConstants.RecipientIDLength]byte]*serviceACL)
+	}
+	if acl == nil {
+		delete(t.acls, endpoint)
+	} else {
+		t.acls[endpoint] = acl
+	}
+	return nil
+}
+
+// check enforces the endpoint's access control list, and returns the
+// request payload without the authentication envelope, and the
+// authenticated user, which is empty for unrestricted endpoints.
+func (t *aclTable) check(glue glue.Glue, endpoint [sConstants.RecipientIDLength]byte, ct []byte) ([]byte, string, error) {
+	t.RLock()
+	acl, ok := t.acls[endpoint]
+	t.RUnlock()
+	if !ok {
+		return ct, "", nil
+	}
+
+	// Parse the envelope.
+	if len(ct) < 2 || ct[0] != aclEnvelopeVersion {
+		return nil, "", errACLMalformed
+	}
+	userLen := int(ct[1])
+	b := ct[2:]
+	if len(b) < userLen+4+sha256.Size {
+		return nil, "", errACLMalformed
+	}
+	rawUser, b := b[:userLen], b[userLen:]
+	payloadLen := binary.BigEndian.Uint32(b[:4])
+	mac, b := b[4:4+sha256.Size], b[4+sha256.Size:]
+	if uint64(payloadLen) > uint64(len(b)) {
+		return nil, "", errACLMalformed
+	}
+	payload := b[:payloadLen]
+
+	user, err := fixupUserName(glue.Config().Provider, string(rawUser))
+	if err != nil {
+		return nil, "", errACLMalformed
+	}
+	if !acl.anyUser && !acl.users[string(user)] {
+		return nil, "", errACLDenied
+	}
+	linkKey, err := glue.Provider().UserDB().Link(user)
+	if err != nil {
+		return nil, "", errACLDenied
+	}
+	if !hmac.Equal(mac, aclMAC(glue, linkKey, endpoint, rawUser, payload)) {
+		return nil, "", errACLAuth
+	}
+	return payload, string(user), nil
+}
+
+func aclMAC(glue glue.Glue, linkKey *ecdh.PublicKey, endpoint [sConstants.RecipientIDLength]byte, user, payload []byte) []byte {
+	var sharedSecret [ecdh.GroupElementLength]byte
+	glue.LinkKey().Exp(&sharedSecret, linkKey)
+
+	m := hmac.New(sha256.New, sharedSecret[:])
+	for _, v := range [][]byte{[]byte(aclMACContext), bytes.TrimRight(endpoint[:], "\x00"), user, payload} {
+		_, _ = m.Write(v)
+		_, _ = m.Write([]byte{0x00})
+	}
+	return m.Sum(nil)
+}
+
+func init() {
+	prometheus.MustRegister(aclRejectedRequests)
+}
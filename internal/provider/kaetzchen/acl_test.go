@@ -0,0 +1,108 @@
+// acl_test.go - Kaetzchen access control list tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+// aclEnvelope returns the authentication envelope of a request, with the
+// payload length overridden if payloadLen is not negative.
+func aclEnvelope(user string, payloadLen int, mac, payload []byte) []byte {
+	if payloadLen < 0 {
+		payloadLen = len(payload)
+	}
+	b := []byte{aclEnvelopeVersion, byte(len(user))}
+	b = append(b, user...)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(payloadLen))
+	b = append(b, l[:]...)
+	b = append(b, mac...)
+	return append(b, payload...)
+}
+
+func TestACLCheck(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	userKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	goo := getGlue(logBackend, &mockProvider{userName: "alice", userKey: userKey.PublicKey()}, linkKey, nil)
+
+	var restricted, open, anyUser [sConstants.RecipientIDLength]byte
+	copy(restricted[:], "+echo")
+	copy(open[:], "+meow")
+	copy(anyUser[:], "+woof")
+
+	var acls aclTable
+	require.NoError(acls.setACL(goo, restricted, []string{"Alice"}))
+	require.NoError(acls.setACL(goo, anyUser, []string{aclAnyUser}))
+	require.Error(acls.setACL(goo, restricted, []string{""}), "invalid user")
+
+	payload := []byte("hello")
+	macFor := func(endpoint [sConstants.RecipientIDLength]byte, user string) []byte {
+		return aclMAC(goo, userKey.PublicKey(), endpoint, []byte(user), payload)
+	}
+	valid := aclEnvelope("alice", -1, macFor(restricted, "alice"), payload)
+
+	for _, v := range []struct {
+		name     string
+		endpoint [sConstants.RecipientIDLength]byte
+		ct       []byte
+		user     string
+		err      error
+	}{
+		{"unrestricted", open, payload, "", nil},
+		{"valid", restricted, valid, "alice", nil},
+		{"trailing padding", restricted, append(append([]byte{}, valid...), 0, 0, 0), "alice", nil},
+		{"case mapped user", restricted, aclEnvelope("ALICE", -1, macFor(restricted, "ALICE"), payload), "alice", nil},
+		{"empty", restricted, nil, "", errACLMalformed},
+		{"bad version", restricted, append([]byte{0xff}, valid[1:]...), "", errACLMalformed},
+		{"truncated user", restricted, valid[:4], "", errACLMalformed},
+		{"truncated MAC", restricted, valid[:2+5+4+10], "", errACLMalformed},
+		{"payload length past the buffer", restricted, aclEnvelope("alice", len(payload)+1, macFor(restricted, "alice"), payload), "", errACLMalformed},
+		{"invalid user", restricted, aclEnvelope("", -1, macFor(restricted, ""), payload), "", errACLMalformed},
+		{"wrong MAC", restricted, aclEnvelope("alice", -1, make([]byte, 32), payload), "", errACLAuth},
+		{"MAC for another endpoint", restricted, aclEnvelope("alice", -1, macFor(anyUser, "alice"), payload), "", errACLAuth},
+		{"unlisted user", restricted, aclEnvelope("bob", -1, macFor(restricted, "bob"), payload), "", errACLDenied},
+		{"any user", anyUser, aclEnvelope("bob", -1, macFor(anyUser, "bob"), payload), "bob", nil},
+	} {
+		ct, user, err := acls.check(goo, v.endpoint, v.ct)
+		require.Equal(v.err, err, v.name)
+		require.Equal(v.user, user, v.name)
+		if err == nil {
+			require.Equal(payload, ct, v.name)
+		}
+	}
+
+	// Removing the list lifts the restriction.
+	require.NoError(acls.setACL(goo, restricted, nil))
+	ct, user, err := acls.check(goo, restricted, payload)
+	require.NoError(err)
+	require.Equal("", user)
+	require.Equal(payload, ct)
+}
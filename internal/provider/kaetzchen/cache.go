@@ -0,0 +1,169 @@
+// cache.go - Kaetzchen reply caching.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxCachedReplies bounds the number of replies cached per endpoint.
+const maxCachedReplies = 4096
+
+var (
+	cacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "cache_hits_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests answered from the reply cache",
+		},
+		[]string{"capability"},
+	)
+	cacheMisses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "cache_misses_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of cacheable Kaetzchen requests not in the reply cache",
+		},
+		[]string{"capability"},
+	)
+)
+
+type cachedReply struct {
+	reply   []byte
+	expires time.Time
+}
+
+type endpointCache struct {
+	ttl     time.Duration
+	replies map[[sha256.Size]byte]*cachedReply
+}
+
+// replyCache caches the replies of Kaetzchen endpoints answering read-only
+// queries, keyed by the hash of the request, so that bursts of identical
+// queries do not all reach the service.
+type replyCache struct {
+	sync.Mutex
+
+	endpoints map[[sConstants.RecipientIDLength]byte]*endpointCache
+}
+
+// setTTL sets how long the replies of an endpoint are cached for, in
+// seconds.  A ttl of 0 disables caching for the endpoint.
+func (c *replyCache) setTTL(endpoint [sConstants.RecipientIDLength]byte, ttl uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.endpoints == nil {
+		c.endpoints = make(map[[sConstants.RecipientIDLength]byte]*endpointCache)
+	}
+	if ttl == 0 {
+		delete(c.endpoints, endpoint)
+		return
+	}
+	c.endpoints[endpoint] = &endpointCache{
+		ttl:     time.Duration(ttl) * time.Second,
+		replies: make(map[[sha256.Size]byte]*cachedReply),
+	}
+}
+
+// cacheKey returns the cache key of a request made by user.  The SURB count
+// is part of the request, since it bounds the size of the reply, and so is
+// the user, since the reply may depend on who asked.
+func cacheKey(user string, payload []byte, nrSURBs int) [sha256.Size]byte {
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(nrSURBs))
+	binary.BigEndian.PutUint32(n[4:], uint32(len(user)))
+	h := sha256.New()
+	_, _ = h.Write(n[:])
+	_, _ = h.Write([]byte(user))
+	_, _ = h.Write(payload)
+
+	var k [sha256.Size]byte
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+// enabled returns true iff replies of the endpoint are cached.
+func (c *replyCache) enabled(endpoint [sConstants.RecipientIDLength]byte) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.endpoints[endpoint]
+	return ok
+}
+
+// get returns the cached reply to a request, if any.
+func (c *replyCache) get(endpoint [sConstants.RecipientIDLength]byte, key [sha256.Size]byte) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	ec, ok := c.endpoints[endpoint]
+	if !ok {
+		return nil, false
+	}
+	r, ok := ec.replies[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(r.expires) {
+		delete(ec.replies, key)
+		return nil, false
+	}
+	return r.reply, true
+}
+
+// put caches the reply to a request.
+func (c *replyCache) put(endpoint [sConstants.RecipientIDLength]byte, key [sha256.Size]byte, reply []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	ec, ok := c.endpoints[endpoint]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if len(ec.replies) >= maxCachedReplies {
+		for k, r := range ec.replies {
+			if now.After(r.expires) {
+				delete(ec.replies, k)
+			}
+		}
+		if len(ec.replies) >= maxCachedReplies {
+			// Still full of live replies, start over rather than tracking
+			// the age of every entry.
+			ec.replies = make(map[[sha256.Size]byte]*cachedReply)
+		}
+	}
+	ec.replies[key] = &cachedReply{
+		reply:   reply,
+		expires: now.Add(ec.ttl),
+	}
+}
+
+func init() {
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+}
@@ -0,0 +1,103 @@
+// cache_test.go - Kaetzchen reply cache tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyCache(t *testing.T) {
+	require := require.New(t)
+
+	var ep, other [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+price")
+	copy(other[:], "+echo")
+
+	var c replyCache
+	c.setTTL(ep, 10)
+	require.True(c.enabled(ep))
+	require.False(c.enabled(other))
+
+	// The SURB count and the user are part of the key.
+	key := cacheKey("alice", []byte("BTC"), 1)
+	require.NotEqual(key, cacheKey("alice", []byte("BTC"), 2))
+	require.NotEqual(key, cacheKey("alice", []byte("ETH"), 1))
+	require.NotEqual(key, cacheKey("bob", []byte("BTC"), 1))
+	require.NotEqual(cacheKey("a", []byte("bc"), 1), cacheKey("ab", []byte("c"), 1))
+
+	_, ok := c.get(ep, key)
+	require.False(ok)
+	c.put(ep, key, []byte("42"))
+	reply, ok := c.get(ep, key)
+	require.True(ok)
+	require.Equal([]byte("42"), reply)
+	_, ok = c.get(ep, cacheKey("alice", []byte("BTC"), 2))
+	require.False(ok)
+
+	// Replies of endpoints without a TTL are not cached.
+	c.put(other, key, []byte("42"))
+	_, ok = c.get(other, key)
+	require.False(ok)
+
+	// Expired replies are discarded.
+	c.endpoints[ep].replies[key].expires = time.Now().Add(-time.Second)
+	_, ok = c.get(ep, key)
+	require.False(ok)
+	require.Empty(c.endpoints[ep].replies)
+
+	// Removing the TTL disables the cache.
+	c.put(ep, key, []byte("42"))
+	c.setTTL(ep, 0)
+	require.False(c.enabled(ep))
+	_, ok = c.get(ep, key)
+	require.False(ok)
+}
+
+func TestReplyCacheBounded(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+price")
+
+	var c replyCache
+	c.setTTL(ep, 10)
+	var b [8]byte
+	for i := 0; i < maxCachedReplies; i++ {
+		binary.BigEndian.PutUint64(b[:], uint64(i))
+		c.put(ep, cacheKey("alice", b[:], 1), b[:])
+	}
+	require.Len(c.endpoints[ep].replies, maxCachedReplies)
+
+	// Expired replies are evicted first.
+	first := cacheKey("alice", make([]byte, 8), 1)
+	c.endpoints[ep].replies[first].expires = time.Now().Add(-time.Second)
+	c.put(ep, cacheKey("alice", []byte("new"), 1), []byte("new"))
+	require.Len(c.endpoints[ep].replies, maxCachedReplies)
+	_, ok := c.get(ep, cacheKey("alice", []byte("new"), 1))
+	require.True(ok)
+
+	// The cache starts over when full of live replies.
+	c.put(ep, cacheKey("alice", []byte("newer"), 1), []byte("newer"))
+	require.Len(c.endpoints[ep].replies, 1)
+	_, ok = c.get(ep, cacheKey("alice", []byte("newer"), 1))
+	require.True(ok)
+}
@@ -19,16 +19,25 @@
 package kaetzchen
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashcloak/Meson-server/cborplugin"
+	"github.com/hashcloak/Meson-server/config"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/hashcloak/Meson-server/internal/pkicache"
+	"github.com/hashcloak/Meson-server/userdb/externuserdb"
 	"github.com/katzenpost/core/monotime"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/worker"
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/text/secure/precis"
@@ -57,226 +66,677 @@ type CBORPluginWorker struct {
 	sync.Mutex
 	worker.Worker
 
-	glue glue.Glue
-	log  *logging.Logger
+	requestPipeline
 
 	haltOnce    sync.Once
 	pluginChans PluginChans
-	clients     []*cborplugin.Client
+	plugins     []*pluginInstance
+	reserved    map[string][sConstants.RecipientIDLength]byte
+	inFlight    int64
+
+	// advertised is the last set of plugin parameters published in the
+	// descriptor.
+	advertised ServiceMap
+
+	// cfgs is the plugin configuration, which is replaced by Reconfigure.
+	cfgs []*config.CBORPluginKaetzchen
 }
 
 // OnKaetzchen enqueues the pkt for processing by our thread pool of plugins.
 func (k *CBORPluginWorker) OnKaetzchen(pkt *packet.Packet) {
+	k.Lock()
+	defer k.Unlock()
+
 	handlerCh, ok := k.pluginChans[pkt.Recipient.ID]
 	if !ok {
 		k.log.Debugf("Failed to find handler. Dropping Kaetzchen request: %v", pkt.ID)
+		pkt.Dispose()
+		return
+	}
+	capa := k.capabilityOf(pkt.Recipient.ID)
+	if !k.limiter.allow(pkt.Recipient.ID) {
+		onRateLimited(k.log, pkt, capa)
+		return
+	}
+	if isQueueFull(k.glue, handlerCh) {
+		onQueueFull(k.log, pkt, capa)
 		return
 	}
 	handlerCh.In() <- pkt
+	queueLength.With(queueLabels(capa)).Set(float64(handlerCh.Len()))
+}
+
+// capabilityOf returns the capability of the plugin serving the endpoint.
+// It must be called with the lock held.
+func (k *CBORPluginWorker) capabilityOf(endpoint [sConstants.RecipientIDLength]byte) string {
+	for _, inst := range k.plugins {
+		if inst.cfg.Endpoint == string(bytes.TrimRight(endpoint[:], "\x00")) {
+			return inst.cfg.Capability
+		}
+	}
+	return "unknown"
 }
 
-func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte, pluginClient cborplugin.ServicePlugin) {
+func (k *CBORPluginWorker) worker(handlerCh *channels.InfiniteChannel, inst *pluginInstance) {
 
 	// Kaetzchen delay is our max dwell time.
 	maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
 
-	defer k.haltOnce.Do(k.haltAllClients)
-
-	handlerCh, ok := k.pluginChans[recipient]
-	if !ok {
-		k.log.Debugf("Failed to find handler. Dropping Kaetzchen request: %v", recipient)
-		kaetzchenRequestsDropped.Inc()
-		return
-	}
 	ch := handlerCh.Out()
 
 	for {
+		// Leave the requests to the other instances of the plugin while
+		// this one is down, till the supervisor restarts it.
+		pluginClient := inst.getClient()
+		if !isClientUp(pluginClient) {
+			select {
+			case <-k.HaltCh():
+				k.log.Debugf("Terminating gracefully.")
+				k.haltOnce.Do(k.haltAllClients)
+				return
+			case <-inst.haltCh:
+				return
+			case <-time.After(pluginDownPollInterval):
+			}
+			continue
+		}
+
 		var pkt *packet.Packet
 		select {
 		case <-k.HaltCh():
 			k.log.Debugf("Terminating gracefully.")
+			k.haltOnce.Do(k.haltAllClients)
 			return
-		case e := <-ch:
+		case <-inst.haltCh:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				// The plugin was unloaded.
+				return
+			}
 			pkt = e.(*packet.Packet)
+			queueLength.With(queueLabels(inst.cfg.Capability)).Set(float64(handlerCh.Len()))
 			if dwellTime := monotime.Now() - pkt.DispatchAt; dwellTime > maxDwell {
 				k.log.Debugf("Dropping packet: %v (Spend %v in queue)", pkt.ID, dwellTime)
 				packetsDropped.Inc()
+				serviceRequestsDropped.With(capabilityLabels(inst.cfg.Capability)).Inc()
 				pkt.Dispose()
 				continue
 			}
 		}
 
-		k.processKaetzchen(pkt, pluginClient)
+		// The plugin may have been restarted while waiting for a request.
+		atomic.AddInt64(&k.inFlight, 1)
+		k.processKaetzchen(pkt, inst.getClient(), inst.upstream())
+		atomic.AddInt64(&k.inFlight, -1)
 		kaetzchenRequests.Inc()
 	}
 }
 
+// Queues returns the number of requests waiting to be dispatched by plugin
+// capability, and the number of requests being processed by the plugins.
+func (k *CBORPluginWorker) Queues() (map[string]int, int) {
+	k.Lock()
+	defer k.Unlock()
+
+	queues := make(map[string]int)
+	for endpoint, ch := range k.pluginChans {
+		queues[k.capabilityOf(endpoint)] = ch.Len()
+	}
+	return queues, int(atomic.LoadInt64(&k.inFlight))
+}
+
+// haltAllClients stops all the plugin clients, after letting their
+// in-flight requests complete.
 func (k *CBORPluginWorker) haltAllClients() {
 	k.log.Debug("Halting plugin clients.")
-	for _, client := range k.clients {
-		go client.Halt()
+	var wg sync.WaitGroup
+	for _, client := range k.clients() {
+		client := client
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.Shutdown(k.drainTimeout())
+		}()
 	}
+	wg.Wait()
 }
 
-func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cborplugin.ServicePlugin) {
-	kaetzchenRequestsTimer = prometheus.NewTimer(kaetzchenRequestsDuration)
-	defer kaetzchenRequestsTimer.ObserveDuration()
-	defer pkt.Dispose()
+// drainTimeout returns the maximum time to wait for the in-flight requests
+// of a plugin when stopping it.
+func (k *CBORPluginWorker) drainTimeout() time.Duration {
+	return time.Duration(k.glue.Config().Debug.KaetzchenDrainTimeout) * time.Millisecond
+}
 
-	ct, surb, err := packet.ParseForwardPacket(pkt)
-	if err != nil {
-		k.log.Debugf("Dropping Kaetzchen request: %v (%v)", pkt.ID, err)
-		kaetzchenRequestsDropped.Inc()
-		return
-	}
+// instances returns a snapshot of the plugin instances.
+func (k *CBORPluginWorker) instances() []*pluginInstance {
+	k.Lock()
+	defer k.Unlock()
+	return append([]*pluginInstance{}, k.plugins...)
+}
 
-	resp, err := pluginClient.OnRequest(&cborplugin.Request{
-		ID:      pkt.ID,
-		Payload: ct,
-		HasSURB: surb != nil,
-	})
-	switch err {
-	case nil:
-	case ErrNoResponse:
-		k.log.Debugf("Processed Kaetzchen request: %v (No response)", pkt.ID)
-		kaetzchenRequests.Inc()
-		return
-	default:
-		k.log.Debugf("Failed to handle Kaetzchen request: %v (%v), response: %s", pkt.ID, err, resp)
-		return
-	}
-	if len(resp) == 0 {
-		k.log.Debugf("No reply from Kaetzchen: %v", pkt.ID)
-		return
+// clients returns the current client of each plugin instance.
+func (k *CBORPluginWorker) clients() []*cborplugin.Client {
+	insts := k.instances()
+	clients := make([]*cborplugin.Client, 0, len(insts))
+	for _, inst := range insts {
+		clients = append(clients, inst.getClient())
 	}
+	return clients
+}
 
-	// Iff there is a SURB, generate a SURB-Reply and schedule.
-	if surb != nil {
-		// Prepend the response header.
-		resp = append([]byte{0x01, 0x00}, resp...)
-
-		respPkt, err := packet.NewPacketFromSURB(pkt, surb, resp)
-		if err != nil {
-			k.log.Debugf("Failed to generate SURB-Reply: %v (%v)", pkt.ID, err)
-			return
+func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cborplugin.ServicePlugin, upstream string) {
+	k.process(pkt, pluginClient.Capability(), upstream, func(payload []byte, surbs [][]byte) ([]byte, time.Duration, error) {
+		resp, err := pluginClient.OnRequest(&cborplugin.Request{
+			ID:        pkt.ID,
+			Payload:   payload,
+			HasSURB:   surbs != nil,
+			SURBCount: len(surbs),
+		})
+		if err == nil && len(resp) == 0 {
+			// The plugins have no way to tell an empty response from no
+			// response.
+			err = ErrNoResponse
 		}
+		return resp, 0, err
+	})
+}
 
-		k.log.Debugf("Handing off newly generated SURB-Reply: %v (Src:%v)", respPkt.ID, pkt.ID)
-		k.glue.Scheduler().OnPacket(respPkt)
+// OnNewDocument sends the PKI document for the current epoch to all of
+// the plugins.
+func (k *CBORPluginWorker) OnNewDocument(ent *pkicache.Entry) {
+	rawDoc, err := k.glue.PKI().GetRawConsensus(ent.Epoch())
+	if err != nil {
+		k.log.Debugf("Failed to get raw PKI document for epoch %v: %v", ent.Epoch(), err)
 		return
 	}
-	k.log.Debugf("No SURB provided: %v", pkt.ID)
+	doc := &cborplugin.Document{
+		Epoch:   ent.Epoch(),
+		Payload: rawDoc,
+	}
+	for _, c := range k.clients() {
+		c := c
+		k.Go(func() {
+			if err := c.OnDocument(doc); err != nil {
+				k.log.Debugf("Failed to send PKI document to plugin %v: %v", c.Capability(), err)
+			}
+		})
+	}
 }
 
 // KaetzchenForPKI returns the plugins Parameters map for publication in the PKI doc.
+//
+// Only the plugins that are running and respond to the parameters query
+// are advertised, so that clients are not directed to services that will
+// silently drop their requests.
 func (k *CBORPluginWorker) KaetzchenForPKI() ServiceMap {
 	s := make(ServiceMap)
-	for _, k := range k.clients {
-		capa := k.Capability()
+	for _, c := range k.clients() {
+		capa := c.Capability()
 		if _, ok := s[capa]; ok {
 			// skip adding twice
 			continue
 		}
+		select {
+		case <-c.HaltCh():
+			continue
+		default:
+		}
+		p := c.GetParameters()
+		if p == nil {
+			continue
+		}
 		params := make(PluginParameters)
-		p := k.GetParameters()
-		if p != nil {
-			for key, value := range *p {
-				params[key] = value
-			}
+		for key, value := range *p {
+			params[key] = value
 		}
 		s[capa] = params
 	}
+	for _, c := range k.clients() {
+		if _, ok := s[c.Capability()]; !ok {
+			k.log.Warningf("Not advertising Kaetzchen plugin '%v', no running instances.", c.Capability())
+		}
+	}
+
+	k.Lock()
+	k.advertised = s
+	k.Unlock()
 	return s
 }
 
 // IsKaetzchen returns true if the given recipient is one of our workers.
 func (k *CBORPluginWorker) IsKaetzchen(recipient [sConstants.RecipientIDLength]byte) bool {
+	k.Lock()
+	defer k.Unlock()
 	_, ok := k.pluginChans[recipient]
 	return ok
 }
 
-func (k *CBORPluginWorker) launch(command, capability, endpoint string, args []string) (*cborplugin.Client, error) {
-	k.log.Debugf("Launching plugin: %s", command)
-	plugin := cborplugin.New(command, capability, endpoint, k.glue.LogBackend())
-	err := plugin.Start(command, args)
+func (k *CBORPluginWorker) launch(cfg *config.CBORPluginKaetzchen, args []string, id int) (*cborplugin.Client, error) {
+	name := cfg.Command
+	if cfg.Remote != nil {
+		name = cfg.Remote.Address
+		k.log.Debugf("Connecting to remote plugin: %s", name)
+	} else {
+		k.log.Debugf("Launching plugin: %s", name)
+	}
+	plugin := cborplugin.New(name, cfg.Capability, cfg.Endpoint, k.glue.LogBackend())
+	plugin.SetOutputLogging(fmt.Sprintf("plugin/%s/%d", cfg.Capability, id), cfg.LogLevel)
+	if r := cfg.Remote; r != nil {
+		remote := &cborplugin.Remote{Address: r.Address}
+		if r.SharedSecret != "" {
+			remote.SharedSecret = []byte(r.SharedSecret)
+		}
+		var err error
+		if remote.TLSConfig, err = externuserdb.LoadTLSConfig(r.CACertificate, r.ClientCertificate, r.ClientKey); err != nil {
+			return nil, fmt.Errorf("provider: Kaetzchen: '%v' failed to load Remote TLS configuration: %v", cfg.Capability, err)
+		}
+		err = plugin.Connect(remote)
+		return plugin, err
+	}
+	if s := cfg.Sandbox; s != nil {
+		plugin.SetSandbox(&cborplugin.Sandbox{
+			WorkingDir:   s.WorkingDir,
+			Chroot:       s.Chroot,
+			Namespaces:   s.Namespaces,
+			MaxMemory:    s.MaxMemory,
+			MaxCPUTime:   s.MaxCPUTime,
+			MaxOpenFiles: s.MaxOpenFiles,
+			MaxProcesses: s.MaxProcesses,
+		})
+	}
+	err := plugin.Start(cfg.Command, args)
 	return plugin, err
 }
 
-// NewCBORPluginWorker returns a new CBORPluginWorker
-func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
+// reserve claims capa and endpoint for a plugin that is being launched, so
+// that concurrent calls to addPlugin, eg: LOAD_PLUGIN and a reload, can't
+// register them twice.  The reservation is released by addPlugin.
+func (k *CBORPluginWorker) reserve(pluginConf *config.CBORPluginKaetzchen, endpoint [sConstants.RecipientIDLength]byte) error {
+	capa := pluginConf.Capability
 
-	kaetzchenWorker := CBORPluginWorker{
-		glue:        glue,
-		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
-		pluginChans: make(PluginChans),
-		clients:     make([]*cborplugin.Client, 0),
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.reserved[capa]; ok {
+		return fmt.Errorf("provider: Kaetzchen '%v' registered more than once", capa)
+	}
+	for _, inst := range k.plugins {
+		if inst.cfg.Capability == capa {
+			return fmt.Errorf("provider: Kaetzchen '%v' registered more than once", capa)
+		}
+	}
+	if _, ok := k.pluginChans[endpoint]; ok {
+		return fmt.Errorf("provider: Kaetzchen: '%v' endpoint '%v' already registered", capa, pluginConf.Endpoint)
+	}
+	for _, ep := range k.reserved {
+		if ep == endpoint {
+			return fmt.Errorf("provider: Kaetzchen: '%v' endpoint '%v' already registered", capa, pluginConf.Endpoint)
+		}
 	}
+	if k.reserved == nil {
+		k.reserved = make(map[string][sConstants.RecipientIDLength]byte)
+	}
+	k.reserved[capa] = endpoint
+	return nil
+}
 
-	capaMap := make(map[string]bool)
+func (k *CBORPluginWorker) release(capa string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.reserved, capa)
+}
 
-	for _, pluginConf := range glue.Config().Provider.CBORPluginKaetzchen {
-		kaetzchenWorker.log.Noticef("Configuring plugin handler for %s", pluginConf.Capability)
+// addPlugin launches the plugin described by pluginConf, and starts
+// dispatching requests to it.
+func (k *CBORPluginWorker) addPlugin(pluginConf *config.CBORPluginKaetzchen) error {
+	// Ensure no duplicates.
+	capa := pluginConf.Capability
+	if capa == "" {
+		return errors.New("kaetzchen plugin capability cannot be empty string")
+	}
+
+	// Sanitize the endpoint.
+	if pluginConf.Endpoint == "" {
+		return fmt.Errorf("provider: Kaetzchen: '%v' provided no endpoint", capa)
+	} else if epNorm, err := precis.UsernameCaseMapped.String(pluginConf.Endpoint); err != nil {
+		return fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint: %v", capa, err)
+	} else if epNorm != pluginConf.Endpoint {
+		return fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint, not normalized", capa)
+	}
+	rawEp := []byte(pluginConf.Endpoint)
+	if len(rawEp) == 0 || len(rawEp) > sConstants.RecipientIDLength {
+		return fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint, length out of bounds", capa)
+	}
+	var endpoint [sConstants.RecipientIDLength]byte
+	copy(endpoint[:], rawEp)
+	if err := k.reserve(pluginConf, endpoint); err != nil {
+		return err
+	}
+	if err := k.acls.setACL(k.glue, endpoint, pluginConf.AllowedUsers); err != nil {
+		k.release(capa)
+		return err
+	}
 
-		// Ensure no duplicates.
-		capa := pluginConf.Capability
-		if capa == "" {
-			return nil, errors.New("kaetzchen plugin capability cannot be empty string")
+	var args []string
+	if len(pluginConf.Config) > 0 {
+		args = []string{}
+		for key, val := range pluginConf.Config {
+			args = append(args, fmt.Sprintf("-%s", key), val.(string))
 		}
-		if pluginConf.Disable {
-			kaetzchenWorker.log.Noticef("Skipping disabled Kaetzchen: '%v'.", capa)
-			continue
+	}
+
+	// Start the plugin clients.
+	insts := make([]*pluginInstance, 0, pluginConf.MaxConcurrency)
+	for i := 0; i < pluginConf.MaxConcurrency; i++ {
+		k.log.Noticef("Starting Kaetzchen plugin client: %s %d", capa, i)
+
+		pluginClient, err := k.launch(pluginConf, args, i)
+		if err != nil {
+			k.log.Errorf("Failed to start a plugin client: %s", err)
+			for _, inst := range insts {
+				go inst.client.Halt()
+			}
+			_ = k.acls.setACL(k.glue, endpoint, nil)
+			k.release(capa)
+			return err
 		}
-		if capaMap[capa] {
-			return nil, fmt.Errorf("provider: Kaetzchen '%v' registered more than once", capa)
+		insts = append(insts, &pluginInstance{
+			cfg:    pluginConf,
+			args:   args,
+			id:     i,
+			client: pluginClient,
+			haltCh: make(chan struct{}),
+		})
+	}
+
+	// Add an infinite channel for this plugin, and accumulate a list of
+	// all plugin instances to facilitate supervision and clean shutdown.
+	handlerCh := channels.NewInfiniteChannel()
+	k.Lock()
+	k.pluginChans[endpoint] = handlerCh
+	k.plugins = append(k.plugins, insts...)
+	delete(k.reserved, capa)
+	k.Unlock()
+	k.limiter.setLimit(endpoint, pluginConf.RateLimit, pluginConf.RateBurst)
+	k.limiter.setUserLimit(endpoint, pluginConf.UserRateLimit, pluginConf.UserRateBurst)
+	k.cache.setTTL(endpoint, pluginConf.CacheTTL)
+	k.dedup.setWindow(endpoint, pluginConf.DedupWindow)
+
+	for _, inst := range insts {
+		inst := inst
+		pluginUp.With(inst.labels()).Set(1)
+		k.Go(func() {
+			k.worker(handlerCh, inst)
+		})
+	}
+
+	return nil
+}
+
+// removePlugin stops and removes all instances of the plugin providing
+// capa, dropping any queued requests.
+func (k *CBORPluginWorker) removePlugin(capa string) error {
+	k.Lock()
+	var removed, kept []*pluginInstance
+	for _, inst := range k.plugins {
+		if inst.cfg.Capability == capa {
+			removed = append(removed, inst)
+		} else {
+			kept = append(kept, inst)
 		}
+	}
+	if len(removed) == 0 {
+		k.Unlock()
+		return fmt.Errorf("provider: Kaetzchen '%v' is not loaded", capa)
+	}
+	k.plugins = kept
+
+	var endpoint [sConstants.RecipientIDLength]byte
+	copy(endpoint[:], removed[0].cfg.Endpoint)
+	handlerCh := k.pluginChans[endpoint]
+	delete(k.pluginChans, endpoint)
+	k.Unlock()
+
+	k.limiter.setLimit(endpoint, 0, 0)
+	k.limiter.setUserLimit(endpoint, 0, 0)
+	k.cache.setTTL(endpoint, 0)
+	k.dedup.setWindow(endpoint, 0)
+	_ = k.acls.setACL(k.glue, endpoint, nil)
+	for _, inst := range removed {
+		close(inst.haltCh)
+		go inst.getClient().Shutdown(k.drainTimeout())
+		pluginUp.Delete(inst.labels())
+	}
+	queueLength.Delete(queueLabels(capa))
+	k.errLog.forget(capa)
 
-		// Sanitize the endpoint.
-		if pluginConf.Endpoint == "" {
-			return nil, fmt.Errorf("provider: Kaetzchen: '%v' provided no endpoint", capa)
-		} else if epNorm, err := precis.UsernameCaseMapped.String(pluginConf.Endpoint); err != nil {
-			return nil, fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint: %v", capa, err)
-		} else if epNorm != pluginConf.Endpoint {
-			return nil, fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint, not normalized", capa)
+	// Dispose of the requests that will never be serviced.
+	handlerCh.Close()
+	for e := range handlerCh.Out() {
+		e.(*packet.Packet).Dispose()
+	}
+
+	k.log.Noticef("Unloaded Kaetzchen plugin '%v'.", capa)
+	return nil
+}
+
+// restartPlugin restarts all instances of the plugin providing capa.
+func (k *CBORPluginWorker) restartPlugin(capa string) error {
+	var found bool
+	for _, inst := range k.instances() {
+		if inst.cfg.Capability != capa {
+			continue
 		}
-		rawEp := []byte(pluginConf.Endpoint)
-		if len(rawEp) == 0 || len(rawEp) > sConstants.RecipientIDLength {
-			return nil, fmt.Errorf("provider: Kaetzchen: '%v' invalid endpoint, length out of bounds", capa)
+		found = true
+		if err := k.restartInstance(inst); err != nil {
+			return err
 		}
+	}
+	if !found {
+		return fmt.Errorf("provider: Kaetzchen '%v' is not loaded", capa)
+	}
+	return nil
+}
 
-		// Add an infinite channel for this plugin.
-		var endpoint [sConstants.RecipientIDLength]byte
-		copy(endpoint[:], rawEp)
-		kaetzchenWorker.pluginChans[endpoint] = channels.NewInfiniteChannel()
-
-		// Start the plugin clients.
-		for i := 0; i < pluginConf.MaxConcurrency; i++ {
-			kaetzchenWorker.log.Noticef("Starting Kaetzchen plugin client: %s %d", capa, i)
-
-			var args []string
-			if len(pluginConf.Config) > 0 {
-				args = []string{}
-				for key, val := range pluginConf.Config {
-					args = append(args, fmt.Sprintf("-%s", key), val.(string))
-				}
-			}
+func (k *CBORPluginWorker) restartInstance(inst *pluginInstance) error {
+	inst.Lock()
+	defer inst.Unlock()
 
-			pluginClient, err := kaetzchenWorker.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args)
-			if err != nil {
-				kaetzchenWorker.log.Error("Failed to start a plugin client: %s", err)
-				return nil, err
-			}
+	go inst.client.Shutdown(k.drainTimeout())
+	c, err := k.launch(inst.cfg, inst.args, inst.id)
+	if err != nil {
+		k.log.Errorf("Failed to restart Kaetzchen plugin '%v' instance %v: %v", inst.cfg.Capability, inst.id, err)
+		k.errLog.record(inst.cfg.Capability, fmt.Errorf("instance %d failed to restart: %v", inst.id, err))
+		return err
+	}
+	inst.client = c
+	inst.totalRestarts++
+	inst.restarts = 0
+	inst.nextStart = time.Time{}
+	pluginRestarts.With(prometheus.Labels{"capability": inst.cfg.Capability}).Inc()
+	k.log.Noticef("Restarted Kaetzchen plugin '%v' instance %v.", inst.cfg.Capability, inst.id)
+	return nil
+}
+
+// configs returns the current plugin configuration, which must not be
+// modified.
+func (k *CBORPluginWorker) configs() []*config.CBORPluginKaetzchen {
+	k.Lock()
+	defer k.Unlock()
+	return k.cfgs
+}
 
-			// Accumulate a list of all clients to facilitate clean shutdown.
-			kaetzchenWorker.clients = append(kaetzchenWorker.clients, pluginClient)
+// isBuiltInKaetzchen returns true iff the capability or endpoint is used by
+// one of the configured built-in Kaetzchen, which take precedence.
+func (k *CBORPluginWorker) isBuiltInKaetzchen(capa, endpoint string) bool {
+	for _, v := range k.glue.Config().Provider.Kaetzchen {
+		if !v.Disable && (v.Capability == capa || v.Endpoint == endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredPlugin returns a copy of the configuration of the plugin
+// providing capa, or nil if there is none.
+func (k *CBORPluginWorker) configuredPlugin(capa string) *config.CBORPluginKaetzchen {
+	for _, v := range k.configs() {
+		if v.Capability == capa {
+			cfg := *v
+			cfg.Disable = false
+			return &cfg
+		}
+	}
+	return nil
+}
 
-			// Start the workers _after_ we have added all of the entries to pluginChans
-			// otherwise the worker() goroutines race this thread.
-			defer kaetzchenWorker.Go(func() {
-				kaetzchenWorker.worker(endpoint, pluginClient)
-			})
+// parseLoadPlugin returns the configuration of the plugin to load from a
+// LOAD_PLUGIN command line, either a configured plugin, or a program from
+// the PluginDir that is run in the PluginSandbox.
+func (k *CBORPluginWorker) parseLoadPlugin(sp []string) (*config.CBORPluginKaetzchen, error) {
+	if len(sp) == 2 {
+		cfg := k.configuredPlugin(sp[1])
+		if cfg == nil {
+			return nil, fmt.Errorf("plugin '%v' is not configured", sp[1])
 		}
+		return cfg, nil
+	}
 
-		capaMap[capa] = true
+	pCfg := k.glue.Config().Provider
+	if pCfg.PluginDir == "" {
+		return nil, errors.New("no PluginDir configured")
+	}
+	if k.configuredPlugin(sp[1]) != nil {
+		return nil, fmt.Errorf("plugin '%v' is configured, it can only be loaded by name", sp[1])
+	}
+
+	// Only the programs of the PluginDir may be executed.
+	name := sp[3]
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid plugin program '%v'", name)
+	}
+	maxConcurrency, err := strconv.Atoi(sp[4])
+	if err != nil || maxConcurrency <= 0 {
+		return nil, fmt.Errorf("invalid concurrency '%v'", sp[4])
+	}
+	sandbox := *pCfg.PluginSandbox
+	cfg := &config.CBORPluginKaetzchen{
+		Capability:     sp[1],
+		Endpoint:       sp[2],
+		Command:        filepath.Join(pCfg.PluginDir, name),
+		MaxConcurrency: maxConcurrency,
+		Sandbox:        &sandbox,
+	}
+	if len(sp) > 5 {
+		// The remaining arguments are passed to the plugin as is.
+		cfg.Config = make(map[string]interface{})
+		args := sp[5:]
+		if len(args)%2 != 0 {
+			return nil, errors.New("invalid plugin arguments")
+		}
+		for i := 0; i < len(args); i += 2 {
+			cfg.Config[strings.TrimPrefix(args[i], "-")] = args[i+1]
+		}
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// onLoadPlugin handles `LOAD_PLUGIN <capability>`, that loads a configured
+// plugin that is disabled or was unloaded, and `LOAD_PLUGIN <capability>
+// <endpoint> <program> <max_concurrency> [-key value ...]`, that loads a
+// program from the PluginDir.
+func (k *CBORPluginWorker) onLoadPlugin(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 && len(sp) < 5 {
+		c.Log().Debugf("LOAD_PLUGIN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	cfg, err := k.parseLoadPlugin(sp)
+	if err != nil {
+		c.Log().Errorf("LOAD_PLUGIN '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	if k.isBuiltInKaetzchen(cfg.Capability, cfg.Endpoint) {
+		c.Log().Errorf("LOAD_PLUGIN '%v' conflicts with a built-in Kaetzchen", cfg.Capability)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	if err = k.addPlugin(cfg); err != nil {
+		c.Log().Errorf("Failed to load Kaetzchen plugin '%v': %v", cfg.Capability, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	k.log.Noticef("Loaded Kaetzchen plugin '%v', it will be advertised with the next descriptor.", cfg.Capability)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (k *CBORPluginWorker) onUnloadPlugin(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("UNLOAD_PLUGIN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if err := k.removePlugin(sp[1]); err != nil {
+		c.Log().Errorf("Failed to unload Kaetzchen plugin '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (k *CBORPluginWorker) onRestartPlugin(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("RESTART_PLUGIN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if err := k.restartPlugin(sp[1]); err != nil {
+		c.Log().Errorf("Failed to restart Kaetzchen plugin '%v': %v", sp[1], err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
+// NewCBORPluginWorker returns a new CBORPluginWorker
+func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
+
+	kaetzchenWorker := CBORPluginWorker{
+		requestPipeline: requestPipeline{
+			glue: glue,
+			log:  glue.LogBackend().GetLogger("CBOR plugin worker"),
+		},
+		pluginChans: make(PluginChans),
+		plugins:     make([]*pluginInstance, 0),
+		cfgs:        glue.Config().Provider.CBORPluginKaetzchen,
+	}
+
+	for _, pluginConf := range kaetzchenWorker.cfgs {
+		kaetzchenWorker.log.Noticef("Configuring plugin handler for %s", pluginConf.Capability)
+
+		if pluginConf.Disable {
+			kaetzchenWorker.log.Noticef("Skipping disabled Kaetzchen: '%v'.", pluginConf.Capability)
+			continue
+		}
+		if err := kaetzchenWorker.addPlugin(pluginConf); err != nil {
+			kaetzchenWorker.Halt()
+			return nil, err
+		}
+	}
+	kaetzchenWorker.Go(kaetzchenWorker.supervisor)
+
+	// Wire in the management related commands.
+	if glue.Config().Management.Enable {
+		const (
+			cmdLoadPlugin    = "LOAD_PLUGIN"
+			cmdUnloadPlugin  = "UNLOAD_PLUGIN"
+			cmdRestartPlugin = "RESTART_PLUGIN"
+		)
+
+		glue.Management().RegisterCommand(cmdLoadPlugin, kaetzchenWorker.onLoadPlugin)
+		glue.Management().RegisterCommand(cmdUnloadPlugin, kaetzchenWorker.onUnloadPlugin)
+		glue.Management().RegisterCommand(cmdRestartPlugin, kaetzchenWorker.onRestartPlugin)
 	}
 
 	return &kaetzchenWorker, nil
@@ -0,0 +1,159 @@
+// dedup.go - Kaetzchen request deduplication.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxDedupEntries bounds the number of requests remembered per endpoint.
+const maxDedupEntries = 16384
+
+var duplicateRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "duplicate_requests_total",
+		Subsystem: constants.KaetzchenSubsystem,
+		Help:      "Number of duplicate Kaetzchen requests suppressed",
+	},
+	[]string{"capability"},
+)
+
+type seenRequest struct {
+	reply   []byte
+	done    bool
+	expires time.Time
+}
+
+type endpointWindow struct {
+	window   time.Duration
+	requests map[[sha256.Size]byte]*seenRequest
+}
+
+// dedupWindow remembers the requests made to Kaetzchen endpoints for a
+// short window, so that retransmitted requests do not repeat side effects
+// such as broadcasting a transaction twice.
+//
+// Note: Retransmissions usually carry fresh SURBs, so requests are
+// identified by the user and their payload alone.
+type dedupWindow struct {
+	sync.Mutex
+
+	endpoints map[[sConstants.RecipientIDLength]byte]*endpointWindow
+}
+
+// setWindow sets the deduplication window of an endpoint, in seconds.  A
+// window of 0 disables deduplication for the endpoint.
+func (d *dedupWindow) setWindow(endpoint [sConstants.RecipientIDLength]byte, window uint64) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.endpoints == nil {
+		d.endpoints = make(map[[sConstants.RecipientIDLength]byte]*endpointWindow)
+	}
+	if window == 0 {
+		delete(d.endpoints, endpoint)
+		return
+	}
+	d.endpoints[endpoint] = &endpointWindow{
+		window:   time.Duration(window) * time.Second,
+		requests: make(map[[sha256.Size]byte]*seenRequest),
+	}
+}
+
+// enabled returns true iff requests to the endpoint are deduplicated.
+func (d *dedupWindow) enabled(endpoint [sConstants.RecipientIDLength]byte) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	_, ok := d.endpoints[endpoint]
+	return ok
+}
+
+// check records a request, and returns true iff it duplicates a request
+// seen within the window.  For duplicates, the reply to the original
+// request is returned if it was already made.
+func (d *dedupWindow) check(endpoint [sConstants.RecipientIDLength]byte, key [sha256.Size]byte) ([]byte, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	ew, ok := d.endpoints[endpoint]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if r, ok := ew.requests[key]; ok && now.Before(r.expires) {
+		if r.done {
+			return r.reply, true
+		}
+		return nil, true
+	}
+
+	if len(ew.requests) >= maxDedupEntries {
+		for k, r := range ew.requests {
+			if now.After(r.expires) {
+				delete(ew.requests, k)
+			}
+		}
+		if len(ew.requests) >= maxDedupEntries {
+			// Under a flood of distinct requests, deduplicating less is
+			// preferable to growing without bound.
+			ew.requests = make(map[[sha256.Size]byte]*seenRequest)
+		}
+	}
+	ew.requests[key] = &seenRequest{expires: now.Add(ew.window)}
+	return nil, false
+}
+
+// done records the reply to a request.
+func (d *dedupWindow) done(endpoint [sConstants.RecipientIDLength]byte, key [sha256.Size]byte, reply []byte) {
+	d.Lock()
+	defer d.Unlock()
+
+	if ew, ok := d.endpoints[endpoint]; ok {
+		if r, ok := ew.requests[key]; ok {
+			r.reply = reply
+			r.done = true
+		}
+	}
+}
+
+// forget removes a request that failed, so that it can be retried.
+func (d *dedupWindow) forget(endpoint [sConstants.RecipientIDLength]byte, key [sha256.Size]byte) {
+	d.Lock()
+	defer d.Unlock()
+
+	if ew, ok := d.endpoints[endpoint]; ok {
+		delete(ew.requests, key)
+	}
+}
+
+// requestKey returns the deduplication key of a request made by user.  The
+// same request made by different users is made for each of them.
+func requestKey(user string, payload []byte) [sha256.Size]byte {
+	return cacheKey(user, payload, 0)
+}
+
+func init() {
+	prometheus.MustRegister(duplicateRequests)
+}
@@ -0,0 +1,101 @@
+// dedup_test.go - Kaetzchen request deduplication tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+	"time"
+
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupWindow(t *testing.T) {
+	require := require.New(t)
+
+	var ep, other [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+broadcast")
+	copy(other[:], "+echo")
+
+	var d dedupWindow
+	d.setWindow(ep, 60)
+	require.True(d.enabled(ep))
+	require.False(d.enabled(other))
+
+	tx := requestKey("alice", []byte("tx"))
+
+	// The first request is made, a retransmission in progress is dropped.
+	reply, dup := d.check(ep, tx)
+	require.False(dup)
+	require.Nil(reply)
+	reply, dup = d.check(ep, tx)
+	require.True(dup)
+	require.Nil(reply)
+
+	// Once answered, retransmissions get the original reply.
+	d.done(ep, tx, []byte("txid"))
+	reply, dup = d.check(ep, tx)
+	require.True(dup)
+	require.Equal([]byte("txid"), reply)
+
+	// Other requests and endpoints are not affected.
+	_, dup = d.check(ep, requestKey("alice", []byte("tx2")))
+	require.False(dup)
+	_, dup = d.check(ep, requestKey("bob", []byte("tx")))
+	require.False(dup, "the same request by another user is made")
+	_, dup = d.check(other, tx)
+	require.False(dup)
+	_, dup = d.check(other, tx)
+	require.False(dup, "deduplication is disabled")
+
+	// Failed requests can be retried.
+	failed := requestKey("alice", []byte("failed"))
+	_, dup = d.check(ep, failed)
+	require.False(dup)
+	d.forget(ep, failed)
+	_, dup = d.check(ep, failed)
+	require.False(dup)
+
+	// Requests are forgotten once the window expires.
+	d.endpoints[ep].requests[tx].expires = time.Now().Add(-time.Second)
+	_, dup = d.check(ep, tx)
+	require.False(dup)
+	_, dup = d.check(ep, tx)
+	require.True(dup)
+}
+
+func TestDedupWindowBounded(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+broadcast")
+
+	var d dedupWindow
+	d.setWindow(ep, 60)
+	for i := 0; i < maxDedupEntries; i++ {
+		_, dup := d.check(ep, cacheKey("alice", nil, i))
+		require.False(dup)
+	}
+	require.Len(d.endpoints[ep].requests, maxDedupEntries)
+
+	// Under a flood of distinct requests, the window starts over.
+	_, dup := d.check(ep, requestKey("alice", []byte("new")))
+	require.False(dup)
+	require.Len(d.endpoints[ep].requests, 1)
+	_, dup = d.check(ep, requestKey("alice", nil))
+	require.False(dup)
+}
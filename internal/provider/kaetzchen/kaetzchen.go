@@ -81,26 +81,53 @@ type Kaetzchen interface {
 	Halt()
 }
 
+// replyDelayer is implemented by the Kaetzchen whose responses are sent
+// after an artificial delay.  The delay is waited for asynchronously, so
+// that it does not occupy one of the shared workers.
+type replyDelayer interface {
+	replyDelay() time.Duration
+}
+
 // BuiltInCtorFn is the constructor type for a built-in Kaetzchen.
 type BuiltInCtorFn func(*config.Kaetzchen, glue.Glue) (Kaetzchen, error)
 
 // BuiltInCtors are the constructors for all built-in Kaetzchen.
 var BuiltInCtors = map[string]BuiltInCtorFn{
-	LoopCapability:      NewLoop,
-	keyserverCapability: NewKeyserver,
+	LoopCapability:         NewLoop,
+	keyserverCapability:    NewKeyserver,
+	PandaCapability:        NewPanda,
+	RegistrationCapability: NewRegistration,
+	KeyRotationCapability:  NewKeyRotation,
+}
+
+// configInt returns the non-negative integer configuration value key of a
+// built-in Kaetzchen, and if it is set.
+func configInt(cfg *config.Kaetzchen, key string) (int, bool, error) {
+	v, ok := cfg.Config[key]
+	if !ok {
+		return 0, false, nil
+	}
+	n, ok := v.(int64) // TOML integers.
+	if !ok || n < 0 {
+		return 0, true, fmt.Errorf("kaetzchen/%v: invalid %v: '%v'", cfg.Capability, key, v)
+	}
+	return int(n), true, nil
 }
 
 type KaetzchenWorker struct {
 	sync.Mutex
 	worker.Worker
 
-	glue glue.Glue
-	log  *logging.Logger
+	requestPipeline
 
 	ch        *channels.InfiniteChannel
 	kaetzchen map[[sConstants.RecipientIDLength]byte]Kaetzchen
 
-	dropCounter uint64
+	// rateLimits is the rate limit of each enabled built-in Kaetzchen,
+	// keyed by capability, and is only used by Reconfigure.
+	rateLimits map[string]*config.Kaetzchen
+
+	inFlight int64
 }
 
 var (
@@ -144,7 +171,61 @@ var (
 			Help:      "Number of total failed kaetzchen requests",
 		},
 	)
-	kaetzchenRequestsTimer *prometheus.Timer
+	serviceRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests per service",
+		},
+		[]string{"capability"},
+	)
+	serviceRequestsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_failed_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of failed Kaetzchen requests per service",
+		},
+		[]string{"capability"},
+	)
+	serviceRequestsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_dropped_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests per service dropped due to queueing delay",
+		},
+		[]string{"capability"},
+	)
+	serviceRequestsOverflow = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_overflow_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests per service dropped due to a full queue",
+		},
+		[]string{"capability"},
+	)
+	queueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "queue_length",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests waiting for a worker",
+		},
+		[]string{"queue"},
+	)
+	serviceRequestsDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_request_duration_seconds",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Duration of Kaetzchen requests per service in seconds",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"capability"},
+	)
 )
 
 func init() {
@@ -153,6 +234,46 @@ func init() {
 	prometheus.MustRegister(kaetzchenRequestsDropped)
 	prometheus.MustRegister(kaetzchenRequestsFailed)
 	prometheus.MustRegister(kaetzchenRequestsDuration)
+	prometheus.MustRegister(serviceRequests)
+	prometheus.MustRegister(serviceRequestsFailed)
+	prometheus.MustRegister(serviceRequestsDropped)
+	prometheus.MustRegister(serviceRequestsOverflow)
+	prometheus.MustRegister(queueLength)
+	prometheus.MustRegister(serviceRequestsDuration)
+}
+
+func capabilityLabels(capa string) prometheus.Labels {
+	return prometheus.Labels{"capability": capa}
+}
+
+// builtInQueue is the queue label of the queue shared by the built-in
+// Kaetzchen, plugins each have a queue labeled with their capability.
+const builtInQueue = "builtin"
+
+func queueLabels(queue string) prometheus.Labels {
+	return prometheus.Labels{"queue": queue}
+}
+
+// isQueueFull returns true iff the queue has reached the configured
+// maximum size.
+func isQueueFull(glue glue.Glue, ch *channels.InfiniteChannel) bool {
+	maxLen := glue.Config().Debug.KaetzchenQueueSize
+	return maxLen > 0 && ch.Len() >= maxLen
+}
+
+// onQueueFull disposes of a request that does not fit in its queue.
+func onQueueFull(log *logging.Logger, pkt *packet.Packet, capa string) {
+	log.Debugf("Dropping Kaetzchen request: %v (Queue full)", pkt.ID)
+	packetsDropped.Inc()
+	serviceRequestsOverflow.With(capabilityLabels(capa)).Inc()
+	pkt.Dispose()
+}
+
+func (k *KaetzchenWorker) capabilityOf(recipient [sConstants.RecipientIDLength]byte) string {
+	if dst, ok := k.kaetzchen[recipient]; ok {
+		return dst.Capability()
+	}
+	return "unknown"
 }
 
 func (k *KaetzchenWorker) IsKaetzchen(recipient [sConstants.RecipientIDLength]byte) bool {
@@ -197,15 +318,16 @@ func (k *KaetzchenWorker) registerKaetzchen(service Kaetzchen) error {
 }
 
 func (k *KaetzchenWorker) OnKaetzchen(pkt *packet.Packet) {
+	if !k.limiter.allow(pkt.Recipient.ID) {
+		onRateLimited(k.log, pkt, k.capabilityOf(pkt.Recipient.ID))
+		return
+	}
+	if isQueueFull(k.glue, k.ch) {
+		onQueueFull(k.log, pkt, k.capabilityOf(pkt.Recipient.ID))
+		return
+	}
 	k.ch.In() <- pkt
-}
-
-func (k *KaetzchenWorker) getDropCounter() uint64 {
-	return atomic.LoadUint64(&k.dropCounter)
-}
-
-func (k *KaetzchenWorker) incrementDropCounter() uint64 {
-	return atomic.AddUint64(&k.dropCounter, uint64(1))
+	queueLength.With(queueLabels(builtInQueue)).Set(float64(k.ch.Len()))
 }
 
 func (k *KaetzchenWorker) worker() {
@@ -225,68 +347,43 @@ func (k *KaetzchenWorker) worker() {
 			return
 		case e := <-ch:
 			pkt = e.(*packet.Packet)
+			queueLength.With(queueLabels(builtInQueue)).Set(float64(k.ch.Len()))
 			if dwellTime := monotime.Now() - pkt.DispatchAt; dwellTime > maxDwell {
 				count := k.incrementDropCounter()
 				k.log.Debugf("Dropping packet: %v (Spend %v in queue), total drops %d", pkt.ID, dwellTime, count)
 				packetsDropped.Inc()
+				serviceRequestsDropped.With(capabilityLabels(k.capabilityOf(pkt.Recipient.ID))).Inc()
 				pkt.Dispose()
 				continue
 			}
 		}
 
+		atomic.AddInt64(&k.inFlight, 1)
 		k.processKaetzchen(pkt)
-	}
-}
-
-func (k *KaetzchenWorker) processKaetzchen(pkt *packet.Packet) {
-	kaetzchenRequestsTimer = prometheus.NewTimer(kaetzchenRequestsDuration)
-	defer kaetzchenRequestsTimer.ObserveDuration()
-	defer pkt.Dispose()
-
-	ct, surb, err := packet.ParseForwardPacket(pkt)
-	if err != nil {
-		k.log.Debugf("Dropping Kaetzchen request: %v (%v)", pkt.ID, err)
-		k.incrementDropCounter()
-		kaetzchenRequestsDropped.Add(float64(k.getDropCounter()))
-		return
-	}
-
-	var resp []byte
-	dst, ok := k.kaetzchen[pkt.Recipient.ID]
-	if ok {
-		resp, err = dst.OnRequest(pkt.ID, ct, surb != nil)
-	}
-	switch {
-	case err == nil:
-	case err == ErrNoResponse:
-		k.log.Debugf("Processed Kaetzchen request: %v (No response)", pkt.ID)
+		atomic.AddInt64(&k.inFlight, -1)
 		kaetzchenRequests.Inc()
-		return
-	default:
-		k.log.Debugf("Failed to handle Kaetzchen request: %v (%v)", pkt.ID, err)
-		kaetzchenRequestsFailed.Inc()
-		return
 	}
+}
 
-	// Iff there is a SURB, generate a SURB-Reply and schedule.
-	if surb != nil {
-		// Prepend the response header.
-		resp = append([]byte{0x01, 0x00}, resp...)
+// Queues returns the number of requests waiting to be dispatched by queue,
+// and the number of requests being processed.
+func (k *KaetzchenWorker) Queues() (map[string]int, int) {
+	return map[string]int{builtInQueue: k.ch.Len()}, int(atomic.LoadInt64(&k.inFlight))
+}
 
-		respPkt, err := packet.NewPacketFromSURB(pkt, surb, resp)
-		if err != nil {
-			k.log.Debugf("Failed to generate SURB-Reply: %v (%v)", pkt.ID, err)
-			return
+func (k *KaetzchenWorker) processKaetzchen(pkt *packet.Packet) {
+	k.process(pkt, k.capabilityOf(pkt.Recipient.ID), "built-in", func(payload []byte, surbs [][]byte) ([]byte, time.Duration, error) {
+		dst, ok := k.kaetzchen[pkt.Recipient.ID]
+		if !ok {
+			return nil, 0, nil
 		}
-
-		k.log.Debugf("Handing off newly generated SURB-Reply: %v (Src:%v)", respPkt.ID, pkt.ID)
-		k.glue.Scheduler().OnPacket(respPkt)
-	} else if resp != nil {
-		// This is silly and I'm not sure why anyone will do this, but
-		// there's nothing that can be done at this point, the Kaetzchen
-		// implementation should have caught this.
-		k.log.Debugf("Kaetzchen message: %v (Has reply but no SURB)", pkt.ID)
-	}
+		resp, err := dst.OnRequest(pkt.ID, payload, surbs != nil)
+		var delay time.Duration
+		if d, ok := dst.(replyDelayer); ok && err == nil {
+			delay = d.replyDelay()
+		}
+		return resp, delay, err
+	})
 }
 
 func (k *KaetzchenWorker) KaetzchenForPKI() map[string]map[string]interface{} {
@@ -304,10 +401,13 @@ func (k *KaetzchenWorker) KaetzchenForPKI() map[string]map[string]interface{} {
 func New(glue glue.Glue) (*KaetzchenWorker, error) {
 
 	kaetzchenWorker := KaetzchenWorker{
-		glue:      glue,
-		log:       glue.LogBackend().GetLogger("kaetzchen_worker"),
-		ch:        channels.NewInfiniteChannel(),
-		kaetzchen: make(map[[sConstants.RecipientIDLength]byte]Kaetzchen),
+		requestPipeline: requestPipeline{
+			glue: glue,
+			log:  glue.LogBackend().GetLogger("kaetzchen_worker"),
+		},
+		ch:         channels.NewInfiniteChannel(),
+		kaetzchen:  make(map[[sConstants.RecipientIDLength]byte]Kaetzchen),
+		rateLimits: make(map[string]*config.Kaetzchen),
 	}
 
 	// Initialize the internal Kaetzchen.
@@ -331,6 +431,23 @@ func New(glue glue.Glue) (*KaetzchenWorker, error) {
 		if err = kaetzchenWorker.registerKaetzchen(k); err != nil {
 			return nil, err
 		}
+		var epKey [sConstants.RecipientIDLength]byte
+		copy(epKey[:], v.Endpoint)
+		kaetzchenWorker.limiter.setLimit(epKey, v.RateLimit, v.RateBurst)
+		kaetzchenWorker.limiter.setUserLimit(epKey, v.UserRateLimit, v.UserRateBurst)
+		kaetzchenWorker.rateLimits[capa] = &config.Kaetzchen{
+			Capability:    capa,
+			Endpoint:      v.Endpoint,
+			RateLimit:     v.RateLimit,
+			RateBurst:     v.RateBurst,
+			UserRateLimit: v.UserRateLimit,
+			UserRateBurst: v.UserRateBurst,
+		}
+		kaetzchenWorker.cache.setTTL(epKey, v.CacheTTL)
+		kaetzchenWorker.dedup.setWindow(epKey, v.DedupWindow)
+		if err = kaetzchenWorker.acls.setACL(glue, epKey, v.AllowedUsers); err != nil {
+			return nil, err
+		}
 
 		if capaMap[capa] {
 			return nil, fmt.Errorf("provider: Kaetzchen '%v' registered more than once", capa)
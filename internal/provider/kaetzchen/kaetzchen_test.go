@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/accounting"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/packet"
 	"github.com/hashcloak/Meson-server/internal/pkicache"
@@ -55,7 +56,7 @@ func (u *mockUserDB) Add([]byte, *ecdh.PublicKey, bool) error { return nil }
 func (u *mockUserDB) SetIdentity([]byte, *ecdh.PublicKey) error { return nil }
 
 func (u *mockUserDB) Link([]byte) (*ecdh.PublicKey, error) {
-	return nil, nil
+	return u.provider.userKey, nil
 }
 
 func (u *mockUserDB) Identity([]byte) (*ecdh.PublicKey, error) {
@@ -115,6 +116,22 @@ func (p *mockProvider) AdvertiseRegistrationHTTPAddresses() []string {
 	return nil
 }
 
+func (p *mockProvider) Accounting() *accounting.Accountant {
+	return nil
+}
+
+func (p *mockProvider) Reconfigure(*config.Provider) ([]string, error) {
+	return nil, nil
+}
+
+func (p *mockProvider) Backlog() int {
+	return 0
+}
+
+func (p *mockProvider) Queues() *glue.ProviderQueues {
+	return &glue.ProviderQueues{}
+}
+
 type mockDecoy struct{}
 
 func (d *mockDecoy) Halt() {}
@@ -187,6 +204,18 @@ func (g *mockGlue) Listeners() []glue.Listener {
 
 func (g *mockGlue) ReshadowCryptoWorkers() {}
 
+func (g *mockGlue) SetLogLevel(string, string) error {
+	return nil
+}
+
+func (g *mockGlue) Draining() bool {
+	return false
+}
+
+func (g *mockGlue) RuntimeConfig() *glue.RuntimeConfig {
+	return &glue.RuntimeConfig{}
+}
+
 func (g *mockGlue) Decoy() glue.Decoy {
 	return &mockDecoy{}
 }
@@ -0,0 +1,227 @@
+// keyrotation.go - User key rotation Kaetzchen.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// KeyRotationCapability is the standardized capability for the user
+	// key rotation service.
+	KeyRotationCapability = "keyrotation"
+	keyRotationVersion    = 0
+
+	keyRotationStatusOk           = 0
+	keyRotationStatusSyntaxError  = 1
+	keyRotationStatusAuthFailed   = 2
+	keyRotationStatusNotSupported = 3
+	keyRotationStatusStorageError = 4
+
+	keyRotationMACContext = "meson-keyrotation-v0"
+)
+
+type keyRotationRequest struct {
+	Version        int
+	User           string
+	NewLinkKey     string
+	NewIdentityKey string
+	MAC            string
+}
+
+type keyRotationResponse struct {
+	Version    int
+	StatusCode int
+	User       string
+}
+
+type kaetzchenKeyRotation struct {
+	log  *logging.Logger
+	glue glue.Glue
+
+	params     Parameters
+	jsonHandle codec.JsonHandle
+	overlap    time.Duration
+}
+
+func (k *kaetzchenKeyRotation) Capability() string {
+	return KeyRotationCapability
+}
+
+func (k *kaetzchenKeyRotation) Parameters() Parameters {
+	return k.params
+}
+
+func (k *kaetzchenKeyRotation) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, error) {
+	if !hasSURB {
+		return nil, ErrNoResponse
+	}
+
+	k.log.Debugf("Handling request: %v", id)
+	resp := keyRotationResponse{
+		Version:    keyRotationVersion,
+		StatusCode: keyRotationStatusSyntaxError,
+	}
+
+	// Parse out the request payload.
+	var req keyRotationRequest
+	dec := codec.NewDecoderBytes(bytes.TrimRight(payload, "\x00"), &k.jsonHandle)
+	if err := dec.Decode(&req); err != nil {
+		k.log.Debugf("Failed to decode request: %v (%v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	if req.Version != keyRotationVersion {
+		k.log.Debugf("Failed to parse request: %v (invalid version: %v)", id, req.Version)
+		return k.encodeResp(&resp), nil
+	}
+	user, err := fixupUserName(k.glue.Config().Provider, req.User)
+	if err != nil {
+		k.log.Debugf("Failed to parse request: %v (invalid user: %v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	resp.User = string(user)
+
+	var newLinkKey, newIdentityKey *ecdh.PublicKey
+	if req.NewLinkKey != "" {
+		newLinkKey = new(ecdh.PublicKey)
+		if err := newLinkKey.FromString(req.NewLinkKey); err != nil {
+			k.log.Debugf("Failed to parse request: %v (invalid link key: %v)", id, err)
+			return k.encodeResp(&resp), nil
+		}
+	}
+	if req.NewIdentityKey != "" {
+		newIdentityKey = new(ecdh.PublicKey)
+		if err := newIdentityKey.FromString(req.NewIdentityKey); err != nil {
+			k.log.Debugf("Failed to parse request: %v (invalid identity key: %v)", id, err)
+			return k.encodeResp(&resp), nil
+		}
+	}
+	mac, err := hex.DecodeString(req.MAC)
+	if err != nil || (newLinkKey == nil && newIdentityKey == nil) {
+		k.log.Debugf("Failed to parse request: %v (invalid MAC or no keys)", id)
+		return k.encodeResp(&resp), nil
+	}
+
+	udb := k.glue.Provider().UserDB()
+	rotator, ok := udb.(userdb.KeyRotator)
+	if !ok {
+		resp.StatusCode = keyRotationStatusNotSupported
+		return k.encodeResp(&resp), nil
+	}
+
+	// The request is authenticated with the user's current link key, and
+	// covers the current identity key, so that a replayed request is
+	// rejected once either rotation has happened.
+	linkKey, err := udb.Link(user)
+	var identityKey string
+	if idKey, idErr := udb.Identity(user); idErr == nil && idKey != nil {
+		identityKey = idKey.String()
+	}
+	if err != nil || !hmac.Equal(mac, k.requestMAC(linkKey, identityKey, &req)) {
+		k.log.Debugf("Rejecting request: %v (authentication failed)", id)
+		resp.StatusCode = keyRotationStatusAuthFailed
+		return k.encodeResp(&resp), nil
+	}
+
+	if newIdentityKey != nil {
+		if err = rotator.RotateIdentity(user, newIdentityKey, k.overlap); err != nil {
+			k.log.Errorf("Failed to rotate identity key: %v (%v)", id, err)
+			resp.StatusCode = keyRotationStatusStorageError
+			return k.encodeResp(&resp), nil
+		}
+	}
+	if newLinkKey != nil {
+		if err = rotator.RotateLink(user, newLinkKey, k.overlap); err != nil {
+			k.log.Errorf("Failed to rotate link key: %v (%v)", id, err)
+			resp.StatusCode = keyRotationStatusStorageError
+			return k.encodeResp(&resp), nil
+		}
+	}
+
+	k.log.Noticef("Rotated keys for user: %s", user)
+	resp.StatusCode = keyRotationStatusOk
+	return k.encodeResp(&resp), nil
+}
+
+// requestMAC returns the HMAC-SHA256 of the request, keyed with the shared
+// secret between the user's link key and the Provider's link key.  It
+// covers the user's current identity key, empty if the user has none.
+func (k *kaetzchenKeyRotation) requestMAC(linkKey *ecdh.PublicKey, identityKey string, req *keyRotationRequest) []byte {
+	var sharedSecret [ecdh.GroupElementLength]byte
+	k.glue.LinkKey().Exp(&sharedSecret, linkKey)
+
+	m := hmac.New(sha256.New, sharedSecret[:])
+	for _, v := range []string{keyRotationMACContext, req.User, identityKey, req.NewLinkKey, req.NewIdentityKey} {
+		_, _ = m.Write([]byte(v))
+		_, _ = m.Write([]byte{0x00})
+	}
+	return m.Sum(nil)
+}
+
+func (k *kaetzchenKeyRotation) Halt() {
+	// No termination required.
+}
+
+func (k *kaetzchenKeyRotation) encodeResp(resp *keyRotationResponse) []byte {
+	var out []byte
+	enc := codec.NewEncoderBytes(&out, &k.jsonHandle)
+	_ = enc.Encode(resp)
+	return out
+}
+
+// NewKeyRotation constructs a new key rotation Kaetzchen instance,
+// providing the "keyrotation" capability on the configured endpoint.
+//
+// Requests are authenticated with a MAC keyed by the ECDH shared secret of
+// the user's current link key and the Provider's link key, covering the
+// user's current identity key so that a request can not be replayed after
+// the rotation.  The optional "overlap" configuration value specifies how
+// long the previous keys remain valid as a Go duration string.
+func NewKeyRotation(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
+	k := &kaetzchenKeyRotation{
+		log:     glue.LogBackend().GetLogger("kaetzchen/keyrotation"),
+		glue:    glue,
+		params:  make(Parameters),
+		overlap: userdb.DefaultKeyOverlap,
+	}
+	k.jsonHandle.Canonical = true
+	k.jsonHandle.ErrorIfNoField = true
+	k.params[ParameterEndpoint] = cfg.Endpoint
+
+	if v, ok := cfg.Config["overlap"]; ok {
+		s, _ := v.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("kaetzchen/keyrotation: invalid overlap: '%v'", v)
+		}
+		k.overlap = d
+	}
+
+	return k, nil
+}
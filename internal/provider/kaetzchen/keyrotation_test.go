@@ -0,0 +1,155 @@
+// keyrotation_test.go - Key rotation Kaetzchen tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+type rotatingUserDB struct {
+	*memUserDB
+}
+
+func (u *rotatingUserDB) RotateLink(user []byte, k *ecdh.PublicKey, overlap time.Duration) error {
+	return u.Add(user, k, true)
+}
+
+func (u *rotatingUserDB) RotateIdentity(user []byte, k *ecdh.PublicKey, overlap time.Duration) error {
+	return u.SetIdentity(user, k)
+}
+
+func (u *rotatingUserDB) PreviousIdentity([]byte) (*ecdh.PublicKey, error) {
+	return nil, nil
+}
+
+type rotatingProvider struct {
+	*mockProvider
+	udb *rotatingUserDB
+}
+
+func (p *rotatingProvider) UserDB() userdb.UserDB {
+	return p.udb
+}
+
+// keyRotationMAC is the client side of requestMAC.
+func keyRotationMAC(userLinkKey *ecdh.PrivateKey, providerLinkKey *ecdh.PublicKey, identityKey string, req *keyRotationRequest) string {
+	var sharedSecret [ecdh.GroupElementLength]byte
+	userLinkKey.Exp(&sharedSecret, providerLinkKey)
+
+	m := hmac.New(sha256.New, sharedSecret[:])
+	for _, v := range []string{keyRotationMACContext, req.User, identityKey, req.NewLinkKey, req.NewIdentityKey} {
+		_, _ = m.Write([]byte(v))
+		_, _ = m.Write([]byte{0x00})
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func TestKeyRotation(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	providerLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	udb := &rotatingUserDB{&memUserDB{
+		links:      make(map[string]*ecdh.PublicKey),
+		identities: make(map[string]*ecdh.PublicKey),
+	}}
+	goo := getGlue(logBackend, &mockProvider{}, providerLinkKey, nil)
+	goo.s.provider = &rotatingProvider{&mockProvider{}, udb}
+
+	k, err := NewKeyRotation(&config.Kaetzchen{
+		Capability: KeyRotationCapability,
+		Endpoint:   "+keyrotation",
+	}, goo)
+	require.NoError(err)
+
+	newKey := func() *ecdh.PrivateKey {
+		key, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err)
+		return key
+	}
+	rotate := func(req *keyRotationRequest) int {
+		var handle codec.JsonHandle
+		var b []byte
+		require.NoError(codec.NewEncoderBytes(&b, &handle).Encode(req))
+		rawResp, err := k.OnRequest(0, b, true)
+		require.NoError(err)
+
+		var resp keyRotationResponse
+		require.NoError(codec.NewDecoderBytes(rawResp, &handle).Decode(&resp))
+		return resp.StatusCode
+	}
+
+	linkKey, identityKey := newKey(), newKey()
+	require.NoError(udb.Add([]byte("alice"), linkKey.PublicKey(), false))
+	require.NoError(udb.SetIdentity([]byte("alice"), identityKey.PublicKey()))
+
+	// Requests with a MAC keyed by another link key are rejected.
+	newLinkKey := newKey()
+	req := &keyRotationRequest{
+		Version:    keyRotationVersion,
+		User:       "alice",
+		NewLinkKey: newLinkKey.PublicKey().String(),
+	}
+	req.MAC = keyRotationMAC(newKey(), providerLinkKey.PublicKey(), identityKey.PublicKey().String(), req)
+	require.Equal(keyRotationStatusAuthFailed, rotate(req))
+	require.Equal(linkKey.PublicKey(), udb.links["alice"])
+
+	// Requests with a MAC over another identity key are rejected.
+	req.MAC = keyRotationMAC(linkKey, providerLinkKey.PublicKey(), "", req)
+	require.Equal(keyRotationStatusAuthFailed, rotate(req))
+	require.Equal(linkKey.PublicKey(), udb.links["alice"])
+
+	// An authenticated request rotates the link key, and can not be
+	// replayed after the rotation.
+	req.MAC = keyRotationMAC(linkKey, providerLinkKey.PublicKey(), identityKey.PublicKey().String(), req)
+	require.Equal(keyRotationStatusOk, rotate(req))
+	require.Equal(newLinkKey.PublicKey(), udb.links["alice"])
+	require.Equal(keyRotationStatusAuthFailed, rotate(req))
+
+	// The same holds for identity key rotations, keyed by the new link key.
+	linkKey = newLinkKey
+	newIdentityKey := newKey()
+	req = &keyRotationRequest{
+		Version:        keyRotationVersion,
+		User:           "alice",
+		NewIdentityKey: newIdentityKey.PublicKey().String(),
+	}
+	req.MAC = keyRotationMAC(linkKey, providerLinkKey.PublicKey(), identityKey.PublicKey().String(), req)
+	require.Equal(keyRotationStatusOk, rotate(req))
+	require.Equal(newIdentityKey.PublicKey(), udb.identities["alice"])
+	require.Equal(keyRotationStatusAuthFailed, rotate(req))
+	require.Equal(linkKey.PublicKey(), udb.links["alice"])
+
+	// Requests without a SURB are dropped.
+	_, err = k.OnRequest(0, nil, false)
+	require.Equal(ErrNoResponse, err)
+}
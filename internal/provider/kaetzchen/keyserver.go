@@ -45,6 +45,10 @@ type keyserverResponse struct {
 	StatusCode int
 	User       string
 	PublicKey  string
+
+	// PreviousPublicKey is the user's previous identity key, during a key
+	// rotation.
+	PreviousPublicKey string `codec:",omitempty"`
 }
 
 type kaetzchenKeyserver struct {
@@ -93,6 +97,11 @@ func (k *kaetzchenKeyserver) OnRequest(id uint64, payload []byte, hasSURB bool)
 	case nil:
 		resp.StatusCode = keyserverStatusOk
 		resp.PublicKey = pubKey.String()
+		if rotator, ok := k.glue.Provider().UserDB().(userdb.KeyRotator); ok {
+			if prevKey, err := rotator.PreviousIdentity([]byte(req.User)); err == nil {
+				resp.PreviousPublicKey = prevKey.String()
+			}
+		}
 	case userdb.ErrNoSuchUser, userdb.ErrNoIdentity:
 		// Treat the user being missing as the user not having an
 		// identity key to make enumeration attacks minutely harder.
@@ -17,18 +17,47 @@
 package kaetzchen
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	mRand "math/rand"
+	"sync"
+	"time"
+
 	"github.com/hashcloak/Meson-server/config"
 	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/crypto/rand"
 	"gopkg.in/op/go-logging.v1"
 )
 
-// LoopCapability is the standardized capability for the loop/discard service.
-const LoopCapability = "loop"
+const (
+	// LoopCapability is the standardized capability for the loop/discard service.
+	LoopCapability = "loop"
+
+	loopDelayConstant    = "constant"
+	loopDelayUniform     = "uniform"
+	loopDelayExponential = "exponential"
+
+	// maxLoopDelay is the maximum artificial response delay.
+	maxLoopDelay = time.Minute
+)
+
+var errInjectedFailure = errors.New("kaetzchen/loop: injected failure")
 
 type kaetzchenLoop struct {
+	sync.Mutex
+
 	log *logging.Logger
 
 	params Parameters
+
+	// Measurement options.
+	echo         bool
+	maxPayload   int
+	delay        time.Duration
+	distribution string
+	failureRate  float64
+	rng          *mRand.Rand
 }
 
 func (k *kaetzchenLoop) Capability() string {
@@ -46,24 +75,113 @@ func (k *kaetzchenLoop) OnRequest(id uint64, payload []byte, hasSURB bool) ([]by
 
 	k.log.Debugf("Handling request: %v", id)
 
-	// TODO: Should this do anything with the payload, and should this send
-	// a meaningful response?  Maybe a digest of the payload?
+	payload = bytes.TrimRight(payload, "\x00")
+	if k.maxPayload > 0 && len(payload) > k.maxPayload {
+		return nil, fmt.Errorf("kaetzchen/loop: oversized payload: %v", len(payload))
+	}
+
+	if k.sampleFailure() {
+		return nil, errInjectedFailure
+	}
 
+	if k.echo {
+		return payload, nil
+	}
 	return nil, nil
 }
 
+// sampleFailure returns true iff the request should fail.
+func (k *kaetzchenLoop) sampleFailure() bool {
+	if k.failureRate == 0 {
+		return false
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	return k.rng.Float64() < k.failureRate
+}
+
+// replyDelay returns the artificial delay of a response, which is capped
+// at maxLoopDelay.
+func (k *kaetzchenLoop) replyDelay() time.Duration {
+	if k.delay == 0 {
+		return 0
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	delay := k.delay
+	switch k.distribution {
+	case loopDelayUniform:
+		delay = time.Duration(k.rng.Int63n(int64(2*k.delay) + 1))
+	case loopDelayExponential:
+		delay = time.Duration(k.rng.ExpFloat64() * float64(k.delay))
+	}
+	if delay > maxLoopDelay {
+		delay = maxLoopDelay
+	}
+	return delay
+}
+
 func (k *kaetzchenLoop) Halt() {
 	// No termination required.
 }
 
 // NewLoop constructs a new Loop Kaetzchen instance, providing the "loop"
 // capability, on the configured endpoint.
+//
+// By default, requests are answered with an empty response.  To serve as a
+// measurement target, the optional "echo" (reply with the request payload),
+// "maxPayload" (bytes), "delay" (mean response delay in milliseconds, the
+// sampled delays are capped at one minute), "delayDistribution"
+// ("constant", "uniform" or "exponential") and "failureRate" (fraction of
+// requests that fail) configuration values can be set.
 func NewLoop(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
 	k := &kaetzchenLoop{
-		log:    glue.LogBackend().GetLogger("kaetzchen/loop"),
-		params: make(Parameters),
+		log:          glue.LogBackend().GetLogger("kaetzchen/loop"),
+		params:       make(Parameters),
+		distribution: loopDelayConstant,
+		rng:          rand.NewMath(),
 	}
 	k.params[ParameterEndpoint] = cfg.Endpoint
 
+	if v, ok := cfg.Config["echo"]; ok {
+		if k.echo, ok = v.(bool); !ok {
+			return nil, fmt.Errorf("kaetzchen/loop: invalid echo: '%v'", v)
+		}
+	}
+	var err error
+	if k.maxPayload, _, err = configInt(cfg, "maxPayload"); err != nil {
+		return nil, err
+	}
+	delay, _, err := configInt(cfg, "delay")
+	if err != nil {
+		return nil, err
+	}
+	k.delay = time.Duration(delay) * time.Millisecond
+	if k.delay > maxLoopDelay {
+		return nil, fmt.Errorf("kaetzchen/loop: delay exceeds %v: %v", maxLoopDelay, k.delay)
+	}
+	if v, ok := cfg.Config["delayDistribution"]; ok {
+		switch v {
+		case loopDelayConstant, loopDelayUniform, loopDelayExponential:
+			k.distribution = v.(string)
+		default:
+			return nil, fmt.Errorf("kaetzchen/loop: invalid delayDistribution: '%v'", v)
+		}
+	}
+	if v, ok := cfg.Config["failureRate"]; ok {
+		f, ok := v.(float64) // TOML floats.
+		if !ok || f < 0 || f > 1 {
+			return nil, fmt.Errorf("kaetzchen/loop: invalid failureRate: '%v'", v)
+		}
+		k.failureRate = f
+	}
+
+	if k.delay > 0 || k.failureRate > 0 {
+		k.log.Warningf("Injecting delay (%v, %v) and failures (%v), for measurement use only.", k.delay, k.distribution, k.failureRate)
+	}
+
 	return k, nil
 }
@@ -0,0 +1,74 @@
+// loop_test.go - Loop Kaetzchen tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopReplyDelay(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+
+	newLoop := func(kv map[string]interface{}) (*kaetzchenLoop, error) {
+		k, err := NewLoop(&config.Kaetzchen{
+			Capability: LoopCapability,
+			Endpoint:   "+loop",
+			Config:     kv,
+		}, goo)
+		if err != nil {
+			return nil, err
+		}
+		return k.(*kaetzchenLoop), nil
+	}
+
+	// Without a delay the replies are sent right away.
+	k, err := newLoop(map[string]interface{}{})
+	require.NoError(err)
+	require.Zero(k.replyDelay())
+
+	k, err = newLoop(map[string]interface{}{"delay": int64(250)})
+	require.NoError(err)
+	require.Equal(250*time.Millisecond, k.replyDelay())
+
+	// The sampled delays are capped.
+	k, err = newLoop(map[string]interface{}{
+		"delay":             int64(maxLoopDelay / time.Millisecond),
+		"delayDistribution": loopDelayUniform,
+	})
+	require.NoError(err)
+	for i := 0; i < 100; i++ {
+		require.True(k.replyDelay() <= maxLoopDelay)
+	}
+
+	_, err = newLoop(map[string]interface{}{"delay": int64(2 * maxLoopDelay / time.Millisecond)})
+	require.Error(err)
+
+	// Failures are injected synchronously.
+	k, err = newLoop(map[string]interface{}{"failureRate": 1.0})
+	require.NoError(err)
+	_, err = k.OnRequest(1, []byte("hello"), true)
+	require.Equal(errInjectedFailure, err)
+}
@@ -0,0 +1,301 @@
+// panda.go - PANDA rendezvous Kaetzchen.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/katzenpost/core/worker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ugorji/go/codec"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// PandaCapability is the standardized capability for the PANDA
+	// rendezvous service.
+	PandaCapability = "panda"
+	pandaVersion    = 0
+
+	pandaStatusOk              = 0
+	pandaStatusSyntaxError     = 1
+	pandaStatusTagContended    = 2
+	pandaStatusRequestRecorded = 3
+	pandaStatusStorageError    = 4
+
+	pandaTagLength         = 32
+	pandaPostingsBucket    = "postings"
+	defaultPandaStore      = "panda.db"
+	defaultPandaExpiration = 3 * time.Hour
+)
+
+var (
+	errPandaTagContended = errors.New("panda: tag contended")
+
+	pandaExpiredPostings = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "panda_expired_postings_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of expired PANDA postings",
+		},
+	)
+)
+
+type pandaRequest struct {
+	Version int
+	Tag     string
+	Message []byte
+}
+
+type pandaResponse struct {
+	Version    int
+	StatusCode int
+	Message    []byte
+}
+
+// pandaPosting is the state of a rendezvous, the first message posted to
+// a tag (A), and the second one (B) once the peer has shown up.
+type pandaPosting struct {
+	A         []byte
+	B         []byte
+	UpdatedAt int64
+}
+
+type kaetzchenPanda struct {
+	worker.Worker
+
+	log *logging.Logger
+
+	params     Parameters
+	jsonHandle codec.JsonHandle
+	db         *bolt.DB
+	expiration time.Duration
+}
+
+func (k *kaetzchenPanda) Capability() string {
+	return PandaCapability
+}
+
+func (k *kaetzchenPanda) Parameters() Parameters {
+	return k.params
+}
+
+func (k *kaetzchenPanda) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, error) {
+	if !hasSURB {
+		return nil, ErrNoResponse
+	}
+
+	k.log.Debugf("Handling request: %v", id)
+	resp := pandaResponse{
+		Version:    pandaVersion,
+		StatusCode: pandaStatusSyntaxError,
+	}
+
+	// Parse out the request payload.
+	var req pandaRequest
+	dec := codec.NewDecoderBytes(bytes.TrimRight(payload, "\x00"), &k.jsonHandle)
+	if err := dec.Decode(&req); err != nil {
+		k.log.Debugf("Failed to decode request: %v (%v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	if req.Version != pandaVersion {
+		k.log.Debugf("Failed to parse request: %v (invalid version: %v)", id, req.Version)
+		return k.encodeResp(&resp), nil
+	}
+	tag, err := hex.DecodeString(req.Tag)
+	if err != nil || len(tag) != pandaTagLength || len(req.Message) == 0 {
+		k.log.Debugf("Failed to parse request: %v (invalid tag or message)", id)
+		return k.encodeResp(&resp), nil
+	}
+
+	msg, err := k.post(tag, req.Message)
+	switch err {
+	case nil:
+		if msg == nil {
+			resp.StatusCode = pandaStatusRequestRecorded
+		} else {
+			resp.StatusCode = pandaStatusOk
+			resp.Message = msg
+		}
+	case errPandaTagContended:
+		resp.StatusCode = pandaStatusTagContended
+	default:
+		k.log.Errorf("Failed to service request: %v (%v)", id, err)
+		resp.StatusCode = pandaStatusStorageError
+	}
+
+	return k.encodeResp(&resp), nil
+}
+
+// post records msg under tag, and returns the peer's message if the peer
+// has posted to the tag.
+func (k *kaetzchenPanda) post(tag, msg []byte) ([]byte, error) {
+	var peerMsg []byte
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(pandaPostingsBucket))
+
+		var p pandaPosting
+		if raw := bkt.Get(tag); raw != nil {
+			if err := codec.NewDecoderBytes(raw, &k.jsonHandle).Decode(&p); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case p.A == nil:
+			p.A = msg
+		case bytes.Equal(p.A, msg):
+			// Still waiting on the peer, or re-polling for the reply.
+			peerMsg = p.B
+			if peerMsg == nil {
+				return nil
+			}
+		case p.B == nil:
+			p.B = msg
+			peerMsg = p.A
+		case bytes.Equal(p.B, msg):
+			peerMsg = p.A
+			return nil
+		default:
+			return errPandaTagContended
+		}
+
+		p.UpdatedAt = time.Now().Unix()
+		var raw []byte
+		if err := codec.NewEncoderBytes(&raw, &k.jsonHandle).Encode(&p); err != nil {
+			return err
+		}
+		return bkt.Put(tag, raw)
+	})
+	return peerMsg, err
+}
+
+// gcWorker periodically removes the postings that were not updated within
+// the expiration period.
+func (k *kaetzchenPanda) gcWorker() {
+	ticker := time.NewTicker(k.expiration / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.HaltCh():
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-k.expiration).Unix()
+		var expired int
+		err := k.db.Update(func(tx *bolt.Tx) error {
+			cur := tx.Bucket([]byte(pandaPostingsBucket)).Cursor()
+			for tag, raw := cur.First(); tag != nil; tag, raw = cur.Next() {
+				var p pandaPosting
+				if err := codec.NewDecoderBytes(raw, &k.jsonHandle).Decode(&p); err == nil && p.UpdatedAt > cutoff {
+					continue
+				}
+				if err := cur.Delete(); err != nil {
+					return err
+				}
+				expired++
+			}
+			return nil
+		})
+		if err != nil {
+			k.log.Errorf("Failed to expire postings: %v", err)
+			continue
+		}
+		if expired > 0 {
+			k.log.Debugf("Expired %v postings.", expired)
+			pandaExpiredPostings.Add(float64(expired))
+		}
+	}
+}
+
+func (k *kaetzchenPanda) Halt() {
+	k.Worker.Halt()
+	_ = k.db.Sync()
+	k.db.Close()
+}
+
+func (k *kaetzchenPanda) encodeResp(resp *pandaResponse) []byte {
+	var out []byte
+	enc := codec.NewEncoderBytes(&out, &k.jsonHandle)
+	_ = enc.Encode(resp)
+	return out
+}
+
+// NewPanda constructs a new PANDA Kaetzchen instance, providing the "panda"
+// capability on the configured endpoint.
+//
+// The optional "fileStore" configuration value specifies the path of the
+// posting store, and "expiration" specifies how long postings are kept
+// after their last update as a Go duration string.
+func NewPanda(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
+	k := &kaetzchenPanda{
+		log:        glue.LogBackend().GetLogger("kaetzchen/panda"),
+		params:     make(Parameters),
+		expiration: defaultPandaExpiration,
+	}
+	k.jsonHandle.Canonical = true
+	k.jsonHandle.ErrorIfNoField = true
+	k.params[ParameterEndpoint] = cfg.Endpoint
+
+	f := filepath.Join(glue.Config().Server.DataDir, defaultPandaStore)
+	if v, ok := cfg.Config["fileStore"]; ok {
+		s, ok := v.(string)
+		if !ok || !filepath.IsAbs(s) {
+			return nil, fmt.Errorf("kaetzchen/panda: invalid fileStore: '%v'", v)
+		}
+		f = s
+	}
+	if v, ok := cfg.Config["expiration"]; ok {
+		s, _ := v.(string)
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("kaetzchen/panda: invalid expiration: '%v'", v)
+		}
+		k.expiration = d
+	}
+
+	var err error
+	if k.db, err = bolt.Open(f, 0600, nil); err != nil {
+		return nil, err
+	}
+	if err = k.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(pandaPostingsBucket))
+		return err
+	}); err != nil {
+		k.db.Close()
+		return nil, err
+	}
+
+	k.Go(k.gcWorker)
+	return k, nil
+}
+
+func init() {
+	prometheus.MustRegister(pandaExpiredPostings)
+}
@@ -0,0 +1,141 @@
+// panda_test.go - PANDA rendezvous Kaetzchen tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestPanda(t *testing.T, dir string, cfg map[string]interface{}) *kaetzchenPanda {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+	goo.s.cfg.Server.DataDir = dir
+
+	k, err := NewPanda(&config.Kaetzchen{
+		Capability: PandaCapability,
+		Endpoint:   "+panda",
+		Config:     cfg,
+	}, goo)
+	require.NoError(t, err)
+	return k.(*kaetzchenPanda)
+}
+
+func TestPandaPost(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "panda")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	k := newTestPanda(t, dir, nil)
+	defer k.Halt()
+
+	tag := bytes.Repeat([]byte{0x42}, pandaTagLength)
+	a, b, c := []byte("alice"), []byte("bob"), []byte("mallory")
+
+	// The first poster waits for the peer.
+	msg, err := k.post(tag, a)
+	require.NoError(err)
+	require.Nil(msg)
+	msg, err = k.post(tag, a)
+	require.NoError(err)
+	require.Nil(msg, "re-polling before the peer posted")
+
+	// The peer gets the first message, and the first poster the peer's.
+	msg, err = k.post(tag, b)
+	require.NoError(err)
+	require.Equal(a, msg)
+	msg, err = k.post(tag, a)
+	require.NoError(err)
+	require.Equal(b, msg)
+	msg, err = k.post(tag, b)
+	require.NoError(err)
+	require.Equal(a, msg, "re-polling after the exchange")
+
+	// A third party can't join the rendezvous.
+	_, err = k.post(tag, c)
+	require.Equal(errPandaTagContended, err)
+
+	// The same, through the request interface.
+	request := func(req *pandaRequest) *pandaResponse {
+		var handle codec.JsonHandle
+		var raw []byte
+		require.NoError(codec.NewEncoderBytes(&raw, &handle).Encode(req))
+		rawResp, err := k.OnRequest(0, raw, true)
+		require.NoError(err)
+		var resp pandaResponse
+		require.NoError(codec.NewDecoderBytes(rawResp, &handle).Decode(&resp))
+		return &resp
+	}
+	otherTag := hex.EncodeToString(bytes.Repeat([]byte{0x23}, pandaTagLength))
+	resp := request(&pandaRequest{Version: pandaVersion, Tag: otherTag, Message: a})
+	require.Equal(pandaStatusRequestRecorded, resp.StatusCode)
+	resp = request(&pandaRequest{Version: pandaVersion, Tag: otherTag, Message: b})
+	require.Equal(pandaStatusOk, resp.StatusCode)
+	require.Equal(a, resp.Message)
+	resp = request(&pandaRequest{Version: pandaVersion, Tag: otherTag, Message: c})
+	require.Equal(pandaStatusTagContended, resp.StatusCode)
+	resp = request(&pandaRequest{Version: pandaVersion, Tag: "42", Message: a})
+	require.Equal(pandaStatusSyntaxError, resp.StatusCode)
+	resp = request(&pandaRequest{Version: pandaVersion + 1, Tag: otherTag, Message: a})
+	require.Equal(pandaStatusSyntaxError, resp.StatusCode)
+}
+
+func TestPandaExpiration(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "panda")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	expired := testutil.ToFloat64(pandaExpiredPostings)
+	k := newTestPanda(t, dir, map[string]interface{}{"expiration": "100ms"})
+	defer k.Halt()
+
+	tag := bytes.Repeat([]byte{0x42}, pandaTagLength)
+	_, err = k.post(tag, []byte("alice"))
+	require.NoError(err)
+
+	// Postings are removed once they were not updated for the expiration
+	// period.
+	require.Eventually(func() bool {
+		var n int
+		_ = k.db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte(pandaPostingsBucket)).Stats().KeyN
+			return nil
+		})
+		return n == 0 && testutil.ToFloat64(pandaExpiredPostings) == expired+1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The tag can be used again.
+	msg, err := k.post(tag, []byte("carol"))
+	require.NoError(err)
+	require.Nil(msg)
+}
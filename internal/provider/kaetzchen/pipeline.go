@@ -0,0 +1,196 @@
+// pipeline.go - Kaetzchen request processing.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// requestPipeline is the request processing shared by the built-in and
+// the plugin Kaetzchen workers.
+type requestPipeline struct {
+	dropCounter uint64
+
+	glue glue.Glue
+	log  *logging.Logger
+
+	limiter    rateLimiter
+	cache      replyCache
+	dedup      dedupWindow
+	acls       aclTable
+	reassembly reassembler
+	slowLog    slowRequestLog
+	errLog     errorLog
+}
+
+// serviceFn calls the Kaetzchen with the request payload, and returns the
+// response, and how long to delay it.
+type serviceFn func(payload []byte, surbs [][]byte) ([]byte, time.Duration, error)
+
+func (p *requestPipeline) getDropCounter() uint64 {
+	return atomic.LoadUint64(&p.dropCounter)
+}
+
+func (p *requestPipeline) incrementDropCounter() uint64 {
+	return atomic.AddUint64(&p.dropCounter, uint64(1))
+}
+
+// process handles the request pkt to the Kaetzchen providing capability
+// via upstream.  The request is reassembled, checked against the access
+// control list and the per-user rate limit, and answered from the reply
+// cache or the deduplication window if possible.  Otherwise the service is
+// called, and the request is accounted for and its reply is sent.
+func (p *requestPipeline) process(pkt *packet.Packet, capability, upstream string, call serviceFn) {
+	defer prometheus.NewTimer(kaetzchenRequestsDuration).ObserveDuration()
+	defer pkt.Dispose()
+
+	timeout := time.Duration(p.glue.Config().Debug.KaetzchenReassemblyTimeout) * time.Millisecond
+	ct, surbs, err := p.reassembly.parse(pkt, timeout)
+	if err == errIncompleteRequest {
+		p.log.Debugf("Buffered Kaetzchen request fragment: %v", pkt.ID)
+		return
+	}
+
+	labels := capabilityLabels(capability)
+	accountant := p.glue.Provider().Accounting()
+	serviceRequests.With(labels).Inc()
+	defer prometheus.NewTimer(serviceRequestsDuration.With(labels)).ObserveDuration()
+
+	if err != nil {
+		p.log.Debugf("Dropping Kaetzchen request: %v (%v)", pkt.ID, err)
+		serviceRequestsFailed.With(labels).Inc()
+		p.incrementDropCounter()
+		kaetzchenRequestsDropped.Inc()
+		return
+	}
+
+	var user string
+	if ct, user, err = p.acls.check(p.glue, pkt.Recipient.ID, ct); err != nil {
+		p.log.Debugf("Rejecting Kaetzchen request: %v (%v)", pkt.ID, err)
+		aclRejectedRequests.With(labels).Inc()
+		return
+	}
+	if !p.limiter.allowUser(pkt.Recipient.ID, user) {
+		onUserRateLimited(p.log, pkt, capability, user)
+		return
+	}
+
+	// Only requests with a SURB are answered from the cache, the others
+	// are made for their side effects.
+	cacheable := surbs != nil && p.cache.enabled(pkt.Recipient.ID)
+	var key [sha256.Size]byte
+	if cacheable {
+		key = cacheKey(user, ct, len(surbs))
+		if resp, ok := p.cache.get(pkt.Recipient.ID, key); ok {
+			p.log.Debugf("Answering Kaetzchen request from cache: %v", pkt.ID)
+			cacheHits.With(labels).Inc()
+			accountant.Record(user, capability, len(ct), len(resp))
+			p.sendReply(pkt, surbs, resp, 0)
+			return
+		}
+		cacheMisses.With(labels).Inc()
+	}
+
+	// Requests with side effects are only made once within the
+	// deduplication window, retransmissions get the original reply.
+	dedup := p.dedup.enabled(pkt.Recipient.ID)
+	var reqKey [sha256.Size]byte
+	if dedup {
+		reqKey = requestKey(user, ct)
+		if resp, dup := p.dedup.check(pkt.Recipient.ID, reqKey); dup {
+			p.log.Debugf("Suppressing duplicate Kaetzchen request: %v", pkt.ID)
+			duplicateRequests.With(labels).Inc()
+			if resp != nil && surbs != nil {
+				p.sendReply(pkt, surbs, resp, 0)
+			}
+			return
+		}
+	}
+
+	requestSizes.With(labels).Observe(float64(len(ct)))
+	start := time.Now()
+	resp, delay, err := call(ct, surbs)
+	p.slowLog.observe(p.glue, p.log, capability, upstream, time.Since(start))
+	switch err {
+	case nil:
+	case ErrNoResponse:
+		p.log.Debugf("Processed Kaetzchen request: %v (No response)", pkt.ID)
+		if dedup {
+			p.dedup.done(pkt.Recipient.ID, reqKey, nil)
+		}
+		accountant.Record(user, capability, len(ct), 0)
+		return
+	default:
+		if dedup {
+			p.dedup.forget(pkt.Recipient.ID, reqKey)
+		}
+		p.log.Debugf("Failed to handle Kaetzchen request: %v (%v)", pkt.ID, err)
+		p.errLog.record(capability, fmt.Errorf("request failed (%v): %v", upstream, err))
+		kaetzchenRequestsFailed.Inc()
+		serviceRequestsFailed.With(labels).Inc()
+		return
+	}
+	if dedup {
+		p.dedup.done(pkt.Recipient.ID, reqKey, resp)
+	}
+	responseSizes.With(labels).Observe(float64(len(resp)))
+	accountant.Record(user, capability, len(ct), len(resp))
+
+	// Iff there is a SURB, generate a SURB-Reply and schedule.
+	if surbs != nil {
+		if cacheable {
+			p.cache.put(pkt.Recipient.ID, key, resp)
+		}
+		p.sendReply(pkt, surbs, resp, delay)
+	} else if resp != nil {
+		// This is silly and I'm not sure why anyone will do this, but
+		// there's nothing that can be done at this point, the Kaetzchen
+		// implementation should have caught this.
+		p.log.Debugf("Kaetzchen message: %v (Has reply but no SURB)", pkt.ID)
+	}
+}
+
+// sendReply hands off the SURB-Reply to the scheduler after delay, without
+// blocking the caller.
+func (p *requestPipeline) sendReply(pkt *packet.Packet, surbs [][]byte, resp []byte, delay time.Duration) {
+	respPkts, err := newReplyPackets(pkt, surbs, resp)
+	if err != nil {
+		p.log.Debugf("Failed to generate SURB-Reply: %v (%v)", pkt.ID, err)
+		return
+	}
+
+	srcID := pkt.ID
+	handOff := func() {
+		for _, respPkt := range respPkts {
+			p.log.Debugf("Handing off newly generated SURB-Reply: %v (Src:%v)", respPkt.ID, srcID)
+			p.glue.Scheduler().OnPacket(respPkt)
+		}
+	}
+	if delay <= 0 {
+		handOff()
+		return
+	}
+	time.AfterFunc(delay, handOff)
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/stretchr/testify/require"
 )
 
@@ -84,3 +85,103 @@ func TestCBORInvalidCommandWithPluginKaetzchenWorker(t *testing.T) {
 	_, err = NewCBORPluginWorker(goo)
 	require.Error(err)
 }
+
+func TestCBORParseLoadPlugin(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+	goo.s.cfg.Provider.CBORPluginKaetzchen = []*config.CBORPluginKaetzchen{
+		&config.CBORPluginKaetzchen{
+			Capability:     "echo",
+			Endpoint:       "+echo",
+			Command:        "/usr/lib/katzenpost/echo",
+			MaxConcurrency: 1,
+			Disable:        true,
+		},
+	}
+	k := &CBORPluginWorker{
+		requestPipeline: requestPipeline{glue: goo},
+		cfgs:            goo.s.cfg.Provider.CBORPluginKaetzchen,
+	}
+
+	// The configured plugins are loaded by name.
+	cfg, err := k.parseLoadPlugin([]string{"LOAD_PLUGIN", "echo"})
+	require.NoError(err)
+	require.Equal("/usr/lib/katzenpost/echo", cfg.Command)
+	require.False(cfg.Disable)
+	_, err = k.parseLoadPlugin([]string{"LOAD_PLUGIN", "meow"})
+	require.Error(err)
+
+	// Arbitrary programs are never executed without a PluginDir.
+	_, err = k.parseLoadPlugin([]string{"LOAD_PLUGIN", "meow", "+meow", "meow", "1"})
+	require.Error(err)
+
+	goo.s.cfg.Provider.PluginDir = "/var/lib/katzenpost/plugins"
+	goo.s.cfg.Provider.PluginSandbox = &config.PluginSandbox{
+		WorkingDir: "/var/lib/katzenpost/plugins",
+		MaxMemory:  1 << 30,
+	}
+	cfg, err = k.parseLoadPlugin([]string{"LOAD_PLUGIN", "meow", "+meow", "meow", "2", "-lang", "ja"})
+	require.NoError(err)
+	require.Equal("/var/lib/katzenpost/plugins/meow", cfg.Command)
+	require.Equal(2, cfg.MaxConcurrency)
+	require.Equal(map[string]interface{}{"lang": "ja"}, cfg.Config)
+	require.Equal(goo.s.cfg.Provider.PluginSandbox, cfg.Sandbox)
+	require.False(goo.s.cfg.Provider.PluginSandbox == cfg.Sandbox, "the sandbox is copied")
+
+	for _, sp := range [][]string{
+		{"LOAD_PLUGIN", "meow", "+meow", "/bin/sh", "1"},
+		{"LOAD_PLUGIN", "meow", "+meow", "../../../bin/sh", "1"},
+		{"LOAD_PLUGIN", "meow", "+meow", "..", "1"},
+		{"LOAD_PLUGIN", "meow", "+meow", "meow", "0"},
+		{"LOAD_PLUGIN", "meow", "+meow", "meow", "1", "-lang"},
+		{"LOAD_PLUGIN", "meow", "+Meow", "meow", "1"},
+		{"LOAD_PLUGIN", "meow", "meow@example.org", "meow", "1"},
+		{"LOAD_PLUGIN", "echo", "+echo2", "meow", "1"},
+	} {
+		_, err = k.parseLoadPlugin(sp)
+		require.Error(err, "%v", sp)
+	}
+}
+
+func TestCBORAddPluginReservation(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+	k := &CBORPluginWorker{
+		requestPipeline: requestPipeline{
+			glue: goo,
+			log:  logBackend.GetLogger("test"),
+		},
+		pluginChans: make(PluginChans),
+	}
+	echo := &config.CBORPluginKaetzchen{Capability: "echo", Endpoint: "+echo"}
+	var echoEp, meowEp [sConstants.RecipientIDLength]byte
+	copy(echoEp[:], "+echo")
+	copy(meowEp[:], "+meow")
+
+	// A capability or endpoint being launched can't be registered again.
+	require.NoError(k.reserve(echo, echoEp))
+	require.Error(k.reserve(echo, meowEp))
+	require.Error(k.reserve(&config.CBORPluginKaetzchen{Capability: "meow", Endpoint: "+echo"}, echoEp))
+	k.release("echo")
+	require.NoError(k.reserve(echo, echoEp))
+	k.release("echo")
+
+	// A failed launch releases the reservation.
+	err = k.addPlugin(&config.CBORPluginKaetzchen{
+		Capability:     "echo",
+		Endpoint:       "+echo",
+		Command:        "non-existent command",
+		MaxConcurrency: 1,
+	})
+	require.Error(err)
+	require.Empty(k.reserved)
+	require.False(k.IsKaetzchen(echoEp))
+}
@@ -0,0 +1,208 @@
+// ratelimit.go - Kaetzchen request rate limiting.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// maxIdleUserBuckets is the number of per-user buckets above which the
+// buckets of the users that are back to a full burst are discarded.
+const maxIdleUserBuckets = 1024
+
+var kaetzchenRequestsRateLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "rate_limited_requests_total",
+		Subsystem: constants.KaetzchenSubsystem,
+		Help:      "Number of kaetzchen requests dropped due to rate limiting",
+	},
+	[]string{"capability"},
+)
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate   float64 // Tokens per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute, burst uint64, now time.Time) *tokenBucket {
+	if burst == 0 {
+		burst = perMinute
+	}
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type userLimit struct {
+	perMinute uint64
+	burst     uint64
+}
+
+type userBucketKey struct {
+	endpoint [sConstants.RecipientIDLength]byte
+	user     string
+}
+
+// rateLimiter limits the rate of requests to each Kaetzchen endpoint.
+//
+// The sender of a request is only known to the Provider when the request
+// is authenticated by the endpoint's access control list, see aclTable.
+// Authenticated requests are limited per user, so that a single user can
+// not exhaust the endpoint's limit, which otherwise applies to the
+// endpoint as a whole, and caps the total rate of requests.
+type rateLimiter struct {
+	sync.Mutex
+
+	buckets     map[[sConstants.RecipientIDLength]byte]*tokenBucket
+	userLimits  map[[sConstants.RecipientIDLength]byte]userLimit
+	userBuckets map[userBucketKey]*tokenBucket
+}
+
+// setLimit sets the rate limit for an endpoint, in requests per minute.  If
+// burst is 0, up to a minute's worth of requests will be accepted at once.
+// A perMinute of 0 disables rate limiting for the endpoint.
+func (r *rateLimiter) setLimit(endpoint [sConstants.RecipientIDLength]byte, perMinute, burst uint64) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.buckets == nil {
+		r.buckets = make(map[[sConstants.RecipientIDLength]byte]*tokenBucket)
+	}
+	if perMinute == 0 {
+		delete(r.buckets, endpoint)
+		return
+	}
+	r.buckets[endpoint] = newTokenBucket(perMinute, burst, time.Now())
+}
+
+// setUserLimit sets the rate limit for each user of an endpoint, in
+// requests per minute, with the same semantics as setLimit.
+func (r *rateLimiter) setUserLimit(endpoint [sConstants.RecipientIDLength]byte, perMinute, burst uint64) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.userLimits == nil {
+		r.userLimits = make(map[[sConstants.RecipientIDLength]byte]userLimit)
+		r.userBuckets = make(map[userBucketKey]*tokenBucket)
+	}
+	for k := range r.userBuckets {
+		if k.endpoint == endpoint {
+			delete(r.userBuckets, k)
+		}
+	}
+	if perMinute == 0 {
+		delete(r.userLimits, endpoint)
+		return
+	}
+	r.userLimits[endpoint] = userLimit{perMinute, burst}
+}
+
+// allow returns true iff a request to the endpoint is within the limit.
+func (r *rateLimiter) allow(endpoint [sConstants.RecipientIDLength]byte) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	b, ok := r.buckets[endpoint]
+	if !ok {
+		return true
+	}
+	return b.allow(time.Now())
+}
+
+// allowUser returns true iff a request to the endpoint by the authenticated
+// user is within the user's limit.  Unauthenticated requests, with an empty
+// user, are only subject to the endpoint's limit.
+func (r *rateLimiter) allowUser(endpoint [sConstants.RecipientIDLength]byte, user string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	limit, ok := r.userLimits[endpoint]
+	if !ok || user == "" {
+		return true
+	}
+	now := time.Now()
+	key := userBucketKey{endpoint, user}
+	b, ok := r.userBuckets[key]
+	if !ok {
+		if len(r.userBuckets) >= maxIdleUserBuckets {
+			r.pruneUserBuckets(now)
+		}
+		b = newTokenBucket(limit.perMinute, limit.burst, now)
+		r.userBuckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// pruneUserBuckets discards the buckets that are full, as they are
+// equivalent to a new bucket.  It must be called with the lock held.
+func (r *rateLimiter) pruneUserBuckets(now time.Time) {
+	for k, b := range r.userBuckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(r.userBuckets, k)
+		}
+	}
+}
+
+// onRateLimited disposes of a request that exceeded the endpoint's rate
+// limit.
+func onRateLimited(log *logging.Logger, pkt *packet.Packet, capa string) {
+	log.Debugf("Dropping Kaetzchen request: %v (Rate limited: '%v')", pkt.ID, capa)
+	kaetzchenRequestsRateLimited.With(capabilityLabels(capa)).Inc()
+	pkt.Dispose()
+}
+
+// onUserRateLimited records a request that exceeded the user's rate limit.
+func onUserRateLimited(log *logging.Logger, pkt *packet.Packet, capa, user string) {
+	log.Debugf("Dropping Kaetzchen request: %v (Rate limited: '%v' user '%v')", pkt.ID, capa, user)
+	kaetzchenRequestsRateLimited.With(capabilityLabels(capa)).Inc()
+}
+
+func init() {
+	prometheus.MustRegister(kaetzchenRequestsRateLimited)
+}
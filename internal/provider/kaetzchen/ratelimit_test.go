@@ -0,0 +1,104 @@
+// ratelimit_test.go - Kaetzchen request rate limiting tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	b := newTokenBucket(60, 2, now)
+	require.True(b.allow(now))
+	require.True(b.allow(now))
+	require.False(b.allow(now), "the burst is exhausted")
+	require.True(b.allow(now.Add(time.Second)), "a token is added every second")
+	require.False(b.allow(now.Add(time.Second)))
+
+	b = newTokenBucket(60, 0, now)
+	require.Equal(float64(60), b.burst, "the burst defaults to the rate")
+}
+
+func TestRateLimiter(t *testing.T) {
+	require := require.New(t)
+
+	var ep, other [sConstants.RecipientIDLength]byte
+	copy(ep[:], "echo")
+	copy(other[:], "meow")
+
+	var r rateLimiter
+	require.True(r.allow(ep), "no limit is set")
+	require.True(r.allowUser(ep, "alice"), "no user limit is set")
+
+	r.setLimit(ep, 60, 3)
+	r.setUserLimit(ep, 60, 1)
+
+	// Each user has their own bucket.
+	require.True(r.allowUser(ep, "alice"))
+	require.False(r.allowUser(ep, "alice"))
+	require.True(r.allowUser(ep, "bob"))
+	require.False(r.allowUser(ep, "bob"))
+
+	// Unauthenticated requests and other endpoints are not limited per user.
+	require.True(r.allowUser(ep, ""))
+	require.True(r.allowUser(other, "alice"))
+
+	// The endpoint's limit caps the requests of all the users.
+	require.True(r.allow(ep))
+	require.True(r.allow(ep))
+	require.True(r.allow(ep))
+	require.False(r.allow(ep))
+	require.True(r.allow(other))
+
+	// Changing the user limit resets the buckets, removing it disables it.
+	r.setUserLimit(ep, 60, 1)
+	require.True(r.allowUser(ep, "alice"))
+	r.setUserLimit(ep, 0, 0)
+	require.True(r.allowUser(ep, "alice"))
+	require.True(r.allowUser(ep, "alice"))
+
+	// Removing the endpoint's limit disables it.
+	r.setLimit(ep, 0, 0)
+	require.True(r.allow(ep))
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "echo")
+
+	var r rateLimiter
+	r.setUserLimit(ep, 60, 1)
+	require.True(r.allowUser(ep, "alice"))
+	for i := 0; i < maxIdleUserBuckets; i++ {
+		r.userBuckets[userBucketKey{ep, fmt.Sprintf("user%d", i)}] = newTokenBucket(60, 1, time.Now())
+	}
+
+	// The full buckets are discarded once the limit is reached, and the
+	// empty bucket of alice is kept.
+	require.True(r.allowUser(ep, "bob"))
+	require.Len(r.userBuckets, 2)
+	require.False(r.allowUser(ep, "alice"))
+}
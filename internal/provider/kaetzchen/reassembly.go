@@ -0,0 +1,178 @@
+// reassembly.go - Kaetzchen multi-packet request reassembly.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxReassemblyBytes bounds the memory used by partially received
+	// requests.
+	maxReassemblyBytes = 64 * 1024 * 1024
+
+	// maxPendingRequests bounds the number of partially received requests.
+	maxPendingRequests = 4096
+)
+
+var (
+	errIncompleteRequest = errors.New("incomplete request")
+
+	reassembledRequests = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "reassembled_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests reassembled from fragments",
+		},
+	)
+	reassemblyExpired = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "reassembly_expired_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of partially received Kaetzchen requests discarded",
+		},
+	)
+)
+
+type reassemblyKey struct {
+	endpoint  [sConstants.RecipientIDLength]byte
+	messageID uint64
+}
+
+type partialRequest struct {
+	fragments [][]byte
+	received  int
+	size      int
+	expires   time.Time
+}
+
+// reassembler reassembles requests spanning multiple packets.
+//
+// Note: The message ID is chosen by the client, and the sender of a
+// fragment is not visible to the Provider, so clients should use random
+// message IDs to avoid collisions.
+type reassembler struct {
+	sync.Mutex
+
+	pending map[reassemblyKey]*partialRequest
+	size    int
+}
+
+// parse parses a request packet, reassembling requests spanning multiple
+// packets.  errIncompleteRequest is returned for the fragments of a
+// request that is not complete yet, which are retained for up to timeout.
+func (r *reassembler) parse(pkt *packet.Packet, timeout time.Duration) ([]byte, [][]byte, error) {
+	if !packet.IsFragment(pkt) {
+		return packet.ParseMultiSURBPacket(pkt)
+	}
+
+	f, err := packet.ParseFragment(pkt)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := r.add(reassemblyKey{pkt.Recipient.ID, f.MessageID}, f, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	reassembledRequests.Inc()
+	return packet.ParseReassembledPayload(b)
+}
+
+// add adds a fragment, and returns the reassembled request payload once all
+// of its fragments have been received.
+func (r *reassembler) add(key reassemblyKey, f *packet.Fragment, timeout time.Duration) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.pending == nil {
+		r.pending = make(map[reassemblyKey]*partialRequest)
+	}
+	now := time.Now()
+	p, ok := r.pending[key]
+	if ok && now.After(p.expires) {
+		r.discard(key, p)
+		reassemblyExpired.Inc()
+		ok = false
+	}
+	if !ok {
+		r.expire(now)
+		if len(r.pending) >= maxPendingRequests {
+			return nil, fmt.Errorf("too many partial requests")
+		}
+		p = &partialRequest{
+			fragments: make([][]byte, f.Count),
+			expires:   now.Add(timeout),
+		}
+		r.pending[key] = p
+	}
+	if len(p.fragments) != f.Count {
+		r.discard(key, p)
+		return nil, fmt.Errorf("inconsistent fragment count: %v", f.Count)
+	}
+	if p.fragments[f.Index] != nil {
+		return nil, fmt.Errorf("duplicate fragment: %v/%v", f.Index, f.Count)
+	}
+	if r.size+len(f.Data) > maxReassemblyBytes {
+		return nil, fmt.Errorf("reassembly buffer full")
+	}
+
+	p.fragments[f.Index] = append([]byte{}, f.Data...)
+	p.received++
+	p.size += len(f.Data)
+	r.size += len(f.Data)
+	if p.received < f.Count {
+		return nil, errIncompleteRequest
+	}
+
+	r.discard(key, p)
+	b := make([]byte, 0, p.size)
+	for _, frag := range p.fragments {
+		b = append(b, frag...)
+	}
+	return b, nil
+}
+
+// expire discards the partially received requests that timed out.  It must
+// be called with the lock held.
+func (r *reassembler) expire(now time.Time) {
+	for k, p := range r.pending {
+		if now.After(p.expires) {
+			r.discard(k, p)
+			reassemblyExpired.Inc()
+		}
+	}
+}
+
+func (r *reassembler) discard(key reassemblyKey, p *partialRequest) {
+	delete(r.pending, key)
+	r.size -= p.size
+}
+
+func init() {
+	prometheus.MustRegister(reassembledRequests)
+	prometheus.MustRegister(reassemblyExpired)
+}
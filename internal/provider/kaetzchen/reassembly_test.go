@@ -0,0 +1,104 @@
+// reassembly_test.go - Kaetzchen request reassembly tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/packet"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+upload")
+	key := reassemblyKey{ep, 42}
+	frag := func(index, count int, data string) *packet.Fragment {
+		return &packet.Fragment{MessageID: 42, Index: index, Count: count, Data: []byte(data)}
+	}
+
+	var r reassembler
+
+	// The fragments may arrive in any order.
+	_, err := r.add(key, frag(2, 3, "baz"), time.Minute)
+	require.Equal(errIncompleteRequest, err)
+	_, err = r.add(key, frag(0, 3, "foo"), time.Minute)
+	require.Equal(errIncompleteRequest, err)
+	_, err = r.add(key, frag(0, 3, "foo"), time.Minute)
+	require.Error(err, "duplicate fragment")
+	require.Equal(6, r.size)
+	b, err := r.add(key, frag(1, 3, "bar"), time.Minute)
+	require.NoError(err)
+	require.Equal([]byte("foobarbaz"), b)
+	require.Empty(r.pending)
+	require.Equal(0, r.size)
+
+	// Requests with the same message ID to other endpoints are distinct.
+	var other [sConstants.RecipientIDLength]byte
+	copy(other[:], "+echo")
+	_, err = r.add(key, frag(0, 2, "foo"), time.Minute)
+	require.Equal(errIncompleteRequest, err)
+	b, err = r.add(reassemblyKey{other, 42}, frag(0, 1, "meow"), time.Minute)
+	require.NoError(err)
+	require.Equal([]byte("meow"), b)
+
+	// An inconsistent fragment count discards the request.
+	_, err = r.add(key, frag(1, 3, "bar"), time.Minute)
+	require.Error(err)
+	require.Empty(r.pending)
+	require.Equal(0, r.size)
+
+	// Partial requests expire.
+	_, err = r.add(key, frag(0, 2, "foo"), time.Minute)
+	require.Equal(errIncompleteRequest, err)
+	r.pending[key].expires = time.Now().Add(-time.Second)
+	_, err = r.add(key, frag(1, 2, "bar"), time.Minute)
+	require.Equal(errIncompleteRequest, err, "the first fragment expired")
+	require.Equal(3, r.size)
+}
+
+func TestReassemblerBounded(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+upload")
+
+	var r reassembler
+	for i := 0; i < maxPendingRequests; i++ {
+		_, err := r.add(reassemblyKey{ep, uint64(i)}, &packet.Fragment{MessageID: uint64(i), Count: 2, Data: []byte{0}}, time.Minute)
+		require.Equal(errIncompleteRequest, err)
+	}
+	_, err := r.add(reassemblyKey{ep, maxPendingRequests}, &packet.Fragment{MessageID: maxPendingRequests, Count: 2, Data: []byte{0}}, time.Minute)
+	require.Error(err, "too many partial requests")
+
+	// Expired requests make room for new ones.
+	r.pending[reassemblyKey{ep, 0}].expires = time.Now().Add(-time.Second)
+	_, err = r.add(reassemblyKey{ep, maxPendingRequests}, &packet.Fragment{MessageID: maxPendingRequests, Count: 2, Data: []byte{0}}, time.Minute)
+	require.Equal(errIncompleteRequest, err)
+
+	// The buffered data is bounded.
+	var r2 reassembler
+	data := make([]byte, maxReassemblyBytes/2+1)
+	_, err = r2.add(reassemblyKey{ep, 1}, &packet.Fragment{MessageID: 1, Count: 2, Data: data}, time.Minute)
+	require.Equal(errIncompleteRequest, err)
+	_, err = r2.add(reassemblyKey{ep, 2}, &packet.Fragment{MessageID: 2, Count: 2, Data: data}, time.Minute)
+	require.Error(err, "reassembly buffer full")
+}
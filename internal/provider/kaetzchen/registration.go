@@ -0,0 +1,345 @@
+// registration.go - Self-service account registration Kaetzchen.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ugorji/go/codec"
+	"golang.org/x/text/secure/precis"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// RegistrationCapability is the standardized capability for the
+	// self-service account registration service.
+	RegistrationCapability = "registration"
+	registrationVersion    = 0
+
+	registrationStatusOk           = 0
+	registrationStatusSyntaxError  = 1
+	registrationStatusUserExists   = 2
+	registrationStatusRejected     = 3
+	registrationStatusRateLimited  = 4
+	registrationStatusStorageError = 5
+
+	maxPoWDifficulty = 32
+)
+
+var registrationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "registrations_total",
+		Subsystem: constants.KaetzchenSubsystem,
+		Help:      "Number of self-service registration requests by status",
+	},
+	[]string{"status"},
+)
+
+type registrationRequest struct {
+	Version     int
+	User        string
+	LinkKey     string
+	IdentityKey string
+	InviteToken string
+	Nonce       uint64
+}
+
+type registrationResponse struct {
+	Version    int
+	StatusCode int
+	User       string
+}
+
+type kaetzchenRegistration struct {
+	sync.Mutex
+
+	log  *logging.Logger
+	glue glue.Glue
+
+	params     Parameters
+	jsonHandle codec.JsonHandle
+
+	// Policy.
+	tokensFile    string
+	tokens        map[string]bool
+	powDifficulty int
+	limiter       *tokenBucket
+}
+
+func (k *kaetzchenRegistration) Capability() string {
+	return RegistrationCapability
+}
+
+func (k *kaetzchenRegistration) Parameters() Parameters {
+	return k.params
+}
+
+func (k *kaetzchenRegistration) OnRequest(id uint64, payload []byte, hasSURB bool) ([]byte, error) {
+	if !hasSURB {
+		return nil, ErrNoResponse
+	}
+
+	k.log.Debugf("Handling request: %v", id)
+	resp := registrationResponse{
+		Version:    registrationVersion,
+		StatusCode: registrationStatusSyntaxError,
+	}
+	defer func() {
+		registrationsTotal.With(prometheus.Labels{"status": fmt.Sprintf("%d", resp.StatusCode)}).Inc()
+	}()
+
+	// Parse out the request payload.
+	var req registrationRequest
+	dec := codec.NewDecoderBytes(bytes.TrimRight(payload, "\x00"), &k.jsonHandle)
+	if err := dec.Decode(&req); err != nil {
+		k.log.Debugf("Failed to decode request: %v (%v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	if req.Version != registrationVersion {
+		k.log.Debugf("Failed to parse request: %v (invalid version: %v)", id, req.Version)
+		return k.encodeResp(&resp), nil
+	}
+	user, err := fixupUserName(k.glue.Config().Provider, req.User)
+	if err != nil {
+		k.log.Debugf("Failed to parse request: %v (invalid user: %v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	resp.User = string(user)
+	linkKey := new(ecdh.PublicKey)
+	if err = linkKey.FromString(req.LinkKey); err != nil {
+		k.log.Debugf("Failed to parse request: %v (invalid link key: %v)", id, err)
+		return k.encodeResp(&resp), nil
+	}
+	var identityKey *ecdh.PublicKey
+	if req.IdentityKey != "" {
+		identityKey = new(ecdh.PublicKey)
+		if err = identityKey.FromString(req.IdentityKey); err != nil {
+			k.log.Debugf("Failed to parse request: %v (invalid identity key: %v)", id, err)
+			return k.encodeResp(&resp), nil
+		}
+	}
+
+	// Apply the policy, the cheap checks first.
+	if !k.checkPoW(user, linkKey, req.Nonce) {
+		k.log.Debugf("Rejecting request: %v (insufficient proof of work)", id)
+		resp.StatusCode = registrationStatusRejected
+		return k.encodeResp(&resp), nil
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	if k.tokens != nil && !k.tokens[req.InviteToken] {
+		k.log.Debugf("Rejecting request: %v (invalid invite token)", id)
+		resp.StatusCode = registrationStatusRejected
+		return k.encodeResp(&resp), nil
+	}
+	if k.limiter != nil && !k.limiter.allow(time.Now()) {
+		k.log.Debugf("Rejecting request: %v (rate limited)", id)
+		resp.StatusCode = registrationStatusRateLimited
+		return k.encodeResp(&resp), nil
+	}
+
+	udb := k.glue.Provider().UserDB()
+	if udb.Exists(user) {
+		resp.StatusCode = registrationStatusUserExists
+		return k.encodeResp(&resp), nil
+	}
+	if err = udb.Add(user, linkKey, false); err != nil {
+		k.log.Errorf("Failed to add user: %v (%v)", id, err)
+		resp.StatusCode = registrationStatusStorageError
+		return k.encodeResp(&resp), nil
+	}
+	if identityKey != nil {
+		if err = udb.SetIdentity(user, identityKey); err != nil {
+			k.log.Errorf("Failed to set identity key: %v (%v)", id, err)
+			resp.StatusCode = registrationStatusStorageError
+			return k.encodeResp(&resp), nil
+		}
+	}
+	if k.tokens != nil {
+		// Invite tokens are single use.
+		delete(k.tokens, req.InviteToken)
+		if err = k.saveTokens(); err != nil {
+			k.log.Errorf("Failed to save invite tokens: %v", err)
+		}
+	}
+
+	k.log.Noticef("Registration created user: %s", user)
+	resp.StatusCode = registrationStatusOk
+	return k.encodeResp(&resp), nil
+}
+
+// fixupUserName normalizes the user name the same way the Provider
+// normalizes recipients.
+func fixupUserName(pCfg *config.Provider, u string) ([]byte, error) {
+	if u == "" || len(u) > userdb.MaxUsernameSize {
+		return nil, fmt.Errorf("invalid length: %v", len(u))
+	}
+
+	switch {
+	case pCfg.BinaryRecipients:
+		return []byte(u), nil
+	case pCfg.CaseSensitiveRecipients:
+		return precis.UsernameCasePreserved.Bytes([]byte(u))
+	default:
+		return precis.UsernameCaseMapped.Bytes([]byte(u))
+	}
+}
+
+// checkPoW returns true iff SHA256(user | linkKey | nonce) has at least the
+// configured number of leading zero bits.
+func (k *kaetzchenRegistration) checkPoW(user []byte, linkKey *ecdh.PublicKey, nonce uint64) bool {
+	if k.powDifficulty == 0 {
+		return true
+	}
+
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], nonce)
+	h := sha256.New()
+	_, _ = h.Write(user)
+	_, _ = h.Write(linkKey.Bytes())
+	_, _ = h.Write(n[:])
+	digest := h.Sum(nil)
+
+	return bits.LeadingZeros32(binary.BigEndian.Uint32(digest)) >= k.powDifficulty
+}
+
+// loadTokens loads the invite tokens, one per line.
+func (k *kaetzchenRegistration) loadTokens() error {
+	f, err := os.Open(k.tokensFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	k.tokens = make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if tok := strings.TrimSpace(scanner.Text()); tok != "" {
+			k.tokens[tok] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// saveTokens atomically rewrites the invite token file with the unused
+// tokens.
+func (k *kaetzchenRegistration) saveTokens() error {
+	var buf bytes.Buffer
+	for tok := range k.tokens {
+		buf.WriteString(tok + "\n")
+	}
+	tmp := k.tokensFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.tokensFile)
+}
+
+func (k *kaetzchenRegistration) Halt() {
+	// No termination required.
+}
+
+func (k *kaetzchenRegistration) encodeResp(resp *registrationResponse) []byte {
+	var out []byte
+	enc := codec.NewEncoderBytes(&out, &k.jsonHandle)
+	_ = enc.Encode(resp)
+	return out
+}
+
+// NewRegistration constructs a new self-service registration Kaetzchen
+// instance, providing the "registration" capability on the configured
+// endpoint.
+//
+// Requests arrive via the mix network, so they can be sent through any
+// Provider the client can already access.  The registration policy is set
+// with the optional "inviteTokens" (path of a file with one single use
+// token per line), "powDifficulty" (leading zero bits of
+// SHA256(user | link key | nonce)), and "maxPerHour" (registrations)
+// configuration values.
+func NewRegistration(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
+	k := &kaetzchenRegistration{
+		log:    glue.LogBackend().GetLogger("kaetzchen/registration"),
+		glue:   glue,
+		params: make(Parameters),
+	}
+	k.jsonHandle.Canonical = true
+	k.jsonHandle.ErrorIfNoField = true
+	k.params[ParameterEndpoint] = cfg.Endpoint
+
+	if v, ok := cfg.Config["inviteTokens"]; ok {
+		s, ok := v.(string)
+		if !ok || !filepath.IsAbs(s) {
+			return nil, fmt.Errorf("kaetzchen/registration: invalid inviteTokens: '%v'", v)
+		}
+		k.tokensFile = s
+		if err := k.loadTokens(); err != nil {
+			return nil, fmt.Errorf("kaetzchen/registration: failed to load invite tokens: %v", err)
+		}
+		// An empty token is never valid.
+		delete(k.tokens, "")
+	}
+
+	var err error
+	if k.powDifficulty, _, err = configInt(cfg, "powDifficulty"); err != nil {
+		return nil, err
+	}
+	if k.powDifficulty > maxPoWDifficulty {
+		return nil, fmt.Errorf("kaetzchen/registration: powDifficulty exceeds %v", maxPoWDifficulty)
+	}
+	maxPerHour, ok, err := configInt(cfg, "maxPerHour")
+	if err != nil {
+		return nil, err
+	}
+	if ok && maxPerHour > 0 {
+		k.limiter = &tokenBucket{
+			rate:   float64(maxPerHour) / 3600,
+			burst:  float64(maxPerHour),
+			tokens: float64(maxPerHour),
+			last:   time.Now(),
+		}
+	}
+
+	if k.tokens == nil && k.powDifficulty == 0 && k.limiter == nil {
+		k.log.Warningf("Registration is enabled without any policy, anyone can create accounts.")
+	}
+
+	return k, nil
+}
+
+func init() {
+	prometheus.MustRegister(registrationsTotal)
+}
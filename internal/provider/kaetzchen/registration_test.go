@@ -0,0 +1,220 @@
+// registration_test.go - Self-service registration Kaetzchen tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+type memUserDB struct {
+	links      map[string]*ecdh.PublicKey
+	identities map[string]*ecdh.PublicKey
+}
+
+func (u *memUserDB) Exists(user []byte) bool {
+	_, ok := u.links[string(user)]
+	return ok
+}
+
+func (u *memUserDB) IsValid([]byte, *ecdh.PublicKey) bool { return true }
+
+func (u *memUserDB) Link(user []byte) (*ecdh.PublicKey, error) {
+	return u.links[string(user)], nil
+}
+
+func (u *memUserDB) Add(user []byte, k *ecdh.PublicKey, update bool) error {
+	u.links[string(user)] = k
+	return nil
+}
+
+func (u *memUserDB) SetIdentity(user []byte, k *ecdh.PublicKey) error {
+	u.identities[string(user)] = k
+	return nil
+}
+
+func (u *memUserDB) Identity(user []byte) (*ecdh.PublicKey, error) {
+	return u.identities[string(user)], nil
+}
+
+func (u *memUserDB) Remove(user []byte) error {
+	delete(u.links, string(user))
+	return nil
+}
+
+func (u *memUserDB) Close() {}
+
+type registrationProvider struct {
+	*mockProvider
+	udb *memUserDB
+}
+
+func (p *registrationProvider) UserDB() userdb.UserDB {
+	return p.udb
+}
+
+type registrationTest struct {
+	t   *testing.T
+	goo *mockGlue
+	udb *memUserDB
+}
+
+func newRegistrationTest(t *testing.T) *registrationTest {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	udb := &memUserDB{
+		links:      make(map[string]*ecdh.PublicKey),
+		identities: make(map[string]*ecdh.PublicKey),
+	}
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+	goo.s.provider = &registrationProvider{&mockProvider{}, udb}
+	return &registrationTest{t: t, goo: goo, udb: udb}
+}
+
+func (r *registrationTest) newRegistration(cfg map[string]interface{}) *kaetzchenRegistration {
+	k, err := NewRegistration(&config.Kaetzchen{
+		Capability: RegistrationCapability,
+		Endpoint:   "+registration",
+		Config:     cfg,
+	}, r.goo)
+	require.NoError(r.t, err)
+	return k.(*kaetzchenRegistration)
+}
+
+func (r *registrationTest) register(k *kaetzchenRegistration, req *registrationRequest) int {
+	var handle codec.JsonHandle
+	var b []byte
+	require.NoError(r.t, codec.NewEncoderBytes(&b, &handle).Encode(req))
+	rawResp, err := k.OnRequest(0, b, true)
+	require.NoError(r.t, err)
+
+	var resp registrationResponse
+	require.NoError(r.t, codec.NewDecoderBytes(rawResp, &handle).Decode(&resp))
+	return resp.StatusCode
+}
+
+func newRegistrationRequest(t *testing.T, user string) *registrationRequest {
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(t, err)
+	return &registrationRequest{
+		Version: registrationVersion,
+		User:    user,
+		LinkKey: linkKey.PublicKey().String(),
+	}
+}
+
+func TestRegistrationPoW(t *testing.T) {
+	require := require.New(t)
+
+	r := newRegistrationTest(t)
+	k := r.newRegistration(map[string]interface{}{"powDifficulty": int64(8)})
+
+	req := newRegistrationRequest(t, "alice")
+	linkKey := new(ecdh.PublicKey)
+	require.NoError(linkKey.FromString(req.LinkKey))
+	var good, bad uint64
+	for good = 0; !k.checkPoW([]byte("alice"), linkKey, good); good++ {
+	}
+	for bad = 0; k.checkPoW([]byte("alice"), linkKey, bad); bad++ {
+	}
+
+	req.Nonce = bad
+	require.Equal(registrationStatusRejected, r.register(k, req))
+	require.False(r.udb.Exists([]byte("alice")))
+
+	req.Nonce = good
+	require.Equal(registrationStatusOk, r.register(k, req))
+	require.True(r.udb.Exists([]byte("alice")))
+}
+
+func TestRegistrationInviteTokens(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "registration")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	tokensFile := filepath.Join(dir, "invites")
+	require.NoError(ioutil.WriteFile(tokensFile, []byte("tok1\n\ntok2\n"), 0600))
+
+	r := newRegistrationTest(t)
+	cfg := map[string]interface{}{"inviteTokens": tokensFile}
+	k := r.newRegistration(cfg)
+
+	req := newRegistrationRequest(t, "alice")
+	require.Equal(registrationStatusRejected, r.register(k, req), "no token")
+	req.InviteToken = "tok3"
+	require.Equal(registrationStatusRejected, r.register(k, req), "unknown token")
+	req.InviteToken = "tok1"
+	require.Equal(registrationStatusOk, r.register(k, req))
+
+	// Tokens are single use.
+	req = newRegistrationRequest(t, "bob")
+	req.InviteToken = "tok1"
+	require.Equal(registrationStatusRejected, r.register(k, req))
+	require.False(r.udb.Exists([]byte("bob")))
+
+	// The used tokens are removed from the file.
+	b, err := ioutil.ReadFile(tokensFile)
+	require.NoError(err)
+	require.Equal("tok2", strings.TrimSpace(string(b)))
+	k = r.newRegistration(cfg)
+	require.Equal(registrationStatusRejected, r.register(k, req), "after a restart")
+	req.InviteToken = "tok2"
+	require.Equal(registrationStatusOk, r.register(k, req))
+}
+
+func TestRegistrationMaxPerHour(t *testing.T) {
+	require := require.New(t)
+
+	r := newRegistrationTest(t)
+	k := r.newRegistration(map[string]interface{}{"maxPerHour": int64(2)})
+
+	require.Equal(registrationStatusOk, r.register(k, newRegistrationRequest(t, "alice")))
+	require.Equal(registrationStatusOk, r.register(k, newRegistrationRequest(t, "bob")))
+	require.Equal(registrationStatusRateLimited, r.register(k, newRegistrationRequest(t, "carol")))
+	require.False(r.udb.Exists([]byte("carol")))
+}
+
+func TestRegistrationDuplicateUser(t *testing.T) {
+	require := require.New(t)
+
+	r := newRegistrationTest(t)
+	k := r.newRegistration(map[string]interface{}{})
+
+	req := newRegistrationRequest(t, "alice")
+	require.Equal(registrationStatusOk, r.register(k, req))
+	linkKey, err := r.udb.Link([]byte("alice"))
+	require.NoError(err)
+
+	// The existing user is left untouched, even with a different case.
+	require.Equal(registrationStatusUserExists, r.register(k, newRegistrationRequest(t, "Alice")))
+	newLinkKey, err := r.udb.Link([]byte("alice"))
+	require.NoError(err)
+	require.True(linkKey.Equal(newLinkKey))
+}
@@ -0,0 +1,136 @@
+// reload.go - Kaetzchen configuration reloading.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/hashcloak/Meson-server/config"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+)
+
+// Reconfigure applies the rate limits of the built-in Kaetzchen in cfgs,
+// and returns a description of the applied changes.  Changes to the other
+// parameters of the built-in Kaetzchen require a restart.
+func (k *KaetzchenWorker) Reconfigure(cfgs []*config.Kaetzchen) []string {
+	var applied []string
+	for _, oldCfg := range k.rateLimits {
+		for _, v := range cfgs {
+			if v.Capability != oldCfg.Capability || v.Endpoint != oldCfg.Endpoint {
+				continue
+			}
+			if v.RateLimit == oldCfg.RateLimit && v.RateBurst == oldCfg.RateBurst &&
+				v.UserRateLimit == oldCfg.UserRateLimit && v.UserRateBurst == oldCfg.UserRateBurst {
+				break
+			}
+
+			var epKey [sConstants.RecipientIDLength]byte
+			copy(epKey[:], v.Endpoint)
+			k.limiter.setLimit(epKey, v.RateLimit, v.RateBurst)
+			k.limiter.setUserLimit(epKey, v.UserRateLimit, v.UserRateBurst)
+			oldCfg.RateLimit, oldCfg.RateBurst = v.RateLimit, v.RateBurst
+			oldCfg.UserRateLimit, oldCfg.UserRateBurst = v.UserRateLimit, v.UserRateBurst
+			applied = append(applied, fmt.Sprintf("Kaetzchen '%v' rate limit", v.Capability))
+			break
+		}
+	}
+	return applied
+}
+
+// withoutRateLimit returns a copy of the plugin configuration without the
+// rate limit, which can be changed without restarting the plugin.
+func withoutRateLimit(cfg *config.CBORPluginKaetzchen) config.CBORPluginKaetzchen {
+	c := *cfg
+	c.RateLimit, c.RateBurst = 0, 0
+	c.UserRateLimit, c.UserRateBurst = 0, 0
+	return c
+}
+
+// Reconfigure loads, unloads and reloads the plugins whose configuration
+// changed, and returns a description of the applied changes.  Plugins that
+// were loaded with the LOAD_PLUGIN management command are left untouched.
+func (k *CBORPluginWorker) Reconfigure(cfgs []*config.CBORPluginKaetzchen) ([]string, error) {
+	oldCfgs := make(map[string]*config.CBORPluginKaetzchen)
+	for _, v := range k.configs() {
+		if !v.Disable {
+			oldCfgs[v.Capability] = v
+		}
+	}
+	newCfgs := make(map[string]*config.CBORPluginKaetzchen)
+	for _, v := range cfgs {
+		if !v.Disable {
+			newCfgs[v.Capability] = v
+		}
+	}
+
+	var applied []string
+	var firstErr error
+	fail := func(err error) {
+		k.log.Errorf("Failed to reconfigure Kaetzchen plugins: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for capa := range oldCfgs {
+		if _, ok := newCfgs[capa]; ok {
+			continue
+		}
+		if err := k.removePlugin(capa); err != nil {
+			fail(err)
+			continue
+		}
+		applied = append(applied, fmt.Sprintf("unloaded plugin '%v'", capa))
+	}
+	for capa, v := range newCfgs {
+		oldCfg, ok := oldCfgs[capa]
+		switch {
+		case !ok:
+			if k.isBuiltInKaetzchen(v.Capability, v.Endpoint) {
+				fail(fmt.Errorf("provider: Kaetzchen '%v' conflicts with a built-in Kaetzchen", capa))
+				continue
+			}
+			if err := k.addPlugin(v); err != nil {
+				fail(err)
+				continue
+			}
+			applied = append(applied, fmt.Sprintf("loaded plugin '%v'", capa))
+		case reflect.DeepEqual(oldCfg, v):
+		case reflect.DeepEqual(withoutRateLimit(oldCfg), withoutRateLimit(v)):
+			var endpoint [sConstants.RecipientIDLength]byte
+			copy(endpoint[:], v.Endpoint)
+			k.limiter.setLimit(endpoint, v.RateLimit, v.RateBurst)
+			k.limiter.setUserLimit(endpoint, v.UserRateLimit, v.UserRateBurst)
+			applied = append(applied, fmt.Sprintf("plugin '%v' rate limit", capa))
+		default:
+			if err := k.removePlugin(capa); err != nil {
+				fail(err)
+				continue
+			}
+			if err := k.addPlugin(v); err != nil {
+				fail(err)
+				continue
+			}
+			applied = append(applied, fmt.Sprintf("reloaded plugin '%v'", capa))
+		}
+	}
+
+	k.Lock()
+	k.cfgs = cfgs
+	k.Unlock()
+	return applied, firstErr
+}
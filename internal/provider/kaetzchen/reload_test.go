@@ -0,0 +1,119 @@
+// reload_test.go - Kaetzchen reconfiguration tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/katzenpost/core/log"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKaetzchenWorkerReconfigure(t *testing.T) {
+	require := require.New(t)
+
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+echo")
+	k := &KaetzchenWorker{
+		rateLimits: map[string]*config.Kaetzchen{
+			"echo": {Capability: "echo", Endpoint: "+echo", RateLimit: 60, RateBurst: 1},
+		},
+	}
+
+	// Unchanged and unknown Kaetzchen are ignored.
+	require.Empty(k.Reconfigure([]*config.Kaetzchen{
+		{Capability: "echo", Endpoint: "+echo", RateLimit: 60, RateBurst: 1},
+		{Capability: "meow", Endpoint: "+meow", RateLimit: 1},
+		{Capability: "echo", Endpoint: "+echo2", RateLimit: 1},
+	}))
+
+	applied := k.Reconfigure([]*config.Kaetzchen{
+		{Capability: "echo", Endpoint: "+echo", RateLimit: 60, RateBurst: 2, UserRateLimit: 60, UserRateBurst: 1},
+	})
+	require.Equal([]string{"Kaetzchen 'echo' rate limit"}, applied)
+	require.Equal(uint64(2), k.rateLimits["echo"].RateBurst)
+	require.True(k.limiter.allowUser(ep, "alice"))
+	require.False(k.limiter.allowUser(ep, "alice"))
+	require.True(k.limiter.allow(ep))
+	require.True(k.limiter.allow(ep))
+	require.False(k.limiter.allow(ep))
+
+	// Reapplying the same configuration is a no-op.
+	require.Empty(k.Reconfigure([]*config.Kaetzchen{
+		{Capability: "echo", Endpoint: "+echo", RateLimit: 60, RateBurst: 2, UserRateLimit: 60, UserRateBurst: 1},
+	}))
+}
+
+func TestCBORPluginWorkerReconfigure(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	goo := getGlue(logBackend, &mockProvider{}, nil, nil)
+	goo.s.cfg.Provider.Kaetzchen = []*config.Kaetzchen{{Capability: "meow", Endpoint: "+meow"}}
+	echo := func(rateBurst uint64) *config.CBORPluginKaetzchen {
+		return &config.CBORPluginKaetzchen{
+			Capability:     "echo",
+			Endpoint:       "+echo",
+			Command:        "echo_server",
+			MaxConcurrency: 1,
+			RateLimit:      60,
+			RateBurst:      rateBurst,
+		}
+	}
+	k := &CBORPluginWorker{
+		requestPipeline: requestPipeline{
+			glue: goo,
+			log:  logBackend.GetLogger("test"),
+		},
+		pluginChans: make(PluginChans),
+		cfgs:        []*config.CBORPluginKaetzchen{echo(1)},
+	}
+	var ep [sConstants.RecipientIDLength]byte
+	copy(ep[:], "+echo")
+
+	// Unchanged and disabled plugins are left alone.
+	disabled := &config.CBORPluginKaetzchen{Capability: "gone", Endpoint: "+gone", Disable: true}
+	applied, err := k.Reconfigure([]*config.CBORPluginKaetzchen{echo(1), disabled})
+	require.NoError(err)
+	require.Empty(applied)
+
+	// Rate limit changes are applied in place, and failures do not stop
+	// the other changes.
+	newCfgs := []*config.CBORPluginKaetzchen{
+		echo(2),
+		{Capability: "meow", Endpoint: "+meow2", Command: "meow_server", MaxConcurrency: 1},
+		{Capability: "fail", Endpoint: "+fail", Command: "non-existent command", MaxConcurrency: 1},
+	}
+	applied, err = k.Reconfigure(newCfgs)
+	require.Error(err)
+	require.Equal([]string{"plugin 'echo' rate limit"}, applied)
+	require.Equal(newCfgs, k.configs())
+	require.True(k.limiter.allow(ep))
+	require.True(k.limiter.allow(ep))
+	require.False(k.limiter.allow(ep))
+	require.Empty(k.reserved)
+
+	// Plugins that are no longer configured are unloaded, which fails as
+	// the test plugins were never launched.
+	_, err = k.Reconfigure(nil)
+	require.Error(err)
+	require.Empty(k.configs())
+}
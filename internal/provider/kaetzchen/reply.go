@@ -0,0 +1,73 @@
+// reply.go - Kaetzchen SURB-Reply generation.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+
+	"github.com/hashcloak/Meson-server/internal/packet"
+	cConstants "github.com/katzenpost/core/constants"
+)
+
+const multiReplyHdrLength = 4
+
+// newReplyPackets generates the SURB-Replies carrying resp.
+//
+// A request with a single SURB gets the traditional response, prefixed
+// with the response header.  A multi-SURB request gets the response split
+// into as many fragments as required, each prefixed with the response
+// header, and the fragment index and count, so that the client can
+// reassemble the response regardless of the order of arrival.
+func newReplyPackets(pkt *packet.Packet, surbs [][]byte, resp []byte) ([]*packet.Packet, error) {
+	if len(surbs) == 1 {
+		resp = append([]byte{0x01, 0x00}, resp...)
+		respPkt, err := packet.NewPacketFromSURB(pkt, surbs[0], resp)
+		if err != nil {
+			return nil, err
+		}
+		return []*packet.Packet{respPkt}, nil
+	}
+
+	const maxFragLength = cConstants.ForwardPayloadLength - multiReplyHdrLength
+	nFrags := (len(resp) + maxFragLength - 1) / maxFragLength
+	if nFrags == 0 {
+		nFrags = 1
+	}
+	if nFrags > len(surbs) {
+		return nil, fmt.Errorf("response requires %v SURBs, request has %v", nFrags, len(surbs))
+	}
+
+	pkts := make([]*packet.Packet, 0, nFrags)
+	for i := 0; i < nFrags; i++ {
+		frag := resp
+		if len(frag) > maxFragLength {
+			frag = frag[:maxFragLength]
+		}
+		resp = resp[len(frag):]
+
+		b := append([]byte{0x01, 0x00, byte(i), byte(nFrags)}, frag...)
+		respPkt, err := packet.NewPacketFromSURB(pkt, surbs[i], b)
+		if err != nil {
+			for _, p := range pkts {
+				p.Dispose()
+			}
+			return nil, err
+		}
+		pkts = append(pkts, respPkt)
+	}
+	return pkts, nil
+}
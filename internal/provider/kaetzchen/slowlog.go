@@ -0,0 +1,112 @@
+// slowlog.go - Kaetzchen slow request logging.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// slowLogInterval is the minimum interval between slow request warnings
+// for a service, the requests in between are only counted.
+const slowLogInterval = 10 * time.Second
+
+var (
+	slowRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_slow_requests_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of Kaetzchen requests per service exceeding the slow request threshold",
+		},
+		[]string{"capability"},
+	)
+	requestSizes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_request_size_bytes",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Size of Kaetzchen requests per service in bytes",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"capability"},
+	)
+	responseSizes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: constants.Namespace,
+			Name:      "service_response_size_bytes",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Size of Kaetzchen responses per service in bytes",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"capability"},
+	)
+)
+
+type slowLogEntry struct {
+	last       time.Time
+	suppressed uint64
+}
+
+// slowRequestLog logs the service requests exceeding the slow request
+// threshold, at most once per slowLogInterval per service.
+type slowRequestLog struct {
+	sync.Mutex
+
+	entries map[string]*slowLogEntry
+}
+
+// observe records the duration of a request made to the upstream serving
+// the capability, eg: a plugin instance, and warns if it was slow.
+func (s *slowRequestLog) observe(glue glue.Glue, log *logging.Logger, capability, upstream string, elapsed time.Duration) {
+	threshold := time.Duration(glue.Config().Debug.KaetzchenSlowRequest) * time.Millisecond
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	slowRequests.With(capabilityLabels(capability)).Inc()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.entries == nil {
+		s.entries = make(map[string]*slowLogEntry)
+	}
+	e, ok := s.entries[capability]
+	if !ok {
+		e = new(slowLogEntry)
+		s.entries[capability] = e
+	}
+	now := time.Now()
+	if now.Sub(e.last) < slowLogInterval {
+		e.suppressed++
+		return
+	}
+	log.Warningf("Slow Kaetzchen request to '%v' (%v): %v (threshold: %v, %v more since last warning)", capability, upstream, elapsed, threshold, e.suppressed)
+	e.last = now
+	e.suppressed = 0
+}
+
+func init() {
+	prometheus.MustRegister(slowRequests)
+	prometheus.MustRegister(requestSizes)
+	prometheus.MustRegister(responseSizes)
+}
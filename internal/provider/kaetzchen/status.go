@@ -0,0 +1,165 @@
+// status.go - Kaetzchen service status.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is the number of recent errors retained per service.
+const maxRecentErrors = 5
+
+// RecentError is an error that occurred while servicing a Kaetzchen.
+type RecentError struct {
+	At  time.Time
+	Err string
+}
+
+// InstanceStatus is the state of an external plugin instance.
+type InstanceStatus struct {
+	ID       int
+	Upstream string
+	Running  bool
+	Restarts uint64
+
+	// NextRestart is when an instance that is down will be restarted by
+	// the supervisor, if it is backing off.
+	NextRestart time.Time
+}
+
+// ServiceStatus is the state of a Kaetzchen service, as reported by the
+// management interface.
+type ServiceStatus struct {
+	Capability string
+	Endpoint   string
+	BuiltIn    bool
+
+	// Parameters are the parameters advertised in the descriptor, or nil
+	// if the service is not advertised.
+	Parameters map[string]interface{}
+
+	// Instances are the instances of an external plugin.
+	Instances []*InstanceStatus
+
+	Errors       uint64
+	RecentErrors []RecentError
+}
+
+// errorLog counts the errors per service, and retains the most recent
+// ones so that failures can be diagnosed without going through the logs.
+type errorLog struct {
+	sync.Mutex
+
+	counts map[string]uint64
+	recent map[string][]RecentError
+}
+
+func (l *errorLog) record(capability string, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.counts == nil {
+		l.counts = make(map[string]uint64)
+		l.recent = make(map[string][]RecentError)
+	}
+	l.counts[capability]++
+	recent := append(l.recent[capability], RecentError{At: time.Now(), Err: err.Error()})
+	if len(recent) > maxRecentErrors {
+		recent = recent[len(recent)-maxRecentErrors:]
+	}
+	l.recent[capability] = recent
+}
+
+// get returns the number of errors of the service, and the most recent
+// ones, oldest first.
+func (l *errorLog) get(capability string) (uint64, []RecentError) {
+	l.Lock()
+	defer l.Unlock()
+	return l.counts[capability], append([]RecentError{}, l.recent[capability]...)
+}
+
+func (l *errorLog) forget(capability string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.counts, capability)
+	delete(l.recent, capability)
+}
+
+// Services returns the state of the built-in Kaetzchen, ordered by
+// capability.
+func (k *KaetzchenWorker) Services() []*ServiceStatus {
+	services := make([]*ServiceStatus, 0, len(k.kaetzchen))
+	for endpoint, v := range k.kaetzchen {
+		s := &ServiceStatus{
+			Capability: v.Capability(),
+			Endpoint:   string(bytes.TrimRight(endpoint[:], "\x00")),
+			BuiltIn:    true,
+			Parameters: v.Parameters(),
+		}
+		s.Errors, s.RecentErrors = k.errLog.get(s.Capability)
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Capability < services[j].Capability })
+	return services
+}
+
+// Services returns the state of the external plugins, ordered by
+// capability.  The parameters are the ones last queried for the
+// descriptor, the plugins are not queried again.
+func (k *CBORPluginWorker) Services() []*ServiceStatus {
+	k.Lock()
+	advertised := k.advertised
+	k.Unlock()
+
+	var services []*ServiceStatus
+	byCapa := make(map[string]*ServiceStatus)
+	for _, inst := range k.instances() {
+		s, ok := byCapa[inst.cfg.Capability]
+		if !ok {
+			s = &ServiceStatus{
+				Capability: inst.cfg.Capability,
+				Endpoint:   inst.cfg.Endpoint,
+				Parameters: advertised[inst.cfg.Capability],
+			}
+			s.Errors, s.RecentErrors = k.errLog.get(s.Capability)
+			byCapa[s.Capability] = s
+			services = append(services, s)
+		}
+		s.Instances = append(s.Instances, inst.status())
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Capability < services[j].Capability })
+	return services
+}
+
+func (i *pluginInstance) status() *InstanceStatus {
+	i.Lock()
+	defer i.Unlock()
+
+	s := &InstanceStatus{
+		ID:       i.id,
+		Upstream: i.upstream(),
+		Running:  isClientUp(i.client),
+		Restarts: i.totalRestarts,
+	}
+	if !s.Running && time.Now().Before(i.nextStart) {
+		s.NextRestart = i.nextStart
+	}
+	return s
+}
@@ -0,0 +1,189 @@
+// supervisor.go - External Kaetzchen plugin supervision.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-server/cborplugin"
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	minPluginRestartDelay  = 1 * time.Second
+	maxPluginRestartDelay  = 5 * time.Minute
+	pluginDownPollInterval = 1 * time.Second
+)
+
+var (
+	pluginUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: constants.Namespace,
+			Name:      "plugin_up",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Whether an external plugin instance is up (1) or down (0)",
+		},
+		[]string{"capability", "instance"},
+	)
+	pluginRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: constants.Namespace,
+			Name:      "plugin_restarts_total",
+			Subsystem: constants.KaetzchenSubsystem,
+			Help:      "Number of external plugin instance restarts",
+		},
+		[]string{"capability"},
+	)
+)
+
+// pluginInstance is a single supervised execution slot of an external
+// plugin.  The client is replaced every time the plugin is restarted.
+type pluginInstance struct {
+	sync.Mutex
+
+	cfg  *config.CBORPluginKaetzchen
+	args []string
+	id   int
+
+	client    *cborplugin.Client
+	restarts  uint
+	nextStart time.Time
+
+	// totalRestarts is the number of times the instance was restarted,
+	// unlike restarts it is not reset once the instance is healthy.
+	totalRestarts uint64
+
+	// haltCh is closed when the plugin is unloaded.
+	haltCh chan struct{}
+}
+
+func (i *pluginInstance) getClient() *cborplugin.Client {
+	i.Lock()
+	defer i.Unlock()
+	return i.client
+}
+
+func (i *pluginInstance) labels() prometheus.Labels {
+	return prometheus.Labels{"capability": i.cfg.Capability, "instance": fmt.Sprintf("%d", i.id)}
+}
+
+// upstream returns a description of the instance, for attributing slow
+// requests.
+func (i *pluginInstance) upstream() string {
+	if i.cfg.Remote != nil {
+		return fmt.Sprintf("instance %d, %s", i.id, i.cfg.Remote.Address)
+	}
+	return fmt.Sprintf("instance %d, %s", i.id, i.cfg.Command)
+}
+
+func isClientUp(c *cborplugin.Client) bool {
+	select {
+	case <-c.HaltCh():
+		return false
+	default:
+		return true
+	}
+}
+
+func (k *CBORPluginWorker) supervisor() {
+	interval := time.Duration(k.glue.Config().Debug.KaetzchenHealthCheckInterval) * time.Millisecond
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.HaltCh():
+			return
+		case <-ticker.C:
+		}
+		for _, inst := range k.instances() {
+			k.checkPlugin(inst)
+		}
+	}
+}
+
+// checkPlugin health checks a plugin instance, and restarts it with an
+// exponential backoff if it is down.
+func (k *CBORPluginWorker) checkPlugin(inst *pluginInstance) {
+	// The health check can take a while if the plugin is wedged, so it is
+	// done without holding the lock that the request workers need.
+	err := inst.getClient().Ping()
+
+	inst.Lock()
+	defer inst.Unlock()
+
+	select {
+	case <-inst.haltCh:
+		// Unloaded while being checked.
+		return
+	default:
+	}
+
+	now := time.Now()
+	if err == nil {
+		pluginUp.With(inst.labels()).Set(1)
+		if inst.restarts > 0 && now.After(inst.nextStart) {
+			inst.restarts = 0
+		}
+		return
+	}
+
+	pluginUp.With(inst.labels()).Set(0)
+	if now.Before(inst.nextStart) {
+		k.log.Debugf("Kaetzchen plugin '%v' instance %v is down, restart in %v.", inst.cfg.Capability, inst.id, inst.nextStart.Sub(now))
+		return
+	}
+	k.log.Warningf("Kaetzchen plugin '%v' instance %v failed health check: %v", inst.cfg.Capability, inst.id, err)
+	k.errLog.record(inst.cfg.Capability, fmt.Errorf("instance %d failed health check: %v", inst.id, err))
+
+	inst.nextStart = now.Add(restartBackoff(inst.restarts))
+	inst.restarts++
+
+	go inst.client.Halt()
+	c, err := k.launch(inst.cfg, inst.args, inst.id)
+	if err != nil {
+		k.log.Errorf("Failed to restart Kaetzchen plugin '%v' instance %v: %v", inst.cfg.Capability, inst.id, err)
+		k.errLog.record(inst.cfg.Capability, fmt.Errorf("instance %d failed to restart: %v", inst.id, err))
+		return
+	}
+	inst.client = c
+	inst.totalRestarts++
+	pluginRestarts.With(prometheus.Labels{"capability": inst.cfg.Capability}).Inc()
+	k.log.Noticef("Restarted Kaetzchen plugin '%v' instance %v.", inst.cfg.Capability, inst.id)
+}
+
+// restartBackoff returns the delay before a plugin instance that was
+// restarted the given number of consecutive times may be restarted again.
+func restartBackoff(restarts uint) time.Duration {
+	backoff := minPluginRestartDelay << restarts
+	if backoff > maxPluginRestartDelay || backoff <= 0 {
+		backoff = maxPluginRestartDelay
+	}
+	return backoff
+}
+
+func init() {
+	prometheus.MustRegister(pluginUp)
+	prometheus.MustRegister(pluginRestarts)
+}
@@ -0,0 +1,44 @@
+// supervisor_test.go - Kaetzchen plugin supervisor tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	require := require.New(t)
+
+	// The delay doubles with each consecutive restart.
+	require.Equal(minPluginRestartDelay, restartBackoff(0))
+	require.Equal(2*minPluginRestartDelay, restartBackoff(1))
+	require.Equal(8*minPluginRestartDelay, restartBackoff(3))
+
+	// It is capped, including when the shift overflows.
+	prev := time.Duration(0)
+	for restarts := uint(0); restarts < 128; restarts++ {
+		backoff := restartBackoff(restarts)
+		require.True(backoff >= prev, "restarts: %v", restarts)
+		require.True(backoff <= maxPluginRestartDelay, "restarts: %v", restarts)
+		prev = backoff
+	}
+	require.Equal(maxPluginRestartDelay, restartBackoff(9))
+	require.Equal(maxPluginRestartDelay, restartBackoff(64))
+}
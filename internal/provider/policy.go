@@ -0,0 +1,140 @@
+// policy.go - Katzenpost server recipient policy.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"bytes"
+
+	"github.com/hashcloak/Meson-server/config"
+	internalConstants "github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultPolicyRule = "default"
+
+var policyDroppedPackets = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: internalConstants.Namespace,
+		Name:      "policy_dropped_packets_total",
+		Subsystem: internalConstants.ProviderSubsystem,
+		Help:      "Number of packets dropped by the recipient policy",
+	},
+	[]string{"rule"},
+)
+
+type policyRule struct {
+	name       string
+	allow      bool
+	any        bool
+	recipients map[string]bool
+}
+
+// recipientPolicy is the compiled form of the configured recipient policy.
+type recipientPolicy struct {
+	rules        []*policyRule
+	defaultAllow bool
+}
+
+// check returns true iff traffic to a recipient, known by any of the names,
+// is allowed, and the name of the rule that decided.
+func (r *recipientPolicy) check(names ...string) (bool, string) {
+	for _, rule := range r.rules {
+		if rule.any {
+			return rule.allow, rule.name
+		}
+		for _, n := range names {
+			if rule.recipients[n] {
+				return rule.allow, rule.name
+			}
+		}
+	}
+	return r.defaultAllow, defaultPolicyRule
+}
+
+func newRecipientPolicy(pCfg *config.ProviderPolicy, fixup func([]byte) ([]byte, error)) *recipientPolicy {
+	r := &recipientPolicy{
+		defaultAllow: pCfg.DefaultAction != config.PolicyDeny,
+	}
+	for _, v := range pCfg.Rules {
+		rule := &policyRule{
+			name:       v.Name,
+			allow:      v.Action == config.PolicyAllow,
+			recipients: make(map[string]bool),
+		}
+		for _, recipient := range v.Recipients {
+			if recipient == "*" {
+				rule.any = true
+			}
+			rule.recipients[recipient] = true
+			if n, err := fixup([]byte(recipient)); err == nil {
+				rule.recipients[string(n)] = true
+			}
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r
+}
+
+// isAllowed applies the recipient policy to a packet, and returns false
+// iff it should be dropped.
+func (p *provider) isAllowed(pkt *packet.Packet) bool {
+	p.policyLock.RLock()
+	policy := p.policy
+	p.policyLock.RUnlock()
+	if policy == nil {
+		return true
+	}
+
+	// Kaetzchen endpoints are matched verbatim, users are matched after
+	// normalization.
+	names := []string{string(bytes.TrimRight(pkt.Recipient.ID[:], "\x00"))}
+	if n, err := p.fixupRecipient(pkt.Recipient.ID[:]); err == nil {
+		names = append(names, string(n))
+	}
+
+	ok, rule := policy.check(names...)
+	if !ok {
+		p.log.Debugf("Dropping packet: %v (Policy rule: '%v')", pkt.ID, rule)
+		policyDroppedPackets.With(prometheus.Labels{"rule": rule}).Inc()
+	}
+	return ok
+}
+
+// setPolicy replaces the recipient policy, a nil pCfg removes it.
+func (p *provider) setPolicy(pCfg *config.ProviderPolicy) {
+	var policy *recipientPolicy
+	if pCfg != nil {
+		policy = newRecipientPolicy(pCfg, p.fixupUserNameCase)
+	}
+
+	p.policyLock.Lock()
+	defer p.policyLock.Unlock()
+	p.policy = policy
+	p.policyCfg = pCfg
+}
+
+// policyConfig returns the configuration of the recipient policy in use.
+func (p *provider) policyConfig() *config.ProviderPolicy {
+	p.policyLock.RLock()
+	defer p.policyLock.RUnlock()
+	return p.policyCfg
+}
+
+func init() {
+	prometheus.MustRegister(policyDroppedPackets)
+}
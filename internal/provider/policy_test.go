@@ -0,0 +1,108 @@
+// policy_test.go - Katzenpost server recipient policy tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecipientPolicy(t *testing.T) {
+	require := require.New(t)
+
+	p := newTestProvider(t)
+	policy := newRecipientPolicy(&config.ProviderPolicy{
+		DefaultAction: config.PolicyDeny,
+		Rules: []*config.PolicyRule{
+			{Name: "blocked", Action: config.PolicyDeny, Recipients: []string{"Mallory"}},
+			{Name: "users", Action: config.PolicyAllow, Recipients: []string{"alice", "mallory", "+echo"}},
+		},
+	}, p.fixupUserNameCase)
+
+	// The first matching rule applies, and recipients in the rules are
+	// normalized as well.
+	for _, v := range []struct {
+		names []string
+		allow bool
+		rule  string
+	}{
+		{[]string{"alice"}, true, "users"},
+		{[]string{"mallory"}, false, "blocked"},
+		{[]string{"Mallory"}, false, "blocked"},
+		{[]string{"+echo"}, true, "users"},
+		{[]string{"bob"}, false, defaultPolicyRule},
+		{[]string{"bob", "alice"}, true, "users"},
+	} {
+		allow, rule := policy.check(v.names...)
+		require.Equal(v.allow, allow, "%v", v.names)
+		require.Equal(v.rule, rule, "%v", v.names)
+	}
+
+	// `*` matches every recipient, and the default action is allow.
+	policy = newRecipientPolicy(&config.ProviderPolicy{
+		Rules: []*config.PolicyRule{
+			{Name: "echo", Action: config.PolicyAllow, Recipients: []string{"+echo"}},
+			{Name: "everyone", Action: config.PolicyDeny, Recipients: []string{"*"}},
+		},
+	}, p.fixupUserNameCase)
+	allow, rule := policy.check("+echo")
+	require.True(allow)
+	require.Equal("echo", rule)
+	allow, rule = policy.check("alice")
+	require.False(allow)
+	require.Equal("everyone", rule)
+	require.True(newRecipientPolicy(&config.ProviderPolicy{}, p.fixupUserNameCase).defaultAllow)
+}
+
+func TestProviderIsAllowed(t *testing.T) {
+	require := require.New(t)
+
+	p := newTestProvider(t)
+	newPacket := func(recipient string) *packet.Packet {
+		pkt := &packet.Packet{Recipient: new(commands.Recipient)}
+		copy(pkt.Recipient.ID[:], recipient)
+		return pkt
+	}
+
+	// Without a policy, everything is allowed.
+	require.True(p.isAllowed(newPacket("bob")))
+	require.Nil(p.policyConfig())
+
+	pCfg := &config.ProviderPolicy{
+		Rules: []*config.PolicyRule{
+			{Name: "test-deny-bob", Action: config.PolicyDeny, Recipients: []string{"bob"}},
+		},
+	}
+	p.setPolicy(pCfg)
+	require.Equal(pCfg, p.policyConfig())
+	dropped := policyDroppedPackets.With(prometheus.Labels{"rule": "test-deny-bob"})
+	before := testutil.ToFloat64(dropped)
+
+	// Users are matched after normalization.
+	require.False(p.isAllowed(newPacket("Bob")))
+	require.True(p.isAllowed(newPacket("alice")))
+	require.Equal(before+1, testutil.ToFloat64(dropped))
+
+	p.setPolicy(nil)
+	require.True(p.isAllowed(newPacket("bob")))
+}
@@ -23,16 +23,19 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/accounting"
 	internalConstants "github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/debug"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/hashcloak/Meson-server/internal/pkicache"
 	"github.com/hashcloak/Meson-server/internal/provider/kaetzchen"
 	"github.com/hashcloak/Meson-server/internal/sqldb"
 	"github.com/hashcloak/Meson-server/registration"
@@ -41,6 +44,7 @@ import (
 	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/hashcloak/Meson-server/userdb/boltuserdb"
 	"github.com/hashcloak/Meson-server/userdb/externuserdb"
+	"github.com/hashcloak/Meson-server/userdb/ldapuserdb"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/monotime"
@@ -73,6 +77,12 @@ type provider struct {
 	userDB userdb.UserDB
 	spool  spool.Spool
 
+	aliases    *aliasDB
+	policy     *recipientPolicy
+	policyCfg  *config.ProviderPolicy
+	policyLock sync.RWMutex
+	accountant *accounting.Accountant
+
 	kaetzchenWorker           *kaetzchen.KaetzchenWorker
 	cborPluginKaetzchenWorker *kaetzchen.CBORPluginWorker
 
@@ -101,6 +111,7 @@ func (p *provider) Halt() {
 	p.ch.Close()
 	p.kaetzchenWorker.Halt()
 	p.cborPluginKaetzchenWorker.Halt()
+	p.accountant.Halt()
 	if p.userDB != nil {
 		p.userDB.Close()
 		p.userDB = nil
@@ -109,6 +120,10 @@ func (p *provider) Halt() {
 		p.spool.Close()
 		p.spool = nil
 	}
+	if p.aliases != nil {
+		p.aliases.close()
+		p.aliases = nil
+	}
 	if p.sqlDB != nil {
 		p.sqlDB.Close()
 	}
@@ -122,6 +137,42 @@ func (p *provider) UserDB() userdb.UserDB {
 	return p.userDB
 }
 
+func (p *provider) Accounting() *accounting.Accountant {
+	return p.accountant
+}
+
+// Reconfigure applies the reloadable parts of a new Provider
+// configuration, the recipient policy, the Kaetzchen rate limits and the
+// plugins, and returns a description of the applied changes.
+func (p *provider) Reconfigure(cfg *config.Provider) ([]string, error) {
+	var applied []string
+	if !reflect.DeepEqual(p.policyConfig(), cfg.Policy) {
+		p.setPolicy(cfg.Policy)
+		applied = append(applied, "Provider.Policy")
+	}
+	applied = append(applied, p.kaetzchenWorker.Reconfigure(cfg.Kaetzchen)...)
+	pluginsApplied, err := p.cborPluginKaetzchenWorker.Reconfigure(cfg.CBORPluginKaetzchen)
+	return append(applied, pluginsApplied...), err
+}
+
+func (p *provider) Queues() *glue.ProviderQueues {
+	q := &glue.ProviderQueues{
+		Inbound: p.ch.Len(),
+	}
+	builtIn, builtInInFlight := p.kaetzchenWorker.Queues()
+	plugins, pluginsInFlight := p.cborPluginKaetzchenWorker.Queues()
+	q.Kaetzchen = builtIn
+	for capa, n := range plugins {
+		q.Kaetzchen[capa] = n
+	}
+	q.KaetzchenInFlight = builtInInFlight + pluginsInFlight
+	return q
+}
+
+func (p *provider) Backlog() int {
+	return p.Queues().Len()
+}
+
 func (p *provider) AuthenticateClient(c *wire.PeerCredentials) bool {
 	ad, err := p.fixupUserNameCase(c.AdditionalData)
 	if err != nil {
@@ -151,12 +202,11 @@ func (p *provider) KaetzchenForPKI() (map[string]map[string]interface{}, error)
 	if map1 != nil && map2 == nil {
 		return map1, nil
 	}
-	// merge sets, panic on duplicate
+	// Merge the sets, the configuration validation should prevent the
+	// same capability from being both a built-in and a plugin.
 	for k, v := range map2 {
-		_, ok := map1[k]
-		if ok {
-			p.log.Debug("WARNING: duplicate plugin entries")
-			panic("WARNING: duplicate plugin entries")
+		if _, ok := map1[k]; ok {
+			return nil, fmt.Errorf("provider: Kaetzchen '%v' is both built-in and a plugin", k)
 		}
 		map1[k] = v
 	}
@@ -229,6 +279,14 @@ func (p *provider) worker() {
 			}
 		}
 
+		// Map aliases to the recipient that owns them, before dispatch.
+		p.resolveAlias(pkt)
+
+		if !p.isAllowed(pkt) {
+			pkt.Dispose()
+			continue
+		}
+
 		// Kaetzchen endpoints are published in the PKI and are never
 		// user-facing, so omit the recipient-post processing.  If clients
 		// are written under the assumption that Kaetzchen addresses are
@@ -314,22 +372,15 @@ func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 	}
 
 	// Store the ciphertext in the spool.
-	if err := p.spool.StoreMessage(recipient, ct); err != nil {
+	err = p.spool.StoreMessage(recipient, ct)
+	if err != nil {
 		p.log.Debugf("Failed to store message payload: %v (%v)", pkt.ID, err)
-		return
 	}
 
 	// Iff there is a SURB, generate a SURB-ACK and schedule.
 	if surb != nil {
-		ackPkt, err := packet.NewPacketFromSURB(pkt, surb, nil)
-		if err != nil {
-			p.log.Debugf("Failed to generate SURB-ACK: %v (%v)", pkt.ID, err)
-			return
-		}
-
-		p.log.Debugf("Handing off newly generated SURB-ACK: %v (Src:%v)", ackPkt.ID, pkt.ID)
-		p.glue.Scheduler().OnPacket(ackPkt)
-	} else {
+		p.sendReceipt(pkt, surb, err)
+	} else if err == nil {
 		p.log.Debugf("Stored Message: %v (No SURB)", pkt.ID)
 	}
 }
@@ -401,6 +452,9 @@ func (p *provider) onRemoveUser(c *thwack.Conn, l string) error {
 		// user has been obliterated from the UserDB at this point.
 		c.Log().Errorf("Failed to remove spool '%v': %v", u, err)
 	}
+	if err = p.removeUserAliases(u); err != nil {
+		c.Log().Errorf("Failed to remove aliases '%v': %v", u, err)
+	}
 
 	return c.WriteReply(thwack.StatusOk)
 }
@@ -465,6 +519,65 @@ func (p *provider) onSetUserIdentity(c *thwack.Conn, l string) error {
 	return c.WriteReply(thwack.StatusOk)
 }
 
+func (p *provider) onRotateUserLink(c *thwack.Conn, l string) error {
+	return p.doRotate(c, l, false)
+}
+
+func (p *provider) onRotateUserIdentity(c *thwack.Conn, l string) error {
+	return p.doRotate(c, l, true)
+}
+
+func (p *provider) doRotate(c *thwack.Conn, l string, isIdentity bool) error {
+	p.Lock()
+	defer p.Unlock()
+
+	rotator, ok := p.userDB.(userdb.KeyRotator)
+	if !ok {
+		c.Log().Errorf("ROTATE_USER_[LINK/IDENTITY] not supported by the UserDB")
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	overlap := userdb.DefaultKeyOverlap
+	sp := strings.Split(l, " ")
+	switch len(sp) {
+	case 3:
+	case 4:
+		secs, err := strconv.ParseUint(sp[3], 10, 32)
+		if err != nil {
+			c.Log().Errorf("ROTATE_USER_[LINK/IDENTITY] invalid overlap: %v", err)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		overlap = time.Duration(secs) * time.Second
+	default:
+		c.Log().Debugf("ROTATE_USER_[LINK/IDENTITY] invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	var pubKey ecdh.PublicKey
+	if err := pubKey.FromString(sp[2]); err != nil {
+		c.Log().Errorf("ROTATE_USER_[LINK/IDENTITY] invalid public key: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	u, err := p.fixupUserNameCase([]byte(sp[1]))
+	if err != nil {
+		c.Log().Errorf("ROTATE_USER_[LINK/IDENTITY] invalid user: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	if isIdentity {
+		err = rotator.RotateIdentity(u, &pubKey, overlap)
+	} else {
+		err = rotator.RotateLink(u, &pubKey, overlap)
+	}
+	if err != nil {
+		c.Log().Errorf("Failed to rotate key for user '%v': %v", u, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	return c.WriteReply(thwack.StatusOk)
+}
+
 func (p *provider) onUserLink(c *thwack.Conn, l string) error {
 	p.Lock()
 	defer p.Unlock()
@@ -730,12 +843,37 @@ func (p *provider) initUserRegistrationHTTP() {
 	}
 }
 
+// OnNewDocument forwards the current PKI document to the Kaetzchen
+// plugins.
+func (p *provider) OnNewDocument(ent *pkicache.Entry) {
+	p.cborPluginKaetzchenWorker.OnNewDocument(ent)
+}
+
 // AdvertiseRegistrationHTTP returns a slice of URL strings
 // or nil if no advertised HTTP URL was set in the configuration.
 func (p *provider) AdvertiseRegistrationHTTPAddresses() []string {
 	return p.glue.Config().Provider.AdvertiseUserRegistrationHTTPAddresses
 }
 
+func newExternUserDB(eCfg *config.ExternUserDB) (userdb.UserDB, error) {
+	opts := &externuserdb.Options{
+		Timeout:          time.Duration(eCfg.RequestTimeout) * time.Millisecond,
+		CacheTTL:         time.Duration(eCfg.CacheTTL) * time.Second,
+		FailureThreshold: eCfg.FailureThreshold,
+		BreakerCooldown:  time.Duration(eCfg.BreakerCooldown) * time.Second,
+	}
+	if eCfg.SigningKey != "" {
+		opts.SigningKey = []byte(eCfg.SigningKey)
+	}
+	if eCfg.CACertificate != "" || eCfg.ClientCertificate != "" {
+		var err error
+		if opts.TLSConfig, err = externuserdb.LoadTLSConfig(eCfg.CACertificate, eCfg.ClientCertificate, eCfg.ClientKey); err != nil {
+			return nil, fmt.Errorf("provider: failed to load Extern TLS configuration: %v", err)
+		}
+	}
+	return externuserdb.NewWithOptions(eCfg.ProviderURL, opts)
+}
+
 // New constructs a new provider instance.
 func New(glue glue.Glue) (glue.Provider, error) {
 	kaetzchenWorker, err := kaetzchen.New(glue)
@@ -778,7 +916,9 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	case config.BackendBolt:
 		p.userDB, err = boltuserdb.New(cfg.Provider.UserDB.Bolt.UserDB)
 	case config.BackendExtern:
-		p.userDB, err = externuserdb.New(cfg.Provider.UserDB.Extern.ProviderURL)
+		p.userDB, err = newExternUserDB(cfg.Provider.UserDB.Extern)
+	case config.BackendLDAP:
+		p.userDB, err = ldapuserdb.New(cfg.Provider.UserDB.LDAP)
 	case config.BackendSQL:
 		if p.sqlDB != nil {
 			p.userDB, err = p.sqlDB.UserDB()
@@ -794,7 +934,15 @@ func New(glue glue.Glue) (glue.Provider, error) {
 
 	switch cfg.Provider.SpoolDB.Backend {
 	case config.BackendBolt:
-		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB)
+		var quota *spool.Quota
+		if q := cfg.Provider.SpoolDB.Quota; q != nil {
+			quota = &spool.Quota{
+				MaxMessages: q.MaxMessages,
+				MaxBytes:    q.MaxBytes,
+				DropOldest:  q.Policy == config.SpoolQuotaDropOldest,
+			}
+		}
+		p.spool, err = boltspool.NewWithQuota(cfg.Provider.SpoolDB.Bolt.SpoolDB, quota)
 	case config.BackendSQL:
 		if p.sqlDB != nil {
 			p.spool = p.sqlDB.Spool()
@@ -809,8 +957,29 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	}
 
 	// Purge spools that belong to users that no longer exist in the user db.
-	if err = p.spool.Vacuum(p.userDB); err != nil {
-		return nil, err
+	//
+	// Note: The remote user databases can't tell a missing user from a
+	// failed query, so vacuuming them could destroy the spools of existing
+	// users whenever the service is unreachable.
+	switch cfg.Provider.UserDB.Backend {
+	case config.BackendExtern, config.BackendLDAP:
+		p.log.Debugf("Not vacuuming the spool with a remote user database.")
+	default:
+		if err = p.spool.Vacuum(p.userDB); err != nil {
+			return nil, err
+		}
+	}
+
+	p.setPolicy(cfg.Provider.Policy)
+	if cfg.Provider.AliasDB != "" {
+		if p.aliases, err = newAliasDB(cfg.Provider.AliasDB); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Provider.Accounting != nil {
+		if p.accountant, err = accounting.New(cfg.Provider.Accounting, glue.LogBackend()); err != nil {
+			return nil, err
+		}
 	}
 
 	// Wire in the management related commands.
@@ -825,6 +994,13 @@ func New(glue glue.Glue) (glue.Provider, error) {
 			cmdUserLink           = "USER_LINK"
 			cmdSendRate           = "SEND_RATE"
 			cmdSendBurst          = "SEND_BURST"
+			cmdRotateUserLink     = "ROTATE_USER_LINK"
+			cmdRotateUserIdentity = "ROTATE_USER_IDENTITY"
+			cmdAddAlias           = "ADD_ALIAS"
+			cmdRemoveAlias        = "REMOVE_ALIAS"
+			cmdAliases            = "ALIASES"
+			cmdKaetzchen          = "KAETZCHEN"
+			cmdKaetzchenInfo      = "KAETZCHEN_INFO"
 		)
 
 		glue.Management().RegisterCommand(cmdAddUser, p.onAddUser)
@@ -836,6 +1012,13 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		glue.Management().RegisterCommand(cmdUserLink, p.onUserLink)
 		glue.Management().RegisterCommand(cmdSendRate, p.onSendRate)
 		glue.Management().RegisterCommand(cmdSendBurst, p.onSendBurst)
+		glue.Management().RegisterCommand(cmdRotateUserLink, p.onRotateUserLink)
+		glue.Management().RegisterCommand(cmdRotateUserIdentity, p.onRotateUserIdentity)
+		glue.Management().RegisterCommand(cmdAddAlias, p.onAddAlias)
+		glue.Management().RegisterCommand(cmdRemoveAlias, p.onRemoveAlias)
+		glue.Management().RegisterCommand(cmdAliases, p.onAliases)
+		glue.Management().RegisterCommand(cmdKaetzchen, p.onKaetzchen)
+		glue.Management().RegisterCommand(cmdKaetzchenInfo, p.onKaetzchenInfo)
 	}
 
 	// Start the User Registration HTTP service listener(s).
@@ -847,7 +1030,11 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	for i := 0; i < cfg.Debug.NumProviderWorkers; i++ {
 		p.Go(p.worker)
 	}
+	if cfg.Provider.SpoolDB.MessageTTL > 0 {
+		p.Go(p.spoolGCWorker)
+	}
 
+	glue.PKI().Subscribe(p)
 	isOk = true
 	return p, nil
 }
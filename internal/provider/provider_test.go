@@ -0,0 +1,139 @@
+// provider_test.go - Katzenpost server provider backend tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/glue"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/hashcloak/Meson-server/internal/provider/kaetzchen"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+type testUserDB struct {
+	userdb.UserDB
+
+	users map[string]bool
+}
+
+func (u *testUserDB) Exists(user []byte) bool {
+	return u.users[string(user)]
+}
+
+func (u *testUserDB) Add(user []byte, k *ecdh.PublicKey, update bool) error {
+	u.users[string(user)] = true
+	return nil
+}
+
+type testScheduler struct {
+	glue.Scheduler
+
+	sync.Mutex
+	pkts []*packet.Packet
+}
+
+func (s *testScheduler) OnPacket(pkt *packet.Packet) {
+	s.Lock()
+	defer s.Unlock()
+	s.pkts = append(s.pkts, pkt)
+}
+
+func (s *testScheduler) packets() []*packet.Packet {
+	s.Lock()
+	defer s.Unlock()
+	return s.pkts
+}
+
+type testGlue struct {
+	glue.Glue
+
+	cfg        *config.Config
+	logBackend *log.Backend
+	scheduler  *testScheduler
+}
+
+func (g *testGlue) Config() *config.Config {
+	return g.cfg
+}
+
+func (g *testGlue) LogBackend() *log.Backend {
+	return g.logBackend
+}
+
+func (g *testGlue) Scheduler() glue.Scheduler {
+	return g.scheduler
+}
+
+func newTestProvider(t *testing.T) *provider {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	goo := &testGlue{
+		cfg: &config.Config{
+			Provider: &config.Provider{},
+			Debug:    &config.Debug{},
+		},
+		logBackend: logBackend,
+		scheduler:  new(testScheduler),
+	}
+	return &provider{
+		glue:                      goo,
+		log:                       logBackend.GetLogger("provider"),
+		userDB:                    &testUserDB{users: make(map[string]bool)},
+		kaetzchenWorker:           new(kaetzchen.KaetzchenWorker),
+		cborPluginKaetzchenWorker: new(kaetzchen.CBORPluginWorker),
+	}
+}
+
+func TestFixupRecipient(t *testing.T) {
+	require := require.New(t)
+
+	p := newTestProvider(t)
+	pCfg := p.glue.Config().Provider
+
+	var recipient [32]byte
+	copy(recipient[:], "Alice+lists")
+	b, err := p.fixupRecipient(recipient[:])
+	require.NoError(err)
+	require.Equal("alice+lists", string(b))
+
+	pCfg.RecipientDelimiter = "+"
+	b, err = p.fixupRecipient(recipient[:])
+	require.NoError(err)
+	require.Equal("alice", string(b))
+
+	// Recipients starting with the delimiter are left alone.
+	b, err = p.fixupRecipient([]byte("+echo"))
+	require.NoError(err)
+	require.Equal("+echo", string(b))
+
+	pCfg.CaseSensitiveRecipients = true
+	b, err = p.fixupRecipient(recipient[:])
+	require.NoError(err)
+	require.Equal("Alice", string(b))
+
+	pCfg.BinaryRecipients = true
+	b, err = p.fixupRecipient(recipient[:])
+	require.NoError(err)
+	require.Equal(recipient[:], b)
+}
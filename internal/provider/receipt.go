@@ -0,0 +1,94 @@
+// receipt.go - Katzenpost server provider delivery receipts.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	receiptVersion = 0
+
+	receiptStatusDelivered = 0
+	receiptStatusRejected  = 1
+)
+
+// receiptMagic identifies a SURB-ACK payload carrying a delivery receipt,
+// as opposed to the traditional all zero payload.
+var receiptMagic = []byte("MRCT")
+
+var deliveryReceipts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: constants.Namespace,
+		Name:      "delivery_receipts_total",
+		Subsystem: constants.ProviderSubsystem,
+		Help:      "Number of delivery receipts sent by status",
+	},
+	[]string{"status"},
+)
+
+// newReceipt returns the SURB-ACK payload carrying a delivery receipt.
+//
+// The receipt follows the 2 byte SURB-Reply header, and consists of the
+// magic, the version and status bytes, and the big endian time at which
+// the message was handled in seconds since the UNIX epoch.
+func newReceipt(status byte, now time.Time) []byte {
+	b := make([]byte, 0, 2+len(receiptMagic)+2+8)
+	b = append(b, 0x00, 0x00)
+	b = append(b, receiptMagic...)
+	b = append(b, receiptVersion, status)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(now.Unix()))
+	return append(b, ts[:]...)
+}
+
+// sendReceipt generates a SURB-ACK for a message, carrying a delivery
+// receipt if enabled, and schedules it.
+func (p *provider) sendReceipt(pkt *packet.Packet, surb []byte, storeErr error) {
+	var payload []byte
+	if p.glue.Config().Provider.DeliveryReceipts {
+		status := byte(receiptStatusDelivered)
+		if storeErr != nil {
+			status = receiptStatusRejected
+		}
+		payload = newReceipt(status, time.Now())
+		deliveryReceipts.With(prometheus.Labels{"status": fmt.Sprintf("%d", status)}).Inc()
+	} else if storeErr != nil {
+		// Without receipts, the absence of a SURB-ACK is the only
+		// indication of a failure.
+		return
+	}
+
+	ackPkt, err := packet.NewPacketFromSURB(pkt, surb, payload)
+	if err != nil {
+		p.log.Debugf("Failed to generate SURB-ACK: %v (%v)", pkt.ID, err)
+		return
+	}
+
+	p.log.Debugf("Handing off newly generated SURB-ACK: %v (Src:%v)", ackPkt.ID, pkt.ID)
+	p.glue.Scheduler().OnPacket(ackPkt)
+}
+
+func init() {
+	prometheus.MustRegister(deliveryReceipts)
+}
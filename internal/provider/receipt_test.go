@@ -0,0 +1,91 @@
+// receipt_test.go - Katzenpost server delivery receipt tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/packet"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReceipt(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Unix(1600000000, 0)
+	b := newReceipt(receiptStatusRejected, now)
+	require.Len(b, 2+len(receiptMagic)+2+8)
+	require.Equal([]byte{0x00, 0x00}, b[:2], "SURB-Reply header")
+	require.Equal(receiptMagic, b[2:6])
+	require.Equal(byte(receiptVersion), b[6])
+	require.Equal(byte(receiptStatusRejected), b[7])
+	require.Equal(uint64(now.Unix()), binary.BigEndian.Uint64(b[8:]))
+}
+
+func TestSendReceipt(t *testing.T) {
+	require := require.New(t)
+
+	p := newTestProvider(t)
+	scheduler := p.glue.(*testGlue).scheduler
+
+	nodeKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	hop := &sphinx.PathHop{
+		PublicKey: nodeKey.PublicKey(),
+		Commands:  []commands.RoutingCommand{&commands.Recipient{}, &commands.SURBReply{}},
+	}
+	surb, _, err := sphinx.NewSURB(rand.Reader, []*sphinx.PathHop{hop})
+	require.NoError(err)
+	pkt := &packet.Packet{
+		NodeDelay: &commands.NodeDelay{},
+		Recipient: &commands.Recipient{},
+	}
+	delivered := deliveryReceipts.With(prometheus.Labels{"status": "0"})
+	rejected := deliveryReceipts.With(prometheus.Labels{"status": "1"})
+	nDelivered, nRejected := testutil.ToFloat64(delivered), testutil.ToFloat64(rejected)
+
+	// Without receipts, only delivered messages are acknowledged.
+	p.sendReceipt(pkt, surb, nil)
+	require.Len(scheduler.packets(), 1)
+	p.sendReceipt(pkt, surb, errors.New("spool full"))
+	require.Len(scheduler.packets(), 1)
+	require.Equal(nDelivered, testutil.ToFloat64(delivered))
+
+	// With receipts, rejected messages are acknowledged too.
+	p.glue.Config().Provider.DeliveryReceipts = true
+	p.sendReceipt(pkt, surb, nil)
+	p.sendReceipt(pkt, surb, errors.New("spool full"))
+	require.Len(scheduler.packets(), 3)
+	require.Equal(nDelivered+1, testutil.ToFloat64(delivered))
+	require.Equal(nRejected+1, testutil.ToFloat64(rejected))
+	for _, ackPkt := range scheduler.packets() {
+		require.True(ackPkt.MustForward)
+	}
+
+	// Malformed SURBs are dropped.
+	p.sendReceipt(pkt, surb[1:], nil)
+	require.Len(scheduler.packets(), 3)
+}
@@ -0,0 +1,140 @@
+// services.go - Katzenpost server Kaetzchen inspection.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashcloak/Meson-server/internal/provider/kaetzchen"
+	"github.com/katzenpost/core/thwack"
+)
+
+// services returns the state of the built-in Kaetzchen, followed by the
+// external plugins.
+func (p *provider) services() []*kaetzchen.ServiceStatus {
+	return append(p.kaetzchenWorker.Services(), p.cborPluginKaetzchenWorker.Services()...)
+}
+
+// formatService summarizes the state of a service as `key=value` pairs.
+func formatService(s *kaetzchen.ServiceStatus) string {
+	kind, advertised := "plugin", "no"
+	if s.BuiltIn {
+		kind = "built-in"
+	}
+	if s.Parameters != nil {
+		advertised = "yes"
+	}
+
+	f := []string{
+		s.Capability,
+		"type=" + kind,
+		"endpoint=" + s.Endpoint,
+		"advertised=" + advertised,
+	}
+	if !s.BuiltIn {
+		running := 0
+		var restarts uint64
+		for _, inst := range s.Instances {
+			if inst.Running {
+				running++
+			}
+			restarts += inst.Restarts
+		}
+		f = append(f, fmt.Sprintf("running=%v/%v", running, len(s.Instances)))
+		f = append(f, fmt.Sprintf("restarts=%v", restarts))
+	}
+	f = append(f, fmt.Sprintf("errors=%v", s.Errors))
+	return strings.Join(f, " ")
+}
+
+// onKaetzchen handles `KAETZCHEN`, that lists the built-in Kaetzchen and
+// the external plugins, one per line.
+func (p *provider) onKaetzchen(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("KAETZCHEN invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	services := p.services()
+	w := c.Writer()
+	for _, s := range services {
+		if err := w.PrintfLine("%v-%v", thwack.StatusOk, formatService(s)); err != nil {
+			return err
+		}
+	}
+	return w.PrintfLine("%v %v services", thwack.StatusOk, len(services))
+}
+
+// onKaetzchenInfo handles `KAETZCHEN_INFO <capability>`, that reports the
+// advertised parameters, the plugin instances and the recent errors of a
+// service, one per line.
+func (p *provider) onKaetzchenInfo(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("KAETZCHEN_INFO invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	var s *kaetzchen.ServiceStatus
+	for _, v := range p.services() {
+		if v.Capability == sp[1] {
+			s = v
+			break
+		}
+	}
+	if s == nil {
+		c.Log().Errorf("KAETZCHEN_INFO: no such service: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	now := time.Now()
+	lines := []string{formatService(s)}
+	keys := make([]string, 0, len(s.Parameters))
+	for key := range s.Parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("param %v=%v", key, s.Parameters[key]))
+	}
+	for _, inst := range s.Instances {
+		state := "running"
+		if !inst.Running {
+			state = "down"
+			if !inst.NextRestart.IsZero() {
+				state = fmt.Sprintf("down restart_in=%v", inst.NextRestart.Sub(now).Round(time.Second))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("instance %v (%v) restarts=%v %v", inst.ID, inst.Upstream, inst.Restarts, state))
+	}
+	for _, e := range s.RecentErrors {
+		lines = append(lines, fmt.Sprintf("error %v ago: %v", now.Sub(e.At).Round(time.Second), e.Err))
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	w := c.Writer()
+	for _, line := range lines {
+		if err := w.PrintfLine("%v-%v", thwack.StatusOk, line); err != nil {
+			return err
+		}
+	}
+	return w.PrintfLine("%v %v", thwack.StatusOk, s.Capability)
+}
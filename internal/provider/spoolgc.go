@@ -0,0 +1,80 @@
+// spoolgc.go - Katzenpost server user message spool garbage collection.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"time"
+
+	internalConstants "github.com/hashcloak/Meson-server/internal/constants"
+	"github.com/hashcloak/Meson-server/spool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	minSpoolGCInterval = 1 * time.Minute
+	maxSpoolGCInterval = 1 * time.Hour
+)
+
+var spoolExpiredMessages = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: internalConstants.Namespace,
+		Name:      "spool_expired_messages_total",
+		Subsystem: internalConstants.ProviderSubsystem,
+		Help:      "Number of spooled messages discarded due to age",
+	},
+)
+
+// spoolGCWorker periodically discards the spooled messages that are older
+// than the configured MessageTTL, so that abandoned accounts do not grow
+// the spool without bound.
+func (p *provider) spoolGCWorker() {
+	expirer, ok := p.spool.(spool.Expirer)
+	if !ok {
+		p.log.Warningf("Spool does not support MessageTTL, messages will not be expired.")
+		return
+	}
+
+	ttl := time.Duration(p.glue.Config().Provider.SpoolDB.MessageTTL) * time.Hour
+	interval := ttl / 8
+	if interval < minSpoolGCInterval {
+		interval = minSpoolGCInterval
+	} else if interval > maxSpoolGCInterval {
+		interval = maxSpoolGCInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := expirer.Expire(time.Now().Add(-ttl))
+		if err != nil {
+			p.log.Errorf("Failed to expire spooled messages: %v", err)
+		} else if n > 0 {
+			p.log.Debugf("Expired %v spooled messages.", n)
+			spoolExpiredMessages.Add(float64(n))
+		}
+
+		select {
+		case <-p.HaltCh():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(spoolExpiredMessages)
+}
@@ -0,0 +1,62 @@
+// proxy.go - Katzenpost server upstream proxy support.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package proxy implements outgoing connections via an upstream proxy.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashcloak/Meson-server/config"
+	"golang.org/x/net/proxy"
+)
+
+// DialContextFn is a net.Dialer.DialContext compatible dial function.
+type DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
+
+// New returns a DialContextFn that will establish connections via the
+// upstream proxy cfg, using dialer to connect to the proxy.  If cfg is nil,
+// connections are made directly with dialer.
+func New(cfg *config.UpstreamProxy, dialer *net.Dialer) (DialContextFn, error) {
+	if cfg == nil {
+		return dialer.DialContext, nil
+	}
+
+	switch strings.ToLower(cfg.Type) {
+	case config.ProxyTypeSOCKS5:
+		var auth *proxy.Auth
+		if cfg.User != "" {
+			auth = &proxy.Auth{
+				User:     cfg.User,
+				Password: cfg.Password,
+			}
+		}
+		d, err := proxy.SOCKS5("tcp", cfg.Address, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("proxy: SOCKS5 dialer does not support contexts")
+		}
+		return cd.DialContext, nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported proxy type: '%v'", cfg.Type)
+	}
+}
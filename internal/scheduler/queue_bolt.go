@@ -194,6 +194,13 @@ func (q *boltQueue) Peek() (time.Duration, *packet.Packet) {
 	return q.headPrio, q.headPkt
 }
 
+func (q *boltQueue) Len() int {
+	if q.headPkt == nil {
+		return 0
+	}
+	return int(q.dbCount) + 1
+}
+
 func (q *boltQueue) Pop() {
 	if q.headPkt != nil {
 		q.headPkt = nil
@@ -78,6 +78,18 @@ func (m *mockGlue) Scheduler() glue.Scheduler {
 }
 func (m *mockGlue) ReshadowCryptoWorkers() {}
 
+func (m *mockGlue) SetLogLevel(string, string) error {
+	return nil
+}
+
+func (m *mockGlue) Draining() bool {
+	return false
+}
+
+func (m *mockGlue) RuntimeConfig() *glue.RuntimeConfig {
+	return &glue.RuntimeConfig{}
+}
+
 // TestMemoryQueueBulkEnqueue verifies that the queue orders packets by delay
 func TestMemoryQueueBulkEnqueue(t *testing.T) {
 	require := require.New(t)
@@ -19,9 +19,9 @@ package scheduler
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
 	"github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/debug"
 	"github.com/hashcloak/Meson-server/internal/glue"
@@ -38,6 +38,7 @@ type queueImpl interface {
 	Peek() (time.Duration, *packet.Packet)
 	Pop()
 	BulkEnqueue([]*packet.Packet)
+	Len() int
 }
 
 type scheduler struct {
@@ -50,6 +51,8 @@ type scheduler struct {
 	inCh       *channels.InfiniteChannel
 	outCh      *channels.BatchingChannel
 	maxDelayCh chan uint64
+
+	queueLen int64
 }
 
 var (
@@ -99,9 +102,15 @@ func (sch *scheduler) OnPacket(pkt *packet.Packet) {
 	sch.inCh.In() <- pkt
 }
 
+// QueueLength returns the number of packets waiting to be scheduled or
+// dispatched.
+func (sch *scheduler) QueueLength() int {
+	return sch.inCh.Len() + sch.outCh.Len() + int(atomic.LoadInt64(&sch.queueLen))
+}
+
 func (sch *scheduler) worker() {
 
-	var absoluteMaxDelay = epochtime.TestPeriod * constants.NumMixKeys
+	var absoluteMaxDelay = sch.glue.PKI().EpochPeriod() * constants.NumMixKeys
 
 	timerSlack := time.Duration(sch.glue.Config().Debug.SchedulerSlack) * time.Millisecond
 	timer := time.NewTimer(math.MaxInt64)
@@ -234,6 +243,9 @@ func (sch *scheduler) worker() {
 				sch.glue.Connector().DispatchPacket(pkt)
 			}
 		}
+
+		// The queue is only safe to access from the worker.
+		atomic.StoreInt64(&sch.queueLen, int64(sch.q.Len()))
 	}
 
 	// NOTREACHED
@@ -97,10 +97,7 @@ func (p *pgxImpl) Log(level pgx.LogLevel, msg string, data map[string]interface{
 }
 
 func (p *pgxImpl) initMetadata() error {
-	const (
-		metadataQuery    = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
-		pgxSchemaVersion = 0
-	)
+	const metadataQuery = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
 
 	var schemaVersion int
 	err := p.pool.QueryRow(metadataQuery).Scan(&schemaVersion, &p.spoolOnly)
@@ -109,10 +106,13 @@ func (p *pgxImpl) initMetadata() error {
 		return fmt.Errorf("sql/pgx: database missing metadata table?")
 	case err != nil:
 		return fmt.Errorf("sql/pgx: metadata_get() failed: %v", err)
-	default:
-		if schemaVersion != pgxSchemaVersion {
-			return fmt.Errorf("sql/pgx: invalid schema version: %v", schemaVersion)
+	case schemaVersion > pgxSchemaVersion || schemaVersion < 0:
+		return fmt.Errorf("sql/pgx: invalid schema version: %v", schemaVersion)
+	case schemaVersion < pgxSchemaVersion:
+		if p.d.glue.Config().Provider.SQLDB.DisableMigrations {
+			return fmt.Errorf("sql/pgx: outdated schema version: %v (need %v)", schemaVersion, pgxSchemaVersion)
 		}
+		return p.migrate(schemaVersion)
 	}
 
 	return nil
@@ -0,0 +1,84 @@
+// pgx_migrate.go - Postgresql schema migrations.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// pgxMigrations are the schema migrations, where pgxMigrations[i] upgrades
+// a database from schema version i to i+1.  Databases are always created
+// at version 0 by `create_database-postgresql.sql`, and brought up to date
+// on startup.
+var pgxMigrations = []string{}
+
+// pgxSchemaVersion is the schema version required by the server.
+var pgxSchemaVersion = len(pgxMigrations)
+
+// migrate upgrades the database schema from version from to the current
+// version, in a single transaction.
+func (p *pgxImpl) migrate(from int) error {
+	tx, err := p.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Serialize concurrent migrations, and ensure that the version did not
+	// change under us.
+	var version int
+	if err = tx.QueryRow("SELECT schema_version FROM metadata FOR UPDATE;").Scan(&version); err != nil {
+		return fmt.Errorf("sql/pgx: failed to lock metadata: %v", err)
+	}
+	if version != from {
+		return fmt.Errorf("sql/pgx: schema version changed during migration: %v", version)
+	}
+
+	if err = applyMigrations(p.d.log, tx, pgxMigrations, from); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// execer is the part of pgx.Tx used to apply migrations.
+type execer interface {
+	Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error)
+}
+
+// applyMigrations applies migrations[from:], and records the resulting
+// schema version.
+func applyMigrations(log *logging.Logger, tx execer, migrations []string, from int) error {
+	if from < 0 || from > len(migrations) {
+		return fmt.Errorf("sql/pgx: invalid schema version: %v", from)
+	}
+	for v := from; v < len(migrations); v++ {
+		log.Noticef("Migrating database schema: %v -> %v", v, v+1)
+		if _, err := tx.Exec(migrations[v]); err != nil {
+			return fmt.Errorf("sql/pgx: migration %v -> %v failed: %v", v, v+1, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE metadata SET schema_version = $1;", len(migrations)); err != nil {
+		return fmt.Errorf("sql/pgx: failed to update schema version: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// pgx_migrate_test.go - Postgresql schema migration tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+type testTx struct {
+	stmts  []string
+	args   [][]interface{}
+	failOn string
+}
+
+func (tx *testTx) Exec(sql string, arguments ...interface{}) (pgx.CommandTag, error) {
+	if sql == tx.failOn {
+		return "", errors.New("syntax error")
+	}
+	tx.stmts = append(tx.stmts, sql)
+	tx.args = append(tx.args, arguments)
+	return "", nil
+}
+
+func TestApplyMigrations(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	l := logBackend.GetLogger("test")
+
+	const setVersion = "UPDATE metadata SET schema_version = $1;"
+	migrations := []string{"M0;", "M1;", "M2;"}
+
+	// Only the missing migrations are applied, in order.
+	for from, want := range [][]string{
+		{"M0;", "M1;", "M2;", setVersion},
+		{"M1;", "M2;", setVersion},
+		{"M2;", setVersion},
+		{setVersion},
+	} {
+		tx := new(testTx)
+		require.NoError(applyMigrations(l, tx, migrations, from))
+		require.Equal(want, tx.stmts)
+		require.Equal([]interface{}{len(migrations)}, tx.args[len(tx.args)-1])
+	}
+
+	// A failed migration does not record the new version.
+	tx := &testTx{failOn: "M1;"}
+	require.Error(applyMigrations(l, tx, migrations, 0))
+	require.Equal([]string{"M0;"}, tx.stmts)
+
+	// Invalid versions are rejected.
+	require.Error(applyMigrations(l, new(testTx), migrations, -1))
+	require.Error(applyMigrations(l, new(testTx), migrations, len(migrations)+1))
+
+	// The server's migrations apply to a freshly created database.
+	tx = new(testTx)
+	require.NoError(applyMigrations(l, tx, pgxMigrations, 0))
+	require.Equal(append(append([]string{}, pgxMigrations...), setVersion), tx.stmts)
+	require.Equal(len(pgxMigrations), pgxSchemaVersion)
+}
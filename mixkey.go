@@ -20,12 +20,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/mixkey"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/thwack"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -126,6 +130,69 @@ func (m *mixKeys) Prune() bool {
 	return didPrune
 }
 
+// Rotate replaces the keys for the epochs after the given one, and returns
+// the epochs of the replaced keys.
+func (m *mixKeys) Rotate(after uint64) ([]uint64, error) {
+	epoch, _, _, err := m.glue.PKI().Now()
+	if err != nil {
+		return nil, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	var toRotate []uint64
+	for e := range m.keys {
+		if e > after {
+			toRotate = append(toRotate, e)
+		}
+	}
+	sort.Slice(toRotate, func(i, j int) bool { return toRotate[i] < toRotate[j] })
+
+	var rotated []uint64
+	for _, e := range toRotate {
+		k := m.keys[e]
+		if err = k.Unlink(); err != nil {
+			return rotated, err
+		}
+		k.Deref(epoch)
+		delete(m.keys, e)
+
+		// If this fails, the key will be generated when the descriptor is
+		// published.
+		if k, err = mixkey.New(m.glue.Config().Server.DataDir, e); err != nil {
+			return rotated, err
+		}
+		k.SetUnlinkIfExpired(true)
+		m.keys[e] = k
+		rotated = append(rotated, e)
+	}
+	return rotated, nil
+}
+
+// Invalidate discards the key for an epoch, and returns true iff there was
+// such a key.
+func (m *mixKeys) Invalidate(e uint64) (bool, error) {
+	epoch, _, _, err := m.glue.PKI().Now()
+	if err != nil {
+		return false, err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	k, ok := m.keys[e]
+	if !ok {
+		return false, nil
+	}
+	if err = k.Unlink(); err != nil {
+		return false, err
+	}
+	k.Deref(epoch)
+	delete(m.keys, e)
+	return true, nil
+}
+
 func (m *mixKeys) Get(epoch uint64) (*ecdh.PublicKey, bool) {
 	m.Lock()
 	defer m.Unlock()
@@ -146,9 +213,9 @@ func (m *mixKeys) Shadow(dst map[uint64]*mixkey.MixKey) {
 		return
 	}
 
-	// Purge the keys no longer listed from dst.
+	// Purge the keys no longer listed, or replaced, from dst.
 	for k, v := range dst {
-		if _, ok := m.keys[k]; !ok {
+		if vv, ok := m.keys[k]; !ok || vv != v {
 			v.Deref(epoch)
 			delete(dst, k)
 		}
@@ -191,3 +258,60 @@ func newMixKeys(glue glue.Glue) (glue.MixKeys, error) {
 
 	return m, nil
 }
+
+// onRotateMixKeys handles `ROTATE_MIX_KEYS`, that replaces the mix keys that
+// have not been published yet, which are uploaded with the next descriptor.
+func (s *Server) onRotateMixKeys(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("ROTATE_MIX_KEYS invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// The keys listed in a descriptor that was uploaded can not be changed,
+	// and nothing is known about the uploads made before a restart.
+	published := s.pki.LastPublishedEpoch()
+	if published == 0 {
+		c.Log().Errorf("ROTATE_MIX_KEYS: no descriptor was published yet")
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+
+	rotated, err := s.mixKeys.Rotate(published)
+	if len(rotated) > 0 {
+		s.reshadowCryptoWorkers()
+	}
+	if err != nil {
+		c.Log().Errorf("Failed to rotate the mix keys: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.log.Noticef("Rotated the mix keys for epochs %v, as requested via the management interface.", rotated)
+	return c.Writer().PrintfLine("%v rotated epochs %v, published from epoch %v", thwack.StatusOk, rotated, published+1)
+}
+
+// onInvalidateMixKey handles `INVALIDATE_MIX_KEY <epoch>`, that discards a
+// compromised mix key.  The packets for the epoch are dropped if its key was
+// already published.
+func (s *Server) onInvalidateMixKey(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("INVALIDATE_MIX_KEY invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	epoch, err := strconv.ParseUint(sp[1], 10, 64)
+	if err != nil {
+		c.Log().Debugf("INVALIDATE_MIX_KEY invalid epoch: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	ok, err := s.mixKeys.Invalidate(epoch)
+	switch {
+	case err != nil:
+		c.Log().Errorf("Failed to invalidate the mix key for epoch %v: %v", epoch, err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	case !ok:
+		c.Log().Errorf("INVALIDATE_MIX_KEY: no mix key for epoch %v", epoch)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.reshadowCryptoWorkers()
+	s.log.Warningf("Invalidated the mix key for epoch %v, as requested via the management interface.", epoch)
+	return c.WriteReply(thwack.StatusOk)
+}
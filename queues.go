@@ -0,0 +1,90 @@
+// queues.go - Katzenpost server queue depths.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashcloak/Meson-server/spool"
+	"github.com/katzenpost/core/thwack"
+)
+
+// queueDepths returns the depth of each of the server's queues, one per
+// line, in the order packets go through them.
+func (s *Server) queueDepths() []string {
+	inbound := 0
+	for _, ch := range s.inboundPackets {
+		inbound += ch.Len()
+	}
+	lines := []string{
+		fmt.Sprintf("inbound %v", inbound),
+		fmt.Sprintf("scheduler %v", s.scheduler.QueueLength()),
+	}
+
+	conns := s.connector.Connections()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Peer < conns[j].Peer })
+	for _, info := range conns {
+		lines = append(lines, fmt.Sprintf("outgoing %v %v", info.Peer, info.QueueLength))
+	}
+
+	if s.provider == nil {
+		return lines
+	}
+	q := s.provider.Queues()
+	lines = append(lines, fmt.Sprintf("provider %v", q.Inbound))
+	queues := make([]string, 0, len(q.Kaetzchen))
+	for name := range q.Kaetzchen {
+		queues = append(queues, name)
+	}
+	sort.Strings(queues)
+	for _, name := range queues {
+		lines = append(lines, fmt.Sprintf("kaetzchen %v %v", name, q.Kaetzchen[name]))
+	}
+	lines = append(lines, fmt.Sprintf("kaetzchen_in_flight %v", q.KaetzchenInFlight))
+
+	if statter, ok := s.provider.Spool().(spool.Statter); ok {
+		spools, messages, size, err := statter.Stats()
+		if err != nil {
+			s.log.Errorf("Failed to query the spool totals: %v", err)
+		} else {
+			lines = append(lines, fmt.Sprintf("spool users=%v messages=%v bytes=%v", spools, messages, size))
+		}
+	}
+	return lines
+}
+
+// onQueues handles `QUEUES`, that reports the depth of the scheduler, the
+// outgoing connection, the Provider and the Kaetzchen queues, and the
+// spool totals, one per line.
+func (s *Server) onQueues(c *thwack.Conn, l string) error {
+	if len(strings.Split(l, " ")) != 1 {
+		c.Log().Debugf("QUEUES invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Multi-line replies use the SMTP continuation syntax.
+	w := c.Writer()
+	for _, line := range s.queueDepths() {
+		if err := w.PrintfLine("%v-%v", thwack.StatusOk, line); err != nil {
+			return err
+		}
+	}
+	n, _ := s.drainBacklog()
+	return w.PrintfLine("%v %v packets queued", thwack.StatusOk, n)
+}
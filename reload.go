@@ -0,0 +1,161 @@
+// reload.go - Katzenpost server configuration reloading.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/internal/glue"
+)
+
+// ReloadReport lists the changes applied by Reload, the changes that only
+// take effect after a restart, and the changes that failed to apply.
+type ReloadReport struct {
+	Applied         []string
+	RestartRequired []string
+	Failed          []string
+}
+
+func (r *ReloadReport) fail(what string, err error) {
+	r.Failed = append(r.Failed, fmt.Sprintf("%v: %v", what, err))
+}
+
+// Reload applies the safely reloadable sections of a new, already
+// validated configuration:
+//
+//   - the log level,
+//   - the directory authority configuration,
+//   - the decoy traffic and connection rate limiting debug options,
+//   - the Provider recipient policy, Kaetzchen rate limits and plugins.
+//
+// The other changes are reported as requiring a restart.  The configuration
+// the server was started with is never modified, as it is read without
+// locking, the reloaded values are published through glue.RuntimeConfig and
+// the subsystems' own Reconfigure methods instead.
+func (s *Server) Reload(newCfg *config.Config) *ReloadReport {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	r := new(ReloadReport)
+	cfg := s.cfg
+
+	// Logging.
+	if s.logLevel != newCfg.Logging.Level {
+		if err := s.SetLogLevel("", newCfg.Logging.Level); err != nil {
+			r.fail("Logging.Level", err)
+		} else {
+			s.logLevel = newCfg.Logging.Level
+			r.Applied = append(r.Applied, "Logging.Level")
+		}
+	}
+	if cfg.Logging.Disable != newCfg.Logging.Disable || cfg.Logging.File != newCfg.Logging.File {
+		r.RestartRequired = append(r.RestartRequired, "Logging")
+	}
+
+	// PKI.
+	if !reflect.DeepEqual(s.pkiCfg, newCfg.PKI) {
+		if err := s.pki.Reconfigure(newCfg.PKI); err != nil {
+			r.fail("PKI", err)
+		} else {
+			s.pkiCfg = newCfg.PKI
+			r.Applied = append(r.Applied, "PKI")
+		}
+	}
+
+	// Debug, only the options that are read on use are reloadable.
+	oldRCfg, newRCfg := s.runtimeConfig(), newRuntimeConfig(newCfg)
+	if oldRCfg.SendDecoyTraffic != newRCfg.SendDecoyTraffic || oldRCfg.DecoySlack != newRCfg.DecoySlack {
+		r.Applied = append(r.Applied, "Debug decoy traffic")
+	}
+	if oldRCfg.DisableRateLimit != newRCfg.DisableRateLimit {
+		r.Applied = append(r.Applied, "Debug.DisableRateLimit")
+	}
+	s.runtimeCfg.Store(newRCfg)
+	if !reflect.DeepEqual(maskDebug(cfg.Debug), maskDebug(newCfg.Debug)) {
+		r.RestartRequired = append(r.RestartRequired, "Debug")
+	}
+
+	// Provider.
+	if s.provider != nil && newCfg.Provider != nil {
+		applied, err := s.provider.Reconfigure(newCfg.Provider)
+		r.Applied = append(r.Applied, applied...)
+		if err != nil {
+			r.fail("Provider", err)
+		}
+	}
+	if !reflect.DeepEqual(maskProvider(cfg.Provider), maskProvider(newCfg.Provider)) {
+		r.RestartRequired = append(r.RestartRequired, "Provider")
+	}
+
+	// The remaining sections.
+	if !reflect.DeepEqual(cfg.Server, newCfg.Server) {
+		r.RestartRequired = append(r.RestartRequired, "Server")
+	}
+	if !reflect.DeepEqual(cfg.UpstreamProxy, newCfg.UpstreamProxy) {
+		r.RestartRequired = append(r.RestartRequired, "UpstreamProxy")
+	}
+	if !reflect.DeepEqual(cfg.Management, newCfg.Management) {
+		r.RestartRequired = append(r.RestartRequired, "Management")
+	}
+
+	s.log.Noticef("Reloaded configuration, applied: %v, restart required: %v, failed: %v", r.Applied, r.RestartRequired, r.Failed)
+	return r
+}
+
+func (s *Server) runtimeConfig() *glue.RuntimeConfig {
+	return s.runtimeCfg.Load().(*glue.RuntimeConfig)
+}
+
+func newRuntimeConfig(cfg *config.Config) *glue.RuntimeConfig {
+	return &glue.RuntimeConfig{
+		SendDecoyTraffic: cfg.Debug.SendDecoyTraffic,
+		DecoySlack:       cfg.Debug.DecoySlack,
+		DisableRateLimit: cfg.Debug.DisableRateLimit,
+	}
+}
+
+// maskDebug returns a copy of the Debug configuration without the
+// reloadable parts.
+func maskDebug(dCfg *config.Debug) *config.Debug {
+	if dCfg == nil {
+		return nil
+	}
+	c := *dCfg
+	c.SendDecoyTraffic, c.DecoySlack, c.DisableRateLimit = false, 0, false
+	return &c
+}
+
+// maskProvider returns a copy of the Provider configuration without the
+// reloadable parts.
+func maskProvider(pCfg *config.Provider) *config.Provider {
+	if pCfg == nil {
+		return nil
+	}
+	c := *pCfg
+	c.Policy = nil
+	c.CBORPluginKaetzchen = nil
+	c.Kaetzchen = make([]*config.Kaetzchen, 0, len(pCfg.Kaetzchen))
+	for _, v := range pCfg.Kaetzchen {
+		k := *v
+		k.RateLimit, k.RateBurst = 0, 0
+		k.UserRateLimit, k.UserRateBurst = 0, 0
+		c.Kaetzchen = append(c.Kaetzchen, &k)
+	}
+	return &c
+}
@@ -22,7 +22,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"git.schwanenlied.me/yawning/aez.git"
 	"github.com/hashcloak/Meson-server/config"
@@ -31,6 +34,7 @@ import (
 	"github.com/hashcloak/Meson-server/internal/glue"
 	"github.com/hashcloak/Meson-server/internal/incoming"
 	"github.com/hashcloak/Meson-server/internal/instrument"
+	"github.com/hashcloak/Meson-server/internal/management"
 	"github.com/hashcloak/Meson-server/internal/outgoing"
 	"github.com/hashcloak/Meson-server/internal/pki"
 	"github.com/hashcloak/Meson-server/internal/provider"
@@ -59,7 +63,7 @@ type Server struct {
 	logBackend *log.Backend
 	log        *logging.Logger
 
-	inboundPackets *channels.InfiniteChannel
+	inboundPackets []*channels.InfiniteChannel
 
 	scheduler     glue.Scheduler
 	cryptoWorkers []*cryptoworker.Worker
@@ -71,10 +75,24 @@ type Server struct {
 	provider      glue.Provider
 	decoy         glue.Decoy
 	management    *thwack.Server
+	httpMgmt      *management.HTTPServer
+	grpcMgmt      *management.GRPCServer
 
 	fatalErrCh chan error
 	haltedCh   chan interface{}
 	haltOnce   sync.Once
+
+	draining         uint32
+	drainLock        sync.Mutex
+	drainStartedAt   time.Time
+	drainConnsClosed bool
+
+	// runtimeCfg is the *glue.RuntimeConfig, and reloadLock, logLevel and
+	// pkiCfg track the reloaded configuration, see Reload.
+	runtimeCfg atomic.Value
+	reloadLock sync.Mutex
+	logLevel   string
+	pkiCfg     *config.PKI
 }
 
 func (s *Server) initLogging() error {
@@ -114,6 +132,24 @@ func (s *Server) RotateLog() {
 	}
 }
 
+// SetLogLevel changes the log level of a module at runtime, or the level
+// of all the modules without their own level if module is empty.
+func (s *Server) SetLogLevel(module, level string) error {
+	lvl, err := logging.LogLevel(strings.ToUpper(level))
+	if err != nil {
+		return err
+	}
+	s.logBackend.SetLevel(lvl, module)
+	s.log.Noticef("Log level of '%v' set to %v.", module, lvl)
+	return nil
+}
+
+// ReloadPKI replaces the directory authority configuration, without
+// restarting the server.
+func (s *Server) ReloadPKI(cfg *config.PKI) error {
+	return s.pki.Reconfigure(cfg)
+}
+
 // Shutdown cleanly shuts down a given Server instance.
 func (s *Server) Shutdown() {
 	s.haltOnce.Do(func() { s.halt() })
@@ -138,6 +174,14 @@ func (s *Server) halt() {
 	}
 
 	// Stop the management interface.
+	if s.httpMgmt != nil {
+		s.httpMgmt.Halt()
+		s.httpMgmt = nil
+	}
+	if s.grpcMgmt != nil {
+		s.grpcMgmt.Halt()
+		s.grpcMgmt = nil
+	}
 	if s.management != nil {
 		s.management.Halt()
 		s.management = nil
@@ -200,8 +244,8 @@ func (s *Server) halt() {
 	}
 
 	// Clean up the top level components.
-	if s.inboundPackets != nil {
-		s.inboundPackets.Close()
+	for _, ch := range s.inboundPackets {
+		ch.Close()
 	}
 	s.linkKey.Reset()
 	s.identityKey.Reset()
@@ -218,7 +262,10 @@ func New(cfg *config.Config) (*Server, error) {
 		cfg:        cfg,
 		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
+		logLevel:   cfg.Logging.Level,
+		pkiCfg:     cfg.PKI,
 	}
+	s.runtimeCfg.Store(newRuntimeConfig(cfg))
 	goo := &serverGlue{s}
 
 	// Do the early initialization and bring up logging.
@@ -332,6 +379,25 @@ func New(cfg *config.Config) (*Server, error) {
 			s.fatalErrCh <- fmt.Errorf("user requested shutdown via mgmt interface")
 			return nil
 		})
+
+		const logLevelCmd = "LOG_LEVEL"
+		s.management.RegisterCommand(logLevelCmd, s.onLogLevel)
+
+		const drainCmd = "DRAIN"
+		s.management.RegisterCommand(drainCmd, s.onDrain)
+
+		const connectionsCmd = "CONNECTIONS"
+		s.management.RegisterCommand(connectionsCmd, s.onConnections)
+
+		const queuesCmd = "QUEUES"
+		s.management.RegisterCommand(queuesCmd, s.onQueues)
+
+		const (
+			rotateMixKeysCmd    = "ROTATE_MIX_KEYS"
+			invalidateMixKeyCmd = "INVALIDATE_MIX_KEY"
+		)
+		s.management.RegisterCommand(rotateMixKeysCmd, s.onRotateMixKeys)
+		s.management.RegisterCommand(invalidateMixKeyCmd, s.onInvalidateMixKey)
 	}
 
 	// Initialize the provider backend.
@@ -349,10 +415,26 @@ func New(cfg *config.Config) (*Server, error) {
 	}
 
 	// Initialize and start the Sphinx workers.
-	s.inboundPackets = channels.NewInfiniteChannel()
+	//
+	// Normally all of the workers share a single inbound queue, but with
+	// worker affinity enabled each worker gets a queue of its own, and
+	// each incoming connection is bound to one of the queues.
+	nrInboundQueues := 1
+	if s.cfg.Debug.SphinxWorkerAffinity {
+		s.log.Noticef("Sphinx worker affinity is enabled.")
+		nrInboundQueues = s.cfg.Debug.NumSphinxWorkers
+	}
+	s.inboundPackets = make([]*channels.InfiniteChannel, 0, nrInboundQueues)
+	inboundChs := make([]chan<- interface{}, 0, nrInboundQueues)
+	for i := 0; i < nrInboundQueues; i++ {
+		ch := channels.NewInfiniteChannel()
+		s.inboundPackets = append(s.inboundPackets, ch)
+		inboundChs = append(inboundChs, ch.In())
+	}
 	s.cryptoWorkers = make([]*cryptoworker.Worker, 0, s.cfg.Debug.NumSphinxWorkers)
 	for i := 0; i < s.cfg.Debug.NumSphinxWorkers; i++ {
-		w := cryptoworker.New(goo, s.inboundPackets.Out(), i)
+		ch := s.inboundPackets[i%nrInboundQueues]
+		w := cryptoworker.New(goo, ch.Out(), i)
 		s.cryptoWorkers = append(s.cryptoWorkers, w)
 	}
 
@@ -367,7 +449,7 @@ func New(cfg *config.Config) (*Server, error) {
 	// Bring the listener(s) online.
 	s.listeners = make([]glue.Listener, 0, len(s.cfg.Server.Addresses))
 	for i, addr := range s.cfg.Server.Addresses {
-		l, err := incoming.New(goo, s.inboundPackets.In(), i, addr)
+		l, err := incoming.New(goo, inboundChs, i, addr)
 		if err != nil {
 			s.log.Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
 			return nil, err
@@ -385,12 +467,45 @@ func New(cfg *config.Config) (*Server, error) {
 	// so.
 	if s.management != nil {
 		_ = s.management.Start()
+		if s.cfg.Management.EnableHTTP {
+			if s.httpMgmt, err = management.NewHTTP(s.cfg.Management, s.logBackend); err != nil {
+				s.log.Errorf("Failed to start the HTTP management API: %v", err)
+				return nil, err
+			}
+		}
+		if s.cfg.Management.GRPC != nil {
+			if s.grpcMgmt, err = management.NewGRPC(s.cfg.Management, s.logBackend); err != nil {
+				s.log.Errorf("Failed to start the gRPC management API: %v", err)
+				return nil, err
+			}
+		}
 	}
 
 	isOk = true
 	return s, nil
 }
 
+// onLogLevel handles `LOG_LEVEL [module] <level>`, that changes the level
+// of a module, or the global level if no module is given.
+func (s *Server) onLogLevel(c *thwack.Conn, l string) error {
+	var module, level string
+	sp := strings.Split(l, " ")
+	switch len(sp) {
+	case 2:
+		level = sp[1]
+	case 3:
+		module, level = sp[1], sp[2]
+	default:
+		c.Log().Debugf("LOG_LEVEL invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	if err := s.SetLogLevel(module, level); err != nil {
+		c.Log().Errorf("LOG_LEVEL invalid level: '%v'", level)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
+
 type serverGlue struct {
 	s *Server
 }
@@ -446,3 +561,15 @@ func (g *serverGlue) Decoy() glue.Decoy {
 func (g *serverGlue) ReshadowCryptoWorkers() {
 	g.s.reshadowCryptoWorkers()
 }
+
+func (g *serverGlue) SetLogLevel(module, level string) error {
+	return g.s.SetLogLevel(module, level)
+}
+
+func (g *serverGlue) Draining() bool {
+	return g.s.IsDraining()
+}
+
+func (g *serverGlue) RuntimeConfig() *glue.RuntimeConfig {
+	return g.s.runtimeConfig()
+}
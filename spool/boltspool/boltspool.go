@@ -21,23 +21,76 @@ package boltspool
 import (
 	"encoding/binary"
 	"fmt"
+	"time"
 
+	iConstants "github.com/hashcloak/Meson-server/internal/constants"
 	"github.com/hashcloak/Meson-server/spool"
 	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/prometheus/client_golang/prometheus"
 	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	usersBucket = "users"
+	usageBucket = "usage"
 	msgKey      = "message"
 	surbIDKey   = "surbID"
+	storedAtKey = "storedAt"
+)
+
+var (
+	quotaRejectedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: iConstants.Namespace,
+			Name:      "spool_quota_rejected_messages_total",
+			Subsystem: iConstants.ProviderSubsystem,
+			Help:      "Number of messages rejected due to spool quotas",
+		},
+	)
+	quotaDroppedMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: iConstants.Namespace,
+			Name:      "spool_quota_dropped_messages_total",
+			Subsystem: iConstants.ProviderSubsystem,
+			Help:      "Number of old messages discarded due to spool quotas",
+		},
+	)
 )
 
 type boltSpool struct {
-	db *bolt.DB
+	db    *bolt.DB
+	quota *spool.Quota
+}
+
+// usage returns the number of messages and total size of a user's spool.
+//
+// The usage is tracked in the `usage` bucket, and recomputed from the
+// spool for databases created before the tracking was introduced.
+func usage(tx *bolt.Tx, u []byte) (count, size uint64) {
+	if b := tx.Bucket([]byte(usageBucket)).Get(u); len(b) == 16 {
+		return binary.BigEndian.Uint64(b[0:]), binary.BigEndian.Uint64(b[8:])
+	}
+
+	sBkt := tx.Bucket([]byte(usersBucket)).Bucket(u)
+	if sBkt == nil {
+		return 0, 0
+	}
+	cur := sBkt.Cursor()
+	for mKey, _ := cur.First(); mKey != nil; mKey, _ = cur.Next() {
+		count++
+		size += uint64(len(sBkt.Bucket(mKey).Get([]byte(msgKey))))
+	}
+	return
+}
+
+func putUsage(tx *bolt.Tx, u []byte, count, size uint64) error {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:], count)
+	binary.BigEndian.PutUint64(b[8:], size)
+	return tx.Bucket([]byte(usageBucket)).Put(u, b[:])
 }
 
 func (s *boltSpool) Close() {
@@ -78,6 +131,26 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
+		// Enforce the quota, if any.
+		count, size := usage(tx, u)
+		count, size = count+1, size+uint64(len(msg))
+		for s.quota != nil && s.quota.IsExceeded(count, size) {
+			oldest, _ := sBkt.Cursor().First()
+			if !s.quota.DropOldest || oldest == nil {
+				quotaRejectedMessages.Inc()
+				return spool.ErrQuotaExceeded
+			}
+			oldLen := uint64(len(sBkt.Bucket(oldest).Get([]byte(msgKey))))
+			if err = sBkt.DeleteBucket(oldest); err != nil {
+				return err
+			}
+			count, size = count-1, size-oldLen
+			quotaDroppedMessages.Inc()
+		}
+		if err = putUsage(tx, u, count, size); err != nil {
+			return err
+		}
+
 		// Allocate a unique identifier for this message.
 		seq, err := sBkt.NextSequence()
 		if err != nil {
@@ -92,12 +165,14 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 			return err
 		}
 
-		// Store the message and (optional) SURB ID.
+		// Store the message, (optional) SURB ID, and time of storage.
 		_ = mBkt.Put([]byte(msgKey), msg)
 		if id != nil {
 			_ = mBkt.Put([]byte(surbIDKey), id[:])
 		}
-		return nil
+		var storedAt [8]byte
+		binary.BigEndian.PutUint64(storedAt[:], uint64(time.Now().Unix()))
+		return mBkt.Put([]byte(storedAtKey), storedAt[:])
 	})
 }
 
@@ -145,9 +220,19 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 
 	if advance {
 		// Delete the 0th message.
+		count, size := usage(tx, u)
+		msgLen := uint64(len(sBkt.Bucket(mKey).Get([]byte(msgKey))))
 		if err = sBkt.DeleteBucket(mKey); err != nil {
 			return
 		}
+		if count > 0 && size >= msgLen {
+			count, size = count-1, size-msgLen
+		} else {
+			count, size = 0, 0
+		}
+		if err = putUsage(tx, u, count, size); err != nil {
+			return
+		}
 
 		if next == nil {
 			// Deleting the message drained the queue.
@@ -195,6 +280,9 @@ func (s *boltSpool) Remove(u []byte) error {
 			return nil
 		}
 
+		if err := tx.Bucket([]byte(usageBucket)).Delete(u); err != nil {
+			return err
+		}
 		return uBkt.DeleteBucket(u)
 	})
 }
@@ -211,6 +299,9 @@ func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
 			if udb.Exists(u) {
 				continue
 			}
+			if err := tx.Bucket([]byte(usageBucket)).Delete(u); err != nil {
+				return err
+			}
 			if err := uBkt.DeleteBucket(u); err != nil {
 				return err
 			}
@@ -219,8 +310,98 @@ func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
 	})
 }
 
+func (s *boltSpool) Expire(before time.Time) (int, error) {
+	var expired int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := uint64(time.Now().Unix())
+		cutoff := uint64(before.Unix())
+
+		uBkt := tx.Bucket([]byte(usersBucket))
+		uCur := uBkt.Cursor()
+		for u, _ := uCur.First(); u != nil; u, _ = uCur.Next() {
+			sBkt := uBkt.Bucket(u)
+			if sBkt == nil {
+				continue
+			}
+
+			// Nested buckets can't be deleted via the cursor, so collect
+			// the expired messages first.
+			var expiredKeys [][]byte
+			var remaining int
+			cur := sBkt.Cursor()
+			for mKey, _ := cur.First(); mKey != nil; mKey, _ = cur.Next() {
+				mBkt := sBkt.Bucket(mKey)
+				b := mBkt.Get([]byte(storedAtKey))
+				if len(b) != 8 {
+					// Messages spooled before the storage time was tracked
+					// start aging now.
+					var storedAt [8]byte
+					binary.BigEndian.PutUint64(storedAt[:], now)
+					if err := mBkt.Put([]byte(storedAtKey), storedAt[:]); err != nil {
+						return err
+					}
+					remaining++
+					continue
+				}
+				if binary.BigEndian.Uint64(b) >= cutoff {
+					remaining++
+					continue
+				}
+				expiredKeys = append(expiredKeys, append([]byte{}, mKey...))
+			}
+			if len(expiredKeys) == 0 {
+				continue
+			}
+
+			count, size := usage(tx, u)
+			for _, mKey := range expiredKeys {
+				msgLen := uint64(len(sBkt.Bucket(mKey).Get([]byte(msgKey))))
+				if err := sBkt.DeleteBucket(mKey); err != nil {
+					return err
+				}
+				if count > 0 && size >= msgLen {
+					count, size = count-1, size-msgLen
+				}
+				expired++
+			}
+			if remaining == 0 {
+				count, size = 0, 0
+				_ = sBkt.SetSequence(0) // Don't keep a lifetime message count.
+			}
+			if err := putUsage(tx, u, count, size); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func (s *boltSpool) Stats() (spools, messages, size uint64, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		uCur := tx.Bucket([]byte(usersBucket)).Cursor()
+		for u, _ := uCur.First(); u != nil; u, _ = uCur.Next() {
+			count, sz := usage(tx, u)
+			if count == 0 {
+				continue
+			}
+			spools++
+			messages += count
+			size += sz
+		}
+		return nil
+	})
+	return
+}
+
 // New creates (or loads) a user message spool with the given file name f.
 func New(f string) (spool.Spool, error) {
+	return NewWithQuota(f, nil)
+}
+
+// NewWithQuota creates (or loads) a user message spool with the given file
+// name f, that enforces the per-user quota if it is non-nil.
+func NewWithQuota(f string, quota *spool.Quota) (spool.Spool, error) {
 	const (
 		metadataBucket = "metadata"
 		versionKey     = "version"
@@ -228,7 +409,7 @@ func New(f string) (spool.Spool, error) {
 
 	var err error
 
-	s := new(boltSpool)
+	s := &boltSpool{quota: quota}
 	s.db, err = bolt.Open(f, 0600, nil)
 	if err != nil {
 		return nil, err
@@ -243,6 +424,9 @@ func New(f string) (spool.Spool, error) {
 		if _, err = tx.CreateBucketIfNotExists([]byte(usersBucket)); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(usageBucket)); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
@@ -264,3 +448,8 @@ func New(f string) (spool.Spool, error) {
 
 	return s, nil
 }
+
+func init() {
+	prometheus.MustRegister(quotaRejectedMessages)
+	prometheus.MustRegister(quotaDroppedMessages)
+}
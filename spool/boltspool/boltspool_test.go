@@ -22,7 +22,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/hashcloak/Meson-server/spool"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
@@ -66,6 +68,9 @@ func TestBoltSpool(t *testing.T) {
 	} else {
 		t.Errorf("create tests failed, skipping load test")
 	}
+	t.Run("quota", doTestQuota)
+	t.Run("expire", doTestExpire)
+	t.Run("stats", doTestStats)
 
 	os.RemoveAll(tmpDir)
 }
@@ -123,6 +128,92 @@ func doTestLoad(t *testing.T) {
 	assert.NoError(err, "Delete(u)")
 }
 
+func doTestQuota(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	quota := &spool.Quota{MaxMessages: 2}
+	s, err := NewWithQuota(filepath.Join(tmpDir, "quota.db"), quota)
+	require.NoError(err, "NewWithQuota()")
+	defer s.Close()
+
+	u := []byte(testUser)
+	for i := 0; i < 2; i++ {
+		err = s.StoreMessage(u, []byte{byte(i)})
+		require.NoError(err, "StoreMessage()")
+	}
+	err = s.StoreMessage(u, []byte{2})
+	assert.Equal(spool.ErrQuotaExceeded, err, "StoreMessage(): over quota")
+
+	// Consuming a message should free up room.
+	_, _, _, err = s.Get(u, true)
+	require.NoError(err, "Get()")
+	err = s.StoreMessage(u, []byte{2})
+	assert.NoError(err, "StoreMessage(): after Get()")
+
+	// Dropping the oldest message should make room for the new one.
+	quota.DropOldest = true
+	err = s.StoreMessage(u, []byte{3})
+	assert.NoError(err, "StoreMessage(): drop oldest")
+	msg, _, remaining, err := s.Get(u, false)
+	assert.NoError(err, "Get()")
+	assert.Equal([]byte{2}, msg, "Oldest remaining message")
+	assert.Equal(1, remaining, "Remaining messages")
+}
+
+func doTestExpire(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s, err := New(filepath.Join(tmpDir, "expire.db"))
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	u := []byte(testUser)
+	err = s.StoreMessage(u, testMsg)
+	require.NoError(err, "StoreMessage()")
+
+	expirer := s.(spool.Expirer)
+	n, err := expirer.Expire(time.Now().Add(-time.Hour))
+	assert.NoError(err, "Expire(): nothing expired")
+	assert.Equal(0, n, "Expired messages")
+
+	n, err = expirer.Expire(time.Now().Add(time.Hour))
+	assert.NoError(err, "Expire()")
+	assert.Equal(1, n, "Expired messages")
+
+	msg, _, _, err := s.Get(u, false)
+	assert.NoError(err, "Get()")
+	assert.Nil(msg, "Spool should be empty")
+}
+
+func doTestStats(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s, err := New(filepath.Join(tmpDir, "stats.db"))
+	require.NoError(err, "New()")
+	defer s.Close()
+
+	statter := s.(spool.Statter)
+	spools, messages, size, err := statter.Stats()
+	assert.NoError(err, "Stats(): empty")
+	assert.Zero(spools, "Spools")
+	assert.Zero(messages, "Messages")
+	assert.Zero(size, "Size")
+
+	err = s.StoreMessage([]byte(testUser), testMsg)
+	require.NoError(err, "StoreMessage()")
+	err = s.StoreSURBReply([]byte(testUser), &testSurbID, testSurbMsg)
+	require.NoError(err, "StoreSURBReply()")
+
+	spools, messages, size, err = statter.Stats()
+	assert.NoError(err, "Stats()")
+	assert.Equal(uint64(1), spools, "Spools")
+	assert.Equal(uint64(2), messages, "Messages")
+	assert.Equal(uint64(len(testMsg)+len(testSurbMsg)), size, "Size")
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltspool_tests")
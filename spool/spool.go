@@ -19,10 +19,52 @@
 package spool
 
 import (
+	"errors"
+	"time"
+
 	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
+// ErrQuotaExceeded is the error returned when a message is rejected due to
+// the user's spool being over quota.
+var ErrQuotaExceeded = errors.New("spool: quota exceeded")
+
+// Quota is the per-user spool limit.  Zero values are treated as unlimited.
+type Quota struct {
+	// MaxMessages is the maximum number of spooled messages.
+	MaxMessages uint64
+
+	// MaxBytes is the maximum total size of the spooled messages.
+	MaxBytes uint64
+
+	// DropOldest causes the oldest messages to be discarded to make room
+	// for new ones, instead of rejecting the new ones.
+	DropOldest bool
+}
+
+// IsExceeded returns true iff a spool with count messages totalling size
+// bytes is over the quota.
+func (q *Quota) IsExceeded(count, size uint64) bool {
+	return (q.MaxMessages != 0 && count > q.MaxMessages) || (q.MaxBytes != 0 && size > q.MaxBytes)
+}
+
+// Expirer is the interface provided by user message spool implementations
+// that support discarding messages based on age.
+type Expirer interface {
+	// Expire removes all messages stored before the specified time, and
+	// returns the number of messages removed.
+	Expire(before time.Time) (int, error)
+}
+
+// Statter is the interface provided by user message spool implementations
+// that can report their totals.
+type Statter interface {
+	// Stats returns the number of non-empty spools, and the total number
+	// and size of the stored messages.
+	Stats() (spools, messages, size uint64, err error)
+}
+
 // Spool is the interface provided by all user messgage spool implementations.
 type Spool interface {
 	// StoreMessage stores a message in the user's spool.
@@ -20,8 +20,10 @@ package boltuserdb
 
 import (
 	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/katzenpost/core/crypto/ecdh"
@@ -29,8 +31,10 @@ import (
 )
 
 const (
-	usersBucket      = "users"
-	identitiesBucket = "identities"
+	usersBucket              = "users"
+	identitiesBucket         = "identities"
+	previousLinksBucket      = "previous_links"
+	previousIdentitiesBucket = "previous_identities"
 )
 
 type boltUserDB struct {
@@ -69,6 +73,13 @@ func (d *boltUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
 		if rawPubKey != nil {
 			isValid = subtle.ConstantTimeCompare(rawPubKey, k.Bytes()) == 1
 		}
+
+		// The previous link key is valid during the rotation overlap.
+		if !isValid && rawPubKey != nil {
+			if rawPrevKey := getPrevious(tx, previousLinksBucket, u); rawPrevKey != nil {
+				isValid = subtle.ConstantTimeCompare(rawPrevKey, k.Bytes()) == 1
+			}
+		}
 		return nil
 	}); err != nil {
 		return false
@@ -187,6 +198,11 @@ func (d *boltUserDB) Remove(u []byte) error {
 		if ent := bkt.Get(u); ent == nil {
 			return userdb.ErrNoSuchUser
 		}
+		for _, b := range []string{previousLinksBucket, previousIdentitiesBucket} {
+			if err := tx.Bucket([]byte(b)).Delete(u); err != nil {
+				return err
+			}
+		}
 		return bkt.Delete(u)
 	})
 	if err == nil {
@@ -200,6 +216,76 @@ func (d *boltUserDB) Remove(u []byte) error {
 	return err
 }
 
+func (d *boltUserDB) RotateLink(u []byte, k *ecdh.PublicKey, overlap time.Duration) error {
+	return d.rotate(u, k, overlap, usersBucket, previousLinksBucket)
+}
+
+func (d *boltUserDB) RotateIdentity(u []byte, k *ecdh.PublicKey, overlap time.Duration) error {
+	return d.rotate(u, k, overlap, identitiesBucket, previousIdentitiesBucket)
+}
+
+func (d *boltUserDB) PreviousIdentity(u []byte) (*ecdh.PublicKey, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+
+	var pubKey *ecdh.PublicKey
+	err := d.db.View(func(tx *bolt.Tx) error {
+		rawPubKey := getPrevious(tx, previousIdentitiesBucket, u)
+		if rawPubKey == nil {
+			return userdb.ErrNoIdentity
+		}
+		pubKey = new(ecdh.PublicKey)
+		return pubKey.FromBytes(rawPubKey)
+	})
+	return pubKey, err
+}
+
+// rotate replaces the user's key in the bucket curBkt, and retains the
+// replaced key in prevBkt until the overlap elapses.
+func (d *boltUserDB) rotate(u []byte, k *ecdh.PublicKey, overlap time.Duration, curBkt, prevBkt string) error {
+	if !userOk(u) {
+		return fmt.Errorf("userdb: invalid username: `%v`", u)
+	}
+	if k == nil {
+		return fmt.Errorf("userdb: must provide a public key")
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if uEnt := tx.Bucket([]byte(usersBucket)).Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		cBkt, pBkt := tx.Bucket([]byte(curBkt)), tx.Bucket([]byte(prevBkt))
+		if rawOldKey := cBkt.Get(u); rawOldKey != nil && overlap > 0 {
+			// The value is the previous key followed by the expiry time.
+			v := make([]byte, len(rawOldKey)+8)
+			copy(v, rawOldKey)
+			binary.BigEndian.PutUint64(v[len(rawOldKey):], uint64(time.Now().Add(overlap).Unix()))
+			if err := pBkt.Put(u, v); err != nil {
+				return err
+			}
+		} else if err := pBkt.Delete(u); err != nil {
+			return err
+		}
+		return cBkt.Put(u, k.Bytes())
+	})
+}
+
+// getPrevious returns the user's previous key from the bucket, iff it has
+// not expired.
+func getPrevious(tx *bolt.Tx, bkt string, u []byte) []byte {
+	v := tx.Bucket([]byte(bkt)).Get(u)
+	if len(v) <= 8 {
+		return nil
+	}
+	expiry := binary.BigEndian.Uint64(v[len(v)-8:])
+	if uint64(time.Now().Unix()) >= expiry {
+		return nil
+	}
+	return v[:len(v)-8]
+}
+
 func (d *boltUserDB) Close() {
 	_ = d.db.Sync()
 	d.db.Close()
@@ -231,8 +317,10 @@ func New(f string) (userdb.UserDB, error) {
 		if err != nil {
 			return err
 		}
-		if _, err = tx.CreateBucketIfNotExists([]byte(identitiesBucket)); err != nil {
-			return err
+		for _, b := range []string{identitiesBucket, previousLinksBucket, previousIdentitiesBucket} {
+			if _, err = tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
 		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
@@ -22,7 +22,9 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -42,6 +44,7 @@ func TestBoltUserDB(t *testing.T) {
 	t.Logf("Temp Dir: %v", tmpDir)
 	if ok := t.Run("create", doTestCreate); ok {
 		t.Run("load", doTestLoad)
+		t.Run("rotate", doTestRotate)
 	} else {
 		t.Errorf("create tests failed, skipping load test")
 	}
@@ -89,6 +92,36 @@ func doTestLoad(t *testing.T) {
 	assert.Error(err, "Add('alice', k, false)")
 }
 
+func doTestRotate(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	d, err := New(testDBPath)
+	require.NoError(err, "New() rotate")
+	defer d.Close()
+
+	rotator := d.(userdb.KeyRotator)
+	oldKey := testUsers["bob"]
+	newPrivKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	newKey := newPrivKey.PublicKey()
+
+	// Both keys are valid during the overlap.
+	err = rotator.RotateLink([]byte("bob"), newKey, time.Hour)
+	require.NoError(err, "RotateLink('bob', k, 1h)")
+	assert.True(d.IsValid([]byte("bob"), newKey), "IsValid('bob', newKey)")
+	assert.True(d.IsValid([]byte("bob"), oldKey), "IsValid('bob', oldKey)")
+
+	// Only the new key is valid without an overlap.
+	err = rotator.RotateLink([]byte("bob"), oldKey, 0)
+	require.NoError(err, "RotateLink('bob', k, 0)")
+	assert.True(d.IsValid([]byte("bob"), oldKey), "IsValid('bob', oldKey)")
+	assert.False(d.IsValid([]byte("bob"), newKey), "IsValid('bob', newKey)")
+
+	err = rotator.RotateLink([]byte("malory"), newKey, time.Hour)
+	assert.Equal(userdb.ErrNoSuchUser, err, "RotateLink('malory', k, 1h)")
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltuserdb_tests")
@@ -19,43 +19,127 @@
 package externuserdb
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"time"
 
-	"encoding/hex"
+	"github.com/hashcloak/Meson-server/httpsign"
 	"github.com/hashcloak/Meson-server/userdb"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/ugorji/go/codec"
 )
 
+const (
+	defaultTimeout = 5 * time.Second
+)
+
 var (
 	errCantModify   = errors.New("Not implemented: External authentication is enabled, you can not modify users")
 	errNotSupported = errors.New("Not implemented: Support not implemented yet")
 	jsonHandle      = &codec.JsonHandle{}
 )
 
+// Options are the optional external user database parameters.
+type Options struct {
+	// TLSConfig is the TLS configuration used for `https` providers.
+	TLSConfig *tls.Config
+
+	// SigningKey is the HMAC-SHA256 key used to sign requests, if any,
+	// as specified by the httpsign package.
+	SigningKey []byte
+
+	// Timeout is the per request timeout.
+	Timeout time.Duration
+
+	// CacheTTL is how long responses are cached for, 0 disables caching.
+	CacheTTL time.Duration
+
+	// FailureThreshold is the number of consecutive failed requests after
+	// which requests are refused for BreakerCooldown, 0 disables the circuit
+	// breaker.
+	FailureThreshold int
+	BreakerCooldown  time.Duration
+}
+
 type externAuth struct {
 	provider string
+
+	client     *http.Client
+	signingKey []byte
+	cache      *responseCache
+	breaker    *circuitBreaker
 }
 
-func (e *externAuth) doPost(endpoint string, data url.Values) bool {
+// query returns the value of the endpoint's field in the response to a
+// request, or nil if the API did not provide one.
+func (e *externAuth) query(endpoint string, data url.Values) (interface{}, error) {
+	body := data.Encode()
+	cacheKey := endpoint + "?" + body
+	if v, ok := e.cache.get(cacheKey); ok {
+		return v, nil
+	}
+	if !e.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	v, err := e.doRequest(endpoint, body)
+	e.breaker.record(err == nil)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	e.cache.put(cacheKey, v)
+	return v, nil
+}
+
+func (e *externAuth) doRequest(endpoint, body string) (interface{}, error) {
 	uri := e.provider + "/" + endpoint
-	rsp, err := http.PostForm(uri, data)
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewBufferString(body))
 	if err != nil {
-		return false
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if e.signingKey != nil {
+		if err = httpsign.SignRequest(e.signingKey, req, []byte(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	rsp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer rsp.Body.Close()
 
-	response := map[string]bool{}
+	switch {
+	case rsp.StatusCode >= 500:
+		// Server side failures count towards tripping the circuit breaker.
+		return nil, fmt.Errorf("externuserdb: %v: %v", endpoint, rsp.Status)
+	case rsp.StatusCode != 200:
+		return nil, nil
+	}
+
+	response := map[string]interface{}{}
 	d := codec.NewDecoder(rsp.Body, jsonHandle)
 	if err = d.Decode(&response); err != nil {
-		return false
+		return nil, err
 	}
-
-	return rsp.StatusCode == 200 && response[endpoint]
+	return response[endpoint], nil
 }
 
+func (e *externAuth) doPost(endpoint string, data url.Values) bool {
+	v, err := e.query(endpoint, data)
+	if err != nil {
+		return false
+	}
+	ok, _ := v.(bool)
+	return ok
+}
 func (e *externAuth) IsValid(u []byte, k *ecdh.PublicKey) bool {
 	form := url.Values{"user": {string(u)}, "key": {k.String()}}
 	return e.doPost("isvalid", form)
@@ -79,28 +163,17 @@ func (e *externAuth) SetIdentity(u []byte, k *ecdh.PublicKey) error {
 }
 
 func (e *externAuth) Identity(u []byte) (*ecdh.PublicKey, error) {
-	endpoint := "getidkey"
-	uri := e.provider + "/" + endpoint
 	form := url.Values{"user": {string(u)}}
-	rsp, err := http.PostForm(uri, form)
+	v, err := e.query("getidkey", form)
 	if err != nil {
 		return nil, err
 	}
-	defer rsp.Body.Close()
 
-	if rsp.StatusCode == 200 {
-		response := map[string]string{}
-		d := codec.NewDecoder(rsp.Body, jsonHandle)
-		if err = d.Decode(&response); err != nil {
-			return nil, err
-		}
-
-		if pkhex, ok := response[endpoint]; ok {
-			if decoded, err := hex.DecodeString(pkhex); err == nil {
-				pk := new(ecdh.PublicKey)
-				if err := pk.FromBytes(decoded); err == nil {
-					return pk, nil
-				}
+	if pkhex, ok := v.(string); ok {
+		if decoded, err := hex.DecodeString(pkhex); err == nil {
+			pk := new(ecdh.PublicKey)
+			if err := pk.FromBytes(decoded); err == nil {
+				return pk, nil
 			}
 		}
 	}
@@ -114,7 +187,64 @@ func (e *externAuth) Remove(u []byte) error {
 func (e *externAuth) Close() {
 }
 
+// LoadTLSConfig returns a TLS configuration that verifies the server with
+// the PEM encoded CA certificate in caFile, and authenticates with the PEM
+// encoded certificate and key in certFile and keyFile.  Empty file names
+// use the system roots, and no client certificate respectively.
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("externuserdb: no certificates in '%v'", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
 // New creates an external user database with the given provider
 func New(provider string) (userdb.UserDB, error) {
-	return &externAuth{provider}, nil
+	return NewWithOptions(provider, nil)
+}
+
+// NewWithOptions creates an external user database with the given provider
+// and options.
+func NewWithOptions(provider string, opts *Options) (userdb.UserDB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	e := &externAuth{
+		provider: provider,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: opts.TLSConfig},
+		},
+		signingKey: opts.SigningKey,
+	}
+	if opts.CacheTTL > 0 {
+		e.cache = newResponseCache(opts.CacheTTL)
+	}
+	if opts.FailureThreshold > 0 {
+		e.breaker = &circuitBreaker{
+			threshold: opts.FailureThreshold,
+			cooldown:  opts.BreakerCooldown,
+		}
+	}
+	return e, nil
 }
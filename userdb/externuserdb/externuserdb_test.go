@@ -20,10 +20,14 @@
 package externuserdb
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/hashcloak/Meson-server/httpsign"
 	"github.com/katzenpost/core/crypto/ecdh"
 )
 
@@ -79,6 +83,65 @@ func TestIsNotValid(t *testing.T) {
 	}
 }
 
+func TestSignature(t *testing.T) {
+	key := []byte("secret")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if httpsign.Verify(key, r, body, time.Minute) != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("{\"exists\": true}"))
+	}))
+	defer ts.Close()
+
+	e, _ := NewWithOptions(ts.URL, &Options{SigningKey: key})
+	if !e.Exists([]byte("testuser")) {
+		t.Errorf("signed request should be accepted")
+	}
+}
+
+func TestCacheAndBreaker(t *testing.T) {
+	var requests int32
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("{\"exists\": true}"))
+	}))
+	defer ts.Close()
+
+	e, _ := NewWithOptions(ts.URL, &Options{
+		CacheTTL:         time.Minute,
+		FailureThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+
+	// Repeated queries should be served from the cache.
+	for i := 0; i < 3; i++ {
+		if !e.Exists([]byte("cached")) {
+			t.Errorf("user expected to exist")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected 1 request, got %v", n)
+	}
+
+	// Consecutive failures should open the circuit breaker.
+	atomic.StoreInt32(&fail, 1)
+	for i := 0; i < 4; i++ {
+		if e.Exists([]byte("uncached")) {
+			t.Errorf("user should not exist while the API is failing")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("expected 3 requests, got %v", n)
+	}
+}
+
 func httpMock(response string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(response))
@@ -0,0 +1,137 @@
+// resilience.go - extern REST API response caching and circuit breaking.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package externuserdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const maxCacheEntries = 16384
+
+var errCircuitOpen = errors.New("externuserdb: circuit breaker open")
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// responseCache caches API responses for a fixed duration.  A nil cache
+// caches nothing.
+type responseCache struct {
+	sync.Mutex
+
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+func (c *responseCache) get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	ent, ok := c.entries[key]
+	if !ok || time.Now().After(ent.expires) {
+		return nil, false
+	}
+	return ent.value, true
+}
+
+func (c *responseCache) put(key string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		for k, ent := range c.entries {
+			if now.After(ent.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			// Everything is live, start over rather than growing unbounded.
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+// circuitBreaker refuses requests for a cooldown period after a number of
+// consecutive failures, so that a failing API does not stall every
+// connection handshake for the full request timeout.  A nil circuit breaker
+// allows everything.
+type circuitBreaker struct {
+	sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns true iff a request may be made.  Once the cooldown has
+// elapsed, a single request is let through to probe the API.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record records the outcome of a request.
+func (b *circuitBreaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,277 @@
+// ldapuserdb.go - LDAP directory backed user database.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package ldapuserdb implements the Katzenpost server user database backed
+// by a LDAP directory.
+package ldapuserdb
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/hashcloak/Meson-server/config"
+	"github.com/hashcloak/Meson-server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	searchTimeout  = 10 // Seconds.
+
+	// maxIdleConns is the number of idle connections kept to the
+	// directory server.
+	maxIdleConns = 4
+)
+
+var errCantModify = errors.New("ldapuserdb: the directory is read-only, manage users with the directory's tooling")
+
+type ldapUserDB struct {
+	sync.Mutex
+
+	cfg    *config.LDAPUserDB
+	idle   chan *ldap.Conn
+	closed bool
+}
+
+// dial establishes and authenticates a new connection to the directory
+// server.
+func (d *ldapUserDB) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(d.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{ServerName: u.Hostname()}
+
+	conn, err := ldap.DialURL(d.cfg.URL, ldap.DialWithTLSConfig(tlsCfg))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(requestTimeout)
+	if d.cfg.StartTLS {
+		if err = conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if d.cfg.BindDN != "" {
+		err = conn.Bind(d.cfg.BindDN, d.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getConn returns an idle connection, or a new one if there is none or
+// fresh is set.  Connections are used by a single request at a time, so
+// that concurrent lookups do not wait on each other.
+func (d *ldapUserDB) getConn(fresh bool) (*ldap.Conn, error) {
+	if !fresh {
+		select {
+		case conn := <-d.idle:
+			return conn, nil
+		default:
+		}
+	}
+	return d.dial()
+}
+
+// putConn returns a connection that is still usable to the idle pool.
+func (d *ldapUserDB) putConn(conn *ldap.Conn) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case d.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// userFilter returns the search filter matching the user identified by
+// the username.
+func userFilter(format string, u []byte) string {
+	return fmt.Sprintf(format, ldap.EscapeFilter(string(u)))
+}
+
+// lookup returns the directory entry of the user identified by the
+// username, or userdb.ErrNoSuchUser.
+func (d *ldapUserDB) lookup(u []byte) (*ldap.Entry, error) {
+	if len(u) == 0 || len(u) > userdb.MaxUsernameSize {
+		return nil, userdb.ErrNoSuchUser
+	}
+
+	req := ldap.NewSearchRequest(
+		d.cfg.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // Anything other than exactly 1 entry is an error.
+		searchTimeout,
+		false,
+		userFilter(d.cfg.UserFilter, u),
+		[]string{d.cfg.LinkKeyAttribute, d.cfg.IdentityKeyAttribute},
+		nil,
+	)
+
+	var res *ldap.SearchResult
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *ldap.Conn
+		if conn, err = d.getConn(attempt > 0); err != nil {
+			continue
+		}
+		if res, err = conn.Search(req); err != nil && isConnError(err) {
+			// The connection went away, retry once with a new one.
+			conn.Close()
+			continue
+		}
+		d.putConn(conn)
+		break
+	}
+	switch {
+	case err != nil && ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return nil, fmt.Errorf("ldapuserdb: UserFilter matches multiple entries")
+	case err != nil:
+		return nil, err
+	case len(res.Entries) != 1:
+		return nil, userdb.ErrNoSuchUser
+	}
+	return res.Entries[0], nil
+}
+
+func isConnError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork)
+}
+
+// keyAttribute returns the public key stored hex encoded in an attribute of
+// the entry, or nil if the attribute is missing.
+func keyAttribute(e *ldap.Entry, attr string) (*ecdh.PublicKey, error) {
+	v := e.GetAttributeValue(attr)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("ldapuserdb: malformed %v: %v", attr, err)
+	}
+	pk := new(ecdh.PublicKey)
+	if err = pk.FromBytes(b); err != nil {
+		return nil, fmt.Errorf("ldapuserdb: malformed %v: %v", attr, err)
+	}
+	return pk, nil
+}
+
+func (d *ldapUserDB) Exists(u []byte) bool {
+	_, err := d.lookup(u)
+	return err == nil
+}
+
+func (d *ldapUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	pk, err := d.Link(u)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pk.Bytes(), k.Bytes()) == 1
+}
+
+func (d *ldapUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	e, err := d.lookup(u)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := keyAttribute(e, d.cfg.LinkKeyAttribute)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return pk, nil
+}
+
+func (d *ldapUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	return errCantModify
+}
+
+func (d *ldapUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	return errCantModify
+}
+
+func (d *ldapUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	e, err := d.lookup(u)
+	if err != nil {
+		return nil, err
+	}
+	pk, err := keyAttribute(e, d.cfg.IdentityKeyAttribute)
+	if err != nil {
+		return nil, err
+	}
+	if pk == nil {
+		return nil, userdb.ErrNoIdentity
+	}
+	return pk, nil
+}
+
+func (d *ldapUserDB) Remove(u []byte) error {
+	return errCantModify
+}
+
+func (d *ldapUserDB) Close() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.closed = true
+	for {
+		select {
+		case conn := <-d.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// New creates a user database backed by the LDAP directory described by
+// cfg.
+func New(cfg *config.LDAPUserDB) (userdb.UserDB, error) {
+	d := &ldapUserDB{
+		cfg:  cfg,
+		idle: make(chan *ldap.Conn, maxIdleConns),
+	}
+
+	// Fail early if the directory is unreachable or the credentials are
+	// wrong, reconnection is handled lazily afterwards.
+	conn, err := d.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldapuserdb: failed to connect to %v: %v", cfg.URL, err)
+	}
+	d.putConn(conn)
+	return d, nil
+}
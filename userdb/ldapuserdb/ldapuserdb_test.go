@@ -0,0 +1,83 @@
+// ldapuserdb_test.go - LDAP directory backed user database tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package ldapuserdb
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyAttribute(t *testing.T) {
+	require := require.New(t)
+
+	k, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	pk := k.PublicKey()
+
+	for _, v := range []struct {
+		desc    string
+		values  []string
+		want    *ecdh.PublicKey
+		wantErr bool
+	}{
+		{"missing", nil, nil, false},
+		{"empty", []string{""}, nil, false},
+		{"valid", []string{hex.EncodeToString(pk.Bytes())}, pk, false},
+		{"not hex", []string{"not a key"}, nil, true},
+		{"truncated", []string{hex.EncodeToString(pk.Bytes()[:16])}, nil, true},
+	} {
+		attrs := map[string][]string{"cn": {"alice"}}
+		if v.values != nil {
+			attrs["katzenpostLinkKey"] = v.values
+		}
+		e := ldap.NewEntry("uid=alice,ou=users,dc=example,dc=org", attrs)
+
+		got, err := keyAttribute(e, "katzenpostLinkKey")
+		if v.wantErr {
+			require.Error(err, v.desc)
+			continue
+		}
+		require.NoError(err, v.desc)
+		if v.want == nil {
+			require.Nil(got, v.desc)
+		} else {
+			require.Equal(v.want.Bytes(), got.Bytes(), v.desc)
+		}
+	}
+}
+
+func TestUserFilter(t *testing.T) {
+	require := require.New(t)
+
+	for _, v := range []struct {
+		format, user, want string
+	}{
+		{"(uid=%s)", "alice", "(uid=alice)"},
+		{"(&(objectClass=person)(uid=%s))", "alice", "(&(objectClass=person)(uid=alice))"},
+		{"(uid=%s)", "*", `(uid=\2a)`},
+		{"(uid=%s)", "alice)(uid=*", `(uid=alice\29\28uid=\2a)`},
+		{"(uid=%s)", `al\ice`, `(uid=al\5cice)`},
+		{"(uid=%s)", "al\x00ice", `(uid=al\00ice)`},
+	} {
+		require.Equal(v.want, userFilter(v.format, []byte(v.user)), v.user)
+	}
+}
@@ -20,13 +20,20 @@ package userdb
 
 import (
 	"errors"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
-// MaxUsernameSize is the maximum username length in bytes.
-const MaxUsernameSize = constants.RecipientIDLength
+const (
+	// MaxUsernameSize is the maximum username length in bytes.
+	MaxUsernameSize = constants.RecipientIDLength
+
+	// DefaultKeyOverlap is the default duration a rotated key remains
+	// valid for.
+	DefaultKeyOverlap = 24 * time.Hour
+)
 
 var (
 	// ErrNoSuchUser is the error returned when an operation fails due to
@@ -70,3 +77,23 @@ type UserDB interface {
 	// Close closes the UserDB instance.
 	Close()
 }
+
+// KeyRotator is the interface provided by user database implementations
+// that support rotating keys with an overlap window, during which the
+// previous key remains usable so that clients can switch over without
+// losing access.
+type KeyRotator interface {
+	// RotateLink replaces the user's link layer authentication key, with
+	// the previous key remaining valid for authentication for the overlap
+	// duration.
+	RotateLink(u []byte, k *ecdh.PublicKey, overlap time.Duration) error
+
+	// RotateIdentity replaces the user's identity key, with the previous
+	// key remaining available via PreviousIdentity for the overlap
+	// duration.
+	RotateIdentity(u []byte, k *ecdh.PublicKey, overlap time.Duration) error
+
+	// PreviousIdentity returns the user's previous identity key, iff it is
+	// within the overlap window.
+	PreviousIdentity(u []byte) (*ecdh.PublicKey, error)
+}